@@ -0,0 +1,173 @@
+// Copyright 2015 Meador Inge.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+// Package analysis defines the interface between a modular static
+// analysis of BCPL programs and the tools that run it, after the
+// package golang.org/x/tools/go/analysis for Go.
+//
+// An analysis is described by an Analyzer: its name, documentation,
+// the analyzers whose results it needs and a Run function.  A driver
+// runs an analyzer over each section of a program in turn, giving
+// its Run function a Pass holding the syntax tree of the section and
+// the results of the analyzers it requires, and collecting the
+// diagnostics it reports.  An analyzer may learn facts about the
+// globals of a section, by which sections communicate, and about the
+// section as a whole; the facts are visible to the analysis of the
+// sections analyzed after it, which the driver analyzes after the
+// sections they need.
+package analysis
+
+import (
+	"fmt"
+	"github.com/meadori/bcpl-go/src/ast"
+	"github.com/meadori/bcpl-go/src/edit"
+	"github.com/meadori/bcpl-go/src/token"
+	"reflect"
+	"unicode"
+)
+
+// An analyzer describes an analysis and the facts it uses.
+type Analyzer struct {
+	// The name of the analyzer, a valid identifier used in flags
+	// and diagnostics.
+	Name string
+
+	// The documentation: a one line summary, then optionally a
+	// blank line and a longer description.
+	Doc string
+
+	// The analyzers whose results Run needs.  They are run first
+	// on each section.
+	Requires []*Analyzer
+
+	// The types of the facts the analyzer exports and imports, each
+	// given by a pointer to a zero value.
+	FactTypes []Fact
+
+	// Run analyzes a section, reporting diagnostics through the pass.
+	// Its result is given to the analyzers requiring this one.
+	Run func(pass *Pass) (interface{}, error)
+}
+
+func (a *Analyzer) String() string {
+	return a.Name
+}
+
+// A fact is something an analyzer learns about a global, or about a
+// section, that it uses in the analysis of other sections.  A fact
+// type must be a pointer.
+type Fact interface {
+	AFact() // A dummy method marking the type as a fact.
+}
+
+// A diagnostic reports a problem found in a section, with the fixes
+// it suggests.  The edits of a fix are byte offsets into the source of
+// the section.
+type Diagnostic struct {
+	Pos      token.Position
+	Category string // An optional classification of the problem.
+	Message  string
+	Fixes    []edit.Fix
+}
+
+// A pass gives the Run function of an analyzer what it needs to
+// analyze a section.
+type Pass struct {
+	Analyzer *Analyzer
+	Section  string       // The name of the section.
+	Program  *ast.Program // The syntax tree of the section.
+
+	// The results of the analyzers required, run on the section.
+	ResultOf map[*Analyzer]interface{}
+
+	// Report a diagnostic.
+	Report func(d Diagnostic)
+
+	// Look up a fact about a global by its number, copying it to
+	// fact and reporting whether there is one.
+	ImportGlobalFact func(global int, fact Fact) bool
+
+	// Record a fact about a global by its number.
+	ExportGlobalFact func(global int, fact Fact)
+
+	// Look up a fact about a section by its name, copying it to fact
+	// and reporting whether there is one.
+	ImportSectionFact func(section string, fact Fact) bool
+
+	// Record a fact about the section being analyzed.
+	ExportSectionFact func(fact Fact)
+}
+
+// Report a diagnostic with a formatted message at a position.
+func (pass *Pass) Reportf(pos token.Position, format string, args ...interface{}) {
+	pass.Report(Diagnostic{Pos: pos, Message: fmt.Sprintf(format, args...)})
+}
+
+// Report whether a name is made of letters, digits and underscores,
+// starting with a letter.
+func isIdent(name string) bool {
+	for i, ch := range name {
+		switch {
+		case unicode.IsLetter(ch):
+		case i > 0 && (unicode.IsDigit(ch) || ch == '_'):
+		default:
+			return false
+		}
+	}
+	return name != ""
+}
+
+// Check that analyzers, and the analyzers they require, are well
+// formed: that each has a name, documentation and a Run function,
+// that their names are unique, that their fact types are pointers
+// and that none requires itself.
+func Validate(analyzers []*Analyzer) error {
+	names := make(map[string]*Analyzer)
+	const (
+		grey  = 1 + iota // Being visited.
+		black            // Visited.
+	)
+	color := make(map[*Analyzer]int)
+	var visit func(a *Analyzer) error
+	visit = func(a *Analyzer) error {
+		switch color[a] {
+		case grey:
+			return fmt.Errorf("analyzer %s requires itself", a)
+		case black:
+			return nil
+		}
+		color[a] = grey
+		switch {
+		case a.Name == "":
+			return fmt.Errorf("analyzer has no name")
+		case !isIdent(a.Name):
+			return fmt.Errorf("analyzer name %q is not an identifier", a.Name)
+		case a.Doc == "":
+			return fmt.Errorf("analyzer %s has no documentation", a)
+		case a.Run == nil:
+			return fmt.Errorf("analyzer %s has no Run function", a)
+		case names[a.Name] != nil:
+			return fmt.Errorf("two analyzers named %s", a)
+		}
+		names[a.Name] = a
+		for _, f := range a.FactTypes {
+			if f == nil || reflect.TypeOf(f).Kind() != reflect.Ptr {
+				return fmt.Errorf("analyzer %s has fact type %T, not a pointer", a, f)
+			}
+		}
+		for _, req := range a.Requires {
+			if err := visit(req); err != nil {
+				return err
+			}
+		}
+		color[a] = black
+		return nil
+	}
+	for _, a := range analyzers {
+		if err := visit(a); err != nil {
+			return err
+		}
+	}
+	return nil
+}
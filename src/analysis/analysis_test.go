@@ -0,0 +1,47 @@
+// Copyright 2015 Meador Inge.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package analysis
+
+import (
+	"testing"
+)
+
+type test_fact struct{}
+
+func (test_fact) AFact() {}
+
+func test_run(pass *Pass) (interface{}, error) {
+	return nil, nil
+}
+
+func TestValidate(t *testing.T) {
+	ok := &Analyzer{Name: "ok", Doc: "doc", Run: test_run}
+	cycle := &Analyzer{Name: "cycle", Doc: "doc", Run: test_run}
+	cycle.Requires = []*Analyzer{{Name: "other", Doc: "doc", Run: test_run, Requires: []*Analyzer{cycle}}}
+	var tests = []struct {
+		analyzers []*Analyzer
+		err       string
+	}{
+		{[]*Analyzer{ok, {Name: "req", Doc: "doc", Run: test_run, Requires: []*Analyzer{ok}}}, ""},
+		{[]*Analyzer{{Doc: "doc", Run: test_run}}, "analyzer has no name"},
+		{[]*Analyzer{{Name: "a-b", Doc: "doc", Run: test_run}}, `analyzer name "a-b" is not an identifier`},
+		{[]*Analyzer{{Name: "_a", Doc: "doc", Run: test_run}}, `analyzer name "_a" is not an identifier`},
+		{[]*Analyzer{{Name: "a", Run: test_run}}, "analyzer a has no documentation"},
+		{[]*Analyzer{{Name: "a", Doc: "doc"}}, "analyzer a has no Run function"},
+		{[]*Analyzer{ok, {Name: "ok", Doc: "doc", Run: test_run}}, "two analyzers named ok"},
+		{[]*Analyzer{{Name: "a", Doc: "doc", Run: test_run, FactTypes: []Fact{test_fact{}}}}, "analyzer a has fact type analysis.test_fact, not a pointer"},
+		{[]*Analyzer{{Name: "a", Doc: "doc", Run: test_run, FactTypes: []Fact{new(test_fact)}}}, ""},
+		{[]*Analyzer{cycle}, "analyzer cycle requires itself"},
+	}
+	for i, test := range tests {
+		err := Validate(test.analyzers)
+		switch {
+		case err == nil && test.err != "":
+			t.Errorf("%d: expected error %q", i, test.err)
+		case err != nil && err.Error() != test.err:
+			t.Errorf("%d: got error %q, expected %q", i, err, test.err)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+// Copyright 2015 Meador Inge.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package multichecker
+
+import (
+	"flag"
+	"fmt"
+	"github.com/meadori/bcpl-go/src/analysis"
+	"github.com/meadori/bcpl-go/src/edit"
+	"github.com/meadori/bcpl-go/src/link"
+	"github.com/meadori/bcpl-go/src/parser"
+	"github.com/meadori/bcpl-go/src/token"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// A flag enabling or disabling an analyzer, remembering whether it
+// was set.
+type analyzerFlag struct {
+	set, on bool
+}
+
+func (f *analyzerFlag) String() string {
+	return fmt.Sprint(f.on)
+}
+
+func (f *analyzerFlag) Set(s string) error {
+	switch s {
+	case "true":
+		f.on = true
+	case "false":
+		f.on = false
+	default:
+		return fmt.Errorf("bad value %q", s)
+	}
+	f.set = true
+	return nil
+}
+
+func (f *analyzerFlag) IsBoolFlag() bool { return true }
+
+// Return the first line of the documentation of an analyzer.
+func summary(a *analysis.Analyzer) string {
+	return strings.SplitN(a.Doc, "\n", 2)[0]
+}
+
+// Return the analyzers selected by their flags: those enabled if any
+// are, or else all but those disabled.
+func selected(analyzers []*analysis.Analyzer, flags map[*analysis.Analyzer]*analyzerFlag) []*analysis.Analyzer {
+	enabled := false
+	for _, f := range flags {
+		if f.set && f.on {
+			enabled = true
+		}
+	}
+	var list []*analysis.Analyzer
+	for _, a := range analyzers {
+		f := flags[a]
+		if enabled && f.on || !enabled && !f.set {
+			list = append(list, a)
+		}
+	}
+	return list
+}
+
+// Apply edits to the source of a file and write it back.
+func fixFile(filename string, src []byte, edits []edit.Edit) error {
+	if len(edits) == 0 {
+		return nil
+	}
+	fixed, err := edit.Apply(src, edits)
+	if err != nil {
+		return fmt.Errorf("%s: %v", filename, err)
+	}
+	return ioutil.WriteFile(filename, fixed, 0644)
+}
+
+// Parse the files of a program with the dialect given, reporting the
+// syntax errors of each and, if fix is set, making the fixes they
+// suggest.  The sources are returned by file name.
+func parseFiles(stderr io.Writer, filenames []string, dialect token.Dialect, fix bool) ([]link.Section, map[string][]byte, bool) {
+	var sections []link.Section
+	srcs := make(map[string][]byte)
+	ok := true
+	for _, filename := range filenames {
+		src, err := ioutil.ReadFile(filename)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			ok = false
+			continue
+		}
+		var p parser.Parser
+		p.Dialect = dialect
+		p.Init(src)
+		prog := p.Parse()
+		for _, err := range p.Errors {
+			fmt.Fprintf(stderr, "%s:%v\n", filename, err)
+			ok = false
+		}
+		if fix {
+			if err := fixFile(filename, src, p.Errors.Edits()); err != nil {
+				fmt.Fprintln(stderr, err)
+			}
+		}
+		sections = append(sections, link.Section{filename, prog})
+		srcs[filename] = src
+	}
+	return sections, srcs, ok
+}
+
+// Main is the main function of a checker command running analyzers
+// over the files named by its arguments, which are the sections of a
+// program.  Each analyzer has a flag, named after it: every analyzer
+// is run unless some are enabled by their flags, in which case only
+// those are, and an analyzer may be disabled, as with -name=false.
+// With the -fix flag, the first fix suggested by each diagnostic, and
+// by each syntax error, is made to the file.  The command exits with 1
+// if there are diagnostics and 2 if a file cannot be read, parsed or
+// fixed or an analyzer fails.
+func Main(analyzers ...*analysis.Analyzer) {
+	os.Exit(check(filepath.Base(os.Args[0]), os.Args[1:], os.Stderr, analyzers))
+}
+
+// Run a checker command with the given arguments, writing its messages
+// to stderr and returning its exit code.
+func check(progname string, args []string, stderr io.Writer, analyzers []*analysis.Analyzer) int {
+	if err := analysis.Validate(analyzers); err != nil {
+		fmt.Fprintf(stderr, "%s: %v\n", progname, err)
+		return 2
+	}
+
+	fs := flag.NewFlagSet(progname, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fixFlag := fs.Bool("fix", false, "apply the fixes suggested by the diagnostics to the source files")
+	dialectFlag := fs.String("dialect", "1967", "the `dialect` of the source: 1967, upper, anycase or richards, or a comma separated combination")
+	flags := make(map[*analysis.Analyzer]*analyzerFlag)
+	for _, a := range analyzers {
+		f := &analyzerFlag{}
+		flags[a] = f
+		fs.Var(f, a.Name, "enable the "+a.Name+" analyzer")
+	}
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "usage: %s [flags] file.b ...\n\n", progname)
+		fmt.Fprintf(stderr, "The analyzers are:\n\n")
+		for _, a := range analyzers {
+			fmt.Fprintf(stderr, "  %-12s %s\n", a.Name, summary(a))
+		}
+		fmt.Fprintf(stderr, "\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	dialect, err := token.ParseDialect(*dialectFlag)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	sections, srcs, ok := parseFiles(stderr, fs.Args(), dialect, *fixFlag)
+	if !ok {
+		return 2
+	}
+	diags, err := Run(sections, selected(analyzers, flags))
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	edits := make(map[string][]edit.Edit)
+	for _, d := range diags {
+		fmt.Fprintln(stderr, d)
+		edits[d.Section] = append(edits[d.Section], edit.First(d.Fixes)...)
+	}
+	if *fixFlag {
+		for _, s := range sections {
+			if err := fixFile(s.Name, srcs[s.Name], edits[s.Name]); err != nil {
+				fmt.Fprintln(stderr, err)
+				return 2
+			}
+		}
+	}
+	if len(diags) > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,191 @@
+// Copyright 2015 Meador Inge.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+// Package multichecker runs analyzers over the sections of a BCPL
+// program, as a library and as the main function of a command like
+// bclvet.
+//
+// The sections are analyzed in the order given, except that a section
+// naming another in a needs directive is analyzed after it, so that
+// it sees the facts learnt there.  A section is named by its section
+// directive, or else by the name it is given.
+package multichecker
+
+import (
+	"fmt"
+	"github.com/meadori/bcpl-go/src/analysis"
+	"github.com/meadori/bcpl-go/src/link"
+	"github.com/meadori/bcpl-go/src/token"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// A diagnostic reported by an analyzer in a section.
+type Diagnostic struct {
+	Section  string // The name the section is given.
+	Analyzer *analysis.Analyzer
+	analysis.Diagnostic
+}
+
+func (d Diagnostic) String() string {
+	return fmt.Sprintf("%s:%s: %s: %s", d.Section, d.Pos, d.Analyzer, d.Message)
+}
+
+// Return the name of a section in needs directives.
+func sectionName(s link.Section) string {
+	for _, d := range s.Prog.Directives {
+		if d.Key == token.SECTION {
+			return strings.Trim(d.Name.Lit, `"`)
+		}
+	}
+	return s.Name
+}
+
+// Order sections so that each comes after the sections it needs.  A
+// cycle of needs is broken where it closes.
+func order(sections []link.Section) []link.Section {
+	byName := make(map[string]int)
+	for i, s := range sections {
+		byName[sectionName(s)] = i
+	}
+	seen := make([]bool, len(sections))
+	var ordered []link.Section
+	var visit func(i int)
+	visit = func(i int) {
+		seen[i] = true
+		for _, d := range sections[i].Prog.Directives {
+			if d.Key != token.NEEDS {
+				continue
+			}
+			if j, ok := byName[strings.Trim(d.Name.Lit, `"`)]; ok && !seen[j] {
+				visit(j)
+			}
+		}
+		ordered = append(ordered, sections[i])
+	}
+	for i := range sections {
+		if !seen[i] {
+			visit(i)
+		}
+	}
+	return ordered
+}
+
+// The key of a fact: the analyzer that learnt it, what it is about
+// and its type.
+type factKey struct {
+	analyzer *analysis.Analyzer
+	global   int    // The global it is about, or -1.
+	section  string // The section it is about, or "".
+	typ      reflect.Type
+}
+
+type checker struct {
+	facts map[factKey]analysis.Fact
+}
+
+// Check that an analyzer declares the type of a fact.
+func checkFact(a *analysis.Analyzer, fact analysis.Fact) {
+	for _, f := range a.FactTypes {
+		if reflect.TypeOf(f) == reflect.TypeOf(fact) {
+			return
+		}
+	}
+	panic(fmt.Sprintf("analyzer %s uses fact type %T it does not declare", a, fact))
+}
+
+func (c *checker) importFact(key factKey, fact analysis.Fact) bool {
+	checkFact(key.analyzer, fact)
+	f, ok := c.facts[key]
+	if ok {
+		reflect.ValueOf(fact).Elem().Set(reflect.ValueOf(f).Elem())
+	}
+	return ok
+}
+
+func (c *checker) exportFact(key factKey, fact analysis.Fact) {
+	checkFact(key.analyzer, fact)
+	c.facts[key] = fact
+}
+
+// Run analyzers over the sections of a program, returning the
+// diagnostics they report in the order the sections are analyzed and
+// then of their positions.  The analyzers required by those given are
+// run too, but their diagnostics are not returned.
+func Run(sections []link.Section, analyzers []*analysis.Analyzer) ([]Diagnostic, error) {
+	if err := analysis.Validate(analyzers); err != nil {
+		return nil, err
+	}
+
+	// The analyzers in the order they are run, each after those it
+	// requires.
+	var all []*analysis.Analyzer
+	seen := make(map[*analysis.Analyzer]bool)
+	var visit func(a *analysis.Analyzer)
+	visit = func(a *analysis.Analyzer) {
+		if seen[a] {
+			return
+		}
+		seen[a] = true
+		for _, req := range a.Requires {
+			visit(req)
+		}
+		all = append(all, a)
+	}
+	for _, a := range analyzers {
+		visit(a)
+	}
+	root := make(map[*analysis.Analyzer]bool)
+	for _, a := range analyzers {
+		root[a] = true
+	}
+
+	c := &checker{make(map[factKey]analysis.Fact)}
+	var diags []Diagnostic
+	for _, s := range order(sections) {
+		name := sectionName(s)
+		var found []Diagnostic
+		results := make(map[*analysis.Analyzer]interface{})
+		for _, a := range all {
+			a := a
+			pass := &analysis.Pass{
+				Analyzer: a,
+				Section:  name,
+				Program:  s.Prog,
+				ResultOf: make(map[*analysis.Analyzer]interface{}),
+				Report: func(d analysis.Diagnostic) {
+					if root[a] {
+						found = append(found, Diagnostic{s.Name, a, d})
+					}
+				},
+				ImportGlobalFact: func(global int, fact analysis.Fact) bool {
+					return c.importFact(factKey{a, global, "", reflect.TypeOf(fact)}, fact)
+				},
+				ExportGlobalFact: func(global int, fact analysis.Fact) {
+					c.exportFact(factKey{a, global, "", reflect.TypeOf(fact)}, fact)
+				},
+				ImportSectionFact: func(section string, fact analysis.Fact) bool {
+					return c.importFact(factKey{a, -1, section, reflect.TypeOf(fact)}, fact)
+				},
+				ExportSectionFact: func(fact analysis.Fact) {
+					c.exportFact(factKey{a, -1, name, reflect.TypeOf(fact)}, fact)
+				},
+			}
+			for _, req := range a.Requires {
+				pass.ResultOf[req] = results[req]
+			}
+			result, err := a.Run(pass)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s: %v", s.Name, a, err)
+			}
+			results[a] = result
+		}
+		sort.SliceStable(found, func(i, j int) bool {
+			return found[i].Pos.Offset < found[j].Pos.Offset
+		})
+		diags = append(diags, found...)
+	}
+	return diags, nil
+}
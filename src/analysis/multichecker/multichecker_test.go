@@ -0,0 +1,165 @@
+// Copyright 2015 Meador Inge.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package multichecker
+
+import (
+	"bytes"
+	"errors"
+	"github.com/meadori/bcpl-go/src/analysis"
+	"github.com/meadori/bcpl-go/src/analysis/passes"
+	"github.com/meadori/bcpl-go/src/ast"
+	"github.com/meadori/bcpl-go/src/link"
+	"github.com/meadori/bcpl-go/src/parser"
+	"github.com/meadori/bcpl-go/src/token"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// An analyzer reporting long names, whose result is the names of a
+// section.
+var test_names = &analysis.Analyzer{
+	Name: "names",
+	Doc:  "report long names",
+	Run: func(pass *analysis.Pass) (interface{}, error) {
+		var names []*ast.Name
+		ast.Inspect(pass.Program, func(n ast.Node) bool {
+			if n, ok := n.(*ast.Name); ok {
+				names = append(names, n)
+				if len(n.Val) > 5 {
+					pass.Reportf(n.NamePos, "long name %s", n.Val)
+				}
+			}
+			return true
+		})
+		return names, nil
+	},
+}
+
+// The number of names in a section.
+type test_count struct {
+	Names int
+}
+
+func (*test_count) AFact() {}
+
+// An analyzer reporting the number of names in the sections needed.
+var test_needs = &analysis.Analyzer{
+	Name:      "needs",
+	Doc:       "report the names of the sections needed",
+	Requires:  []*analysis.Analyzer{test_names},
+	FactTypes: []analysis.Fact{new(test_count)},
+	Run: func(pass *analysis.Pass) (interface{}, error) {
+		pass.ExportSectionFact(&test_count{len(pass.ResultOf[test_names].([]*ast.Name))})
+		for _, d := range pass.Program.Directives {
+			var fact test_count
+			name := strings.Trim(d.Name.Lit, `"`)
+			if d.Key == token.NEEDS && pass.ImportSectionFact(name, &fact) {
+				pass.Reportf(d.Pos(), "%s needs %s with %d names", pass.Section, name, fact.Names)
+			}
+		}
+		return nil, nil
+	},
+}
+
+var test_fail = &analysis.Analyzer{
+	Name: "fail",
+	Doc:  "fail",
+	Run: func(pass *analysis.Pass) (interface{}, error) {
+		return nil, errors.New("failed")
+	},
+}
+
+var test_sections = []link.Section{
+	{"user.b", parse("section \"user\"\nneeds \"lib\"\nlet start() = Square(2)")},
+	{"lib.b", parse("section \"lib\"\nlet Square(N) = N * N\nlet Answer() = 42")},
+	{"other.b", parse("needs \"user\"\nlet Double(N) = N + N")},
+}
+
+func parse(src string) *ast.Program {
+	var p parser.Parser
+	p.Dialect = token.Richards
+	p.Init([]byte(src))
+	prog := p.Parse()
+	if len(p.Errors) > 0 {
+		panic(p.Errors)
+	}
+	return prog
+}
+
+func TestRun(t *testing.T) {
+	var tests = []struct {
+		analyzers []*analysis.Analyzer
+		diags     []string
+	}{
+		{[]*analysis.Analyzer{test_needs}, []string{
+			"user.b:2:1: needs: user needs lib with 3 names",
+			"other.b:1:1: needs: other.b needs user with 1 names",
+		}},
+		{[]*analysis.Analyzer{test_names, test_needs}, []string{
+			"user.b:2:1: needs: user needs lib with 3 names",
+			"user.b:3:15: names: long name Square",
+			"other.b:1:1: needs: other.b needs user with 1 names",
+		}},
+	}
+	for _, test := range tests {
+		diags, err := Run(test_sections, test.analyzers)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, d := range diags {
+			got = append(got, d.String())
+		}
+		if strings.Join(got, "\n") != strings.Join(test.diags, "\n") {
+			t.Errorf("%v: got\n%s\nexpected\n%s", test.analyzers, strings.Join(got, "\n"), strings.Join(test.diags, "\n"))
+		}
+	}
+}
+
+func TestRunErrors(t *testing.T) {
+	if _, err := Run(test_sections, []*analysis.Analyzer{test_names, test_fail}); err == nil || err.Error() != "lib.b: fail: failed" {
+		t.Errorf("got error %v", err)
+	}
+	if _, err := Run(test_sections, []*analysis.Analyzer{{Name: "bad"}}); err == nil {
+		t.Error("expected an error for an invalid analyzer")
+	}
+}
+
+func TestFixFlag(t *testing.T) {
+	dir, err := ioutil.TempDir("", "multichecker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "a.b")
+	if err := ioutil.WriteFile(file, []byte("let F(X) be $( X = 1; writen(X) $)\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The diagnostic is reported and its fix made to the file, after
+	// which there is nothing to report.
+	var stderr bytes.Buffer
+	analyzers := []*analysis.Analyzer{passes.Assign}
+	if code := check("bclvet", []string{"-fix", file}, &stderr, analyzers); code != 1 {
+		t.Errorf("got exit code %d, expected 1", code)
+	}
+	if expected := file + ":1:18: assign: comparison used as a command: did you mean := for assignment?\n"; stderr.String() != expected {
+		t.Errorf("got %q, expected %q", stderr.String(), expected)
+	}
+	src, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "let F(X) be $( X := 1; writen(X) $)\n"; string(src) != expected {
+		t.Errorf("got %q after -fix, expected %q", src, expected)
+	}
+	stderr.Reset()
+	if code := check("bclvet", []string{file}, &stderr, analyzers); code != 0 || stderr.Len() > 0 {
+		t.Errorf("got exit code %d and %q after -fix", code, stderr.String())
+	}
+}
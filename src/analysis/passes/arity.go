@@ -0,0 +1,121 @@
+// Copyright 2015 Meador Inge.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package passes
+
+import (
+	"fmt"
+	"github.com/meadori/bcpl-go/src/analysis"
+	"github.com/meadori/bcpl-go/src/ast"
+	"github.com/meadori/bcpl-go/src/token"
+	"github.com/meadori/bcpl-go/src/xref"
+)
+
+var Arity = &analysis.Analyzer{
+	Name: "arity",
+	Doc: `check the number of arguments of calls
+
+A call of a function should pass as many arguments as the function
+has parameters, as a missing argument has no defined value and an
+extra one is lost.  A function given to a global by one section may
+be called by another: the calls are checked if the section defining
+it is analyzed first, as it is when the calling section needs it.`,
+	Requires:  []*analysis.Analyzer{Xref},
+	FactTypes: []analysis.Fact{new(ArityFact)},
+	Run:       checkArity,
+}
+
+// The number of parameters of the function a section gives a global.
+type ArityFact struct {
+	Params  int
+	Section string
+	Pos     token.Position
+}
+
+func (*ArityFact) AFact() {}
+
+func plural(n int, noun string) string {
+	if n == 1 {
+		return fmt.Sprintf("%d %s", n, noun)
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
+}
+
+func checkArity(pass *analysis.Pass) (interface{}, error) {
+	x := pass.ResultOf[Xref].(*xref.Listing)
+
+	// The symbol each name refers to, by the offset of the name.
+	syms := make(map[int]*xref.Symbol)
+	for _, sym := range x.Symbols {
+		for _, u := range sym.Uses {
+			syms[u.Pos.Offset] = sym
+		}
+	}
+
+	// The number of parameters of the names given a value by a single
+	// definition, which is a function or routine definition.
+	writes := make(map[*xref.Symbol]int)
+	for _, sym := range x.Symbols {
+		for _, u := range sym.Uses {
+			if u.Kind == xref.Write {
+				writes[sym]++
+			}
+		}
+	}
+	funcs := make(map[*xref.Symbol]int)
+	for _, d := range defs(pass.Program) {
+		var pos token.Position
+		var params *ast.NameList
+		switch d := d.(type) {
+		case *ast.FuncDef:
+			pos, params = d.NamePos, d.Params
+		case *ast.RoutineDef:
+			pos, params = d.NamePos, d.Params
+		default:
+			continue
+		}
+		sym := syms[pos.Offset]
+		if sym == nil || writes[sym] != 1 {
+			continue
+		}
+		funcs[sym] = len(params.Names)
+		if sym.Kind == xref.Global {
+			pass.ExportGlobalFact(sym.Number, &ArityFact{len(params.Names), pass.Section, pos})
+		}
+	}
+
+	ast.Inspect(pass.Program, func(n ast.Node) bool {
+		call, ok := n.(*ast.CallExpr)
+		if !ok {
+			return true
+		}
+		fn := call.Fn
+		for p, ok := fn.(*ast.ParenExpr); ok; p, ok = fn.(*ast.ParenExpr) {
+			fn = p.X
+		}
+		name, ok := fn.(*ast.Name)
+		if !ok {
+			return true
+		}
+		sym := syms[name.NamePos.Offset]
+		if sym == nil {
+			return true
+		}
+		args := len(call.Args.Exprs)
+		if params, ok := funcs[sym]; ok {
+			if args != params {
+				pass.Reportf(name.NamePos, "%s called with %s but takes %s",
+					name.Val, plural(args, "argument"), plural(params, "parameter"))
+			}
+			return true
+		}
+		var fact ArityFact
+		if sym.Kind == xref.Global && pass.ImportGlobalFact(sym.Number, &fact) && args != fact.Params {
+			pass.Reportf(name.NamePos, "%s called with %s but takes %s as defined at %s:%s",
+				name.Val, plural(args, "argument"), plural(fact.Params, "parameter"), fact.Section, fact.Pos)
+		}
+		return true
+	})
+	return nil, nil
+}
@@ -0,0 +1,408 @@
+// Copyright 2015 Meador Inge.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package passes
+
+import (
+	"github.com/meadori/bcpl-go/src/analysis"
+	"github.com/meadori/bcpl-go/src/ast"
+	"github.com/meadori/bcpl-go/src/edit"
+	"github.com/meadori/bcpl-go/src/token"
+	"github.com/meadori/bcpl-go/src/xref"
+)
+
+// ----------------------------------------------------------------------------
+// Assignments to manifest constants
+
+var Manifest = &analysis.Analyzer{
+	Name: "manifest",
+	Doc: `check for assignments to manifest constants
+
+A manifest constant names a value, not a cell, so it cannot be given
+another value by an assignment.`,
+	Requires: []*analysis.Analyzer{Xref},
+	Run:      checkManifests,
+}
+
+func checkManifests(pass *analysis.Pass) (interface{}, error) {
+	assigns := assigned(pass.Program)
+	for _, sym := range pass.ResultOf[Xref].(*xref.Listing).Symbols {
+		if sym.Kind != xref.Manifest || defined(sym, assigns) {
+			continue
+		}
+		for _, u := range sym.Uses {
+			if assigns[u.Pos.Offset] {
+				pass.Reportf(u.Pos, "assignment to manifest constant %s declared at %s", sym.Name, sym.Decl)
+			}
+		}
+	}
+	return nil, nil
+}
+
+// ----------------------------------------------------------------------------
+// Definitions hiding manifest constants
+
+var Shadow = &analysis.Analyzer{
+	Name: "shadow",
+	Doc: `check for definitions hiding manifest constants
+
+A let definition of a name declared manifest gives the name a cell of
+its own, so the uses of the name see the definition and not the
+constant.`,
+	Requires: []*analysis.Analyzer{Xref},
+	Run:      checkShadow,
+}
+
+func checkShadow(pass *analysis.Pass) (interface{}, error) {
+	assigns := assigned(pass.Program)
+	for _, sym := range pass.ResultOf[Xref].(*xref.Listing).Symbols {
+		if sym.Kind != xref.Manifest {
+			continue
+		}
+		for _, u := range sym.Uses {
+			if u.Kind == xref.Write && !assigns[u.Pos.Offset] {
+				pass.Reportf(u.Pos, "definition of manifest constant %s declared at %s", sym.Name, sym.Decl)
+			}
+		}
+	}
+	return nil, nil
+}
+
+// ----------------------------------------------------------------------------
+// Unreachable commands
+
+var Unreachable = &analysis.Analyzer{
+	Name: "unreachable",
+	Doc: `check for unreachable commands
+
+A command of a block following a goto, return, finish, break or
+resultis is never run, unless it has a label or is a case of a
+switchon, which a jump may reach.`,
+	Run: checkUnreachable,
+}
+
+// Return the keyword of a command that never goes on to the next, or
+// "" if it may.
+func jump(c ast.Cmd) string {
+	switch c := c.(type) {
+	case *ast.JumpCmd:
+		return c.Tok.String()
+	case *ast.GotoCmd:
+		return "goto"
+	case *ast.ResultisCmd:
+		return "resultis"
+	}
+	return ""
+}
+
+// Report whether a jump may reach a command.
+func labelled(c ast.Cmd) bool {
+	switch c.(type) {
+	case *ast.LabelCmd, *ast.CaseCmd:
+		return true
+	}
+	return false
+}
+
+func checkUnreachable(pass *analysis.Pass) (interface{}, error) {
+	ast.Inspect(pass.Program, func(n ast.Node) bool {
+		b, ok := n.(*ast.BlockCmd)
+		if !ok {
+			return true
+		}
+		after := ""
+		for _, item := range b.Items {
+			if labelled(item) {
+				after = ""
+			} else if _, ok := item.(*ast.LetCmd); !ok && after != "" {
+				pass.Reportf(item.Pos(), "unreachable code after %s", after)
+				after = ""
+				continue
+			}
+			if k := jump(item); k != "" {
+				after = k
+			}
+		}
+		return true
+	})
+	return nil, nil
+}
+
+// ----------------------------------------------------------------------------
+// Dead match arms
+
+var DeadArm = &analysis.Analyzer{
+	Name: "deadarm",
+	Doc: `check for match arms that are never chosen
+
+The arms of a match are tried in order, so an arm after one whose
+patterns are all ? or names, which match anything, is never chosen.`,
+	Requires: []*analysis.Analyzer{Xref},
+	Run:      checkDeadArms,
+}
+
+// Report whether the patterns of an arm match any arguments.
+func matchesAll(arm *ast.MatchArm, manifests map[string]bool) bool {
+	for _, pat := range arm.Patterns.Exprs {
+		switch pat := pat.(type) {
+		case *ast.QueryExpr:
+		case *ast.Name:
+			if manifests[pat.Val] {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func checkDeadArms(pass *analysis.Pass) (interface{}, error) {
+	consts := manifests(pass)
+	ast.Inspect(pass.Program, func(n ast.Node) bool {
+		m, ok := n.(*ast.MatchExpr)
+		if !ok {
+			return true
+		}
+		for i := 0; i+1 < len(m.Arms); i++ {
+			arm := m.Arms[i]
+			if matchesAll(arm, consts) {
+				pass.Reportf(m.Arms[i+1].Pos(), "match arm is never chosen: the arm at %s matches anything", arm.Pos())
+				break
+			}
+		}
+		return true
+	})
+	return nil, nil
+}
+
+// ----------------------------------------------------------------------------
+// Misplaced resultis and break
+
+var Resultis = &analysis.Analyzer{
+	Name: "resultis",
+	Doc: `check for resultis outside a valof
+
+A resultis gives the value of the innermost valof around it, so one
+outside every valof of its routine has nowhere to go.`,
+	Run: checkResultis,
+}
+
+var Break = &analysis.Analyzer{
+	Name: "break",
+	Doc: `check for break outside a loop
+
+A break leaves the innermost while, until, for or repeat loop around
+it, so one outside every loop of its routine has nowhere to go.  So
+too for the loop, endcase, next and exit commands of the Richards
+dialect, which need a loop, a switchon and a match or every around
+them.`,
+	Run: checkBreak,
+}
+
+// Report the nodes that match outside every node enclosing them.
+func outside(pass *analysis.Pass, enclosing, match func(ast.Node) bool, msg string) {
+	depth := 0
+	var stack []bool
+	ast.Inspect(pass.Program, func(n ast.Node) bool {
+		if n == nil {
+			if stack[len(stack)-1] {
+				depth--
+			}
+			stack = stack[:len(stack)-1]
+			return true
+		}
+		if depth == 0 && match(n) {
+			pass.Reportf(n.Pos(), "%s", msg)
+		}
+		e := enclosing(n)
+		if e {
+			depth++
+		}
+		stack = append(stack, e)
+		return true
+	})
+}
+
+func checkResultis(pass *analysis.Pass) (interface{}, error) {
+	outside(pass, func(n ast.Node) bool {
+		_, ok := n.(*ast.ValofExpr)
+		return ok
+	}, func(n ast.Node) bool {
+		_, ok := n.(*ast.ResultisCmd)
+		return ok
+	}, "resultis outside valof")
+	return nil, nil
+}
+
+func checkBreak(pass *analysis.Pass) (interface{}, error) {
+	loop := func(n ast.Node) bool {
+		switch n.(type) {
+		case *ast.WhileCmd, *ast.RepeatCmd, *ast.ForCmd:
+			return true
+		}
+		return false
+	}
+	switchon := func(n ast.Node) bool {
+		_, ok := n.(*ast.SwitchonCmd)
+		return ok
+	}
+	match := func(n ast.Node) bool {
+		_, ok := n.(*ast.MatchExpr)
+		return ok
+	}
+	for _, j := range []struct {
+		tok       token.TokenKind
+		enclosing func(ast.Node) bool
+		target    string
+	}{
+		{token.BREAK, loop, "a loop"},
+		{token.LOOP, loop, "a loop"},
+		{token.ENDCASE, switchon, "a switchon"},
+		{token.NEXT, match, "a match"},
+		{token.EXIT, match, "a match"},
+	} {
+		tok := j.tok
+		outside(pass, j.enclosing, func(n ast.Node) bool {
+			c, ok := n.(*ast.JumpCmd)
+			return ok && c.Tok == tok
+		}, tok.String()+" outside "+j.target)
+	}
+	return nil, nil
+}
+
+// ----------------------------------------------------------------------------
+// Comparisons meant as assignments
+
+var Assign = &analysis.Analyzer{
+	Name: "assign",
+	Doc: `check for = used where := was meant
+
+A command made of an equality, as in X = 1, compares the two and
+throws the result away; it was probably meant to be the assignment
+X := 1, which the fix makes it.`,
+	Run: checkAssign,
+}
+
+func checkAssign(pass *analysis.Pass) (interface{}, error) {
+	ast.Inspect(pass.Program, func(n ast.Node) bool {
+		c, ok := n.(*ast.ExprCmd)
+		if !ok {
+			return true
+		}
+		if e, ok := c.X.(*ast.BinaryExpr); ok && e.Op == token.EQ {
+			pass.Report(analysis.Diagnostic{
+				Pos:     e.OpPos,
+				Message: "comparison used as a command: did you mean := for assignment?",
+				Fixes: []edit.Fix{{
+					"replace = with :=",
+					[]edit.Edit{{e.OpPos.Offset, e.OpPos.Offset + 1, ":="}},
+				}},
+			})
+		}
+		return true
+	})
+	return nil, nil
+}
+
+// ----------------------------------------------------------------------------
+// Unused let variables
+
+var Unused = &analysis.Analyzer{
+	Name: "unused",
+	Doc: `check for unused let variables
+
+A value or vector given a name by a let definition that is never
+used was probably meant to be.`,
+	Requires: []*analysis.Analyzer{Xref},
+	Run:      checkUnused,
+}
+
+func checkUnused(pass *analysis.Pass) (interface{}, error) {
+	for _, sym := range pass.ResultOf[Xref].(*xref.Listing).Symbols {
+		if sym.Kind != xref.Value && sym.Kind != xref.Vector {
+			continue
+		}
+		used := false
+		for _, u := range sym.Uses {
+			if u.Kind != xref.Write {
+				used = true
+			}
+		}
+		if !used {
+			pass.Reportf(sym.Decl, "%s %s is defined but never used", sym.Kind, sym.Name)
+		}
+	}
+	return nil, nil
+}
+
+// ----------------------------------------------------------------------------
+// Unused globals
+
+var Globals = &analysis.Analyzer{
+	Name: "globals",
+	Doc: `check for globals declared but never used
+
+A global declared but neither defined nor used in a section may still
+be used by another, so the analyzer is best run on the section
+defining the global, or on the whole program.`,
+	Requires: []*analysis.Analyzer{Xref},
+	Run:      checkGlobals,
+}
+
+func checkGlobals(pass *analysis.Pass) (interface{}, error) {
+	for _, sym := range pass.ResultOf[Xref].(*xref.Listing).Symbols {
+		if sym.Kind == xref.Global && sym.Decl.IsValid() && len(sym.Uses) == 0 {
+			pass.Reportf(sym.Decl, "global %s is declared but never used", sym.Name)
+		}
+	}
+	return nil, nil
+}
+
+// ----------------------------------------------------------------------------
+// Vector sizes
+
+var VecSize = &analysis.Analyzer{
+	Name: "vecsize",
+	Doc: `check that the sizes of vectors are constant
+
+The size of a vector must be a constant expression, made of numbers,
+truth values and manifest constants with the arithmetic operators, so
+that its store can be set aside when the program is compiled.`,
+	Requires: []*analysis.Analyzer{Xref},
+	Run:      checkVecSizes,
+}
+
+// Report whether an expression is constant.
+func constant(e ast.Expr, manifests map[string]bool) bool {
+	switch e := e.(type) {
+	case *ast.ConstExpr, *ast.BoolExpr:
+		return true
+	case *ast.Name:
+		return manifests[e.Val]
+	case *ast.ParenExpr:
+		return constant(e.X, manifests)
+	case *ast.UnaryExpr:
+		switch e.Op {
+		case token.PLUS, token.MINUS:
+			return constant(e.X, manifests)
+		}
+	case *ast.BinaryExpr:
+		switch e.Op {
+		case token.PLUS, token.MINUS, token.STAR, token.DIV, token.REM:
+			return constant(e.X, manifests) && constant(e.Y, manifests)
+		}
+	}
+	return false
+}
+
+func checkVecSizes(pass *analysis.Pass) (interface{}, error) {
+	consts := manifests(pass)
+	for _, d := range defs(pass.Program) {
+		if v, ok := d.(*ast.VecDef); ok && !constant(v.Expr, consts) {
+			pass.Reportf(v.Expr.Pos(), "size of vector %s is not a constant", v.Name)
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,68 @@
+// Copyright 2015 Meador Inge.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package passes
+
+import (
+	"fmt"
+	"github.com/meadori/bcpl-go/src/analysis"
+	"github.com/meadori/bcpl-go/src/ast"
+	"github.com/meadori/bcpl-go/src/edit"
+	"github.com/meadori/bcpl-go/src/xref"
+)
+
+var Magic = &analysis.Analyzer{
+	Name: "magic",
+	Doc: `check for numbers that have a manifest constant
+
+A number written out where a manifest constant of the section has the
+same value was probably meant to be the constant, so that the two do
+not drift apart.  The numbers 0 and 1, and values shared by several
+constants, are left alone; the fix replaces the number by the name.`,
+	Requires: []*analysis.Analyzer{Xref},
+	Run:      checkMagic,
+}
+
+func checkMagic(pass *analysis.Pass) (interface{}, error) {
+	x := pass.ResultOf[Xref].(*xref.Listing)
+	assigns := assigned(pass.Program)
+
+	// The name of the manifest constant of each value, or "" if the
+	// value has several.  A name that is also bound otherwise may not
+	// mean the constant everywhere and is left out.
+	bound := make(map[string]int)
+	for _, sym := range x.Symbols {
+		bound[sym.Name]++
+	}
+	names := make(map[int]string)
+	for _, sym := range x.Symbols {
+		if sym.Kind != xref.Manifest || defined(sym, assigns) || bound[sym.Name] > 1 || sym.Number == 0 || sym.Number == 1 {
+			continue
+		}
+		if _, ok := names[sym.Number]; ok {
+			names[sym.Number] = ""
+		} else {
+			names[sym.Number] = sym.Name
+		}
+	}
+
+	ast.Inspect(pass.Program, func(n ast.Node) bool {
+		c, ok := n.(*ast.ConstExpr)
+		if !ok {
+			return true
+		}
+		if name := names[c.Contant]; name != "" && c.Lit != "" {
+			pass.Report(analysis.Diagnostic{
+				Pos:     c.ValuePos,
+				Message: fmt.Sprintf("%s is the value of manifest constant %s", c.Lit, name),
+				Fixes: []edit.Fix{{
+					"replace " + c.Lit + " with " + name,
+					[]edit.Edit{{c.ValuePos.Offset, c.ValuePos.Offset + len(c.Lit), name}},
+				}},
+			})
+		}
+		return true
+	})
+	return nil, nil
+}
@@ -0,0 +1,101 @@
+// Copyright 2015 Meador Inge.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+// Package passes holds the analyzers of bclvet, which look for
+// suspicious constructs in BCPL programs: code the compiler accepts
+// but that is probably a mistake.  Most of them use the result of the
+// Xref analyzer, the cross-reference listing of the section.
+package passes
+
+import (
+	"github.com/meadori/bcpl-go/src/analysis"
+	"github.com/meadori/bcpl-go/src/ast"
+	"github.com/meadori/bcpl-go/src/xref"
+)
+
+// The analyzers reporting diagnostics, in the order bclvet lists them.
+var Analyzers = []*analysis.Analyzer{
+	Manifest,
+	Shadow,
+	Unreachable,
+	DeadArm,
+	Resultis,
+	Break,
+	Assign,
+	Unused,
+	Globals,
+	VecSize,
+	Arity,
+	Magic,
+}
+
+// Lookup the analyzer with the given name, or nil if there is none.
+func Lookup(name string) *analysis.Analyzer {
+	for _, a := range Analyzers {
+		if a.Name == name {
+			return a
+		}
+	}
+	return nil
+}
+
+var Xref = &analysis.Analyzer{
+	Name: "xref",
+	Doc: `compute the cross-reference listing of a section
+
+The result is an *xref.Listing.  No diagnostics are reported.`,
+	Run: func(pass *analysis.Pass) (interface{}, error) {
+		return xref.New(pass.Program), nil
+	},
+}
+
+// Return the offsets of the names the commands of a program assign.
+func assigned(prog *ast.Program) map[int]bool {
+	offsets := make(map[int]bool)
+	ast.Inspect(prog, func(n ast.Node) bool {
+		if a, ok := n.(*ast.AssignCmd); ok {
+			for _, x := range a.Lhs.Exprs {
+				if name, ok := x.(*ast.Name); ok {
+					offsets[name.NamePos.Offset] = true
+				}
+			}
+		}
+		return true
+	})
+	return offsets
+}
+
+// Report whether a definition, rather than an assignment, gives a name
+// a value.
+func defined(sym *xref.Symbol, assigns map[int]bool) bool {
+	for _, u := range sym.Uses {
+		if u.Kind == xref.Write && !assigns[u.Pos.Offset] {
+			return true
+		}
+	}
+	return false
+}
+
+// Return the names of the manifest constants of a section that are
+// not redefined.
+func manifests(pass *analysis.Pass) map[string]bool {
+	assigns := assigned(pass.Program)
+	names := make(map[string]bool)
+	for _, sym := range pass.ResultOf[Xref].(*xref.Listing).Symbols {
+		if sym.Kind == xref.Manifest && !defined(sym, assigns) {
+			names[sym.Name] = true
+		}
+	}
+	return names
+}
+
+// Return the definitions of a program, with those joined by "and"
+// flattened.
+func defs(prog *ast.Program) []ast.Def {
+	var list []ast.Def
+	for _, def := range prog.Defs {
+		list = append(list, ast.Defs(def)...)
+	}
+	return list
+}
@@ -0,0 +1,215 @@
+// Copyright 2015 Meador Inge.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package passes
+
+import (
+	"github.com/meadori/bcpl-go/src/analysis"
+	"github.com/meadori/bcpl-go/src/analysis/multichecker"
+	"github.com/meadori/bcpl-go/src/ast"
+	"github.com/meadori/bcpl-go/src/edit"
+	"github.com/meadori/bcpl-go/src/link"
+	"github.com/meadori/bcpl-go/src/parser"
+	"github.com/meadori/bcpl-go/src/token"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func parse(t *testing.T, src string) *ast.Program {
+	var p parser.Parser
+	p.Dialect = token.Richards
+	p.Init([]byte(src))
+	prog := p.Parse()
+	if len(p.Errors) > 0 {
+		t.Fatal(p.Errors)
+	}
+	return prog
+}
+
+var test_analyzers = []struct {
+	analyzer string
+	src      string
+	diags    []string
+}{
+	{"manifest", "manifest $( K = 1 $)\nlet F() be K := 2", []string{
+		"2:12: manifest: assignment to manifest constant K declared at 1:13",
+	}},
+	{"manifest", "manifest $( K = 1 $)\nlet F() be $( let K = 0; K := 2 $)", nil},
+	{"shadow", "manifest $( K = 1 $)\nlet K = 2\nlet F() = K", []string{
+		"2:5: shadow: definition of manifest constant K declared at 1:13",
+	}},
+	{"shadow", "manifest $( K = 1 $)\nlet F(K) = K", nil},
+	{"unreachable", "let F(X) be\n$( if X goto L\n   return\n   writen(X)\n   writen(2)\nL: writen(1)\n   finish\n$)", []string{
+		"4:4: unreachable: unreachable code after return",
+	}},
+	{"unreachable", "let F(X) = valof\n$( resultis X\n   let Y = 1\n   writen(Y)\n$)", []string{
+		"4:4: unreachable: unreachable code after resultis",
+	}},
+	{"unreachable", "let F(X) be switchon X into\n$( case 1: return\n   case 2: writen(2)\n$)", nil},
+	{"deadarm", "manifest $( Red = 1 $)\nlet F(X, Y) = match (X, Y) : Red, ? => 1 : A, ? => A : ?, 2 => 3 : ?, ? => 4 .", []string{
+		"2:54: deadarm: match arm is never chosen: the arm at 2:42 matches anything",
+	}},
+	{"deadarm", "manifest $( Red = 1 $)\nlet F(X) = match (X) : Red => 1 : 2 => 2 : ? => 3 .", nil},
+	{"resultis", "let F(X) be resultis X\nlet G(X) = valof $( while X do resultis X; resultis 0 $)", []string{
+		"1:13: resultis: resultis outside valof",
+	}},
+	{"break", "let F(X) be\n$( while X do $( if X = 1 break $)\n   break\n$)", []string{
+		"3:4: break: break outside a loop",
+	}},
+	{"break", "let F(X) = valof $( for I = 1 to X do resultis valof $( break $); resultis 0 $)", nil},
+	{"break", "let F(X) be\n$( loop; endcase\n   while X do $( next; loop $)\n   switchon X into $( case 1: endcase $)\n$)", []string{
+		"2:4: break: loop outside a loop",
+		"2:10: break: endcase outside a switchon",
+		"3:18: break: next outside a match",
+	}},
+	{"assign", "let F(X) be $( X = 1; X := 1; if X = 1 do X := 2 $)", []string{
+		"1:18: assign: comparison used as a command: did you mean := for assignment?",
+	}},
+	{"unused", "let A, B = 1, 2\nlet V = vec 3\nlet F(X) = B\nlet G() = 0", []string{
+		"1:5: unused: value A is defined but never used",
+		"2:5: unused: vector V is defined but never used",
+	}},
+	{"unused", "let A = 1\nand F() = lv A", nil},
+	{"globals", "global $( Hook: 200; Used: 201; Defined: 202 $)\nlet Defined() = Used", []string{
+		"1:11: globals: global Hook is declared but never used",
+	}},
+	{"vecsize", "manifest $( N = 10 $)\nlet X = 3\nlet A = vec N * 2 + 1\nlet B = vec X\nlet C = vec N < 3", []string{
+		"4:13: vecsize: size of vector B is not a constant",
+		"5:13: vecsize: size of vector C is not a constant",
+	}},
+	{"arity", "let F(A, B) = A + B\nlet G() = F(1) + F(1, 2) + (F)(1, 2, 3)\nlet H(F) = F(1)", []string{
+		"2:11: arity: F called with 1 argument but takes 2 parameters",
+		"2:29: arity: F called with 3 arguments but takes 2 parameters",
+	}},
+	{"arity", "let F(A) = A\nlet F(A, B) = A\nlet G() = F(1, 2, 3)", nil},
+	{"magic", "manifest $( Size = 100; Mask = #XFF; One = 1 $)\nlet V = vec 100\nlet F(X) = X & 255 + 1 + 1000", []string{
+		"2:13: magic: 100 is the value of manifest constant Size",
+		"3:16: magic: 255 is the value of manifest constant Mask",
+	}},
+	{"magic", "manifest $( A = 2; B = 2; C = 3 $)\nlet C = 4\nlet F(X) = X + 2 + 3", nil},
+	{"magic", "manifest $( N = 10 $)\nlet F(N) = N + 10", nil},
+	{"vecsize", "manifest $( N = 10 $)\nlet N = 3\nlet A = vec N", []string{
+		"3:13: vecsize: size of vector A is not a constant",
+	}},
+}
+
+// Run analyzers over sections with the given sources, named a.b, b.b
+// and so on, returning their diagnostics.  The names of the sections
+// are left out if there is one.
+func run(t *testing.T, analyzers []*analysis.Analyzer, srcs ...string) []string {
+	var sections []link.Section
+	for i, src := range srcs {
+		sections = append(sections, link.Section{string(rune('a'+i)) + ".b", parse(t, src)})
+	}
+	diags, err := multichecker.Run(sections, analyzers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, d := range diags {
+		if len(srcs) == 1 {
+			got = append(got, d.Pos.String()+": "+d.Analyzer.Name+": "+d.Message)
+		} else {
+			got = append(got, d.String())
+		}
+	}
+	return got
+}
+
+func TestAnalyzers(t *testing.T) {
+	for _, test := range test_analyzers {
+		a := Lookup(test.analyzer)
+		if a == nil {
+			t.Fatalf("no analyzer %s", test.analyzer)
+		}
+		got := run(t, []*analysis.Analyzer{a}, test.src)
+		if strings.Join(got, "\n") != strings.Join(test.diags, "\n") {
+			t.Errorf("%q: got\n%s\nexpected\n%s", test.src, strings.Join(got, "\n"), strings.Join(test.diags, "\n"))
+		}
+	}
+}
+
+func TestAll(t *testing.T) {
+	src := "global $( G: 100 $)\nlet V = vec G\nmanifest $( K = 1 $)\nlet K = 2"
+	got := run(t, Analyzers, src)
+	expected := []string{
+		"2:5: unused: vector V is defined but never used",
+		"2:13: vecsize: size of vector V is not a constant",
+		"4:5: shadow: definition of manifest constant K declared at 3:13",
+	}
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("got\n%s\nexpected\n%s", strings.Join(got, "\n"), strings.Join(expected, "\n"))
+	}
+}
+
+// The calls of a global are checked in the sections analyzed after
+// the section defining it: those needing it, and those after it.
+func TestArityFacts(t *testing.T) {
+	lib := "section \"lib\"\nglobal $( Add: 200 $)\nlet Add(A, B) = A + B"
+	user := "needs \"lib\"\nglobal $( Add: 200 $)\nlet start() = Add(1)"
+	got := run(t, []*analysis.Analyzer{Arity}, user, lib)
+	expected := []string{
+		"a.b:3:15: arity: Add called with 1 argument but takes 2 parameters as defined at lib:3:5",
+	}
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("got\n%s\nexpected\n%s", strings.Join(got, "\n"), strings.Join(expected, "\n"))
+	}
+	if got := run(t, []*analysis.Analyzer{Arity}, strings.Replace(user, "needs \"lib\"\n", "", 1), lib); len(got) != 0 {
+		t.Errorf("got %v before the section defining Add", got)
+	}
+}
+
+var test_fixes = []struct {
+	src, fixed string
+}{
+	{"manifest $( Size = 100 $)\nlet V = vec 100\nlet F(I) = I < 100 -> V!I, 0",
+		"manifest $( Size = 100 $)\nlet V = vec Size\nlet F(I) = I < Size -> V!I, 0"},
+	{"manifest $( Mask = #XFF $)\nlet F(X) = X & #XFF", "manifest $( Mask = #XFF $)\nlet F(X) = X & Mask"},
+	{"let F(X) be $( X = 1; if X = 1 do X := 2 $)", "let F(X) be $( X := 1; if X = 1 do X := 2 $)"},
+}
+
+func TestFixes(t *testing.T) {
+	for _, test := range test_fixes {
+		diags, err := multichecker.Run([]link.Section{{"t.b", parse(t, test.src)}}, Analyzers)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var edits []edit.Edit
+		for _, d := range diags {
+			edits = append(edits, edit.First(d.Fixes)...)
+		}
+		fixed, err := edit.Apply([]byte(test.src), edits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(fixed) != test.fixed {
+			t.Errorf("%q: got %q, expected %q", test.src, fixed, test.fixed)
+		}
+	}
+}
+
+func TestTestdata(t *testing.T) {
+	files, _ := filepath.Glob("../../../testdata/*.b")
+	for _, file := range files {
+		src, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		prog, err := parser.ParseProgram(src)
+		if err != nil {
+			continue
+		}
+		diags, err := multichecker.Run([]link.Section{{file, prog}}, Analyzers)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, d := range diags {
+			if d.Analyzer != Globals && d.Analyzer != Unused {
+				t.Error(d)
+			}
+		}
+	}
+}
@@ -4,10 +4,161 @@
 
 package ast
 
+import (
+	"github.com/meadori/bcpl-go/src/token"
+	"strings"
+)
+
+// All nodes in the tree know where they start in the source.
+type Node interface {
+	Pos() token.Position
+}
+
+// The kind of a node.  It tells apart the implementations of the
+// Expr, Cmd, Def and Decl interfaces, for example when a tree is
+// serialized.
+type NodeKind int
+
+const (
+	BadNode NodeKind = iota
+	NameNode
+	ConstExprNode
+	StringExprNode
+	BoolExprNode
+	ParenExprNode
+	CallExprNode
+	VecApExprNode
+	UnaryExprNode
+	BinaryExprNode
+	CondExprNode
+	GlobalDeclNode
+	ConstantDeclNode
+	AndDefNode
+	SimpleDefNode
+	VecDefNode
+	FuncDefNode
+	QueryExprNode
+	MatchExprNode
+	StaticDeclNode
+	ValofExprNode
+	RoutineDefNode
+	AssignCmdNode
+	ExprCmdNode
+	IfCmdNode
+	TestCmdNode
+	WhileCmdNode
+	RepeatCmdNode
+	ForCmdNode
+	JumpCmdNode
+	GotoCmdNode
+	ResultisCmdNode
+	SwitchonCmdNode
+	CaseCmdNode
+	LabelCmdNode
+	BlockCmdNode
+	LetCmdNode
+)
+
+var nodeKinds = [...]string{
+	BadNode:          "BadNode",
+	NameNode:         "Name",
+	ConstExprNode:    "ConstExpr",
+	StringExprNode:   "StringExpr",
+	BoolExprNode:     "BoolExpr",
+	ParenExprNode:    "ParenExpr",
+	CallExprNode:     "CallExpr",
+	VecApExprNode:    "VecApExpr",
+	UnaryExprNode:    "UnaryExpr",
+	BinaryExprNode:   "BinaryExpr",
+	CondExprNode:     "CondExpr",
+	GlobalDeclNode:   "GlobalDecl",
+	ConstantDeclNode: "ConstantDecl",
+	AndDefNode:       "AndDef",
+	SimpleDefNode:    "SimpleDef",
+	VecDefNode:       "VecDef",
+	FuncDefNode:      "FuncDef",
+	QueryExprNode:    "QueryExpr",
+	MatchExprNode:    "MatchExpr",
+	StaticDeclNode:   "StaticDecl",
+	ValofExprNode:    "ValofExpr",
+	RoutineDefNode:   "RoutineDef",
+	AssignCmdNode:    "AssignCmd",
+	ExprCmdNode:      "ExprCmd",
+	IfCmdNode:        "IfCmd",
+	TestCmdNode:      "TestCmd",
+	WhileCmdNode:     "WhileCmd",
+	RepeatCmdNode:    "RepeatCmd",
+	ForCmdNode:       "ForCmd",
+	JumpCmdNode:      "JumpCmd",
+	GotoCmdNode:      "GotoCmd",
+	ResultisCmdNode:  "ResultisCmd",
+	SwitchonCmdNode:  "SwitchonCmd",
+	CaseCmdNode:      "CaseCmd",
+	LabelCmdNode:     "LabelCmd",
+	BlockCmdNode:     "BlockCmd",
+	LetCmdNode:       "LetCmd",
+}
+
+// Return the name of the node kind, which is also the name
+// of the node type.
+func (kind NodeKind) String() string {
+	return nodeKinds[kind]
+}
+
+// Lookup the node kind with the given name, returning
+// BadNode if there is none.
+func LookupNodeKind(name string) NodeKind {
+	for kind, str := range nodeKinds {
+		if str == name {
+			return NodeKind(kind)
+		}
+	}
+	return BadNode
+}
+
+// ----------------------------------------------------------------------------
+// 2.1.2 Comments
+
+// A single "//" comment.  The text does not include the
+// terminating newline.
+type Comment struct {
+	Slash token.Position // The position of the "//".
+	Text  string
+}
+
+func (c *Comment) Pos() token.Position { return c.Slash }
+
+// A sequence of comments on consecutive lines with no
+// other tokens in between.
+type CommentGroup struct {
+	List []*Comment
+}
+
+func (g *CommentGroup) Pos() token.Position { return g.List[0].Pos() }
+
+// Return the text of the comments with the comment markers
+// and leading space removed, one line per comment.
+func (g *CommentGroup) Text() string {
+	if g == nil {
+		return ""
+	}
+	var lines []string
+	for _, c := range g.List {
+		text := strings.TrimPrefix(c.Text, "//")
+		if len(text) > 0 && text[0] == ' ' {
+			text = text[1:]
+		}
+		lines = append(lines, strings.TrimRight(text, " \t"))
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
 // ----------------------------------------------------------------------------
 // 4.0 Primary expressions
 
 type Expr interface {
+	Node
+	Kind() NodeKind
 }
 
 // ----------------------------------------------------------------------------
@@ -15,10 +166,15 @@ type Expr interface {
 
 // A name is a sequence of characters used
 // to declare variables and define functions.
+// A name is also an expression.
 type Name struct {
-	Val string
+	NamePos token.Position
+	Val     string
 }
 
+func (n *Name) Pos() token.Position { return n.NamePos }
+func (*Name) Kind() NodeKind        { return NameNode }
+
 // A list of names.
 type NameList struct {
 	Names []*Name
@@ -31,36 +187,399 @@ type ExprList struct {
 	Exprs []Expr
 }
 
+// A number.  The literal is kept as written, as in #X1F.
 type ConstExpr struct {
-	Contant int
+	ValuePos token.Position
+	Contant  int
+	Lit      string
+}
+
+func (c *ConstExpr) Pos() token.Position { return c.ValuePos }
+func (*ConstExpr) Kind() NodeKind        { return ConstExprNode }
+
+// A string constant.  The literal is kept as written, with
+// its quotes and "*" escapes.
+type StringExpr struct {
+	ValuePos token.Position
+	Lit      string
+}
+
+func (s *StringExpr) Pos() token.Position { return s.ValuePos }
+func (*StringExpr) Kind() NodeKind        { return StringExprNode }
+
+// The constant true or false.
+type BoolExpr struct {
+	ValuePos token.Position
+	Value    bool
+}
+
+func (b *BoolExpr) Pos() token.Position { return b.ValuePos }
+func (*BoolExpr) Kind() NodeKind        { return BoolExprNode }
+
+// A parenthesized expression.
+type ParenExpr struct {
+	Rbra token.Position // The position of the "(".
+	X    Expr
 }
 
+func (p *ParenExpr) Pos() token.Position { return p.Rbra }
+func (*ParenExpr) Kind() NodeKind        { return ParenExprNode }
+
+// ----------------------------------------------------------------------------
+// 5.1 Function Calls
+
+// A function application F(E1, E2, ...).
+type CallExpr struct {
+	Fn   Expr
+	Args *ExprList
+}
+
+func (c *CallExpr) Pos() token.Position { return c.Fn.Pos() }
+func (*CallExpr) Kind() NodeKind        { return CallExprNode }
+
+// ----------------------------------------------------------------------------
+// 5.2 Vector Applications
+
+// A vector application E1*[E2], the word at subscript E2 of the
+// vector E1.
+type VecApExpr struct {
+	X     Expr
+	Index Expr
+}
+
+func (v *VecApExpr) Pos() token.Position { return v.X.Pos() }
+func (*VecApExpr) Kind() NodeKind        { return VecApExprNode }
+
+// ----------------------------------------------------------------------------
+// 5.3 Operators
+
+// A prefix operator: lv, rv, "+", "-" or "!" (not).
+type UnaryExpr struct {
+	OpPos token.Position
+	Op    token.TokenKind
+	X     Expr
+}
+
+func (u *UnaryExpr) Pos() token.Position { return u.OpPos }
+func (*UnaryExpr) Kind() NodeKind        { return UnaryExprNode }
+
+// An infix operator.
+type BinaryExpr struct {
+	X     Expr
+	OpPos token.Position
+	Op    token.TokenKind
+	Y     Expr
+}
+
+func (b *BinaryExpr) Pos() token.Position { return b.X.Pos() }
+func (*BinaryExpr) Kind() NodeKind        { return BinaryExprNode }
+
+// ----------------------------------------------------------------------------
+// 5.4 Conditional Expressions
+
+// A conditional expression Cond -> Then, Else.
+type CondExpr struct {
+	Cond Expr
+	Then Expr
+	Else Expr
+}
+
+func (c *CondExpr) Pos() token.Position { return c.Cond.Pos() }
+func (*CondExpr) Kind() NodeKind        { return CondExprNode }
+
+// ----------------------------------------------------------------------------
+// 5.5 Valof Expressions
+
+// A valof expression, whose value is given by the first resultis
+// command executed in its body.
+type ValofExpr struct {
+	Valof token.Position // The position of the "valof" keyword.
+	Body  Cmd
+}
+
+func (v *ValofExpr) Pos() token.Position { return v.Valof }
+func (*ValofExpr) Kind() NodeKind        { return ValofExprNode }
+
+// ----------------------------------------------------------------------------
+// 6.0 Commands
+
+type Cmd interface {
+	Node
+	Kind() NodeKind
+	cmd()
+}
+
+// ----------------------------------------------------------------------------
+// 6.1 Assignment Commands
+
+// An assignment L1, L2, ... := E1, E2, ...  Each left hand side is a
+// name, a vector application or an rv expression.
+type AssignCmd struct {
+	Lhs *ExprList
+	Ass token.Position // The position of the ":=".
+	Rhs *ExprList
+}
+
+func (a *AssignCmd) Pos() token.Position { return a.Lhs.Exprs[0].Pos() }
+func (*AssignCmd) Kind() NodeKind        { return AssignCmdNode }
+func (*AssignCmd) cmd()                  {}
+
+// An expression evaluated for its effect, usually a routine call.
+type ExprCmd struct {
+	X Expr
+}
+
+func (e *ExprCmd) Pos() token.Position { return e.X.Pos() }
+func (*ExprCmd) Kind() NodeKind        { return ExprCmdNode }
+func (*ExprCmd) cmd()                  {}
+
+// ----------------------------------------------------------------------------
+// 6.2 Conditional Commands
+
+// A command if E do C, or unless E do C.
+type IfCmd struct {
+	If     token.Position // The position of the "if" or "unless" keyword.
+	Unless bool
+	Cond   Expr
+	Body   Cmd
+}
+
+func (i *IfCmd) Pos() token.Position { return i.If }
+func (*IfCmd) Kind() NodeKind        { return IfCmdNode }
+func (*IfCmd) cmd()                  {}
+
+// A command test E do C1 or C2.
+type TestCmd struct {
+	Test token.Position // The position of the "test" keyword.
+	Cond Expr
+	Then Cmd
+	Else Cmd
+}
+
+func (t *TestCmd) Pos() token.Position { return t.Test }
+func (*TestCmd) Kind() NodeKind        { return TestCmdNode }
+func (*TestCmd) cmd()                  {}
+
+// ----------------------------------------------------------------------------
+// 6.3 Repetitive Commands
+
+// A command while E do C, or until E do C.
+type WhileCmd struct {
+	While token.Position // The position of the "while" or "until" keyword.
+	Until bool
+	Cond  Expr
+	Body  Cmd
+}
+
+func (w *WhileCmd) Pos() token.Position { return w.While }
+func (*WhileCmd) Kind() NodeKind        { return WhileCmdNode }
+func (*WhileCmd) cmd()                  {}
+
+// A command C repeat, C repeatwhile E or C repeatuntil E.
+type RepeatCmd struct {
+	Body  Cmd
+	OpPos token.Position  // The position of the keyword.
+	Op    token.TokenKind // token.REPEAT, token.REPEATWHILE or token.REPEATUNTIL.
+	Cond  Expr            // The condition, or nil for repeat.
+}
+
+func (r *RepeatCmd) Pos() token.Position { return r.Body.Pos() }
+func (*RepeatCmd) Kind() NodeKind        { return RepeatCmdNode }
+func (*RepeatCmd) cmd()                  {}
+
+// A command for N = E1 to E2 do C.  The limit E2 is evaluated once.
+// The Richards dialect gives the step as a constant: for N = E1 to E2
+// by K do C.
+type ForCmd struct {
+	For  token.Position // The position of the "for" keyword.
+	Var  *Name
+	From Expr
+	To   Expr
+	By   Expr // The step, or nil for 1.
+	Body Cmd
+}
+
+func (f *ForCmd) Pos() token.Position { return f.For }
+func (*ForCmd) Kind() NodeKind        { return ForCmdNode }
+func (*ForCmd) cmd()                  {}
+
+// ----------------------------------------------------------------------------
+// 6.4 Transfer of Control
+
+// A break, return or finish command, or one of the Richards dialect:
+// loop, going on to the next iteration of a loop, endcase, leaving a
+// switchon, and next and exit, going on to the next arm of a match or
+// every and leaving it.
+type JumpCmd struct {
+	TokPos token.Position
+	Tok    token.TokenKind // token.BREAK, token.RETURN, token.FINISH, token.LOOP, token.ENDCASE, token.NEXT or token.EXIT.
+}
+
+func (j *JumpCmd) Pos() token.Position { return j.TokPos }
+func (*JumpCmd) Kind() NodeKind        { return JumpCmdNode }
+func (*JumpCmd) cmd()                  {}
+
+// A command goto L, jumping to a label of the enclosing function.
+type GotoCmd struct {
+	Goto  token.Position // The position of the "goto" keyword.
+	Label *Name
+}
+
+func (g *GotoCmd) Pos() token.Position { return g.Goto }
+func (*GotoCmd) Kind() NodeKind        { return GotoCmdNode }
+func (*GotoCmd) cmd()                  {}
+
+// A command resultis E, giving the value of the enclosing valof.
+type ResultisCmd struct {
+	Resultis token.Position // The position of the "resultis" keyword.
+	X        Expr
+}
+
+func (r *ResultisCmd) Pos() token.Position { return r.Resultis }
+func (*ResultisCmd) Kind() NodeKind        { return ResultisCmdNode }
+func (*ResultisCmd) cmd()                  {}
+
+// A command switchon E into C, going to the case of C whose
+// constant is the value of E, or to its default.
+type SwitchonCmd struct {
+	Switchon token.Position // The position of the "switchon" keyword.
+	X        Expr
+	Body     Cmd
+}
+
+func (s *SwitchonCmd) Pos() token.Position { return s.Switchon }
+func (*SwitchonCmd) Kind() NodeKind        { return SwitchonCmdNode }
+func (*SwitchonCmd) cmd()                  {}
+
+// ----------------------------------------------------------------------------
+// 6.5 Labels
+
+// A command labelled case K: C, or default: C.  The body is nil when
+// the label ends a block.
+type CaseCmd struct {
+	Case  token.Position // The position of the "case" or "default" keyword.
+	Value Expr           // The constant, or nil for default.
+	Body  Cmd
+}
+
+func (c *CaseCmd) Pos() token.Position { return c.Case }
+func (*CaseCmd) Kind() NodeKind        { return CaseCmdNode }
+func (*CaseCmd) cmd()                  {}
+
+// A command labelled L: C.  The body is nil when the label ends a
+// block.
+type LabelCmd struct {
+	Label *Name
+	Body  Cmd
+}
+
+func (l *LabelCmd) Pos() token.Position { return l.Label.Pos() }
+func (*LabelCmd) Kind() NodeKind        { return LabelCmdNode }
+func (*LabelCmd) cmd()                  {}
+
+// ----------------------------------------------------------------------------
+// 6.6 Blocks
+
+// A block $( C1; C2; ... $) of commands and local definitions.  The
+// scope of a definition is the rest of the block.
+type BlockCmd struct {
+	Sectbra token.Position // The position of the "$(".
+	Items   []Cmd
+	Sectket token.Position // The position of the "$)".
+}
+
+func (b *BlockCmd) Pos() token.Position { return b.Sectbra }
+func (*BlockCmd) Kind() NodeKind        { return BlockCmdNode }
+func (*BlockCmd) cmd()                  {}
+
+// A local definition in a block.
+type LetCmd struct {
+	Let token.Position // The position of the "let" keyword.
+	Def Def
+}
+
+func (l *LetCmd) Pos() token.Position { return l.Let }
+func (*LetCmd) Kind() NodeKind        { return LetCmdNode }
+func (*LetCmd) cmd()                  {}
+
+// ----------------------------------------------------------------------------
+// Expressions of the Richards dialect
+
+// The undefined value "?".
+type QueryExpr struct {
+	Query token.Position
+}
+
+func (q *QueryExpr) Pos() token.Position { return q.Query }
+func (*QueryExpr) Kind() NodeKind        { return QueryExprNode }
+
+// A pattern matching expression
+//
+//	match (E1, ..., En) : P1, ..., Pn => E ... .
+//
+// A match gives the value of the first arm whose patterns match the
+// arguments; an every evaluates every such arm and gives the value
+// of the last.
+type MatchExpr struct {
+	Match token.Position // The position of the "match" or "every" keyword.
+	Every bool
+	Args  *ExprList
+	Arms  []*MatchArm
+}
+
+func (m *MatchExpr) Pos() token.Position { return m.Match }
+func (*MatchExpr) Kind() NodeKind        { return MatchExprNode }
+
+// An arm of a pattern matching expression.  A pattern is a constant,
+// which matches an equal argument, a name, which is bound to the
+// argument, or "?", which matches anything.
+type MatchArm struct {
+	Colon    token.Position // The position of the ":".
+	Patterns *ExprList
+	Body     Expr
+}
+
+func (a *MatchArm) Pos() token.Position { return a.Colon }
+
 // ----------------------------------------------------------------------------
 // 7.0 Definitions
 
 type Def interface {
+	Node
+	Kind() NodeKind
 	def()
 }
 
-// A global or constant declaration.
+// A global, constant or static declaration.
 type Decl interface {
+	Node
+	Kind() NodeKind
 	VarDecls() []*VarDecl
 }
 
 // A single declaration from a constant or global
 // declaration.
 type VarDecl struct {
+	NamePos  token.Position
 	Name     string
 	Constant int
 }
 
+func (v *VarDecl) Pos() token.Position { return v.NamePos }
+
 // ----------------------------------------------------------------------------
 // 7.3 Global Declarations
 
 type GlobalDecl struct {
-	Items []*VarDecl
+	Doc     *CommentGroup  // The associated documentation, or nil.
+	Global  token.Position // The position of the "global" keyword.
+	Items   []*VarDecl
+	Sectket token.Position // The position of the closing "$)".
 }
 
+func (g *GlobalDecl) Pos() token.Position { return g.Global }
+func (*GlobalDecl) Kind() NodeKind        { return GlobalDeclNode }
+
 func (g *GlobalDecl) VarDecls() []*VarDecl {
 	return g.Items
 }
@@ -69,13 +588,38 @@ func (g *GlobalDecl) VarDecls() []*VarDecl {
 // 7.4 Manifest Declarations
 
 type ConstantDecl struct {
-	Items []*VarDecl
+	Doc      *CommentGroup  // The associated documentation, or nil.
+	Manifest token.Position // The position of the "manifest" keyword.
+	Items    []*VarDecl
+	Sectket  token.Position // The position of the closing "$)".
 }
 
+func (c *ConstantDecl) Pos() token.Position { return c.Manifest }
+func (*ConstantDecl) Kind() NodeKind        { return ConstantDeclNode }
+
 func (c *ConstantDecl) VarDecls() []*VarDecl {
 	return c.Items
 }
 
+// ----------------------------------------------------------------------------
+// Static Declarations
+
+// A declaration of static variables, each a cell of its own that
+// lives as long as the program and starts with the given constant.
+type StaticDecl struct {
+	Doc     *CommentGroup  // The associated documentation, or nil.
+	Static  token.Position // The position of the "static" keyword.
+	Items   []*VarDecl
+	Sectket token.Position // The position of the closing "$)".
+}
+
+func (s *StaticDecl) Pos() token.Position { return s.Static }
+func (*StaticDecl) Kind() NodeKind        { return StaticDeclNode }
+
+func (s *StaticDecl) VarDecls() []*VarDecl {
+	return s.Items
+}
+
 // ----------------------------------------------------------------------------
 // 7.5 Simple Definitions
 
@@ -84,25 +628,109 @@ type AndDef struct {
 	Rhs Def
 }
 
-func (*AndDef) def() {}
+func (a *AndDef) Pos() token.Position { return a.Lhs.Pos() }
+func (*AndDef) Kind() NodeKind        { return AndDefNode }
+func (*AndDef) def()                  {}
+
+// Return the simultaneous definitions joined by "and" in a definition,
+// in order.
+func Defs(d Def) []Def {
+	if and, ok := d.(*AndDef); ok {
+		return append(Defs(and.Lhs), Defs(and.Rhs)...)
+	}
+	return []Def{d}
+}
 
 type SimpleDef struct {
+	Doc   *CommentGroup // The associated documentation, or nil.
 	Names *NameList
 	Exprs *ExprList
 }
 
-func (*SimpleDef) def() {}
+func (s *SimpleDef) Pos() token.Position { return s.Names.Names[0].Pos() }
+func (*SimpleDef) Kind() NodeKind        { return SimpleDefNode }
+func (*SimpleDef) def()                  {}
 
 type VecDef struct {
-	Name string
-	Expr Expr
+	Doc     *CommentGroup // The associated documentation, or nil.
+	NamePos token.Position
+	Name    string
+	Expr    Expr
+}
+
+func (v *VecDef) Pos() token.Position { return v.NamePos }
+func (*VecDef) Kind() NodeKind        { return VecDefNode }
+func (*VecDef) def()                  {}
+
+// ----------------------------------------------------------------------------
+// 7.6 Function Definitions
+
+// A function definition F(P1, P2, ...) = E.
+type FuncDef struct {
+	Doc     *CommentGroup // The associated documentation, or nil.
+	NamePos token.Position
+	Name    string
+	Params  *NameList
+	Body    Expr
+}
+
+func (f *FuncDef) Pos() token.Position { return f.NamePos }
+func (*FuncDef) Kind() NodeKind        { return FuncDefNode }
+func (*FuncDef) def()                  {}
+
+// ----------------------------------------------------------------------------
+// 7.7 Routine Definitions
+
+// A routine definition R(P1, P2, ...) be C.
+type RoutineDef struct {
+	Doc     *CommentGroup // The associated documentation, or nil.
+	NamePos token.Position
+	Name    string
+	Params  *NameList
+	Body    Cmd
+}
+
+func (r *RoutineDef) Pos() token.Position { return r.NamePos }
+func (*RoutineDef) Kind() NodeKind        { return RoutineDefNode }
+func (*RoutineDef) def()                  {}
+
+// ----------------------------------------------------------------------------
+// Directives
+
+// A "section" directive of the Richards dialect naming the section
+// being compiled, a "needs" directive naming a section it depends on,
+// or a "get" directive naming a header.  Every section has the
+// declarations of the library, so a get of "libhdr" adds nothing.
+type Directive struct {
+	Doc    *CommentGroup   // The associated documentation, or nil.
+	KeyPos token.Position  // The position of the keyword.
+	Key    token.TokenKind // token.SECTION, token.NEEDS or token.GET.
+	Name   *StringExpr
 }
 
-func (*VecDef) def() {}
+func (d *Directive) Pos() token.Position { return d.KeyPos }
 
 // A top-level module that is a collection of all
 // declarations and definitions in the program segment.
 type Program struct {
-	Decls []Decl
-	Defs  []Def
+	Directives []*Directive
+	Decls      []Decl
+	Defs       []Def
+	Comments   []*CommentGroup // All comments in source order.
+}
+
+// The position of the first directive, declaration or definition,
+// or the zero Position for an empty program.
+func (p *Program) Pos() token.Position {
+	var pos token.Position
+	if len(p.Directives) > 0 {
+		pos = p.Directives[0].Pos()
+	}
+	if len(p.Decls) > 0 && (!pos.IsValid() || p.Decls[0].Pos().Offset < pos.Offset) {
+		pos = p.Decls[0].Pos()
+	}
+	if len(p.Defs) > 0 && (!pos.IsValid() || p.Defs[0].Pos().Offset < pos.Offset) {
+		pos = p.Defs[0].Pos()
+	}
+	return pos
 }
@@ -0,0 +1,236 @@
+// Copyright 2015 Meador Inge.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+// This code was heavily inspired by the Go programming language's
+// AST walking code:
+//
+//   * https://github.com/golang/go/blob/master/src/go/ast/walk.go
+
+package ast
+
+import "fmt"
+
+// A Visitor's Visit method is invoked for each node encountered by Walk.
+// If the result visitor w is not nil, Walk visits each of the children
+// of node with the visitor w, followed by a call of w.Visit(nil).
+type Visitor interface {
+	Visit(node Node) (w Visitor)
+}
+
+// Walk traverses an AST in depth-first order: It starts by calling
+// v.Visit(node); node must not be nil.  If the visitor w returned by
+// v.Visit(node) is not nil, Walk is invoked recursively with visitor
+// w for each of the non-nil children of node, followed by a call of
+// w.Visit(nil).  The directives, declarations and definitions of a
+// Program are visited in the order they are stored, not in source
+// order.  Doc comments are not visited.
+func Walk(v Visitor, node Node) {
+	if v = v.Visit(node); v == nil {
+		return
+	}
+
+	switch n := node.(type) {
+	case *Comment, *Name, *ConstExpr, *StringExpr, *BoolExpr, *VarDecl, *QueryExpr:
+		// nothing to do
+
+	case *CommentGroup:
+		for _, c := range n.List {
+			Walk(v, c)
+		}
+
+	case *ParenExpr:
+		Walk(v, n.X)
+
+	case *CallExpr:
+		Walk(v, n.Fn)
+		for _, arg := range n.Args.Exprs {
+			Walk(v, arg)
+		}
+
+	case *VecApExpr:
+		Walk(v, n.X)
+		Walk(v, n.Index)
+
+	case *UnaryExpr:
+		Walk(v, n.X)
+
+	case *BinaryExpr:
+		Walk(v, n.X)
+		Walk(v, n.Y)
+
+	case *CondExpr:
+		Walk(v, n.Cond)
+		Walk(v, n.Then)
+		Walk(v, n.Else)
+
+	case *ValofExpr:
+		Walk(v, n.Body)
+
+	case *MatchExpr:
+		for _, arg := range n.Args.Exprs {
+			Walk(v, arg)
+		}
+		for _, arm := range n.Arms {
+			Walk(v, arm)
+		}
+
+	case *MatchArm:
+		for _, p := range n.Patterns.Exprs {
+			Walk(v, p)
+		}
+		Walk(v, n.Body)
+
+	case *AssignCmd:
+		for _, e := range n.Lhs.Exprs {
+			Walk(v, e)
+		}
+		for _, e := range n.Rhs.Exprs {
+			Walk(v, e)
+		}
+
+	case *ExprCmd:
+		Walk(v, n.X)
+
+	case *IfCmd:
+		Walk(v, n.Cond)
+		Walk(v, n.Body)
+
+	case *TestCmd:
+		Walk(v, n.Cond)
+		Walk(v, n.Then)
+		Walk(v, n.Else)
+
+	case *WhileCmd:
+		Walk(v, n.Cond)
+		Walk(v, n.Body)
+
+	case *RepeatCmd:
+		Walk(v, n.Body)
+		if n.Cond != nil {
+			Walk(v, n.Cond)
+		}
+
+	case *ForCmd:
+		Walk(v, n.Var)
+		Walk(v, n.From)
+		Walk(v, n.To)
+		if n.By != nil {
+			Walk(v, n.By)
+		}
+		Walk(v, n.Body)
+
+	case *JumpCmd:
+		// nothing to do
+
+	case *GotoCmd:
+		Walk(v, n.Label)
+
+	case *ResultisCmd:
+		Walk(v, n.X)
+
+	case *SwitchonCmd:
+		Walk(v, n.X)
+		Walk(v, n.Body)
+
+	case *CaseCmd:
+		if n.Value != nil {
+			Walk(v, n.Value)
+		}
+		if n.Body != nil {
+			Walk(v, n.Body)
+		}
+
+	case *LabelCmd:
+		Walk(v, n.Label)
+		if n.Body != nil {
+			Walk(v, n.Body)
+		}
+
+	case *BlockCmd:
+		for _, item := range n.Items {
+			Walk(v, item)
+		}
+
+	case *LetCmd:
+		Walk(v, n.Def)
+
+	case *Directive:
+		Walk(v, n.Name)
+
+	case *GlobalDecl:
+		for _, item := range n.Items {
+			Walk(v, item)
+		}
+
+	case *ConstantDecl:
+		for _, item := range n.Items {
+			Walk(v, item)
+		}
+
+	case *StaticDecl:
+		for _, item := range n.Items {
+			Walk(v, item)
+		}
+
+	case *AndDef:
+		Walk(v, n.Lhs)
+		Walk(v, n.Rhs)
+
+	case *SimpleDef:
+		for _, name := range n.Names.Names {
+			Walk(v, name)
+		}
+		for _, e := range n.Exprs.Exprs {
+			Walk(v, e)
+		}
+
+	case *VecDef:
+		Walk(v, n.Expr)
+
+	case *FuncDef:
+		for _, name := range n.Params.Names {
+			Walk(v, name)
+		}
+		Walk(v, n.Body)
+
+	case *RoutineDef:
+		for _, name := range n.Params.Names {
+			Walk(v, name)
+		}
+		Walk(v, n.Body)
+
+	case *Program:
+		for _, d := range n.Directives {
+			Walk(v, d)
+		}
+		for _, d := range n.Decls {
+			Walk(v, d)
+		}
+		for _, d := range n.Defs {
+			Walk(v, d)
+		}
+
+	default:
+		panic(fmt.Sprintf("ast.Walk: unexpected node type %T", n))
+	}
+
+	v.Visit(nil)
+}
+
+type inspector func(Node) bool
+
+func (f inspector) Visit(node Node) Visitor {
+	if f(node) {
+		return f
+	}
+	return nil
+}
+
+// Inspect traverses an AST in depth-first order: It starts by calling
+// f(node); node must not be nil.  If f returns true, Inspect invokes f
+// recursively for each of the non-nil children of node, followed by a
+// call of f(nil).
+func Inspect(node Node, f func(Node) bool) {
+	Walk(inspector(f), node)
+}
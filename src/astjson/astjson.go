@@ -0,0 +1,974 @@
+// Copyright 2015 Meador Inge.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+// Package astjson encodes token streams and syntax trees as JSON and
+// decodes them again.
+//
+// A token is encoded as an object with its kind (the string form of
+// token.TokenKind), literal and position.  A tree node is encoded as an
+// object whose "type" member names the node type (ast.NodeKind for the
+// members of the Expr, Cmd, Def and Decl interfaces) and whose other
+// members are its fields, with lower-case names.  The missing command
+// of a label is encoded as null.  Positions are encoded as
+// objects with "offset", "line" and "column" members.
+package astjson
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/meadori/bcpl-go/src/ast"
+	"github.com/meadori/bcpl-go/src/token"
+)
+
+type object map[string]interface{}
+
+type jsonPos struct {
+	Offset int `json:"offset"`
+	Line   int `json:"line"`
+	Column int `json:"column"`
+}
+
+type jsonToken struct {
+	Kind string  `json:"kind"`
+	Lit  string  `json:"lit"`
+	Pos  jsonPos `json:"pos"`
+}
+
+func encodePos(pos token.Position) jsonPos {
+	return jsonPos{pos.Offset, pos.Line, pos.Column}
+}
+
+func (p jsonPos) position() token.Position {
+	return token.Position{p.Offset, p.Line, p.Column}
+}
+
+// ----------------------------------------------------------------------------
+// Tokens
+
+// Encode a token stream.
+func MarshalTokens(toks []*token.Token) ([]byte, error) {
+	list := make([]jsonToken, len(toks))
+	for i, tok := range toks {
+		list[i] = jsonToken{tok.Kind.String(), tok.Lit, encodePos(tok.Pos)}
+	}
+	return json.Marshal(list)
+}
+
+// Decode a token stream.
+func UnmarshalTokens(data []byte) ([]*token.Token, error) {
+	var list []jsonToken
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, err
+	}
+	toks := make([]*token.Token, len(list))
+	for i, t := range list {
+		kind := token.LookupKind(t.Kind)
+		if kind == token.ILLEGAL && t.Kind != token.ILLEGAL.String() {
+			return nil, fmt.Errorf("astjson: unknown token kind %q", t.Kind)
+		}
+		toks[i] = token.NewToken(kind, t.Lit)
+		toks[i].Pos = t.Pos.position()
+	}
+	return toks, nil
+}
+
+// ----------------------------------------------------------------------------
+// Encoding
+
+func encodeComments(g *ast.CommentGroup) interface{} {
+	if g == nil {
+		return nil
+	}
+	var list []interface{}
+	for _, c := range g.List {
+		list = append(list, object{
+			"type":  "Comment",
+			"slash": encodePos(c.Slash),
+			"text":  c.Text,
+		})
+	}
+	return object{"type": "CommentGroup", "list": list}
+}
+
+func encodeVarDecls(items []*ast.VarDecl) []interface{} {
+	var list []interface{}
+	for _, v := range items {
+		list = append(list, object{
+			"type":     "VarDecl",
+			"namePos":  encodePos(v.NamePos),
+			"name":     v.Name,
+			"constant": v.Constant,
+		})
+	}
+	return list
+}
+
+func encodeNames(names *ast.NameList) []interface{} {
+	var list []interface{}
+	for _, name := range names.Names {
+		list = append(list, object{
+			"type":    name.Kind().String(),
+			"namePos": encodePos(name.NamePos),
+			"val":     name.Val,
+		})
+	}
+	return list
+}
+
+func encodeNode(n ast.Node) (interface{}, error) {
+	switch n := n.(type) {
+	case *ast.Name:
+		return object{
+			"type":    n.Kind().String(),
+			"namePos": encodePos(n.NamePos),
+			"val":     n.Val,
+		}, nil
+	case *ast.StringExpr:
+		return object{
+			"type":     n.Kind().String(),
+			"valuePos": encodePos(n.ValuePos),
+			"lit":      n.Lit,
+		}, nil
+	case *ast.BoolExpr:
+		return object{
+			"type":     n.Kind().String(),
+			"valuePos": encodePos(n.ValuePos),
+			"value":    n.Value,
+		}, nil
+	case *ast.ParenExpr:
+		x, err := encodeNode(n.X)
+		if err != nil {
+			return nil, err
+		}
+		return object{"type": n.Kind().String(), "rbra": encodePos(n.Rbra), "x": x}, nil
+	case *ast.CallExpr:
+		fn, err := encodeNode(n.Fn)
+		if err != nil {
+			return nil, err
+		}
+		args, err := encodeList(n.Args.Exprs)
+		if err != nil {
+			return nil, err
+		}
+		return object{"type": n.Kind().String(), "fn": fn, "args": args}, nil
+	case *ast.VecApExpr:
+		x, err := encodeNode(n.X)
+		if err != nil {
+			return nil, err
+		}
+		index, err := encodeNode(n.Index)
+		if err != nil {
+			return nil, err
+		}
+		return object{"type": n.Kind().String(), "x": x, "index": index}, nil
+	case *ast.UnaryExpr:
+		x, err := encodeNode(n.X)
+		if err != nil {
+			return nil, err
+		}
+		return object{
+			"type":  n.Kind().String(),
+			"opPos": encodePos(n.OpPos),
+			"op":    n.Op.String(),
+			"x":     x,
+		}, nil
+	case *ast.BinaryExpr:
+		list, err := encodeList([]ast.Expr{n.X, n.Y})
+		if err != nil {
+			return nil, err
+		}
+		return object{
+			"type":  n.Kind().String(),
+			"x":     list[0],
+			"opPos": encodePos(n.OpPos),
+			"op":    n.Op.String(),
+			"y":     list[1],
+		}, nil
+	case *ast.CondExpr:
+		list, err := encodeList([]ast.Expr{n.Cond, n.Then, n.Else})
+		if err != nil {
+			return nil, err
+		}
+		return object{
+			"type": n.Kind().String(),
+			"cond": list[0],
+			"then": list[1],
+			"else": list[2],
+		}, nil
+	case *ast.QueryExpr:
+		return object{"type": n.Kind().String(), "query": encodePos(n.Query)}, nil
+	case *ast.MatchExpr:
+		args, err := encodeList(n.Args.Exprs)
+		if err != nil {
+			return nil, err
+		}
+		var arms []interface{}
+		for _, arm := range n.Arms {
+			patterns, err := encodeList(arm.Patterns.Exprs)
+			if err != nil {
+				return nil, err
+			}
+			body, err := encodeNode(arm.Body)
+			if err != nil {
+				return nil, err
+			}
+			arms = append(arms, object{
+				"type":     "MatchArm",
+				"colon":    encodePos(arm.Colon),
+				"patterns": patterns,
+				"body":     body,
+			})
+		}
+		return object{
+			"type":  n.Kind().String(),
+			"match": encodePos(n.Match),
+			"every": n.Every,
+			"args":  args,
+			"arms":  arms,
+		}, nil
+	case *ast.ValofExpr:
+		body, err := encodeNode(n.Body)
+		if err != nil {
+			return nil, err
+		}
+		return object{"type": n.Kind().String(), "valof": encodePos(n.Valof), "body": body}, nil
+	case *ast.AssignCmd:
+		lhs, err := encodeList(n.Lhs.Exprs)
+		if err != nil {
+			return nil, err
+		}
+		rhs, err := encodeList(n.Rhs.Exprs)
+		if err != nil {
+			return nil, err
+		}
+		return object{"type": n.Kind().String(), "lhs": lhs, "ass": encodePos(n.Ass), "rhs": rhs}, nil
+	case *ast.ExprCmd:
+		x, err := encodeNode(n.X)
+		if err != nil {
+			return nil, err
+		}
+		return object{"type": n.Kind().String(), "x": x}, nil
+	case *ast.IfCmd:
+		list, err := encodeNodes(n.Cond, n.Body)
+		if err != nil {
+			return nil, err
+		}
+		return object{
+			"type":   n.Kind().String(),
+			"if":     encodePos(n.If),
+			"unless": n.Unless,
+			"cond":   list[0],
+			"body":   list[1],
+		}, nil
+	case *ast.TestCmd:
+		list, err := encodeNodes(n.Cond, n.Then, n.Else)
+		if err != nil {
+			return nil, err
+		}
+		return object{
+			"type": n.Kind().String(),
+			"test": encodePos(n.Test),
+			"cond": list[0],
+			"then": list[1],
+			"else": list[2],
+		}, nil
+	case *ast.WhileCmd:
+		list, err := encodeNodes(n.Cond, n.Body)
+		if err != nil {
+			return nil, err
+		}
+		return object{
+			"type":  n.Kind().String(),
+			"while": encodePos(n.While),
+			"until": n.Until,
+			"cond":  list[0],
+			"body":  list[1],
+		}, nil
+	case *ast.RepeatCmd:
+		var cond ast.Node
+		if n.Cond != nil {
+			cond = n.Cond
+		}
+		list, err := encodeNodes(n.Body, cond)
+		if err != nil {
+			return nil, err
+		}
+		return object{
+			"type":  n.Kind().String(),
+			"body":  list[0],
+			"opPos": encodePos(n.OpPos),
+			"op":    n.Op.String(),
+			"cond":  list[1],
+		}, nil
+	case *ast.ForCmd:
+		list, err := encodeNodes(n.Var, n.From, n.To, n.By, n.Body)
+		if err != nil {
+			return nil, err
+		}
+		return object{
+			"type": n.Kind().String(),
+			"for":  encodePos(n.For),
+			"var":  list[0],
+			"from": list[1],
+			"to":   list[2],
+			"by":   list[3],
+			"body": list[4],
+		}, nil
+	case *ast.JumpCmd:
+		return object{"type": n.Kind().String(), "tokPos": encodePos(n.TokPos), "tok": n.Tok.String()}, nil
+	case *ast.GotoCmd:
+		label, err := encodeNode(n.Label)
+		if err != nil {
+			return nil, err
+		}
+		return object{"type": n.Kind().String(), "goto": encodePos(n.Goto), "label": label}, nil
+	case *ast.ResultisCmd:
+		x, err := encodeNode(n.X)
+		if err != nil {
+			return nil, err
+		}
+		return object{"type": n.Kind().String(), "resultis": encodePos(n.Resultis), "x": x}, nil
+	case *ast.SwitchonCmd:
+		list, err := encodeNodes(n.X, n.Body)
+		if err != nil {
+			return nil, err
+		}
+		return object{
+			"type":     n.Kind().String(),
+			"switchon": encodePos(n.Switchon),
+			"x":        list[0],
+			"body":     list[1],
+		}, nil
+	case *ast.CaseCmd:
+		var value, body ast.Node
+		if n.Value != nil {
+			value = n.Value
+		}
+		if n.Body != nil {
+			body = n.Body
+		}
+		list, err := encodeNodes(value, body)
+		if err != nil {
+			return nil, err
+		}
+		return object{
+			"type":  n.Kind().String(),
+			"case":  encodePos(n.Case),
+			"value": list[0],
+			"body":  list[1],
+		}, nil
+	case *ast.LabelCmd:
+		var body ast.Node
+		if n.Body != nil {
+			body = n.Body
+		}
+		list, err := encodeNodes(n.Label, body)
+		if err != nil {
+			return nil, err
+		}
+		return object{"type": n.Kind().String(), "label": list[0], "body": list[1]}, nil
+	case *ast.BlockCmd:
+		var items []ast.Node
+		for _, item := range n.Items {
+			items = append(items, item)
+		}
+		list, err := encodeNodes(items...)
+		if err != nil {
+			return nil, err
+		}
+		return object{
+			"type":    n.Kind().String(),
+			"sectbra": encodePos(n.Sectbra),
+			"items":   list,
+			"sectket": encodePos(n.Sectket),
+		}, nil
+	case *ast.LetCmd:
+		def, err := encodeNode(n.Def)
+		if err != nil {
+			return nil, err
+		}
+		return object{"type": n.Kind().String(), "let": encodePos(n.Let), "def": def}, nil
+	case *ast.Directive:
+		return object{
+			"type":   "Directive",
+			"doc":    encodeComments(n.Doc),
+			"keyPos": encodePos(n.KeyPos),
+			"key":    n.Key.String(),
+			"name": object{
+				"type":     n.Name.Kind().String(),
+				"valuePos": encodePos(n.Name.ValuePos),
+				"lit":      n.Name.Lit,
+			},
+		}, nil
+	case *ast.FuncDef:
+		body, err := encodeNode(n.Body)
+		if err != nil {
+			return nil, err
+		}
+		return object{
+			"type":    n.Kind().String(),
+			"doc":     encodeComments(n.Doc),
+			"namePos": encodePos(n.NamePos),
+			"name":    n.Name,
+			"params":  encodeNames(n.Params),
+			"body":    body,
+		}, nil
+	case *ast.RoutineDef:
+		body, err := encodeNode(n.Body)
+		if err != nil {
+			return nil, err
+		}
+		return object{
+			"type":    n.Kind().String(),
+			"doc":     encodeComments(n.Doc),
+			"namePos": encodePos(n.NamePos),
+			"name":    n.Name,
+			"params":  encodeNames(n.Params),
+			"body":    body,
+		}, nil
+	case *ast.ConstExpr:
+		return object{
+			"type":     n.Kind().String(),
+			"valuePos": encodePos(n.ValuePos),
+			"value":    n.Contant,
+			"lit":      n.Lit,
+		}, nil
+	case *ast.GlobalDecl:
+		return object{
+			"type":    n.Kind().String(),
+			"doc":     encodeComments(n.Doc),
+			"global":  encodePos(n.Global),
+			"items":   encodeVarDecls(n.Items),
+			"sectket": encodePos(n.Sectket),
+		}, nil
+	case *ast.ConstantDecl:
+		return object{
+			"type":     n.Kind().String(),
+			"doc":      encodeComments(n.Doc),
+			"manifest": encodePos(n.Manifest),
+			"items":    encodeVarDecls(n.Items),
+			"sectket":  encodePos(n.Sectket),
+		}, nil
+	case *ast.StaticDecl:
+		return object{
+			"type":    n.Kind().String(),
+			"doc":     encodeComments(n.Doc),
+			"static":  encodePos(n.Static),
+			"items":   encodeVarDecls(n.Items),
+			"sectket": encodePos(n.Sectket),
+		}, nil
+	case *ast.AndDef:
+		lhs, err := encodeNode(n.Lhs)
+		if err != nil {
+			return nil, err
+		}
+		rhs, err := encodeNode(n.Rhs)
+		if err != nil {
+			return nil, err
+		}
+		return object{"type": n.Kind().String(), "lhs": lhs, "rhs": rhs}, nil
+	case *ast.SimpleDef:
+		names := encodeNames(n.Names)
+		exprs, err := encodeList(n.Exprs.Exprs)
+		if err != nil {
+			return nil, err
+		}
+		return object{
+			"type":  n.Kind().String(),
+			"doc":   encodeComments(n.Doc),
+			"names": names,
+			"exprs": exprs,
+		}, nil
+	case *ast.VecDef:
+		expr, err := encodeNode(n.Expr)
+		if err != nil {
+			return nil, err
+		}
+		return object{
+			"type":    n.Kind().String(),
+			"doc":     encodeComments(n.Doc),
+			"namePos": encodePos(n.NamePos),
+			"name":    n.Name,
+			"expr":    expr,
+		}, nil
+	}
+	return nil, fmt.Errorf("astjson: cannot encode %T", n)
+}
+
+func encodeList(exprs []ast.Expr) ([]interface{}, error) {
+	var list []interface{}
+	for _, e := range exprs {
+		enc, err := encodeNode(e)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, enc)
+	}
+	return list, nil
+}
+
+// Encode nodes, a nil node as null.
+func encodeNodes(nodes ...ast.Node) ([]interface{}, error) {
+	list := make([]interface{}, len(nodes))
+	for i, n := range nodes {
+		if n == nil {
+			continue
+		}
+		enc, err := encodeNode(n)
+		if err != nil {
+			return nil, err
+		}
+		list[i] = enc
+	}
+	return list, nil
+}
+
+// Encode a whole program.
+func Marshal(prog *ast.Program) ([]byte, error) {
+	var directives, decls, defs, comments []interface{}
+	for _, d := range prog.Directives {
+		enc, err := encodeNode(d)
+		if err != nil {
+			return nil, err
+		}
+		directives = append(directives, enc)
+	}
+	for _, d := range prog.Decls {
+		enc, err := encodeNode(d)
+		if err != nil {
+			return nil, err
+		}
+		decls = append(decls, enc)
+	}
+	for _, d := range prog.Defs {
+		enc, err := encodeNode(d)
+		if err != nil {
+			return nil, err
+		}
+		defs = append(defs, enc)
+	}
+	for _, g := range prog.Comments {
+		comments = append(comments, encodeComments(g))
+	}
+	enc := object{
+		"type":     "Program",
+		"decls":    decls,
+		"defs":     defs,
+		"comments": comments,
+	}
+	if len(directives) > 0 {
+		enc["directives"] = directives
+	}
+	return json.Marshal(enc)
+}
+
+// ----------------------------------------------------------------------------
+// Decoding
+
+// A decoding error, raised with panic and recovered by Unmarshal.
+type decodeError struct {
+	err error
+}
+
+type decoder struct{}
+
+func (d *decoder) fail(format string, args ...interface{}) {
+	panic(&decodeError{fmt.Errorf("astjson: "+format, args...)})
+}
+
+func (d *decoder) unmarshal(data json.RawMessage, v interface{}) {
+	if err := json.Unmarshal(data, v); err != nil {
+		panic(&decodeError{err})
+	}
+}
+
+// Decode an object and check that its type member is one of the
+// given types.  Return the fields and the type.
+func (d *decoder) object(data json.RawMessage, types ...string) (map[string]json.RawMessage, string) {
+	var fields map[string]json.RawMessage
+	d.unmarshal(data, &fields)
+	var typ string
+	if raw, ok := fields["type"]; ok {
+		d.unmarshal(raw, &typ)
+	}
+	for _, t := range types {
+		if t == typ {
+			return fields, typ
+		}
+	}
+	d.fail("expected %v, found %q", types, typ)
+	return nil, ""
+}
+
+func (d *decoder) pos(data json.RawMessage) token.Position {
+	var p jsonPos
+	if data != nil {
+		d.unmarshal(data, &p)
+	}
+	return p.position()
+}
+
+func (d *decoder) list(data json.RawMessage) []json.RawMessage {
+	var list []json.RawMessage
+	if data != nil {
+		d.unmarshal(data, &list)
+	}
+	return list
+}
+
+func (d *decoder) comments(data json.RawMessage) *ast.CommentGroup {
+	if isNull(data) {
+		return nil
+	}
+	fields, _ := d.object(data, "CommentGroup")
+	g := new(ast.CommentGroup)
+	for _, raw := range d.list(fields["list"]) {
+		cf, _ := d.object(raw, "Comment")
+		c := &ast.Comment{Slash: d.pos(cf["slash"])}
+		d.unmarshal(cf["text"], &c.Text)
+		g.List = append(g.List, c)
+	}
+	if len(g.List) == 0 {
+		d.fail("empty comment group")
+	}
+	return g
+}
+
+func (d *decoder) varDecls(data json.RawMessage) []*ast.VarDecl {
+	var items []*ast.VarDecl
+	for _, raw := range d.list(data) {
+		fields, _ := d.object(raw, "VarDecl")
+		v := &ast.VarDecl{NamePos: d.pos(fields["namePos"])}
+		d.unmarshal(fields["name"], &v.Name)
+		d.unmarshal(fields["constant"], &v.Constant)
+		items = append(items, v)
+	}
+	return items
+}
+
+// The type tags of the implementations of ast.Expr.
+var exprTypes = []string{
+	ast.NameNode.String(),
+	ast.ConstExprNode.String(),
+	ast.StringExprNode.String(),
+	ast.BoolExprNode.String(),
+	ast.ParenExprNode.String(),
+	ast.CallExprNode.String(),
+	ast.VecApExprNode.String(),
+	ast.UnaryExprNode.String(),
+	ast.BinaryExprNode.String(),
+	ast.CondExprNode.String(),
+	ast.QueryExprNode.String(),
+	ast.MatchExprNode.String(),
+	ast.ValofExprNode.String(),
+}
+
+// The type tags of the implementations of ast.Cmd.
+var cmdTypes = []string{
+	ast.AssignCmdNode.String(),
+	ast.ExprCmdNode.String(),
+	ast.IfCmdNode.String(),
+	ast.TestCmdNode.String(),
+	ast.WhileCmdNode.String(),
+	ast.RepeatCmdNode.String(),
+	ast.ForCmdNode.String(),
+	ast.JumpCmdNode.String(),
+	ast.GotoCmdNode.String(),
+	ast.ResultisCmdNode.String(),
+	ast.SwitchonCmdNode.String(),
+	ast.CaseCmdNode.String(),
+	ast.LabelCmdNode.String(),
+	ast.BlockCmdNode.String(),
+	ast.LetCmdNode.String(),
+}
+
+func (d *decoder) names(data json.RawMessage) *ast.NameList {
+	names := new(ast.NameList)
+	for _, raw := range d.list(data) {
+		fields, _ := d.object(raw, ast.NameNode.String())
+		names.Names = append(names.Names, d.name(fields))
+	}
+	return names
+}
+
+func (d *decoder) name(fields map[string]json.RawMessage) *ast.Name {
+	name := &ast.Name{NamePos: d.pos(fields["namePos"])}
+	d.unmarshal(fields["val"], &name.Val)
+	return name
+}
+
+func (d *decoder) op(data json.RawMessage) token.TokenKind {
+	var str string
+	d.unmarshal(data, &str)
+	op := token.LookupKind(str)
+	if !op.IsOperator() && !op.IsKeyword() {
+		d.fail("unknown operator %q", str)
+	}
+	return op
+}
+
+func (d *decoder) expr(data json.RawMessage) ast.Expr {
+	fields, typ := d.object(data, exprTypes...)
+	switch ast.LookupNodeKind(typ) {
+	case ast.NameNode:
+		return d.name(fields)
+	case ast.ConstExprNode:
+		e := &ast.ConstExpr{ValuePos: d.pos(fields["valuePos"])}
+		d.unmarshal(fields["value"], &e.Contant)
+		if lit, ok := fields["lit"]; ok {
+			d.unmarshal(lit, &e.Lit)
+		}
+		return e
+	case ast.StringExprNode:
+		e := &ast.StringExpr{ValuePos: d.pos(fields["valuePos"])}
+		d.unmarshal(fields["lit"], &e.Lit)
+		return e
+	case ast.BoolExprNode:
+		e := &ast.BoolExpr{ValuePos: d.pos(fields["valuePos"])}
+		d.unmarshal(fields["value"], &e.Value)
+		return e
+	case ast.ParenExprNode:
+		return &ast.ParenExpr{d.pos(fields["rbra"]), d.expr(fields["x"])}
+	case ast.CallExprNode:
+		args := new(ast.ExprList)
+		for _, raw := range d.list(fields["args"]) {
+			args.Exprs = append(args.Exprs, d.expr(raw))
+		}
+		return &ast.CallExpr{d.expr(fields["fn"]), args}
+	case ast.VecApExprNode:
+		return &ast.VecApExpr{d.expr(fields["x"]), d.expr(fields["index"])}
+	case ast.UnaryExprNode:
+		return &ast.UnaryExpr{d.pos(fields["opPos"]), d.op(fields["op"]), d.expr(fields["x"])}
+	case ast.BinaryExprNode:
+		return &ast.BinaryExpr{d.expr(fields["x"]), d.pos(fields["opPos"]),
+			d.op(fields["op"]), d.expr(fields["y"])}
+	case ast.QueryExprNode:
+		return &ast.QueryExpr{d.pos(fields["query"])}
+	case ast.MatchExprNode:
+		m := &ast.MatchExpr{Match: d.pos(fields["match"]), Args: d.exprs(fields["args"])}
+		d.unmarshal(fields["every"], &m.Every)
+		for _, raw := range d.list(fields["arms"]) {
+			af, _ := d.object(raw, "MatchArm")
+			m.Arms = append(m.Arms, &ast.MatchArm{d.pos(af["colon"]), d.exprs(af["patterns"]), d.expr(af["body"])})
+		}
+		if len(m.Arms) == 0 {
+			d.fail("MatchExpr with no arms")
+		}
+		return m
+	case ast.ValofExprNode:
+		return &ast.ValofExpr{d.pos(fields["valof"]), d.cmd(fields["body"])}
+	default:
+		return &ast.CondExpr{d.expr(fields["cond"]), d.expr(fields["then"]), d.expr(fields["else"])}
+	}
+}
+
+func (d *decoder) exprs(data json.RawMessage) *ast.ExprList {
+	list := new(ast.ExprList)
+	for _, raw := range d.list(data) {
+		list.Exprs = append(list.Exprs, d.expr(raw))
+	}
+	return list
+}
+
+// Report whether a member is missing or null.
+func isNull(data json.RawMessage) bool {
+	return data == nil || string(data) == "null"
+}
+
+func (d *decoder) cmd(data json.RawMessage) ast.Cmd {
+	fields, typ := d.object(data, cmdTypes...)
+	switch ast.LookupNodeKind(typ) {
+	case ast.AssignCmdNode:
+		c := &ast.AssignCmd{d.exprs(fields["lhs"]), d.pos(fields["ass"]), d.exprs(fields["rhs"])}
+		if len(c.Lhs.Exprs) == 0 || len(c.Lhs.Exprs) != len(c.Rhs.Exprs) {
+			d.fail("AssignCmd with %d left and %d right hand sides",
+				len(c.Lhs.Exprs), len(c.Rhs.Exprs))
+		}
+		return c
+	case ast.ExprCmdNode:
+		return &ast.ExprCmd{d.expr(fields["x"])}
+	case ast.IfCmdNode:
+		c := &ast.IfCmd{If: d.pos(fields["if"]), Cond: d.expr(fields["cond"]), Body: d.cmd(fields["body"])}
+		d.unmarshal(fields["unless"], &c.Unless)
+		return c
+	case ast.TestCmdNode:
+		return &ast.TestCmd{d.pos(fields["test"]), d.expr(fields["cond"]),
+			d.cmd(fields["then"]), d.cmd(fields["else"])}
+	case ast.WhileCmdNode:
+		c := &ast.WhileCmd{While: d.pos(fields["while"]), Cond: d.expr(fields["cond"]), Body: d.cmd(fields["body"])}
+		d.unmarshal(fields["until"], &c.Until)
+		return c
+	case ast.RepeatCmdNode:
+		c := &ast.RepeatCmd{Body: d.cmd(fields["body"]), OpPos: d.pos(fields["opPos"])}
+		var op string
+		d.unmarshal(fields["op"], &op)
+		switch c.Op = token.LookupKind(op); c.Op {
+		case token.REPEAT:
+		case token.REPEATWHILE, token.REPEATUNTIL:
+			c.Cond = d.expr(fields["cond"])
+		default:
+			d.fail("unknown repetition %q", op)
+		}
+		return c
+	case ast.ForCmdNode:
+		v, ok := d.expr(fields["var"]).(*ast.Name)
+		if !ok {
+			d.fail("ForCmd variable is not a name")
+		}
+		var by ast.Expr
+		if !isNull(fields["by"]) {
+			by = d.expr(fields["by"])
+		}
+		return &ast.ForCmd{d.pos(fields["for"]), v, d.expr(fields["from"]),
+			d.expr(fields["to"]), by, d.cmd(fields["body"])}
+	case ast.JumpCmdNode:
+		c := &ast.JumpCmd{TokPos: d.pos(fields["tokPos"])}
+		var tok string
+		d.unmarshal(fields["tok"], &tok)
+		switch c.Tok = token.LookupKind(tok); c.Tok {
+		case token.BREAK, token.RETURN, token.FINISH, token.LOOP,
+			token.ENDCASE, token.NEXT, token.EXIT:
+		default:
+			d.fail("unknown jump %q", tok)
+		}
+		return c
+	case ast.GotoCmdNode:
+		label, ok := d.expr(fields["label"]).(*ast.Name)
+		if !ok {
+			d.fail("GotoCmd label is not a name")
+		}
+		return &ast.GotoCmd{d.pos(fields["goto"]), label}
+	case ast.ResultisCmdNode:
+		return &ast.ResultisCmd{d.pos(fields["resultis"]), d.expr(fields["x"])}
+	case ast.SwitchonCmdNode:
+		return &ast.SwitchonCmd{d.pos(fields["switchon"]), d.expr(fields["x"]), d.cmd(fields["body"])}
+	case ast.CaseCmdNode:
+		c := &ast.CaseCmd{Case: d.pos(fields["case"]), Body: d.optCmd(fields["body"])}
+		if !isNull(fields["value"]) {
+			c.Value = d.expr(fields["value"])
+		}
+		return c
+	case ast.LabelCmdNode:
+		label, ok := d.expr(fields["label"]).(*ast.Name)
+		if !ok {
+			d.fail("LabelCmd label is not a name")
+		}
+		return &ast.LabelCmd{label, d.optCmd(fields["body"])}
+	case ast.BlockCmdNode:
+		b := &ast.BlockCmd{Sectbra: d.pos(fields["sectbra"]), Sectket: d.pos(fields["sectket"])}
+		for _, raw := range d.list(fields["items"]) {
+			b.Items = append(b.Items, d.cmd(raw))
+		}
+		return b
+	default:
+		return &ast.LetCmd{d.pos(fields["let"]), d.def(fields["def"])}
+	}
+}
+
+// Decode a command that may be missing.
+func (d *decoder) optCmd(data json.RawMessage) ast.Cmd {
+	if isNull(data) {
+		return nil
+	}
+	return d.cmd(data)
+}
+
+func (d *decoder) directive(data json.RawMessage) *ast.Directive {
+	fields, _ := d.object(data, "Directive")
+	dir := &ast.Directive{Doc: d.comments(fields["doc"]), KeyPos: d.pos(fields["keyPos"])}
+	var key string
+	d.unmarshal(fields["key"], &key)
+	if dir.Key = token.LookupKind(key); dir.Key != token.SECTION && dir.Key != token.NEEDS && dir.Key != token.GET {
+		d.fail("unknown directive %q", key)
+	}
+	name, ok := d.expr(fields["name"]).(*ast.StringExpr)
+	if !ok {
+		d.fail("directive name is not a string")
+	}
+	dir.Name = name
+	return dir
+}
+
+func (d *decoder) decl(data json.RawMessage) ast.Decl {
+	fields, typ := d.object(data, ast.GlobalDeclNode.String(),
+		ast.ConstantDeclNode.String(), ast.StaticDeclNode.String())
+	doc := d.comments(fields["doc"])
+	items := d.varDecls(fields["items"])
+	end := d.pos(fields["sectket"])
+	switch ast.LookupNodeKind(typ) {
+	case ast.GlobalDeclNode:
+		return &ast.GlobalDecl{doc, d.pos(fields["global"]), items, end}
+	case ast.StaticDeclNode:
+		return &ast.StaticDecl{doc, d.pos(fields["static"]), items, end}
+	}
+	return &ast.ConstantDecl{doc, d.pos(fields["manifest"]), items, end}
+}
+
+func (d *decoder) def(data json.RawMessage) ast.Def {
+	fields, typ := d.object(data, ast.AndDefNode.String(),
+		ast.SimpleDefNode.String(), ast.VecDefNode.String(), ast.FuncDefNode.String(),
+		ast.RoutineDefNode.String())
+	switch ast.LookupNodeKind(typ) {
+	case ast.AndDefNode:
+		return &ast.AndDef{d.def(fields["lhs"]), d.def(fields["rhs"])}
+	case ast.SimpleDefNode:
+		names := d.names(fields["names"])
+		exprs := new(ast.ExprList)
+		for _, raw := range d.list(fields["exprs"]) {
+			exprs.Exprs = append(exprs.Exprs, d.expr(raw))
+		}
+		if len(names.Names) == 0 || len(names.Names) != len(exprs.Exprs) {
+			d.fail("SimpleDef with %d names and %d expressions",
+				len(names.Names), len(exprs.Exprs))
+		}
+		return &ast.SimpleDef{d.comments(fields["doc"]), names, exprs}
+	case ast.FuncDefNode:
+		f := &ast.FuncDef{Doc: d.comments(fields["doc"]), NamePos: d.pos(fields["namePos"])}
+		d.unmarshal(fields["name"], &f.Name)
+		f.Params = d.names(fields["params"])
+		f.Body = d.expr(fields["body"])
+		return f
+	case ast.RoutineDefNode:
+		r := &ast.RoutineDef{Doc: d.comments(fields["doc"]), NamePos: d.pos(fields["namePos"])}
+		d.unmarshal(fields["name"], &r.Name)
+		r.Params = d.names(fields["params"])
+		r.Body = d.cmd(fields["body"])
+		return r
+	default:
+		v := &ast.VecDef{Doc: d.comments(fields["doc"]), NamePos: d.pos(fields["namePos"])}
+		d.unmarshal(fields["name"], &v.Name)
+		v.Expr = d.expr(fields["expr"])
+		return v
+	}
+}
+
+// Decode a whole program.
+func Unmarshal(data []byte) (prog *ast.Program, err error) {
+	defer func() {
+		if x := recover(); x != nil {
+			e, ok := x.(*decodeError)
+			if !ok {
+				panic(x)
+			}
+			prog, err = nil, e.err
+		}
+	}()
+
+	var d decoder
+	fields, _ := d.object(data, "Program")
+	prog = new(ast.Program)
+	for _, raw := range d.list(fields["directives"]) {
+		prog.Directives = append(prog.Directives, d.directive(raw))
+	}
+	for _, raw := range d.list(fields["decls"]) {
+		prog.Decls = append(prog.Decls, d.decl(raw))
+	}
+	for _, raw := range d.list(fields["defs"]) {
+		prog.Defs = append(prog.Defs, d.def(raw))
+	}
+	for _, raw := range d.list(fields["comments"]) {
+		prog.Comments = append(prog.Comments, d.comments(raw))
+	}
+	return prog, nil
+}
@@ -0,0 +1,170 @@
+// Copyright 2015 Meador Inge.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package astjson
+
+import (
+	"github.com/meadori/bcpl-go/src/parser"
+	"github.com/meadori/bcpl-go/src/scanner"
+	"github.com/meadori/bcpl-go/src/token"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var test_program_str = `// The globals.
+global $(
+        COUNT: 200 // a counter
+        ALL: 13
+$)
+
+manifest $( N = 20000 $)
+
+// Some definitions.
+let	X, Y, Z = 1, 2, 3
+and	V = vec N + 1
+
+let Fact(N) = N = 0 -> 1, N * Fact(N - 1)
+and S = writes("hi*n") + V*[2] rem (!true | lv X)
+and Nil() = rv Y
+`
+
+func TestProgramRoundTrip(t *testing.T) {
+	prog, err := parser.ParseProgram([]byte(test_program_str))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := Marshal(prog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := Unmarshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(prog, decoded) {
+		t.Errorf("decoded tree differs from the original:\n%s", data)
+	}
+
+	again, err := Marshal(decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != string(again) {
+		t.Errorf("encoding is not stable:\n%s\nthen:\n%s", data, again)
+	}
+}
+
+var test_commands_str = `let Sum(v, n) = valof
+$( let s = 0
+   for i = 0 to n - 1 do s := s + v*[i]
+   resultis s
+$)
+
+let start() be
+$( let i, j = 0, 1
+   while i < 10 do i, j := i + 1, j * 2
+   unless i = 10 do finish
+   test i > 5 do writen(i) or writen(0)
+   switchon i into
+   $( case 1: writes("one")
+      default: break
+   $)
+   L: i := i - 1
+   if i > 0 goto L
+   $( i := i + 1 $) repeatuntil i > 3
+   M:
+   return
+$)
+`
+
+func TestCommandsRoundTrip(t *testing.T) {
+	prog, err := parser.ParseProgram([]byte(test_commands_str))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := Marshal(prog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := Unmarshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(prog, decoded) {
+		t.Errorf("decoded tree differs from the original:\n%s", data)
+	}
+}
+
+var test_richards_str = `SECTION "demo" // the section
+NEEDS "lib"
+LET Fact(n) = MATCH (n) : 0 => 1 : m => m * Fact(m - 1) .
+AND G(v, i) = EVERY (v!i, ?) : -1, ? => FLOAT v%i #+ #- 1.
+`
+
+func TestRichardsRoundTrip(t *testing.T) {
+	var p parser.Parser
+	p.Dialect = token.Richards | token.Upper
+	p.Init([]byte(test_richards_str))
+	prog := p.Parse()
+	if err := p.Errors.Err(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := Marshal(prog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := Unmarshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(prog, decoded) {
+		t.Errorf("decoded tree differs from the original:\n%s", data)
+	}
+}
+
+func TestTokenRoundTrip(t *testing.T) {
+	var s scanner.Scanner
+	s.Init([]byte(test_program_str))
+	var toks []*token.Token
+	for {
+		tok := s.Next()
+		toks = append(toks, tok)
+		if tok.Kind == token.EOF {
+			break
+		}
+	}
+
+	data, err := MarshalTokens(toks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), `[{"kind":"COMMENT","lit":"// The globals.\n","pos":{"offset":0,"line":1,"column":1}}`) {
+		t.Errorf("unexpected encoding %s", data)
+	}
+	decoded, err := UnmarshalTokens(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(toks, decoded) {
+		t.Errorf("decoded tokens differ from the original")
+	}
+}
+
+var test_bad_json = []string{
+	`[]`,
+	`{"type":"Decl"}`,
+	`{"type":"Program","decls":[{"type":"SimpleDef"}]}`,
+	`{"type":"Program","defs":[{"type":"SimpleDef","names":[],"exprs":[]}]}`,
+	`{"type":"Program","defs":[{"type":"VecDef","name":"V","expr":{"type":"VecDef"}}]}`,
+	`{"type":"Program","defs":[{"type":"RoutineDef","name":"R","body":{"type":"AssignCmd","lhs":[],"rhs":[]}}]}`,
+}
+
+func TestBadProgram(t *testing.T) {
+	for _, str := range test_bad_json {
+		if _, err := Unmarshal([]byte(str)); err == nil {
+			t.Errorf("expected an error decoding %s", str)
+		}
+	}
+}
@@ -0,0 +1,289 @@
+// Copyright 2015 Meador Inge.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package cfg
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/meadori/bcpl-go/src/ast"
+	"github.com/meadori/bcpl-go/src/runtime"
+	"github.com/meadori/bcpl-go/src/token"
+	"io"
+)
+
+// A node of a call graph: a name defined at the top level by let or
+// declared global.  The names defined more than once share a node, as
+// they share a cell.
+type Node struct {
+	Name   string
+	Pos    token.Position // Where it is first declared or defined.
+	Global int            // The number of the global, or -1.
+	Func   bool           // Whether a function definition gives it its value.
+	Calls  []*Node        // The nodes it calls, in the order first called.
+	Refs   []*Node        // The nodes whose values it uses other than by calling them.
+}
+
+// The call graph of a program.  The definitions of a name call the
+// names they call directly, and refer to the names whose values they
+// use otherwise, say by passing a function to another.  Names of the
+// library are in the graph only if they are used.
+type CallGraph struct {
+	Nodes []*Node // In the order they are declared or defined.
+	nodes map[string]*Node
+}
+
+// Return the node of a name, or nil if there is none.
+func (g *CallGraph) Node(name string) *Node {
+	return g.nodes[name]
+}
+
+func (g *CallGraph) add(name string, pos token.Position, global int) *Node {
+	n := g.nodes[name]
+	if n == nil {
+		n = &Node{Name: name, Pos: pos, Global: global}
+		g.nodes[name] = n
+		g.Nodes = append(g.Nodes, n)
+	}
+	if n.Global < 0 {
+		n.Global = global
+	}
+	return n
+}
+
+func appendNode(nodes []*Node, n *Node) []*Node {
+	for _, m := range nodes {
+		if m == n {
+			return nodes
+		}
+	}
+	return append(nodes, n)
+}
+
+// Make the call graph of a program.
+func NewCallGraph(prog *ast.Program) *CallGraph {
+	g := &CallGraph{nodes: make(map[string]*Node)}
+	manifest := make(map[string]bool)
+	static := make(map[string]bool)
+	for _, decl := range prog.Decls {
+		for _, v := range decl.VarDecls() {
+			switch decl.(type) {
+			case *ast.GlobalDecl:
+				g.add(v.Name, v.NamePos, v.Constant)
+				delete(manifest, v.Name)
+				delete(static, v.Name)
+			case *ast.ConstantDecl:
+				manifest[v.Name] = true
+			case *ast.StaticDecl:
+				static[v.Name] = true
+			}
+		}
+	}
+	var defs []ast.Def
+	for _, def := range prog.Defs {
+		defs = append(defs, ast.Defs(def)...)
+	}
+	for _, d := range defs {
+		switch d := d.(type) {
+		case *ast.FuncDef:
+			g.add(d.Name, d.NamePos, -1).Func = true
+			delete(manifest, d.Name)
+		case *ast.RoutineDef:
+			g.add(d.Name, d.NamePos, -1).Func = true
+			delete(manifest, d.Name)
+		case *ast.SimpleDef:
+			for _, n := range d.Names.Names {
+				g.add(n.Val, n.NamePos, -1)
+				delete(manifest, n.Val)
+			}
+		case *ast.VecDef:
+			g.add(d.Name, d.NamePos, -1)
+			delete(manifest, d.Name)
+		}
+	}
+
+	// Find the node a free name refers to, adding the globals of the
+	// library as they are used.
+	lookup := func(name *ast.Name) *Node {
+		if n := g.nodes[name.Val]; n != nil {
+			return n
+		}
+		if manifest[name.Val] || static[name.Val] {
+			return nil
+		}
+		if name.Val == "start" {
+			return g.add(name.Val, token.Position{}, runtime.StartGlobal)
+		}
+		for _, lib := range runtime.Library {
+			if lib.Name == name.Val {
+				return g.add(name.Val, token.Position{}, lib.Number)
+			}
+		}
+		return nil
+	}
+	for _, d := range defs {
+		switch d := d.(type) {
+		case *ast.FuncDef:
+			bound := make(map[string]int)
+			for _, p := range d.Params.Names {
+				bound[p.Val]++
+			}
+			g.uses(g.nodes[d.Name], d.Body, bound, manifest, lookup)
+		case *ast.RoutineDef:
+			bound := make(map[string]int)
+			for _, p := range d.Params.Names {
+				bound[p.Val]++
+			}
+			g.uses(g.nodes[d.Name], d.Body, bound, manifest, lookup)
+		case *ast.SimpleDef:
+			for i, n := range d.Names.Names {
+				if i < len(d.Exprs.Exprs) {
+					g.uses(g.nodes[n.Val], d.Exprs.Exprs[i], nil, manifest, lookup)
+				}
+			}
+		}
+	}
+	return g
+}
+
+// Add the calls and references made by an expression or command to a
+// node.  The names bound by parameters, patterns, the definitions of
+// blocks and for loops are counted in bound.
+func (g *CallGraph) uses(from *Node, e ast.Node, bound map[string]int, manifest map[string]bool, lookup func(*ast.Name) *Node) {
+	if bound == nil {
+		bound = make(map[string]int)
+	}
+	var walk func(e ast.Node, call bool)
+	walk = func(e ast.Node, call bool) {
+		switch e := e.(type) {
+		case *ast.Name:
+			if bound[e.Val] > 0 {
+				return
+			}
+			if n := lookup(e); n != nil {
+				if call {
+					from.Calls = appendNode(from.Calls, n)
+				} else {
+					from.Refs = appendNode(from.Refs, n)
+				}
+			}
+		case *ast.ParenExpr:
+			walk(e.X, call)
+		case *ast.CallExpr:
+			walk(e.Fn, true)
+			for _, arg := range e.Args.Exprs {
+				walk(arg, false)
+			}
+		case *ast.MatchExpr:
+			for _, arg := range e.Args.Exprs {
+				walk(arg, false)
+			}
+			for _, arm := range e.Arms {
+				var names []string
+				for _, pat := range arm.Patterns.Exprs {
+					if n, ok := pat.(*ast.Name); ok && !manifest[n.Val] {
+						names = append(names, n.Val)
+					}
+				}
+				for _, name := range names {
+					bound[name]++
+				}
+				walk(arm.Body, false)
+				for _, name := range names {
+					bound[name]--
+				}
+			}
+		case *ast.BlockCmd:
+			var names []string
+			for _, item := range e.Items {
+				let, ok := item.(*ast.LetCmd)
+				if !ok {
+					walk(item, false)
+					continue
+				}
+				var defined []string
+				for _, d := range ast.Defs(let.Def) {
+					switch d := d.(type) {
+					case *ast.SimpleDef:
+						for _, x := range d.Exprs.Exprs {
+							walk(x, false)
+						}
+						for _, n := range d.Names.Names {
+							defined = append(defined, n.Val)
+						}
+					case *ast.VecDef:
+						walk(d.Expr, false)
+						defined = append(defined, d.Name)
+					}
+				}
+				for _, name := range defined {
+					bound[name]++
+				}
+				names = append(names, defined...)
+			}
+			for _, name := range names {
+				bound[name]--
+			}
+		case *ast.ForCmd:
+			walk(e.From, false)
+			walk(e.To, false)
+			if e.By != nil {
+				walk(e.By, false)
+			}
+			bound[e.Var.Val]++
+			walk(e.Body, false)
+			bound[e.Var.Val]--
+		case *ast.LabelCmd:
+			if e.Body != nil {
+				walk(e.Body, false)
+			}
+		case *ast.GotoCmd:
+		default:
+			ast.Inspect(e, func(n ast.Node) bool {
+				if n == e || n == nil {
+					return true
+				}
+				walk(n, false)
+				return false
+			})
+		}
+	}
+	walk(e, false)
+}
+
+// Write the call graph in DOT.  Functions are boxes and other values
+// ellipses; globals give their numbers.  Calls are solid edges and
+// other references dashed.
+func (g *CallGraph) Fprint(w io.Writer) error {
+	var buf bytes.Buffer
+	buf.WriteString("digraph calls {\n")
+	for _, n := range g.Nodes {
+		shape := "ellipse"
+		if n.Func {
+			shape = "box"
+		}
+		l := escape(n.Name)
+		if n.Global >= 0 {
+			l += fmt.Sprintf(`\nglobal %d`, n.Global)
+		}
+		fmt.Fprintf(&buf, "\t%s [shape=%s label=\"%s\"];\n", quote(n.Name), shape, l)
+	}
+	for _, n := range g.Nodes {
+		for _, m := range n.Calls {
+			fmt.Fprintf(&buf, "\t%s -> %s;\n", quote(n.Name), quote(m.Name))
+		}
+		for _, m := range n.Refs {
+			fmt.Fprintf(&buf, "\t%s -> %s [style=dashed];\n", quote(n.Name), quote(m.Name))
+		}
+	}
+	buf.WriteString("}\n")
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func (g *CallGraph) String() string {
+	var buf bytes.Buffer
+	g.Fprint(&buf)
+	return buf.String()
+}
@@ -0,0 +1,122 @@
+// Copyright 2015 Meador Inge.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+// Package cfg writes the control flow graphs of the functions of a
+// module and the call graph of a program in the DOT language of
+// Graphviz.
+//
+// The control flow graph of a function has a box for each block
+// listing its values and the control transfer ending it.  The edges
+// of a branch are labelled with the outcome of its condition and
+// those of a switch with their cases.  An edge to a block dominating
+// the block it leaves closes a loop; such back edges are dashed.
+// Blocks leaving the function have a double border.
+package cfg
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/meadori/bcpl-go/src/ir"
+	"io"
+	"strings"
+)
+
+// Escape the backslashes and quotes of a string for a DOT string.
+func escape(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	return strings.Replace(s, `"`, `\"`, -1)
+}
+
+// Quote a string as a DOT identifier.
+func quote(s string) string {
+	return `"` + escape(s) + `"`
+}
+
+// Quote lines as a DOT label, each line justified left.
+func label(lines []string) string {
+	var buf bytes.Buffer
+	buf.WriteByte('"')
+	for _, line := range lines {
+		buf.WriteString(escape(line))
+		buf.WriteString(`\l`)
+	}
+	buf.WriteByte('"')
+	return buf.String()
+}
+
+// Return the control transfer ending a block without its successors,
+// which are given by the edges.
+func transfer(b *ir.Block) string {
+	s := b.Kind.String()
+	if b.Control != nil {
+		s += " " + b.Control.String()
+	}
+	if b.Kind == ir.BlockFail {
+		s += fmt.Sprintf(" %q", b.Msg)
+	}
+	return s
+}
+
+// Return the label of the edge to successor i of a block.
+func edgeLabel(b *ir.Block, i int) string {
+	switch b.Kind {
+	case ir.BlockIf:
+		if i == 0 {
+			return "true"
+		}
+		return "false"
+	case ir.BlockSwitch:
+		if i < len(b.Cases) {
+			return fmt.Sprintf("case %d", b.Cases[i])
+		}
+		return "default"
+	}
+	return ""
+}
+
+// Write the control flow graph of a function.
+func Fprint(w io.Writer, f *ir.Func) error {
+	var buf bytes.Buffer
+	dom := f.Dominators()
+	fmt.Fprintf(&buf, "digraph %s {\n", quote(f.Name))
+	buf.WriteString("\tnode [shape=box fontname=\"monospace\"];\n")
+	for _, b := range f.Blocks {
+		lines := []string{b.String() + ":"}
+		for _, v := range b.Values {
+			lines = append(lines, "  "+v.LongString())
+		}
+		lines = append(lines, "  "+transfer(b))
+		fmt.Fprintf(&buf, "\t%s [label=%s", b, label(lines))
+		if len(b.Succs) == 0 {
+			buf.WriteString(" peripheries=2")
+		}
+		buf.WriteString("];\n")
+	}
+	for _, b := range f.Blocks {
+		for i, succ := range b.Succs {
+			var attrs []string
+			if l := edgeLabel(b, i); l != "" {
+				attrs = append(attrs, "label="+quote(l))
+			}
+			if dom.Dominates(succ, b) {
+				attrs = append(attrs, "style=dashed")
+			}
+			fmt.Fprintf(&buf, "\t%s -> %s", b, succ)
+			if len(attrs) > 0 {
+				fmt.Fprintf(&buf, " [%s]", strings.Join(attrs, " "))
+			}
+			buf.WriteString(";\n")
+		}
+	}
+	buf.WriteString("}\n")
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// Return the control flow graph of a function in DOT.
+func String(f *ir.Func) string {
+	var buf bytes.Buffer
+	Fprint(&buf, f)
+	return buf.String()
+}
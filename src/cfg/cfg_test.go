@@ -0,0 +1,234 @@
+// Copyright 2015 Meador Inge.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package cfg
+
+import (
+	"github.com/meadori/bcpl-go/src/ast"
+	"github.com/meadori/bcpl-go/src/ir"
+	"github.com/meadori/bcpl-go/src/opt"
+	"github.com/meadori/bcpl-go/src/parser"
+	"github.com/meadori/bcpl-go/src/runtime"
+	"github.com/meadori/bcpl-go/src/token"
+	"strings"
+	"testing"
+)
+
+var test_cfg_str = `global $( Hook: 200 $)
+manifest $( Red = 1; Green = 2 $)
+static $( Count = 0 $)
+
+let Fact(N) = N = 0 -> 1, N * Fact(N - 1)
+let Colour(X) = match (X) : Red => "red\green" : Green => Count : Y => Hook(Y) .
+let Loop(N, Acc) = N = 0 -> Acc, Loop(N - 1, Acc + N)
+let Table = Fact
+let start() = writen(Fact(5) + Loop(3, 0) + Apply(Fact))
+and Apply(F) = F(2)
+let Shadow(Fact) = Fact(1) + (match (2) : Loop => Loop(3) .)
+`
+
+func parse(t *testing.T, src string) *ast.Program {
+	var p parser.Parser
+	p.Dialect = token.Richards
+	p.Init([]byte(src))
+	prog := p.Parse()
+	if len(p.Errors) > 0 {
+		t.Fatal(p.Errors)
+	}
+	return prog
+}
+
+func newTestModule(t *testing.T, src string) *ir.Module {
+	m, err := ir.Build(parse(t, src), runtime.Target{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := opt.Optimize(m, opt.Options{Level: opt.MaxLevel}); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestFprint(t *testing.T) {
+	m := newTestModule(t, test_cfg_str)
+	expected := `digraph "Fact" {
+	node [shape=box fontname="monospace"];
+	b0 [label="b0:\l  v0 = Param [0]\l  v1 = Const [0]\l  v2 = Eq v0 v1\l  If v2\l"];
+	b1 [label="b1:\l  v3 = Const [1]\l  Return v3\l" peripheries=2];
+	b2 [label="b2:\l  v4 = Func {Fact}\l  v5 = Const [1]\l  v6 = Sub v0 v5\l  v7 = Call v4 v6\l  v8 = Mul v0 v7\l  Return v8\l" peripheries=2];
+	b0 -> b1 [label="true"];
+	b0 -> b2 [label="false"];
+}
+`
+	if got := String(m.Func("Fact")); got != expected {
+		t.Errorf("got\n%s\nexpected\n%s", got, expected)
+	}
+}
+
+var test_edges = []struct {
+	name  string
+	edges []string
+}{
+	{"Colour", []string{
+		`[label="case 1"]`,
+		`[label="case 2"]`,
+		`[label="default"]`,
+		`String {\"red\\green\"}`,
+	}},
+	{"Loop", []string{
+		`[style=dashed]`,
+		`[label="true"]`,
+		`[label="false"]`,
+	}},
+}
+
+func TestEdges(t *testing.T) {
+	m := newTestModule(t, test_cfg_str)
+	for _, test := range test_edges {
+		got := String(m.Func(test.name))
+		for _, edge := range test.edges {
+			if !strings.Contains(got, edge) {
+				t.Errorf("%s: no %s in\n%s", test.name, edge, got)
+			}
+		}
+	}
+	if got := String(m.Func("Fact")); strings.Contains(got, "dashed") {
+		t.Errorf("Fact: back edge in\n%s", got)
+	}
+}
+
+var test_commands_str = `let Sum(N) = valof
+$( let S = 0
+   while N > 0 do $( S := S + N; N := N - 1 $)
+   resultis S
+$)
+let Skip(X) be
+$( if X = 0 goto Done
+   writen(X)
+Done: writes("*N")
+$)
+let Kind(X) be switchon X into
+$( case 1: writes("one"); return
+   case 2: writes("two"); return
+   default: writes("many")
+$)
+`
+
+// The edges of the graphs of commands: the loop of a while has a back
+// edge, a goto joins the block of its label and a switchon branches
+// to each case.
+var test_command_edges = []struct {
+	name  string
+	edges string
+}{
+	{"Sum", `	b0 -> b2;
+	b2 -> b3 [label="true"];
+	b2 -> b4 [label="false"];
+	b3 -> b2 [style=dashed];
+`},
+	{"Skip", `	b0 -> b1 [label="true"];
+	b0 -> b2 [label="false"];
+	b1 -> b3;
+	b2 -> b3;
+`},
+	{"Kind", `	b0 -> b2 [label="case 1"];
+	b0 -> b3 [label="case 2"];
+	b0 -> b4 [label="default"];
+	b4 -> b1;
+`},
+}
+
+func TestCommandEdges(t *testing.T) {
+	m := newTestModule(t, test_commands_str)
+	for _, test := range test_command_edges {
+		got := String(m.Func(test.name))
+		var edges string
+		for _, line := range strings.SplitAfter(got, "\n") {
+			if strings.Contains(line, " -> ") {
+				edges += line
+			}
+		}
+		if edges != test.edges {
+			t.Errorf("%s: got edges\n%s\nexpected\n%s", test.name, edges, test.edges)
+		}
+	}
+
+	// Routines are functions calling the routines of their commands,
+	// and the names a block defines are not nodes.
+	g := NewCallGraph(parse(t, test_commands_str))
+	if n := g.Node("Skip"); n == nil || !n.Func || names(n.Calls) != "writen writes" {
+		t.Errorf("Skip: got %+v, expected a function calling writen writes", n)
+	}
+	if n := g.Node("Sum"); n == nil || len(n.Calls) > 0 || len(n.Refs) > 0 || g.Node("S") != nil {
+		t.Errorf("Sum: got %+v and S %+v, expected no calls or references", n, g.Node("S"))
+	}
+}
+
+var test_calls = []struct {
+	name   string
+	global int
+	fn     bool
+	calls  string
+	refs   string
+}{
+	{"Hook", 200, false, "", ""},
+	{"Fact", -1, true, "Fact", ""},
+	{"Colour", -1, true, "Hook", ""},
+	{"Loop", -1, true, "Loop", ""},
+	{"Table", -1, false, "", "Fact"},
+	{"start", -1, true, "writen Fact Loop Apply", "Fact"},
+	{"Apply", -1, true, "", ""},
+	{"Shadow", -1, true, "", ""},
+	{"writen", 12, false, "", ""},
+}
+
+func names(nodes []*Node) string {
+	var strs []string
+	for _, n := range nodes {
+		strs = append(strs, n.Name)
+	}
+	return strings.Join(strs, " ")
+}
+
+func TestCallGraph(t *testing.T) {
+	g := NewCallGraph(parse(t, test_cfg_str))
+	if len(g.Nodes) != len(test_calls) {
+		t.Errorf("got %d nodes, expected %d", len(g.Nodes), len(test_calls))
+	}
+	for i, test := range test_calls {
+		n := g.Node(test.name)
+		if n == nil {
+			t.Errorf("%s: no node", test.name)
+			continue
+		}
+		if i < len(g.Nodes) && g.Nodes[i] != n {
+			t.Errorf("%s: node %d is %s", test.name, i, g.Nodes[i].Name)
+		}
+		if n.Global != test.global || n.Func != test.fn {
+			t.Errorf("%s: got global %d func %v, expected global %d func %v",
+				test.name, n.Global, n.Func, test.global, test.fn)
+		}
+		if got := names(n.Calls); got != test.calls {
+			t.Errorf("%s: got calls %q, expected %q", test.name, got, test.calls)
+		}
+		if got := names(n.Refs); got != test.refs {
+			t.Errorf("%s: got refs %q, expected %q", test.name, got, test.refs)
+		}
+	}
+	if g.Node("Count") != nil || g.Node("Red") != nil {
+		t.Errorf("got nodes for a static or manifest")
+	}
+
+	dot := g.String()
+	for _, line := range []string{
+		"\t\"Hook\" [shape=ellipse label=\"Hook\\nglobal 200\"];\n",
+		"\t\"Fact\" [shape=box label=\"Fact\"];\n",
+		"\t\"start\" -> \"Apply\";\n",
+		"\t\"Table\" -> \"Fact\" [style=dashed];\n",
+	} {
+		if !strings.Contains(dot, line) {
+			t.Errorf("no %q in\n%s", line, dot)
+		}
+	}
+}
@@ -0,0 +1,25 @@
+// Copyright 2015 Meador Inge.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+// Bclang-dap is a BCPL debug adapter.  It speaks the Debug Adapter
+// Protocol over the standard input and output.
+package main
+
+import (
+	"fmt"
+	"github.com/meadori/bcpl-go/src/dap"
+	"io"
+	"os"
+)
+
+func main() {
+	var s dap.Server
+	s.Init(os.Stdin, os.Stdout)
+	if err := s.Serve(); err != nil {
+		if err != io.EOF {
+			fmt.Fprintln(os.Stderr, "bclang-dap:", err)
+		}
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,36 @@
+// Copyright 2015 Meador Inge.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+// Bclang-lsp is a BCPL language server.  It speaks the Language
+// Server Protocol over the standard input and output.  The -dialect
+// flag gives the dialect of the documents, as for bclang.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/meadori/bcpl-go/src/lsp"
+	"github.com/meadori/bcpl-go/src/token"
+	"io"
+	"os"
+)
+
+var dialectFlag = flag.String("dialect", "1967", "the `dialect` of the source: 1967, upper, anycase or richards, or a comma separated combination")
+
+func main() {
+	flag.Parse()
+	var s lsp.Server
+	var err error
+	if s.Dialect, err = token.ParseDialect(*dialectFlag); err != nil {
+		fmt.Fprintln(os.Stderr, "bclang-lsp:", err)
+		os.Exit(2)
+	}
+	s.Init(os.Stdin, os.Stdout)
+	if err := s.Serve(); err != nil {
+		if err != io.EOF {
+			fmt.Fprintln(os.Stderr, "bclang-lsp:", err)
+		}
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,289 @@
+// Copyright 2015 Meador Inge.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+// Bclang compiles BCPL programs.
+//
+// Usage:
+//
+//	bclang [flags] file.b ...
+//	bclang [flags] run file.b ...
+//	bclang repl
+//
+// Each file is parsed and any syntax errors are reported; with -fix,
+// the fixes they suggest, such as inserting a missing $), are made to
+// the file.  The run command links the files as the sections of one
+// program and runs it by calling start.  The repl command reads
+// declarations, definitions and expressions from the standard input
+// and prints the value of each expression.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/meadori/bcpl-go/src/ast"
+	"github.com/meadori/bcpl-go/src/cfg"
+	"github.com/meadori/bcpl-go/src/edit"
+	"github.com/meadori/bcpl-go/src/interp"
+	"github.com/meadori/bcpl-go/src/ir"
+	"github.com/meadori/bcpl-go/src/link"
+	"github.com/meadori/bcpl-go/src/ocode"
+	"github.com/meadori/bcpl-go/src/opt"
+	"github.com/meadori/bcpl-go/src/parser"
+	"github.com/meadori/bcpl-go/src/regalloc"
+	"github.com/meadori/bcpl-go/src/repl"
+	"github.com/meadori/bcpl-go/src/runtime"
+	"github.com/meadori/bcpl-go/src/token"
+	"github.com/meadori/bcpl-go/src/xref"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+var (
+	dumpAST     = flag.Bool("ast", false, "print the syntax tree of each file")
+	dumpIR      = flag.Bool("ir", false, "print the intermediate representation of each file")
+	dumpCFG     = flag.Bool("cfg", false, "print the control flow graph of each function in the DOT language of Graphviz")
+	dumpCalls   = flag.Bool("callgraph", false, "print the call graph of each file in the DOT language of Graphviz")
+	xrefFlag    = flag.String("xref", "", "print the cross-reference listing of each file in the `format` text or json")
+	regsFlag    = flag.String("regalloc", "", "print the register allocation of each function for the `arch`itecture: amd64 or arm64")
+	dumpOCODE   = flag.Bool("ocode", false, "print the stack code of each file, improved by the peephole optimizer when optimizing")
+	o0          = flag.Bool("O0", false, "do not optimize")
+	o1          = flag.Bool("O1", false, "optimize")
+	o2          = flag.Bool("O2", false, "optimize more, merging common subexpressions")
+	enableFlag  = flag.String("enable", "", "a comma separated list of optimization `passes` to run whatever the level")
+	disableFlag = flag.String("disable", "", "a comma separated list of optimization `passes` not to run")
+	dialectFlag = flag.String("dialect", "1967", "the `dialect` of the source: 1967, upper, anycase or richards, or a comma separated combination")
+	targetFlag  = flag.String("target", runtime.DefaultTarget.Name, "the `target` machine: 64, 32, 32be, 16, 16be or 36")
+	fixFlag     = flag.Bool("fix", false, "apply the fixes suggested for syntax errors to the source files")
+)
+
+// The dialect, target, optimizations and register allocation
+// architecture selected by the flags.
+var (
+	dialect token.Dialect
+	target  runtime.Target
+	options opt.Options
+	arch    *regalloc.Arch
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: bclang [flags] file.b ...\n")
+	fmt.Fprintf(os.Stderr, "       bclang [flags] run file.b ...\n")
+	fmt.Fprintf(os.Stderr, "       bclang repl\n")
+	flag.PrintDefaults()
+}
+
+// Apply edits to the source of a file and write it back.
+func fixFile(filename string, src []byte, edits []edit.Edit) error {
+	if len(edits) == 0 {
+		return nil
+	}
+	fixed, err := edit.Apply(src, edits)
+	if err != nil {
+		return fmt.Errorf("%s: %v", filename, err)
+	}
+	return ioutil.WriteFile(filename, fixed, 0644)
+}
+
+func compile(filename string) (*ast.Program, error) {
+	src, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var p parser.Parser
+	p.Dialect = dialect
+	p.Init(src)
+	prog := p.Parse()
+	if len(p.Errors) > 0 {
+		if *fixFlag {
+			if err := fixFile(filename, src, p.Errors.Edits()); err != nil {
+				return nil, err
+			}
+		}
+		for _, err := range p.Errors[:len(p.Errors)-1] {
+			fmt.Fprintf(os.Stderr, "%s:%v\n", filename, err)
+		}
+		return nil, fmt.Errorf("%s:%v", filename, p.Errors[len(p.Errors)-1])
+	}
+	if *dumpAST {
+		if err := ast.Fprint(os.Stdout, prog, ast.NotNilFilter); err != nil {
+			return nil, err
+		}
+	}
+	switch *xrefFlag {
+	case "text":
+		if err := xref.New(prog).Fprint(os.Stdout); err != nil {
+			return nil, err
+		}
+	case "json":
+		if err := xref.New(prog).FprintJSON(os.Stdout); err != nil {
+			return nil, err
+		}
+	}
+	if *dumpCalls {
+		if err := cfg.NewCallGraph(prog).Fprint(os.Stdout); err != nil {
+			return nil, err
+		}
+	}
+	if *dumpIR || *dumpCFG || arch != nil {
+		m, err := ir.Build(prog, target)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%v", filename, err)
+		}
+		if err := opt.Optimize(m, options); err != nil {
+			return nil, fmt.Errorf("%s: %v", filename, err)
+		}
+		if *dumpIR {
+			if err := m.Fprint(os.Stdout); err != nil {
+				return nil, err
+			}
+		}
+		for _, f := range append([]*ir.Func{m.Init}, m.Funcs...) {
+			if *dumpCFG {
+				if err := cfg.Fprint(os.Stdout, f); err != nil {
+					return nil, err
+				}
+			}
+			if arch != nil {
+				if err := regalloc.Allocate(f, arch).Fprint(os.Stdout); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	if *dumpOCODE {
+		p, err := ocode.Generate(prog, target)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%v", filename, err)
+		}
+		if options.Level > 0 {
+			ocode.Peephole(p, ocode.Rules)
+		}
+		if err := p.Fprint(os.Stdout); err != nil {
+			return nil, err
+		}
+	}
+	return prog, nil
+}
+
+// Link the files into one program and run it with the given input
+// and output, returning the code it stopped with.
+func run(filenames []string, stdin io.Reader, stdout io.Writer) (int, error) {
+	var sections []link.Section
+	for _, filename := range filenames {
+		prog, err := compile(filename)
+		if err != nil {
+			return 1, err
+		}
+		sections = append(sections, link.Section{filename, prog})
+	}
+	img, err := link.Link(sections)
+	if list, ok := err.(link.ErrorList); ok {
+		for _, err := range list[:len(list)-1] {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		return 1, list[len(list)-1]
+	} else if err != nil {
+		return 1, err
+	}
+
+	var in interp.Interp
+	in.Target = target
+	in.Init(stdin, stdout)
+	defer in.Flush()
+	if err := img.Load(&in); err != nil {
+		return 1, err
+	}
+	if _, err := img.Start(&in); err != nil {
+		if e, ok := err.(*runtime.Exit); ok {
+			return int(e.Code), nil
+		}
+		return 1, err
+	}
+	return 0, nil
+}
+
+// Set the optimization options from the flags.  The highest level
+// given is used.
+func setOptions() error {
+	switch {
+	case *o2:
+		options.Level = 2
+	case *o1:
+		options.Level = 1
+	case *o0:
+		options.Level = 0
+	}
+	var err error
+	if options.Enable, err = opt.ParsePasses(*enableFlag); err != nil {
+		return err
+	}
+	options.Disable, err = opt.ParsePasses(*disableFlag)
+	return err
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	var err error
+	if dialect, err = token.ParseDialect(*dialectFlag); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	var ok bool
+	if target, ok = runtime.LookupTarget(*targetFlag); !ok {
+		fmt.Fprintf(os.Stderr, "unknown target %q\n", *targetFlag)
+		os.Exit(2)
+	}
+	if *xrefFlag != "" && *xrefFlag != "text" && *xrefFlag != "json" {
+		fmt.Fprintf(os.Stderr, "unknown cross-reference format %q\n", *xrefFlag)
+		os.Exit(2)
+	}
+	if *regsFlag != "" {
+		if arch = regalloc.LookupArch(*regsFlag); arch == nil {
+			fmt.Fprintf(os.Stderr, "unknown architecture %q\n", *regsFlag)
+			os.Exit(2)
+		}
+	}
+	if err := setOptions(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	if flag.Arg(0) == "run" && flag.NArg() > 1 {
+		code, err := run(flag.Args()[1:], os.Stdin, os.Stdout)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		os.Exit(code)
+	}
+
+	if flag.Arg(0) == "repl" && flag.NArg() == 1 {
+		var r repl.REPL
+		r.Target = target
+		r.Dialect = dialect
+		r.Init(os.Stdin, os.Stdout)
+		if err := r.Run(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	exitCode := 0
+	for _, filename := range flag.Args() {
+		if _, err := compile(filename); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			exitCode = 1
+		}
+	}
+	os.Exit(exitCode)
+}
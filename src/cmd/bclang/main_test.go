@@ -0,0 +1,82 @@
+// Copyright 2015 Meador Inge.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"github.com/meadori/bcpl-go/src/token"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Write the sources to files a.b, b.b and so on of a directory,
+// returning their names.
+func writeFiles(t *testing.T, dir string, srcs ...string) []string {
+	var filenames []string
+	for i, src := range srcs {
+		filename := filepath.Join(dir, string(rune('a'+i))+".b")
+		if err := ioutil.WriteFile(filename, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+		filenames = append(filenames, filename)
+	}
+	return filenames
+}
+
+// The names of a program in capitals are those of the library.
+func TestRunUpper(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bclang")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dialect = token.Upper
+	defer func() { dialect = 0 }()
+
+	filenames := writeFiles(t, dir, "GLOBAL $( SQUARE: 200 $)\nLET START() BE $(\n  FOR I = 1 TO 3 DO WRITEN(I)\n  WRITEF(\"*N%N*N\", SQUARE(7))\n$)\n",
+		"GLOBAL $( SQUARE: 200 $)\nLET SQUARE(N) = N * N\n")
+	var out bytes.Buffer
+	if code, err := run(filenames, strings.NewReader(""), &out); code != 0 || err != nil {
+		t.Fatalf("exit code %d, error %v", code, err)
+	}
+	if out.String() != "123\n49\n" {
+		t.Errorf("got output %q", out.String())
+	}
+
+	filenames = writeFiles(t, dir, "LET START() BE FOR I = 1 WRITEN(I)\n")
+	if _, err := run(filenames, strings.NewReader(""), &out); err == nil || !strings.Contains(err.Error(), "expected 'TO'") {
+		t.Errorf("got error %v, expected one naming TO", err)
+	}
+}
+
+var test_run_errors = []struct {
+	srcs []string
+	msg  string
+}{
+	{[]string{"global $( H: 200 $)\nlet start() be H(1)\n", "global $( H: 200 $)\nlet H(X) be writen(Y)\n"},
+		"b.b:2:20: error: undeclared name Y"},
+	{[]string{"let start() be writen(1)\n", "let X = Y\n"},
+		"b.b:1:9: error: undeclared name Y"},
+}
+
+func TestRunErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bclang")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, test := range test_run_errors {
+		filenames := writeFiles(t, dir, test.srcs...)
+		var out bytes.Buffer
+		_, err := run(filenames, strings.NewReader(""), &out)
+		if err == nil || !strings.HasSuffix(err.Error(), test.msg) {
+			t.Errorf("%q: got error %v, expected %s", test.srcs, err, test.msg)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright 2015 Meador Inge.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// The number of unchanged lines around each hunk of a diff.
+const context = 3
+
+// An operation of an edit script turning the lines of one text into
+// those of another: a line kept (' '), deleted ('-') or inserted ('+').
+type op struct {
+	kind byte
+	line string
+}
+
+// Split a text into lines, each keeping its newline.
+func splitLines(text []byte) []string {
+	var lines []string
+	for len(text) > 0 {
+		i := bytes.IndexByte(text, '\n') + 1
+		if i == 0 {
+			i = len(text)
+		}
+		lines = append(lines, string(text[:i]))
+		text = text[i:]
+	}
+	return lines
+}
+
+// Return the shortest edit script turning a into b, found by Myers'
+// algorithm.  The furthest reaching path on each diagonal k = x - y
+// is kept for every number of edits d, and the script is recovered
+// by walking back through them from the end.
+func editScript(a, b []string) []op {
+	n, m := len(a), len(b)
+	max := n + m
+	v := make([]int, 2*max+2)
+	var trace [][]int
+	var d int
+search:
+	for d = 0; d <= max; d++ {
+		trace = append(trace, append([]int(nil), v...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || k != d && v[max+k-1] < v[max+k+1] {
+				x = v[max+k+1]
+			} else {
+				x = v[max+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[max+k] = x
+			if x >= n && y >= m {
+				break search
+			}
+		}
+	}
+
+	var ops []op
+	x, y := n, m
+	for ; d > 0; d-- {
+		v := trace[d]
+		k := x - y
+		var prev int
+		if k == -d || k != d && v[max+k-1] < v[max+k+1] {
+			prev = k + 1
+		} else {
+			prev = k - 1
+		}
+		px := v[max+prev]
+		py := px - prev
+		for x > px && y > py {
+			ops = append(ops, op{' ', a[x-1]})
+			x--
+			y--
+		}
+		if x == px {
+			ops = append(ops, op{'+', b[y-1]})
+		} else {
+			ops = append(ops, op{'-', a[x-1]})
+		}
+		x, y = px, py
+	}
+	for ; x > 0; x-- {
+		ops = append(ops, op{' ', a[x-1]})
+	}
+	for i, j := 0, len(ops)-1; i < j; i, j = i+1, j-1 {
+		ops[i], ops[j] = ops[j], ops[i]
+	}
+	return ops
+}
+
+// Return the range of lines of a hunk header, in which a count of
+// one is left out and an empty range starts at the line before it.
+func hunkRange(start, count int) string {
+	switch count {
+	case 0:
+		return fmt.Sprintf("%d,0", start)
+	case 1:
+		return fmt.Sprint(start + 1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, count)
+}
+
+// Return the unified diff turning the text of a file into its
+// formatted text, or nil if they are the same.
+func diff(filename string, b1, b2 []byte) []byte {
+	ops := editScript(splitLines(b1), splitLines(b2))
+
+	// The lines of each text before each operation.
+	lines1 := make([]int, len(ops)+1)
+	lines2 := make([]int, len(ops)+1)
+	var changes []int
+	for i, o := range ops {
+		lines1[i+1], lines2[i+1] = lines1[i], lines2[i]
+		if o.kind != '+' {
+			lines1[i+1]++
+		}
+		if o.kind != '-' {
+			lines2[i+1]++
+		}
+		if o.kind != ' ' {
+			changes = append(changes, i)
+		}
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "--- %s\n+++ bclfmt/%s\n", filename, filename)
+	for i := 0; i < len(changes); {
+		// A hunk holds the changes separated by no more than
+		// twice the context of unchanged lines.
+		j := i + 1
+		for j < len(changes) && changes[j]-changes[j-1] <= 2*context+1 {
+			j++
+		}
+		start := changes[i] - context
+		if start < 0 {
+			start = 0
+		}
+		end := changes[j-1] + context + 1
+		if end > len(ops) {
+			end = len(ops)
+		}
+		fmt.Fprintf(&buf, "@@ -%s +%s @@\n",
+			hunkRange(lines1[start], lines1[end]-lines1[start]),
+			hunkRange(lines2[start], lines2[end]-lines2[start]))
+		for _, o := range ops[start:end] {
+			buf.WriteByte(o.kind)
+			buf.WriteString(o.line)
+			if !strings.HasSuffix(o.line, "\n") {
+				buf.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		i = j
+	}
+	return buf.Bytes()
+}
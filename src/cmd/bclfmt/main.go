@@ -0,0 +1,162 @@
+// Copyright 2015 Meador Inge.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+// Bclfmt formats BCPL programs.
+//
+// Usage:
+//
+//	bclfmt [flags] [path ...]
+//
+// Without an explicit path it processes the standard input.  Given a
+// file it operates on that file; given a directory it operates on all
+// .b and .bcpl files in that directory, recursively.  With -fix, a
+// file with syntax errors is formatted after making the fixes they
+// suggest, such as inserting a missing $), if that corrects them.
+// The source is read, and its reserved words written, in the dialect
+// given by -dialect.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"github.com/meadori/bcpl-go/src/edit"
+	"github.com/meadori/bcpl-go/src/parser"
+	"github.com/meadori/bcpl-go/src/printer"
+	"github.com/meadori/bcpl-go/src/token"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	list   = flag.Bool("l", false, "list files whose formatting differs from bclfmt's")
+	write  = flag.Bool("w", false, "write result to (source) file instead of stdout")
+	doDiff = flag.Bool("d", false, "display diffs instead of rewriting files")
+	fix    = flag.Bool("fix", false, "apply the fixes suggested for syntax errors before formatting")
+
+	dialectFlag = flag.String("dialect", "1967", "the `dialect` of the source: 1967, upper, anycase or richards, or a comma separated combination")
+)
+
+var (
+	exitCode = 0
+	dialect  token.Dialect
+)
+
+func report(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	exitCode = 2
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: bclfmt [flags] [path ...]\n")
+	flag.PrintDefaults()
+}
+
+func isBCPLFile(info os.FileInfo) bool {
+	name := info.Name()
+	return !info.IsDir() && !strings.HasPrefix(name, ".") &&
+		(strings.HasSuffix(name, ".b") || strings.HasSuffix(name, ".bcpl"))
+}
+
+func processFile(filename string, in io.Reader, out io.Writer) error {
+	if in == nil {
+		f, err := os.Open(filename)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	src, err := ioutil.ReadAll(in)
+	if err != nil {
+		return err
+	}
+
+	res, err := printer.Source(src, dialect)
+	if list, ok := err.(parser.ErrorList); ok && *fix {
+		fixed, ferr := edit.Apply(src, list.Edits())
+		if ferr != nil {
+			return fmt.Errorf("%s: %v", filename, ferr)
+		}
+		res, err = printer.Source(fixed, dialect)
+	}
+	if err != nil {
+		return fmt.Errorf("%s:%v", filename, err)
+	}
+
+	if !bytes.Equal(src, res) {
+		if *list {
+			fmt.Fprintln(out, filename)
+		}
+		if *write {
+			if err := ioutil.WriteFile(filename, res, 0644); err != nil {
+				return err
+			}
+		}
+		if *doDiff {
+			fmt.Fprintf(out, "diff %s bclfmt/%s\n", filename, filename)
+			out.Write(diff(filename, src, res))
+		}
+	}
+
+	if !*list && !*write && !*doDiff {
+		_, err = out.Write(res)
+	}
+
+	return err
+}
+
+func visitFile(path string, f os.FileInfo, err error) error {
+	if err == nil && isBCPLFile(f) {
+		err = processFile(path, nil, os.Stdout)
+	}
+	if err != nil {
+		report(err)
+	}
+	return nil
+}
+
+func walkDir(path string) {
+	filepath.Walk(path, visitFile)
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	var err error
+	if dialect, err = token.ParseDialect(*dialectFlag); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	if flag.NArg() == 0 {
+		if *write {
+			fmt.Fprintln(os.Stderr, "error: cannot use -w with standard input")
+			os.Exit(2)
+		}
+		if err := processFile("<standard input>", os.Stdin, os.Stdout); err != nil {
+			report(err)
+		}
+		os.Exit(exitCode)
+	}
+
+	for _, path := range flag.Args() {
+		switch dir, err := os.Stat(path); {
+		case err != nil:
+			report(err)
+		case dir.IsDir():
+			walkDir(path)
+		default:
+			if err := processFile(path, nil, os.Stdout); err != nil {
+				report(err)
+			}
+		}
+	}
+	os.Exit(exitCode)
+}
@@ -0,0 +1,53 @@
+// Copyright 2015 Meador Inge.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+var test_diffs = []struct {
+	a, b string
+	diff string
+}{
+	{"a\nb\nc\n", "a\nb\nc\n", ""},
+	{"a\nb\nc\n", "a\nB\nc\n", "@@ -1,3 +1,3 @@\n a\n-b\n+B\n c\n"},
+	{"", "a\n", "@@ -0,0 +1 @@\n+a\n"},
+	{"a\nb\n", "b\n", "@@ -1,2 +1 @@\n-a\n b\n"},
+	{"x", "x\n", "@@ -1 +1 @@\n-x\n\\ No newline at end of file\n+x\n"},
+	// Changes more than twice the context apart are in separate hunks.
+	{"1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n", "one\n2\n3\n4\n5\n6\n7\n8\n9\nten\n",
+		"@@ -1,4 +1,4 @@\n-1\n+one\n 2\n 3\n 4\n@@ -7,4 +7,4 @@\n 7\n 8\n 9\n-10\n+ten\n"},
+	{"1\n2\n3\n4\n5\n6\n7\n8\n", "one\n2\n3\n4\n5\n6\n7\neight\n",
+		"@@ -1,8 +1,8 @@\n-1\n+one\n 2\n 3\n 4\n 5\n 6\n 7\n-8\n+eight\n"},
+}
+
+func TestDiff(t *testing.T) {
+	for _, test := range test_diffs {
+		expected := ""
+		if test.diff != "" {
+			expected = "--- t.b\n+++ bclfmt/t.b\n" + test.diff
+		}
+		if got := string(diff("t.b", []byte(test.a), []byte(test.b))); got != expected {
+			t.Errorf("%q to %q: got\n%s\nexpected\n%s", test.a, test.b, got, expected)
+		}
+	}
+}
+
+func TestProcessFileDiff(t *testing.T) {
+	*doDiff = true
+	defer func() { *doDiff = false }()
+	var out bytes.Buffer
+	if err := processFile("t.b", strings.NewReader("let F(X)=X\nlet G() = F(1)\n"), &out); err != nil {
+		t.Fatal(err)
+	}
+	expected := "diff t.b bclfmt/t.b\n--- t.b\n+++ bclfmt/t.b\n" +
+		"@@ -1,2 +1,3 @@\n-let F(X)=X\n+let F(X) = X\n+\n let G() = F(1)\n"
+	if out.String() != expected {
+		t.Errorf("got\n%s\nexpected\n%s", out.String(), expected)
+	}
+}
@@ -0,0 +1,31 @@
+// Copyright 2015 Meador Inge.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+// Bclvet reports suspicious constructs in BCPL programs.
+//
+// Usage:
+//
+//	bclvet [flags] file.b ...
+//
+// The files are parsed as the sections of a program and the analyzers
+// of package passes are run over them, printing their diagnostics.
+// Every analyzer is run unless some are enabled by their flags, as
+// with -unused, in which case only those are; an analyzer may also be
+// disabled, as with -unused=false.  With -fix, the fixes suggested by
+// the diagnostics, such as replacing a number by the manifest constant
+// of its value, are made to the files.  The exit code is 1 if there
+// are diagnostics and 2 if a file cannot be read or parsed.
+//
+// A team may build its own checker running its own analyzers beside
+// these by calling multichecker.Main with them all.
+package main
+
+import (
+	"github.com/meadori/bcpl-go/src/analysis/multichecker"
+	"github.com/meadori/bcpl-go/src/analysis/passes"
+)
+
+func main() {
+	multichecker.Main(passes.Analyzers...)
+}
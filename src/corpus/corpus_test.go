@@ -0,0 +1,220 @@
+// Copyright 2015 Meador Inge.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package corpus
+
+import (
+	"bytes"
+	"flag"
+	"github.com/meadori/bcpl-go/src/ast"
+	"github.com/meadori/bcpl-go/src/interp"
+	"github.com/meadori/bcpl-go/src/parser"
+	"github.com/meadori/bcpl-go/src/scanner"
+	"github.com/meadori/bcpl-go/src/token"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update the .golden and .out files")
+
+// The directory holding the corpus, and the one holding its programs
+// in the Richards dialect.
+const (
+	dir         = "../../testdata"
+	richardsDir = "../../testdata/richards"
+)
+
+var errorRx = regexp.MustCompile(`^// ERROR "(.*)"\s*$`)
+
+// An expected diagnostic.
+type expectation struct {
+	line    int
+	rx      *regexp.Regexp
+	matched bool
+}
+
+// A diagnostic, without its position.
+type diagnostic struct {
+	line int
+	msg  string
+}
+
+// Scan a program, checking that each token's position and literal
+// agree with the source, and return its ERROR comments.
+func scan(t *testing.T, name string, src []byte, dialect token.Dialect) []*expectation {
+	var s scanner.Scanner
+	s.Init(src)
+	s.Dialect = dialect
+	var expects []*expectation
+	last := -1
+	for {
+		tok := s.Next()
+		pos := tok.Pos
+		if pos.Offset < last || pos.Offset > len(src) {
+			t.Fatalf("%s: token %s at bad offset %d", name, tok, pos.Offset)
+		}
+		last = pos.Offset
+		if tok.Kind == token.EOF {
+			return expects
+		}
+
+		// Inserted semicolons and dos take the position of the
+		// following token.
+		if tok.Kind != token.SEMICOLON && tok.Kind != token.DO &&
+			!bytes.HasPrefix(src[pos.Offset:], []byte(tok.Lit)) {
+			t.Errorf("%s:%s: token %q does not match the source", name, pos, tok.Lit)
+		}
+		if lineStart := bytes.LastIndexByte(src[:pos.Offset], '\n') + 1; pos.Column != pos.Offset-lineStart+1 {
+			t.Errorf("%s:%s: token %q has the wrong column", name, pos, tok.Lit)
+		}
+
+		if tok.Kind != token.COMMENT {
+			continue
+		}
+		m := errorRx.FindStringSubmatch(tok.Lit)
+		if m == nil {
+			continue
+		}
+		rx, err := regexp.Compile(m[1])
+		if err != nil {
+			t.Fatalf("%s:%s: bad ERROR comment: %v", name, pos, err)
+		}
+		expects = append(expects, &expectation{pos.Line, rx, false})
+	}
+}
+
+// Compare data with the contents of a file, or update the file.
+func compare(t *testing.T, path string, data []byte) {
+	if *update {
+		if err := ioutil.WriteFile(path, data, 0666); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	expected, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Errorf("%v (run the tests with -update to create it)", err)
+		return
+	}
+	if !bytes.Equal(data, expected) {
+		t.Errorf("%s differs; got:\n%s", path, data)
+	}
+}
+
+// Report whether a program defines start.
+func definesStart(prog *ast.Program) bool {
+	found := false
+	ast.Inspect(prog, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.FuncDef:
+			found = found || n.Name == "start"
+		case *ast.RoutineDef:
+			found = found || n.Name == "start"
+		case *ast.Name:
+			found = found || n.Val == "start"
+		}
+		return !found
+	})
+	return found
+}
+
+func position(err error) diagnostic {
+	switch e := err.(type) {
+	case *parser.Error:
+		return diagnostic{e.Pos.Line, e.Msg}
+	case *interp.Error:
+		return diagnostic{e.Pos.Line, e.Msg}
+	}
+	return diagnostic{0, err.Error()}
+}
+
+// Run a program under the parser and interpreter and return the
+// diagnostics.
+func check(t *testing.T, path string, src []byte, dialect token.Dialect) []diagnostic {
+	var diags []diagnostic
+	var p parser.Parser
+	p.Dialect = dialect
+	p.Init(src)
+	prog := p.Parse()
+	for _, err := range p.Errors {
+		diags = append(diags, position(err))
+	}
+	if len(diags) > 0 {
+		return diags
+	}
+
+	var buf bytes.Buffer
+	if err := ast.Fprint(&buf, prog, ast.NotNilFilter); err != nil {
+		t.Fatal(err)
+	}
+	base := strings.TrimSuffix(path, ".b")
+	compare(t, base+".golden", buf.Bytes())
+
+	input, err := ioutil.ReadFile(base + ".in")
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	var in interp.Interp
+	var out bytes.Buffer
+	in.Init(bytes.NewReader(input), &out)
+	if err := in.Load(prog); err != nil {
+		return append(diags, position(err))
+	}
+	if definesStart(prog) {
+		if _, err := in.Start(); err != nil {
+			diags = append(diags, position(err))
+		}
+		compare(t, base+".out", out.Bytes())
+	}
+	return diags
+}
+
+func TestCorpus(t *testing.T) {
+	testCorpus(t, dir, 0)
+}
+
+func TestRichards(t *testing.T) {
+	testCorpus(t, richardsDir, token.Richards)
+}
+
+// Check the programs of a directory, written in a dialect.
+func testCorpus(t *testing.T, dir string, dialect token.Dialect) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) == 0 {
+		t.Fatalf("no programs in %s", dir)
+	}
+
+	for _, path := range paths {
+		name := filepath.Base(path)
+		src, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expects := scan(t, name, src, dialect)
+
+		for _, d := range check(t, path, src, dialect) {
+			matched := false
+			for _, e := range expects {
+				if e.line == d.line && e.rx.MatchString(d.msg) {
+					e.matched, matched = true, true
+				}
+			}
+			if !matched {
+				t.Errorf("%s:%d: unexpected error: %s", name, d.line, d.msg)
+			}
+		}
+		for _, e := range expects {
+			if !e.matched {
+				t.Errorf("%s:%d: missing error matching %q", name, e.line, e.rx)
+			}
+		}
+	}
+}
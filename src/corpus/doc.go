@@ -0,0 +1,25 @@
+// Copyright 2015 Meador Inge.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+// Package corpus checks the scanner, parser and interpreter against
+// the BCPL programs in the testdata directory at the top of the
+// repository, and those in the Richards dialect in testdata/richards.
+// It has no code of its own; see the tests.
+//
+// Each program name.b may contain comments of the form
+//
+//	// ERROR "regexp"
+//
+// Every diagnostic reported for a line must match a regular
+// expression given by an ERROR comment on that line, and every
+// ERROR comment must match a diagnostic.  Diagnostics are the syntax
+// errors of the parser and the errors found while loading and running
+// the program.
+//
+// A program without syntax errors has its syntax tree, as printed by
+// ast.Fprint, recorded in name.golden.  A program defining start is
+// run with the text of name.in, if there is one, as input; its
+// output is recorded in name.out.  Running the tests with -update
+// rewrites the .golden and .out files.
+package corpus
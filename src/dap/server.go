@@ -0,0 +1,572 @@
+// Copyright 2015 Meador Inge.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+// Package dap implements a Debug Adapter Protocol server for BCPL.
+// It launches a program under the debugger of package debug and
+// offers breakpoints by line, stepping over, into and out of calls,
+// inspection of parameters, globals and vectors, evaluation of
+// expressions and data breakpoints on cells of the global vector.
+//
+// The program is a single source file; lines and columns are those
+// recorded by the scanner.
+package dap
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/meadori/bcpl-go/src/debug"
+	"github.com/meadori/bcpl-go/src/interp"
+	"github.com/meadori/bcpl-go/src/parser"
+	"github.com/meadori/bcpl-go/src/runtime"
+	"github.com/meadori/bcpl-go/src/token"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The only thread of a program.
+const threadID = 1
+
+// The most elements of a vector shown as variables.
+const maxElements = 1000
+
+// What a variables reference refers to.
+type varRef struct {
+	frame   *interp.Frame // The frame whose parameters are listed, or nil.
+	globals bool          // The names declared at the top level.
+	vec     runtime.Word  // The address of a vector, if size > 0.
+	size    int
+}
+
+type Server struct {
+	in       *bufio.Reader   // The stream of client messages.
+	out      io.Writer       // The stream of server messages.
+	lineBase int             // The client's first line number.
+	colBase  int             // The client's first column number.
+	paths    []string        // The paths of the files of the program.
+	debugger *debug.Debugger // The debugger, once a program is launched.
+	entry    bool            // Stop on entry to start.
+	started  bool            // Whether the program has started.
+	exited   chan struct{}   // Closed when the program exits.
+	refs     map[int]varRef  // The variables references of this stop.
+	resume   func()          // How to resume the program after replying.
+
+	mu      sync.Mutex // Guards the fields below and writes to out.
+	seq     int        // The sequence number of the last message.
+	stopped bool       // Whether the program is stopped.
+}
+
+func (s *Server) Init(in io.Reader, out io.Writer) {
+	s.in = bufio.NewReader(in)
+	s.out = out
+	s.lineBase, s.colBase = 1, 1
+	s.paths = nil
+	s.debugger = nil
+	s.started = false
+	s.exited = make(chan struct{})
+	s.refs = nil
+	s.resume = nil
+	s.seq = 0
+	s.stopped = false
+}
+
+// Serve client messages until the client disconnects.
+func (s *Server) Serve() error {
+	for {
+		body, err := readMessage(s.in)
+		if err != nil {
+			return err
+		}
+
+		var req request
+		if err := json.Unmarshal(body, &req); err != nil {
+			return fmt.Errorf("dap: %v", err)
+		}
+		if req.Type != "request" {
+			continue
+		}
+
+		result, err := s.handle(&req)
+		if err := s.reply(&req, result, err); err != nil {
+			return err
+		}
+		if s.resume != nil {
+			// Resume only once the reply has been sent, so that it
+			// comes before the next stopped event.
+			s.resume()
+			s.resume = nil
+		}
+		switch req.Command {
+		case "launch":
+			if err == nil {
+				s.send("initialized", nil)
+			}
+		case "disconnect":
+			return nil
+		}
+	}
+}
+
+func (s *Server) write(msg interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seq++
+	switch msg := msg.(type) {
+	case *response:
+		msg.Seq = s.seq
+	case *event:
+		msg.Seq = s.seq
+	}
+	return writeMessage(s.out, msg)
+}
+
+func (s *Server) reply(req *request, body interface{}, err error) error {
+	resp := &response{Type: "response", RequestSeq: req.Seq, Command: req.Command}
+	if err != nil {
+		resp.Message = err.Error()
+	} else {
+		resp.Success = true
+		resp.Body = body
+	}
+	return s.write(resp)
+}
+
+func (s *Server) send(name string, body interface{}) error {
+	return s.write(&event{Type: "event", Event: name, Body: body})
+}
+
+// A writer sending the program's output as output events.
+type output struct {
+	s        *Server
+	category string
+}
+
+func (w output) Write(p []byte) (int, error) {
+	if err := w.s.send("output", &OutputEventBody{w.category, string(p)}); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (s *Server) isStopped() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stopped
+}
+
+// Report an error unless the program can be inspected: it is
+// stopped, or it has been launched but not started.
+func (s *Server) inspectable() error {
+	if s.debugger == nil {
+		return errors.New("no program launched")
+	}
+	if s.started && !s.isStopped() {
+		return errors.New("the program is running")
+	}
+	return nil
+}
+
+// Handle a request, returning the response body.
+func (s *Server) handle(req *request) (interface{}, error) {
+	args := func(v interface{}) error {
+		if len(req.Arguments) == 0 {
+			return nil
+		}
+		return json.Unmarshal(req.Arguments, v)
+	}
+
+	switch req.Command {
+	case "initialize":
+		var a InitializeArguments
+		if err := args(&a); err != nil {
+			return nil, err
+		}
+		if a.LinesStartAt1 != nil && !*a.LinesStartAt1 {
+			s.lineBase = 0
+		}
+		if a.ColumnsStartAt1 != nil && !*a.ColumnsStartAt1 {
+			s.colBase = 0
+		}
+		return &Capabilities{true, true, true, true}, nil
+	case "launch":
+		var a LaunchArguments
+		if err := args(&a); err != nil {
+			return nil, err
+		}
+		return nil, s.launch(&a)
+	case "setBreakpoints":
+		var a SetBreakpointsArguments
+		if err := args(&a); err != nil {
+			return nil, err
+		}
+		return s.setBreakpoints(&a), nil
+	case "setExceptionBreakpoints":
+		return &BreakpointsResponseBody{[]Breakpoint{}}, nil
+	case "dataBreakpointInfo":
+		var a DataBreakpointInfoArguments
+		if err := args(&a); err != nil {
+			return nil, err
+		}
+		return s.dataBreakpointInfo(&a), nil
+	case "setDataBreakpoints":
+		var a SetDataBreakpointsArguments
+		if err := args(&a); err != nil {
+			return nil, err
+		}
+		return s.setDataBreakpoints(&a)
+	case "configurationDone":
+		return nil, s.start()
+	case "threads":
+		return &ThreadsResponseBody{[]Thread{{threadID, "main"}}}, nil
+	case "stackTrace":
+		return s.stackTrace()
+	case "scopes":
+		var a ScopesArguments
+		if err := args(&a); err != nil {
+			return nil, err
+		}
+		return s.scopes(&a)
+	case "variables":
+		var a VariablesArguments
+		if err := args(&a); err != nil {
+			return nil, err
+		}
+		return s.variables(&a)
+	case "evaluate":
+		var a EvaluateArguments
+		if err := args(&a); err != nil {
+			return nil, err
+		}
+		return s.evaluate(&a)
+	case "continue", "next", "stepIn", "stepOut":
+		return s.step(req.Command)
+	case "pause":
+		if s.debugger == nil || !s.started {
+			return nil, errors.New("the program is not running")
+		}
+		s.debugger.Pause()
+		return nil, nil
+	case "disconnect", "terminate":
+		s.terminate()
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unsupported request %s", req.Command)
+}
+
+func (s *Server) launch(a *LaunchArguments) error {
+	if s.debugger != nil {
+		return errors.New("a program is already launched")
+	}
+	paths := append([]string{a.Program}, a.Sections...)
+	var files []debug.File
+	for _, path := range paths {
+		src, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		files = append(files, debug.File{path, src})
+	}
+	var d debug.Debugger
+	if a.Dialect != "" {
+		var err error
+		if d.Dialect, err = token.ParseDialect(a.Dialect); err != nil {
+			return err
+		}
+	}
+	if err := d.Init(files, strings.NewReader(a.Input), output{s, "stdout"}); err != nil {
+		return err
+	}
+	s.paths = paths
+	s.debugger = &d
+	s.entry = a.StopOnEntry
+	return nil
+}
+
+func source(path string) *Source {
+	return &Source{filepath.Base(path), path}
+}
+
+// Return the file of the program with a path, reporting whether
+// there is one.
+func (s *Server) file(path string) (string, bool) {
+	for _, p := range s.paths {
+		if filepath.Clean(p) == filepath.Clean(path) {
+			return p, true
+		}
+	}
+	return "", false
+}
+
+func (s *Server) setBreakpoints(a *SetBreakpointsArguments) *BreakpointsResponseBody {
+	bps := make([]Breakpoint, len(a.Breakpoints))
+	path, ok := s.file(a.Source.Path)
+	if s.debugger == nil || !ok {
+		for i, bp := range a.Breakpoints {
+			bps[i] = Breakpoint{false, "not a file of the program being debugged", nil, bp.Line}
+		}
+		return &BreakpointsResponseBody{bps}
+	}
+
+	lines := make([]int, len(a.Breakpoints))
+	for i, bp := range a.Breakpoints {
+		lines[i] = bp.Line + 1 - s.lineBase
+	}
+	verified := s.debugger.SetBreakpoints(path, lines)
+	for i, bp := range a.Breakpoints {
+		bps[i] = Breakpoint{verified[i], "", source(path), bp.Line}
+		if !verified[i] {
+			bps[i].Message = "no call or function body on this line"
+		}
+	}
+	return &BreakpointsResponseBody{bps}
+}
+
+func (s *Server) dataBreakpointInfo(a *DataBreakpointInfoArguments) *DataBreakpointInfoResponseBody {
+	ref, ok := s.refs[a.VariablesReference]
+	if s.debugger != nil && ok && ref.globals {
+		for _, v := range s.debugger.Interp().Globals() {
+			if v.Name == a.Name && v.Global {
+				id := strconv.Itoa(int(v.Addr))
+				return &DataBreakpointInfoResponseBody{&id,
+					fmt.Sprintf("global %d (%s)", v.Addr, v.Name), []string{"write"}}
+			}
+		}
+	}
+	return &DataBreakpointInfoResponseBody{nil, "only cells of the global vector can be watched", nil}
+}
+
+func (s *Server) setDataBreakpoints(a *SetDataBreakpointsArguments) (interface{}, error) {
+	if s.debugger == nil {
+		return nil, errors.New("no program launched")
+	}
+	var globals []int
+	for _, bp := range a.Breakpoints {
+		n, err := strconv.Atoi(bp.DataID)
+		if err != nil {
+			return nil, fmt.Errorf("bad data breakpoint %q", bp.DataID)
+		}
+		globals = append(globals, n)
+	}
+	if err := s.debugger.SetWatchpoints(globals); err != nil {
+		return nil, err
+	}
+	bps := make([]Breakpoint, len(a.Breakpoints))
+	for i := range bps {
+		bps[i].Verified = true
+	}
+	return &BreakpointsResponseBody{bps}, nil
+}
+
+// Start the program and wait for its stops in the background.
+func (s *Server) start() error {
+	if s.debugger == nil {
+		return errors.New("no program launched")
+	}
+	if s.started {
+		return nil
+	}
+	s.started = true
+	s.debugger.Start(s.entry)
+
+	go func() {
+		for {
+			stop := s.debugger.Wait()
+			if stop.Reason == debug.Exited {
+				s.exit(stop)
+				return
+			}
+			s.mu.Lock()
+			s.stopped = true
+			s.mu.Unlock()
+			s.send("stopped", &StoppedEventBody{stop.Reason.String(), stop.Desc, threadID, true})
+		}
+	}()
+	return nil
+}
+
+func (s *Server) exit(stop debug.Stop) {
+	code := int(stop.Value)
+	if stop.Err != nil {
+		s.send("output", &OutputEventBody{"stderr", stop.Err.Error() + "\n"})
+		code = 1
+		if e, ok := stop.Err.(*runtime.Exit); ok {
+			code = int(e.Code)
+		}
+	}
+	s.send("exited", &ExitedEventBody{code})
+	s.send("terminated", nil)
+	close(s.exited)
+}
+
+func (s *Server) step(command string) (interface{}, error) {
+	if s.debugger == nil || !s.isStopped() {
+		return nil, errors.New("the program is not stopped")
+	}
+	s.mu.Lock()
+	s.stopped = false
+	s.mu.Unlock()
+	s.refs = nil
+
+	d := s.debugger
+	switch command {
+	case "continue":
+		s.resume = d.Continue
+		return &ContinueResponseBody{true}, nil
+	case "next":
+		s.resume = d.StepOver
+	case "stepIn":
+		s.resume = d.StepIn
+	case "stepOut":
+		s.resume = d.StepOut
+	}
+	return nil, nil
+}
+
+// Stop the program, if it is running, and wait for it to exit.
+func (s *Server) terminate() {
+	if s.debugger == nil || !s.started {
+		return
+	}
+	select {
+	case <-s.exited:
+		return
+	default:
+	}
+	if s.isStopped() {
+		s.mu.Lock()
+		s.stopped = false
+		s.mu.Unlock()
+		s.debugger.Kill()
+	} else {
+		s.debugger.Interrupt()
+	}
+	<-s.exited
+}
+
+// Return the active calls, innermost first.
+func (s *Server) frames() []*interp.Frame {
+	frames := s.debugger.Interp().Frames()
+	list := make([]*interp.Frame, len(frames))
+	for i, f := range frames {
+		list[len(frames)-1-i] = f
+	}
+	return list
+}
+
+func (s *Server) stackTrace() (interface{}, error) {
+	if err := s.inspectable(); err != nil {
+		return nil, err
+	}
+	frames := []StackFrame{}
+	for i, f := range s.frames() {
+		frames = append(frames, StackFrame{i + 1, f.Name, source(s.debugger.File(f)),
+			f.Pos.Line - 1 + s.lineBase, f.Pos.Column - 1 + s.colBase})
+	}
+	return &StackTraceResponseBody{frames, len(frames)}, nil
+}
+
+// Return the frame with an identifier, or nil for the top level.
+func (s *Server) frame(id int) (*interp.Frame, error) {
+	if id == 0 {
+		return nil, nil
+	}
+	frames := s.frames()
+	if id < 0 || id > len(frames) {
+		return nil, fmt.Errorf("no frame %d", id)
+	}
+	return frames[id-1], nil
+}
+
+func (s *Server) ref(r varRef) int {
+	if s.refs == nil {
+		s.refs = make(map[int]varRef)
+	}
+	id := len(s.refs) + 1
+	s.refs[id] = r
+	return id
+}
+
+func (s *Server) scopes(a *ScopesArguments) (interface{}, error) {
+	if err := s.inspectable(); err != nil {
+		return nil, err
+	}
+	f, err := s.frame(a.FrameID)
+	if err != nil {
+		return nil, err
+	}
+	var scopes []Scope
+	if f != nil {
+		scopes = append(scopes, Scope{"Locals", s.ref(varRef{frame: f}), false})
+	}
+	scopes = append(scopes, Scope{"Globals", s.ref(varRef{globals: true}), false})
+	return &ScopesResponseBody{scopes}, nil
+}
+
+func (s *Server) variable(v interp.Variable) Variable {
+	value := strconv.FormatInt(int64(v.Value), 10)
+	if v.Vec > 0 {
+		value = fmt.Sprintf("vec %d @ %d", v.Vec-1, v.Value)
+		n := v.Vec
+		if n > maxElements {
+			n = maxElements
+		}
+		return Variable{v.Name, value, s.ref(varRef{vec: v.Value, size: n}), n}
+	}
+	return Variable{v.Name, value, 0, 0}
+}
+
+func (s *Server) variables(a *VariablesArguments) (interface{}, error) {
+	if err := s.inspectable(); err != nil {
+		return nil, err
+	}
+	r, ok := s.refs[a.VariablesReference]
+	if !ok {
+		return nil, fmt.Errorf("no variables reference %d", a.VariablesReference)
+	}
+	in := s.debugger.Interp()
+	vars := []Variable{}
+	switch {
+	case r.frame != nil:
+		for _, v := range in.Locals(r.frame) {
+			vars = append(vars, s.variable(v))
+		}
+	case r.globals:
+		for _, v := range in.Globals() {
+			vars = append(vars, s.variable(v))
+		}
+	default:
+		for i := 0; i < r.size; i++ {
+			val, ok := in.Peek(r.vec + runtime.Word(i))
+			if !ok {
+				break
+			}
+			vars = append(vars, Variable{strconv.Itoa(i), strconv.FormatInt(int64(val), 10), 0, 0})
+		}
+	}
+	return &VariablesResponseBody{vars}, nil
+}
+
+func (s *Server) evaluate(a *EvaluateArguments) (interface{}, error) {
+	if err := s.inspectable(); err != nil {
+		return nil, err
+	}
+	f, err := s.frame(a.FrameID)
+	if err != nil {
+		return nil, err
+	}
+	e, err := parser.ParseExpr([]byte(a.Expression))
+	if err != nil {
+		return nil, err
+	}
+	val, err := s.debugger.Interp().EvalIn(f, e)
+	if err != nil {
+		return nil, err
+	}
+	return &EvaluateResponseBody{strconv.FormatInt(int64(val), 10), 0}, nil
+}
@@ -0,0 +1,348 @@
+// Copyright 2015 Meador Inge.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package dap
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Helper test functions.
+
+type testMessage struct {
+	Seq        int             `json:"seq"`
+	Type       string          `json:"type"`
+	RequestSeq int             `json:"request_seq"`
+	Success    bool            `json:"success"`
+	Command    string          `json:"command"`
+	Message    string          `json:"message"`
+	Event      string          `json:"event"`
+	Body       json.RawMessage `json:"body"`
+}
+
+// A client talking to a server over pipes.
+type client struct {
+	t      *testing.T
+	in     io.Writer
+	out    *bufio.Reader
+	seq    int
+	events []testMessage // The events received so far.
+	done   chan error
+}
+
+func newClient(t *testing.T) *client {
+	inr, inw := io.Pipe()
+	outr, outw := io.Pipe()
+	c := &client{t: t, in: inw, out: bufio.NewReader(outr), done: make(chan error, 1)}
+	go func() {
+		var s Server
+		s.Init(inr, outw)
+		err := s.Serve()
+		outw.Close()
+		c.done <- err
+	}()
+	return c
+}
+
+func (c *client) read() testMessage {
+	body, err := readMessage(c.out)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	var msg testMessage
+	if err := json.Unmarshal(body, &msg); err != nil {
+		c.t.Fatal(err)
+	}
+	return msg
+}
+
+// Send a request and return the body of its response.
+func (c *client) call(command string, args interface{}, body interface{}) testMessage {
+	c.seq++
+	req := map[string]interface{}{"seq": c.seq, "type": "request", "command": command, "arguments": args}
+	if err := writeMessage(c.in, req); err != nil {
+		c.t.Fatal(err)
+	}
+	for {
+		msg := c.read()
+		if msg.Type == "event" {
+			c.events = append(c.events, msg)
+			continue
+		}
+		if msg.RequestSeq != c.seq {
+			c.t.Fatalf("response to request %d, expected %d", msg.RequestSeq, c.seq)
+		}
+		if body != nil {
+			if !msg.Success {
+				c.t.Fatalf("%s failed: %s", command, msg.Message)
+			}
+			if len(msg.Body) > 0 {
+				if err := json.Unmarshal(msg.Body, body); err != nil {
+					c.t.Fatal(err)
+				}
+			}
+		}
+		return msg
+	}
+}
+
+// Wait for an event and return it.
+func (c *client) wait(name string, body interface{}) {
+	for {
+		var msg testMessage
+		if len(c.events) > 0 {
+			msg, c.events = c.events[0], c.events[1:]
+		} else {
+			msg = c.read()
+		}
+		if msg.Type == "event" && msg.Event == name {
+			if body != nil {
+				if err := json.Unmarshal(msg.Body, body); err != nil {
+					c.t.Fatal(err)
+				}
+			}
+			return
+		}
+	}
+}
+
+// Wait for the program to stop and return the line.
+func (c *client) stopped(reason string) int {
+	var stop StoppedEventBody
+	c.wait("stopped", &stop)
+	if stop.Reason != reason {
+		c.t.Fatalf("stopped for %s, expected %s", stop.Reason, reason)
+	}
+	var trace StackTraceResponseBody
+	c.call("stackTrace", map[string]int{"threadId": threadID}, &trace)
+	return trace.StackFrames[0].Line
+}
+
+var test_program_str = `global $( Count: 100 $)
+
+let Square(N) = N * N
+
+let Sum(N) =
+  N = 0 -> 0,
+  Square(N) + Sum(N - 1)
+
+let start() = writen(Sum(3))
+and V = vec 2
+`
+
+// Launch the test program, with breakpoints on the given lines.
+func launch(t *testing.T, stopOnEntry bool, lines ...int) (*client, string) {
+	return launchProgram(t, test_program_str, stopOnEntry, lines...)
+}
+
+// Launch a program, with breakpoints on the given lines.
+func launchProgram(t *testing.T, src string, stopOnEntry bool, lines ...int) (*client, string) {
+	dir, err := ioutil.TempDir("", "dap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "sum.b")
+	if err := ioutil.WriteFile(path, []byte(src), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	c := newClient(t)
+	var caps Capabilities
+	c.call("initialize", map[string]string{"adapterID": "bclang"}, &caps)
+	if !caps.SupportsConfigurationDoneRequest || !caps.SupportsDataBreakpoints {
+		t.Errorf("bad capabilities %v", caps)
+	}
+	c.call("launch", map[string]interface{}{"program": path, "stopOnEntry": stopOnEntry}, &struct{}{})
+	c.wait("initialized", nil)
+
+	var bps []SourceBreakpoint
+	for _, line := range lines {
+		bps = append(bps, SourceBreakpoint{line})
+	}
+	var resp BreakpointsResponseBody
+	c.call("setBreakpoints", &SetBreakpointsArguments{Source{"sum.b", path}, bps}, &resp)
+	for i, bp := range resp.Breakpoints {
+		if bp.Line != lines[i] {
+			t.Errorf("breakpoint at line %d, expected %d", bp.Line, lines[i])
+		}
+	}
+	c.call("configurationDone", nil, &struct{}{})
+	return c, dir
+}
+
+func finish(t *testing.T, c *client, dir string, code int) {
+	var exited ExitedEventBody
+	c.wait("exited", &exited)
+	if exited.ExitCode != code {
+		t.Errorf("exit code %d, expected %d", exited.ExitCode, code)
+	}
+	c.wait("terminated", nil)
+	c.call("disconnect", nil, &struct{}{})
+	if err := <-c.done; err != nil {
+		t.Error(err)
+	}
+	os.RemoveAll(dir)
+}
+
+func TestBreakpoints(t *testing.T) {
+	c, dir := launch(t, false, 1, 3)
+	for i := 0; i < 3; i++ {
+		if line := c.stopped("breakpoint"); line != 3 {
+			t.Fatalf("stopped at line %d", line)
+		}
+		c.call("continue", map[string]int{"threadId": threadID}, &ContinueResponseBody{})
+	}
+	var out OutputEventBody
+	c.wait("output", &out)
+	if out.Output != "14" {
+		t.Errorf("got output %q", out.Output)
+	}
+	finish(t, c, dir, 0)
+}
+
+func TestStepping(t *testing.T) {
+	c, dir := launch(t, true)
+	lines := []int{c.stopped("entry")}
+	for _, command := range []string{"stepIn", "next", "stepIn", "stepOut", "stepOut"} {
+		c.call(command, map[string]int{"threadId": threadID}, nil)
+		lines = append(lines, c.stopped("step"))
+	}
+	if !reflect.DeepEqual(lines, []int{9, 6, 7, 3, 7, 9}) {
+		t.Errorf("stepped through lines %v", lines)
+	}
+	c.call("continue", map[string]int{"threadId": threadID}, nil)
+	finish(t, c, dir, 0)
+}
+
+func TestVariables(t *testing.T) {
+	c, dir := launch(t, false, 3)
+	c.stopped("breakpoint")
+
+	var scopes ScopesResponseBody
+	c.call("scopes", map[string]int{"frameId": 1}, &scopes)
+	if len(scopes.Scopes) != 2 || scopes.Scopes[0].Name != "Locals" {
+		t.Fatalf("bad scopes %v", scopes)
+	}
+	var vars VariablesResponseBody
+	c.call("variables", map[string]int{"variablesReference": scopes.Scopes[0].VariablesReference}, &vars)
+	if !reflect.DeepEqual(vars.Variables, []Variable{{"N", "3", 0, 0}}) {
+		t.Errorf("bad locals %v", vars.Variables)
+	}
+
+	globals := scopes.Scopes[1].VariablesReference
+	c.call("variables", map[string]int{"variablesReference": globals}, &vars)
+	var names []string
+	var vec Variable
+	for _, v := range vars.Variables {
+		names = append(names, v.Name)
+		if v.Name == "V" {
+			vec = v
+		}
+	}
+	if !reflect.DeepEqual(names, []string{"Count", "Square", "Sum", "V", "start"}) {
+		t.Errorf("bad globals %v", names)
+	}
+	c.call("variables", map[string]int{"variablesReference": vec.VariablesReference}, &vars)
+	if len(vars.Variables) != 3 || vars.Variables[2].Name != "2" {
+		t.Errorf("bad vector elements %v", vars.Variables)
+	}
+
+	var info DataBreakpointInfoResponseBody
+	c.call("dataBreakpointInfo", map[string]interface{}{"variablesReference": globals, "name": "Count"}, &info)
+	if info.DataID == nil || *info.DataID != "100" {
+		t.Errorf("bad data breakpoint info %v", info)
+	}
+	c.call("setDataBreakpoints", &SetDataBreakpointsArguments{[]DataBreakpoint{{"100"}}}, &BreakpointsResponseBody{})
+
+	var result EvaluateResponseBody
+	c.call("evaluate", map[string]interface{}{"expression": "Square(N + 1)", "frameId": 2}, &result)
+	if result.Result != "16" {
+		t.Errorf("evaluated to %s in frame 2", result.Result)
+	}
+	if msg := c.call("evaluate", map[string]interface{}{"expression": "Z"}, nil); msg.Success {
+		t.Errorf("expected an error evaluating an undeclared name")
+	}
+
+	c.call("disconnect", nil, &struct{}{})
+	if err := <-c.done; err != nil {
+		t.Error(err)
+	}
+	os.RemoveAll(dir)
+}
+
+// The locals of a frame include the names defined in the blocks the
+// command stopped at is in.
+func TestBlockLocals(t *testing.T) {
+	src := "let start() be $(\n  let X = 41\n  let Y = vec 3\n  writen(X + 1)\n$)\n"
+	c, dir := launchProgram(t, src, false, 4)
+	c.stopped("breakpoint")
+
+	var scopes ScopesResponseBody
+	c.call("scopes", map[string]int{"frameId": 1}, &scopes)
+	var vars VariablesResponseBody
+	c.call("variables", map[string]int{"variablesReference": scopes.Scopes[0].VariablesReference}, &vars)
+	if len(vars.Variables) != 2 || vars.Variables[0] != (Variable{"X", "41", 0, 0}) ||
+		vars.Variables[1].Name != "Y" || vars.Variables[1].IndexedVariables != 4 {
+		t.Errorf("bad locals %v", vars.Variables)
+	}
+
+	c.call("continue", map[string]int{"threadId": threadID}, nil)
+	var out OutputEventBody
+	c.wait("output", &out)
+	if out.Output != "42" {
+		t.Errorf("got output %q", out.Output)
+	}
+	finish(t, c, dir, 0)
+}
+
+// The program is linked from two files, each with a line 3.
+func TestSections(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	main := filepath.Join(dir, "main.b")
+	square := filepath.Join(dir, "square.b")
+	for path, src := range map[string]string{
+		main:   "global $( Square: 200 $)\n\nlet start() = writen(Square(3))\n",
+		square: "global $( Square: 200 $)\n\nlet Square(N) = N * N\n",
+	} {
+		if err := ioutil.WriteFile(path, []byte(src), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := newClient(t)
+	c.call("initialize", map[string]string{"adapterID": "bclang"}, &Capabilities{})
+	c.call("launch", map[string]interface{}{"program": main, "sections": []string{square}}, &struct{}{})
+	c.wait("initialized", nil)
+	var resp BreakpointsResponseBody
+	c.call("setBreakpoints", &SetBreakpointsArguments{Source{"square.b", square}, []SourceBreakpoint{{3}}}, &resp)
+	if len(resp.Breakpoints) != 1 || !resp.Breakpoints[0].Verified {
+		t.Errorf("bad breakpoints %v", resp.Breakpoints)
+	}
+	c.call("configurationDone", nil, &struct{}{})
+
+	var stop StoppedEventBody
+	c.wait("stopped", &stop)
+	var trace StackTraceResponseBody
+	c.call("stackTrace", map[string]int{"threadId": threadID}, &trace)
+	var got []string
+	for _, f := range trace.StackFrames {
+		got = append(got, fmt.Sprintf("%s:%d", f.Source.Name, f.Line))
+	}
+	if !reflect.DeepEqual(got, []string{"square.b:3", "main.b:3"}) {
+		t.Errorf("got stack %v", got)
+	}
+	c.call("continue", map[string]int{"threadId": threadID}, nil)
+	finish(t, c, dir, 0)
+}
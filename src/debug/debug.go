@@ -0,0 +1,361 @@
+// Copyright 2015 Meador Inge.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+// Package debug implements a source-level debugger for BCPL programs
+// run by the interpreter.
+//
+// The program runs in its own goroutine and stops at the events
+// reported by the interpreter: before each call, on entry to each
+// function body and after each call returns.  A stop is caused by a
+// breakpoint on the line of the event, by the completion of a step,
+// by a change to a watched cell of the global vector or by a request
+// to pause.  While the program is stopped its call stack, variables
+// and store may be inspected through Interp.
+package debug
+
+import (
+	"errors"
+	"fmt"
+	"github.com/meadori/bcpl-go/src/ast"
+	"github.com/meadori/bcpl-go/src/interp"
+	"github.com/meadori/bcpl-go/src/link"
+	"github.com/meadori/bcpl-go/src/parser"
+	"github.com/meadori/bcpl-go/src/runtime"
+	"github.com/meadori/bcpl-go/src/token"
+	"io"
+	"sort"
+	"sync"
+)
+
+// Why the program stopped.
+type Reason int
+
+const (
+	Entry      Reason = iota // Stopped on entry to start.
+	Breakpoint               // Reached a breakpoint.
+	Step                     // Completed a step.
+	Watchpoint               // A watched cell changed.
+	Pause                    // Paused on request.
+	Exited                   // The program finished.
+)
+
+var reasons = [...]string{
+	Entry:      "entry",
+	Breakpoint: "breakpoint",
+	Step:       "step",
+	Watchpoint: "data breakpoint",
+	Pause:      "pause",
+	Exited:     "exited",
+}
+
+func (r Reason) String() string {
+	return reasons[r]
+}
+
+// A stop of the program.
+type Stop struct {
+	Reason Reason
+	File   string         // The file where the program stopped.
+	Pos    token.Position // Where the program stopped, in File.
+	Desc   string         // A description of a watchpoint stop.
+	Value  runtime.Word   // The result of start, when the program exited.
+	Err    error          // The error that ended the program, if any.
+}
+
+// How to resume the program.
+type action int
+
+const (
+	stepNone action = iota // Run until a breakpoint.
+	stepIn                 // Stop at the next event on another line.
+	stepOver               // Stop at the next line in this call or a caller.
+	stepOut                // Stop when this call returns.
+	kill                   // Stop the program.
+)
+
+// The error that stops a killed program.
+var errKilled = errors.New("program killed")
+
+// A source file of the program, compiled as a separate section.
+type File struct {
+	Name string
+	Src  []byte
+}
+
+type Debugger struct {
+	Dialect token.Dialect // The dialect of the source, used by Init.
+
+	interp interp.Interp           // The interpreter running the program.
+	files  map[*ast.Program]string // The file of each section.
+	lines  map[string]map[int]bool // The lines of each file where the program can stop.
+	stops  chan Stop               // The stops of the running program.
+	resume chan action             // How to resume the stopped program.
+
+	// The stepping state, used only by the program's goroutine.
+	step      action
+	stepFile  string
+	stepLine  int
+	stepDepth int
+	lastFile  string
+	lastLine  int
+	lastDepth int
+
+	mu      sync.Mutex                    // Guards the fields below.
+	breaks  map[string]map[int]bool       // The lines of each file with breakpoints.
+	watches map[runtime.Word]runtime.Word // Watched cells and their last values.
+	pause   bool                          // Stop at the next event.
+	killed  bool                          // Stop the program at the next event.
+}
+
+// Parse the files of a program, link them and load the program to
+// be debugged, as bclang run does.  The program reads from in and
+// writes to out.
+func (d *Debugger) Init(files []File, in io.Reader, out io.Writer) error {
+	var sections []link.Section
+	d.files = make(map[*ast.Program]string)
+	d.lines = make(map[string]map[int]bool)
+	for _, f := range files {
+		var p parser.Parser
+		p.Dialect = d.Dialect
+		p.Init(f.Src)
+		prog := p.Parse()
+		if err := p.Errors.Err(); err != nil {
+			return fmt.Errorf("%s:%v", f.Name, err)
+		}
+		sections = append(sections, link.Section{f.Name, prog})
+		d.files[prog] = f.Name
+		d.lines[f.Name] = lines(prog)
+	}
+	img, err := link.Link(sections)
+	if err != nil {
+		return err
+	}
+	d.interp.Init(in, out)
+	if err := img.Load(&d.interp); err != nil {
+		return err
+	}
+
+	d.stops = make(chan Stop)
+	d.resume = make(chan action)
+	d.breaks = make(map[string]map[int]bool)
+	d.watches = make(map[runtime.Word]runtime.Word)
+	d.pause, d.killed = false, false
+	return nil
+}
+
+// Return the lines of a section where the program can stop: the
+// first line of each function body and the lines of its calls and
+// commands.
+func lines(prog *ast.Program) map[int]bool {
+	lines := make(map[int]bool)
+	for _, def := range prog.Defs {
+		ast.Inspect(def, func(n ast.Node) bool {
+			var body ast.Node
+			switch n := n.(type) {
+			case *ast.FuncDef:
+				body = n.Body
+			case *ast.RoutineDef:
+				body = n.Body
+			default:
+				return true
+			}
+			lines[body.Pos().Line] = true
+			ast.Inspect(body, func(n ast.Node) bool {
+				switch n := n.(type) {
+				case *ast.CallExpr:
+					lines[n.Pos().Line] = true
+				case *ast.BlockCmd, *ast.LabelCmd, *ast.CaseCmd:
+				case ast.Cmd:
+					lines[n.Pos().Line] = true
+				}
+				return true
+			})
+			return false
+		})
+	}
+	return lines
+}
+
+// Return the interpreter running the program.  It may only be used
+// while the program is stopped.
+func (d *Debugger) Interp() *interp.Interp {
+	return &d.interp
+}
+
+// Return the file of the section defining the function of a frame.
+func (d *Debugger) File(f *interp.Frame) string {
+	return d.files[f.Section]
+}
+
+// Return the lines of a file where the program can stop, in order.
+func (d *Debugger) Lines(file string) []int {
+	var lines []int
+	for line := range d.lines[file] {
+		lines = append(lines, line)
+	}
+	sort.Ints(lines)
+	return lines
+}
+
+// Replace the breakpoints of a file, reporting for each line whether
+// the program can stop there.
+func (d *Debugger) SetBreakpoints(file string, lines []int) []bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	verified := make([]bool, len(lines))
+	breaks := make(map[int]bool)
+	for i, line := range lines {
+		if d.lines[file][line] {
+			breaks[line] = true
+			verified[i] = true
+		}
+	}
+	d.breaks[file] = breaks
+	return verified
+}
+
+// Replace the watchpoints by ones on the given cells of the global
+// vector.
+func (d *Debugger) SetWatchpoints(globals []int) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	watches := make(map[runtime.Word]runtime.Word)
+	for _, n := range globals {
+		if n < 0 || n >= runtime.NumGlobals {
+			return fmt.Errorf("global %d is not in the global vector", n)
+		}
+		val, _ := d.interp.Peek(runtime.Word(n))
+		watches[runtime.Word(n)] = val
+	}
+	d.watches = watches
+	return nil
+}
+
+// Start running the program, stopping on entry to start if
+// stopOnEntry is set.
+func (d *Debugger) Start(stopOnEntry bool) {
+	if stopOnEntry {
+		d.step = stepIn
+	} else {
+		d.step = stepNone
+	}
+	d.stepFile, d.stepLine, d.stepDepth = "", -1, -1
+	d.lastFile, d.lastLine, d.lastDepth = "", -1, -1
+	d.interp.Trace = d.trace
+
+	go func() {
+		val, err := d.interp.Start()
+		d.stops <- Stop{Reason: Exited, Value: val, Err: err}
+	}()
+}
+
+// Wait for the program to stop or exit.  After it exits Wait must
+// not be called again.
+func (d *Debugger) Wait() Stop {
+	return <-d.stops
+}
+
+// Resume the stopped program until the next breakpoint.
+func (d *Debugger) Continue() { d.resume <- stepNone }
+
+// Resume the stopped program until it reaches another line, in
+// this call or any other.
+func (d *Debugger) StepIn() { d.resume <- stepIn }
+
+// Resume the stopped program until it reaches another line in this
+// call, or this call returns.
+func (d *Debugger) StepOver() { d.resume <- stepOver }
+
+// Resume the stopped program until this call returns.
+func (d *Debugger) StepOut() { d.resume <- stepOut }
+
+// Stop the stopped program, which then exits with an error.
+func (d *Debugger) Kill() { d.resume <- kill }
+
+// Ask the running program to stop at the next event; if the program
+// is stopped, ask it to stop again when resumed.
+func (d *Debugger) Pause() {
+	d.mu.Lock()
+	d.pause = true
+	d.mu.Unlock()
+}
+
+// Ask the running program to exit at the next event.
+func (d *Debugger) Interrupt() {
+	d.mu.Lock()
+	d.killed = true
+	d.mu.Unlock()
+}
+
+// Decide whether to stop at an event.
+func (d *Debugger) check(file string, pos token.Position, depth int) (Reason, string, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	newLine := file != d.lastFile || pos.Line != d.lastLine || depth != d.lastDepth
+	otherLine := file != d.stepFile || pos.Line != d.stepLine
+	switch {
+	case d.pause:
+		d.pause = false
+		return Pause, "", true
+	case d.step == stepIn && (otherLine || depth != d.stepDepth):
+		if d.stepDepth < 0 {
+			return Entry, "", true
+		}
+		return Step, "", true
+	case d.step == stepOver && (depth < d.stepDepth || depth == d.stepDepth && otherLine):
+		return Step, "", true
+	case d.step == stepOut && depth < d.stepDepth:
+		return Step, "", true
+	}
+
+	var addrs []runtime.Word
+	for addr := range d.watches {
+		addrs = append(addrs, addr)
+	}
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i] < addrs[j] })
+	for _, addr := range addrs {
+		old := d.watches[addr]
+		if val, _ := d.interp.Peek(addr); val != old {
+			d.watches[addr] = val
+			return Watchpoint, fmt.Sprintf("global %d changed from %d to %d", addr, old, val), true
+		}
+	}
+
+	if d.breaks[file][pos.Line] && newLine {
+		return Breakpoint, "", true
+	}
+	return 0, "", false
+}
+
+// The tracer of the program.
+func (d *Debugger) trace(ev interp.Event, pos token.Position) error {
+	d.mu.Lock()
+	killed := d.killed
+	d.mu.Unlock()
+	if killed {
+		return errKilled
+	}
+
+	frames := d.interp.Frames()
+	depth := len(frames)
+	var file string
+	if depth > 0 {
+		file = d.File(frames[depth-1])
+	}
+	reason, desc, stop := d.check(file, pos, depth)
+	d.lastFile, d.lastLine, d.lastDepth = file, pos.Line, depth
+	if !stop {
+		return nil
+	}
+
+	d.interp.Flush()
+	d.stops <- Stop{Reason: reason, File: file, Pos: pos, Desc: desc}
+	act := <-d.resume
+	if act == kill {
+		return errKilled
+	}
+	d.step, d.stepFile, d.stepLine, d.stepDepth = act, file, pos.Line, depth
+	return nil
+}
@@ -0,0 +1,232 @@
+// Copyright 2015 Meador Inge.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package debug
+
+import (
+	"bytes"
+	"github.com/meadori/bcpl-go/src/parser"
+	"github.com/meadori/bcpl-go/src/runtime"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var test_program_str = `global $( Count: 100 $)
+
+let Square(N) = N * N
+
+let Sum(N) =
+  N = 0 -> 0,
+  Square(N) + Sum(N - 1)
+
+let start() = valueof(Sum(3))
+and valueof(X) = writen(X)
+`
+
+// Make a debugger for a program with files of the given sources,
+// named a.b, b.b and so on.
+func newTestDebugger(t *testing.T, srcs ...string) (*Debugger, *bytes.Buffer) {
+	var d Debugger
+	var out bytes.Buffer
+	var files []File
+	for i, src := range srcs {
+		files = append(files, File{string(rune('a'+i)) + ".b", []byte(src)})
+	}
+	if err := d.Init(files, strings.NewReader(""), &out); err != nil {
+		t.Fatal(err)
+	}
+	return &d, &out
+}
+
+// Check that the program stopped at a line with a given call depth.
+func expectStop(t *testing.T, d *Debugger, reason Reason, line, depth int) {
+	stop := d.Wait()
+	if stop.Reason != reason || stop.Pos.Line != line {
+		t.Fatalf("got %s stop at line %d, expected %s at line %d", stop.Reason, stop.Pos.Line, reason, line)
+	}
+	if n := len(d.Interp().Frames()); n != depth {
+		t.Fatalf("got depth %d at line %d, expected %d", n, line, depth)
+	}
+}
+
+func expectExit(t *testing.T, d *Debugger, output string, out *bytes.Buffer) {
+	stop := d.Wait()
+	if stop.Reason != Exited || stop.Err != nil {
+		t.Fatalf("got %s stop with error %v, expected exit", stop.Reason, stop.Err)
+	}
+	if out.String() != output {
+		t.Errorf("got output %q, expected %q", out.String(), output)
+	}
+}
+
+func TestLines(t *testing.T) {
+	d, _ := newTestDebugger(t, test_program_str)
+	if lines := d.Lines("a.b"); !reflect.DeepEqual(lines, []int{3, 6, 7, 9, 10}) {
+		t.Errorf("got lines %v", lines)
+	}
+	if verified := d.SetBreakpoints("a.b", []int{1, 7}); !reflect.DeepEqual(verified, []bool{false, true}) {
+		t.Errorf("got verified %v", verified)
+	}
+}
+
+func TestBreakpoints(t *testing.T) {
+	d, out := newTestDebugger(t, test_program_str)
+	d.SetBreakpoints("a.b", []int{3})
+	d.Start(false)
+	for _, depth := range []int{3, 4, 5} {
+		expectStop(t, d, Breakpoint, 3, depth)
+		locals := d.Interp().Locals(d.Interp().Frames()[depth-1])
+		if len(locals) != 1 || locals[0].Name != "N" || locals[0].Value != runtime.Word(6-depth) {
+			t.Errorf("bad locals %v", locals)
+		}
+		d.Continue()
+	}
+	expectExit(t, d, "14", out)
+}
+
+var test_locals_str = `let start() be $(
+   let X = 41
+   let Y = vec 3
+   for I = 1 to 2 do
+      writen(X + I)
+$)
+`
+
+// The locals of a call include the names of the blocks and for
+// commands the command stopped at is in.
+func TestLocals(t *testing.T) {
+	d, out := newTestDebugger(t, test_locals_str)
+	d.SetBreakpoints("a.b", []int{5})
+	d.Start(false)
+	expectStop(t, d, Breakpoint, 5, 1)
+	locals := d.Interp().Locals(d.Interp().Frames()[0])
+	if len(locals) != 3 || locals[0].Name != "X" || locals[0].Value != 41 ||
+		locals[1].Name != "Y" || locals[1].Vec != 4 ||
+		locals[2].Name != "I" || locals[2].Value != 1 {
+		t.Errorf("bad locals %v", locals)
+	}
+	d.SetBreakpoints("a.b", nil)
+	d.Continue()
+	expectExit(t, d, "4243", out)
+}
+
+var test_sections_str = []string{`global $( Square: 200 $)
+
+let start() = writen(Square(3))
+`, `global $( Square: 200 $)
+
+let Square(N) = N * N
+`}
+
+// A breakpoint is on a line of one file, so the same line of another
+// file does not stop the program.
+func TestSections(t *testing.T) {
+	d, out := newTestDebugger(t, test_sections_str...)
+	if lines := d.Lines("b.b"); !reflect.DeepEqual(lines, []int{3}) {
+		t.Errorf("got lines %v", lines)
+	}
+	if verified := d.SetBreakpoints("b.b", []int{3}); !reflect.DeepEqual(verified, []bool{true}) {
+		t.Errorf("got verified %v", verified)
+	}
+	d.Start(false)
+	stop := d.Wait()
+	if stop.Reason != Breakpoint || stop.File != "b.b" || stop.Pos.Line != 3 {
+		t.Fatalf("got %s stop at %s:%d, expected a breakpoint at b.b:3", stop.Reason, stop.File, stop.Pos.Line)
+	}
+	frames := d.Interp().Frames()
+	if len(frames) != 2 || d.File(frames[0]) != "a.b" || d.File(frames[1]) != "b.b" {
+		t.Errorf("bad frames %v", frames)
+	}
+	d.Continue()
+	expectExit(t, d, "9", out)
+}
+
+func TestStepping(t *testing.T) {
+	d, out := newTestDebugger(t, test_program_str)
+	d.Start(true)
+	expectStop(t, d, Entry, 9, 1)
+	d.StepIn()
+	expectStop(t, d, Step, 6, 2) // Sum(3)
+	d.StepOver()
+	expectStop(t, d, Step, 7, 2) // Square(3) + Sum(2)
+	d.StepIn()
+	expectStop(t, d, Step, 3, 3) // in Square
+	d.StepOut()
+	expectStop(t, d, Step, 7, 2) // back in Sum
+	d.StepOut()
+	expectStop(t, d, Step, 9, 1) // back in start
+	d.Continue()
+	expectExit(t, d, "14", out)
+}
+
+func TestInspect(t *testing.T) {
+	d, _ := newTestDebugger(t, test_program_str)
+	d.SetBreakpoints("a.b", []int{3})
+	d.Start(false)
+	expectStop(t, d, Breakpoint, 3, 3)
+
+	globals := d.Interp().Globals()
+	if len(globals) != 5 || globals[0].Name != "Count" || !globals[0].Global {
+		t.Errorf("bad globals %v", globals)
+	}
+	e, err := parser.ParseExpr([]byte("Square(N) + N"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	frames := d.Interp().Frames()
+	if val, err := d.Interp().EvalIn(frames[len(frames)-1], e); err != nil || val != 12 {
+		t.Errorf("got %d, %v evaluating in Square(3)", val, err)
+	}
+
+	d.Kill()
+	if stop := d.Wait(); stop.Reason != Exited || stop.Err == nil {
+		t.Errorf("expected the killed program to exit with an error, got %v", stop)
+	}
+}
+
+var test_watch_str = `global $( Buf: 100 $)
+
+let start() = unpackstring("ab", lv Buf) + writen(Buf)
+`
+
+func TestWatchpoints(t *testing.T) {
+	d, out := newTestDebugger(t, test_watch_str)
+	if err := d.SetWatchpoints([]int{1000}); err == nil {
+		t.Errorf("expected an error watching a cell outside the global vector")
+	}
+	if err := d.SetWatchpoints([]int{100}); err != nil {
+		t.Fatal(err)
+	}
+	d.Start(false)
+	stop := d.Wait()
+	if stop.Reason != Watchpoint || stop.Desc != "global 100 changed from 0 to 2" {
+		t.Fatalf("got %s stop %q", stop.Reason, stop.Desc)
+	}
+	d.Continue()
+	expectExit(t, d, "2", out)
+}
+
+var test_assign_str = `global $( Count: 100 $)
+
+let start() be
+$( writen(Count)
+   Count := 5
+   writen(Count)
+$)
+`
+
+func TestWatchAssignment(t *testing.T) {
+	d, out := newTestDebugger(t, test_assign_str)
+	if err := d.SetWatchpoints([]int{100}); err != nil {
+		t.Fatal(err)
+	}
+	d.Start(false)
+	stop := d.Wait()
+	if stop.Reason != Watchpoint || stop.Pos.Line != 6 || stop.Desc != "global 100 changed from 0 to 5" {
+		t.Fatalf("got %s stop at line %d %q", stop.Reason, stop.Pos.Line, stop.Desc)
+	}
+	d.Continue()
+	expectExit(t, d, "05", out)
+}
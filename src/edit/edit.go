@@ -0,0 +1,75 @@
+// Copyright 2015 Meador Inge.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+// Package edit applies edits to the source of a BCPL program, such as
+// the fixes suggested by syntax errors and by analyzers.
+//
+// An edit replaces a range of bytes of the source with new text; an
+// empty range inserts the text.  The ranges are byte offsets into the
+// original source, so the edits of a fix, and the fixes of several
+// diagnostics, may be applied together as long as they do not overlap.
+package edit
+
+import (
+	"fmt"
+	"sort"
+)
+
+// An edit replacing the bytes of a source from offset Pos up to End
+// with New.
+type Edit struct {
+	Pos, End int
+	New      string
+}
+
+// A fix for a problem: edits made together, with a message saying
+// what they do.
+type Fix struct {
+	Message string
+	Edits   []Edit
+}
+
+// Return the edits of the first fix of each of a list of problems,
+// as applied by a -fix flag.
+func First(fixes ...[]Fix) []Edit {
+	var edits []Edit
+	for _, list := range fixes {
+		if len(list) > 0 {
+			edits = append(edits, list[0].Edits...)
+		}
+	}
+	return edits
+}
+
+// Apply edits to a source, returning the new source.  The edits may
+// be in any order; insertions at the same offset are made in the
+// order given, and an edit given twice is made once.  It is an error
+// for an edit to lie outside the source or for two edits to overlap.
+func Apply(src []byte, edits []Edit) ([]byte, error) {
+	sorted := make([]Edit, len(edits))
+	copy(sorted, edits)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].Pos != sorted[j].Pos {
+			return sorted[i].Pos < sorted[j].Pos
+		}
+		return sorted[i].End < sorted[j].End
+	})
+
+	var out []byte
+	last := 0
+	for i, e := range sorted {
+		switch {
+		case e.Pos < 0 || e.End < e.Pos || e.End > len(src):
+			return nil, fmt.Errorf("edit of offsets %d to %d is outside the source", e.Pos, e.End)
+		case i > 0 && e == sorted[i-1]:
+			continue
+		case e.Pos < last:
+			return nil, fmt.Errorf("edits overlap at offset %d", e.Pos)
+		}
+		out = append(out, src[last:e.Pos]...)
+		out = append(out, e.New...)
+		last = e.End
+	}
+	return append(out, src[last:]...), nil
+}
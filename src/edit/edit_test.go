@@ -0,0 +1,58 @@
+// Copyright 2015 Meador Inge.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package edit
+
+import (
+	"testing"
+)
+
+var test_apply = []struct {
+	src   string
+	edits []Edit
+	out   string
+	err   string
+}{
+	{"let F() = (1 + 2", nil, "let F() = (1 + 2", ""},
+	{"let F() = (1 + 2", []Edit{{16, 16, ")"}}, "let F() = (1 + 2)", ""},
+	{"let V = vec 100", []Edit{{12, 15, "Size"}, {4, 5, "W"}}, "let W = vec Size", ""},
+	{"F(1)", []Edit{{2, 2, "0, "}, {2, 3, "2"}, {2, 2, "1, "}}, "F(0, 1, 2)", ""},
+	{"F(1)", []Edit{{2, 3, "2"}, {2, 3, "2"}}, "F(2)", ""},
+	{"F(1)", []Edit{{4, 4, ")"}, {4, 4, ")"}}, "F(1))", ""},
+	{"F(1)", []Edit{{0, 3, "G"}, {2, 4, ""}}, "", "edits overlap at offset 2"},
+	{"F(1)", []Edit{{3, 5, ""}}, "", "edit of offsets 3 to 5 is outside the source"},
+	{"F(1)", []Edit{{3, 2, ""}}, "", "edit of offsets 3 to 2 is outside the source"},
+}
+
+func TestApply(t *testing.T) {
+	for _, test := range test_apply {
+		out, err := Apply([]byte(test.src), test.edits)
+		switch {
+		case err != nil && err.Error() != test.err:
+			t.Errorf("%q %v: got error %q, expected %q", test.src, test.edits, err, test.err)
+		case err == nil && test.err != "":
+			t.Errorf("%q %v: expected error %q", test.src, test.edits, test.err)
+		case err == nil && string(out) != test.out:
+			t.Errorf("%q %v: got %q, expected %q", test.src, test.edits, out, test.out)
+		}
+	}
+}
+
+func TestFirst(t *testing.T) {
+	fixes := [][]Fix{
+		{{"insert", []Edit{{1, 1, ")"}}}, {"delete", []Edit{{0, 1, ""}}}},
+		nil,
+		{{"replace", []Edit{{2, 3, "K"}, {4, 4, " "}}}},
+	}
+	got := First(fixes...)
+	expected := []Edit{{1, 1, ")"}, {2, 3, "K"}, {4, 4, " "}}
+	if len(got) != len(expected) {
+		t.Fatalf("got %v, expected %v", got, expected)
+	}
+	for i := range got {
+		if got[i] != expected[i] {
+			t.Errorf("got %v, expected %v", got, expected)
+		}
+	}
+}
@@ -0,0 +1,1167 @@
+// Copyright 2015 Meador Inge.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+// Package interp evaluates BCPL declarations, definitions, expressions
+// and commands directly from their syntax trees.
+//
+// Every variable is a cell in the store of a runtime.Runtime, so
+// lv, rv and vector application behave as they do in compiled code.
+// Global names denote cells of the global vector, names declared by
+// static or defined at the top level by let denote static cells and
+// function parameters denote cells that live for the duration of a
+// call, as the names defined by let in a block live until the block
+// is left.  A call in tail position of a function body replaces the
+// activation of the function, so tail recursion runs in constant
+// space.  A goto may jump to a label of an item of a block
+// enclosing it, and a longjump to a label of a block of the activation
+// at its level, the calls made since being unwound.  The routines
+// declared in LIBHDR are predeclared.
+package interp
+
+import (
+	"fmt"
+	"github.com/meadori/bcpl-go/src/ast"
+	"github.com/meadori/bcpl-go/src/runtime"
+	"github.com/meadori/bcpl-go/src/token"
+	"io"
+	"strings"
+)
+
+// The values of the truth values.
+const (
+	True  runtime.Word = -1
+	False runtime.Word = 0
+)
+
+// An error detected while evaluating a tree.
+type Error struct {
+	Pos     token.Position
+	Msg     string
+	Section *ast.Program // The section of the function running, or nil.
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: error: %s", e.Pos, e.Msg)
+}
+
+// What a name denotes: either the cell at an address or,
+// for a manifest constant, a value.
+type binding struct {
+	addr     runtime.Word
+	value    runtime.Word
+	manifest bool
+	vec      int  // The number of words of a vector defined by vec, or 0.
+	lib      bool // Predeclared for a library routine.
+	static   bool // Declared by static.
+	label    bool // A label, whose value longjump jumps to.
+}
+
+// A scope maps names to bindings.  The scope of a function body
+// encloses only its parameters and the scope it was defined in.
+type scope struct {
+	outer *scope
+	names map[string]binding
+	cells []runtime.Word // The cells and vectors allocated for the names.
+	prog  *ast.Program   // The section whose names a section scope holds.
+}
+
+func newScope(outer *scope) *scope {
+	return &scope{outer, make(map[string]binding), nil, nil}
+}
+
+// Return the section a scope is nested in, or nil if it is not in one.
+func (s *scope) section() *ast.Program {
+	for ; s != nil; s = s.outer {
+		if s.prog != nil {
+			return s.prog
+		}
+	}
+	return nil
+}
+
+func (s *scope) lookup(name string) (binding, bool) {
+	for ; s != nil; s = s.outer {
+		if b, ok := s.names[name]; ok {
+			return b, true
+		}
+	}
+	return binding{}, false
+}
+
+type Interp struct {
+	Target   runtime.Target                   // The target machine, used by Init.
+	Trace    Tracer                           // Notified of evaluation events, or nil.
+	rt       runtime.Runtime                  // The runtime holding the store.
+	top      *scope                           // The top-level scope.
+	sections []*scope                         // The scopes of the loaded sections.
+	strings  map[*ast.StringExpr]runtime.Word // Allocated string constants.
+	labels   map[*ast.LabelCmd]runtime.Word   // The values of the labels.
+	jumps    map[runtime.Word]*ast.LabelCmd   // The labels by value.
+	frames   []*Frame                         // The active function calls.
+	procs    map[runtime.Word]*proc           // The functions and routines defined, by routine.
+}
+
+// The maximum depth of nested function calls.
+const MaxDepth = 10000
+
+// Initialize the interpreter with a fresh runtime for the target,
+// reading from input and writing to output, and predeclare the
+// library routines.
+func (in *Interp) Init(input io.Reader, output io.Writer) {
+	in.rt.Target = in.Target
+	in.rt.Init(input, output)
+	in.top = newScope(nil)
+	in.sections = nil
+	in.strings = make(map[*ast.StringExpr]runtime.Word)
+	in.labels = make(map[*ast.LabelCmd]runtime.Word)
+	in.jumps = make(map[runtime.Word]*ast.LabelCmd)
+	in.frames = nil
+	in.procs = make(map[runtime.Word]*proc)
+	in.top.names["start"] = binding{addr: runtime.StartGlobal, lib: true}
+	for _, g := range runtime.Library {
+		in.top.names[g.Name] = binding{addr: runtime.Word(g.Number), lib: true}
+	}
+}
+
+func (in *Interp) error(pos token.Position, format string, args ...interface{}) {
+	var section *ast.Program
+	if len(in.frames) > 0 {
+		section = in.frames[len(in.frames)-1].Section
+	}
+	panic(&Error{pos, fmt.Sprintf(format, args...), section})
+}
+
+// Evaluate fn, turning the errors it raises and the calls of stop
+// and faults in the routines it calls into an error.
+func (in *Interp) protect(fn func() runtime.Word) (val runtime.Word, err error) {
+	defer func() {
+		if x := recover(); x != nil {
+			e, ok := x.(*Error)
+			if !ok {
+				panic(x)
+			}
+			val, err = 0, e
+		}
+	}()
+	return in.rt.Protect(func() (val runtime.Word) {
+		defer in.uncaught(&val)
+		return fn()
+	})
+}
+
+// Allocate a cell holding val.
+func (in *Interp) cell(pos token.Position, val runtime.Word) runtime.Word {
+	addr := in.rt.Store.GetVec(0)
+	if addr == 0 {
+		in.error(pos, "out of store")
+	}
+	in.rt.Store.Put(addr, val)
+	return addr
+}
+
+// ----------------------------------------------------------------------------
+// Declarations and definitions
+
+// Add the declarations and definitions of a program to the
+// top-level scope.  Declarations and definitions made before an
+// error is reported remain in effect.
+func (in *Interp) Load(prog *ast.Program) error {
+	return in.load(in.top, prog)
+}
+
+// Load a program as a separately compiled section.  Its names are
+// private to it, so it shares only the cells of the global vector
+// with the other sections and the top-level scope.  Like every
+// section it starts with the library routines declared.
+func (in *Interp) LoadSection(prog *ast.Program) error {
+	s := newScope(in.top)
+	s.prog = prog
+	for name, b := range in.top.names {
+		if b.lib {
+			s.names[name] = b
+		}
+	}
+	in.sections = append(in.sections, s)
+	return in.load(s, prog)
+}
+
+func (in *Interp) load(s *scope, prog *ast.Program) error {
+	_, err := in.protect(func() runtime.Word {
+		for _, decl := range prog.Decls {
+			in.declare(s, decl)
+		}
+		for _, def := range prog.Defs {
+			in.define(s, def)
+		}
+		return 0
+	})
+	return err
+}
+
+func (in *Interp) declare(s *scope, decl ast.Decl) {
+	for _, v := range decl.VarDecls() {
+		switch decl.(type) {
+		case *ast.GlobalDecl:
+			if v.Constant < 0 || v.Constant >= runtime.NumGlobals {
+				in.error(v.NamePos, "global number %d out of range", v.Constant)
+			}
+			s.names[v.Name] = binding{addr: runtime.Word(v.Constant)}
+		case *ast.ConstantDecl:
+			s.names[v.Name] = binding{value: in.rt.Target.Wrap(runtime.Word(v.Constant)), manifest: true}
+		case *ast.StaticDecl:
+			val := in.rt.Target.Wrap(runtime.Word(v.Constant))
+			s.names[v.Name] = binding{addr: in.cell(v.NamePos, val), static: true}
+		}
+	}
+}
+
+// Define simultaneous definitions in a scope.  The functions and
+// routines are defined first so they may call each other; the values
+// of the other definitions are evaluated before any of them is bound.
+func (in *Interp) define(s *scope, def ast.Def) {
+	defs := ast.Defs(def)
+	for _, d := range defs {
+		switch d := d.(type) {
+		case *ast.FuncDef:
+			in.store(s, d.NamePos, d.Name, in.function(s, d))
+		case *ast.RoutineDef:
+			in.store(s, d.NamePos, d.Name, in.routine(s, d))
+		}
+	}
+
+	type value struct {
+		pos  token.Position
+		name string
+		val  runtime.Word
+		vec  int
+	}
+	var values []value
+	for _, d := range defs {
+		switch d := d.(type) {
+		case *ast.SimpleDef:
+			if len(d.Names.Names) != len(d.Exprs.Exprs) {
+				in.error(d.Pos(), "%d names defined by %d values",
+					len(d.Names.Names), len(d.Exprs.Exprs))
+			}
+			for i, n := range d.Names.Names {
+				values = append(values, value{n.NamePos, n.Val, in.eval(s, d.Exprs.Exprs[i]), 0})
+			}
+		case *ast.VecDef:
+			n, ok := in.constant(s, d.Expr)
+			if !ok {
+				in.error(d.Expr.Pos(), "vector size is not a constant")
+			}
+			if n < 0 {
+				in.error(d.Expr.Pos(), "negative vector size %d", n)
+			}
+			v := in.rt.Store.GetVec(n)
+			if v == 0 {
+				in.error(d.NamePos, "out of store")
+			}
+			s.cells = append(s.cells, v)
+			values = append(values, value{d.NamePos, d.Name, v, int(n) + 1})
+		}
+	}
+	for _, v := range values {
+		in.store(s, v.pos, v.name, v.val)
+		if v.vec > 0 {
+			b := s.names[v.name]
+			b.vec = v.vec
+			s.names[v.name] = b
+		}
+	}
+}
+
+// Give a name a value.  A name already declared global or static
+// keeps its cell, as when a function is defined for a global.
+func (in *Interp) store(s *scope, pos token.Position, name string, val runtime.Word) {
+	if b, ok := s.names[name]; ok && !b.manifest && (b.addr < runtime.NumGlobals || b.static) {
+		in.rt.Store.Put(b.addr, val)
+		s.names[name] = binding{addr: b.addr, static: b.static}
+		return
+	}
+	addr := in.cell(pos, val)
+	s.cells = append(s.cells, addr)
+	s.names[name] = binding{addr: addr}
+}
+
+// Free the cells and vectors allocated for the names of a scope.
+func (in *Interp) free(s *scope) {
+	for _, addr := range s.cells {
+		in.rt.Store.FreeVec(addr)
+	}
+}
+
+// Make a routine for a function definition in a scope.  Unless the
+// body takes the address of a name, which might outlive the cells of
+// the parameters, a call in tail position of the body is made once the
+// activation has ended.
+func (in *Interp) function(top *scope, f *ast.FuncDef) runtime.Word {
+	tail := !takesAddress(f.Body)
+	return in.procedure(&proc{top, f.Name, f.NamePos, f.Params, f.Body.Pos(), func(s *scope) (runtime.Word, *tailCall) {
+		if tail {
+			return in.tail(s, f.Body)
+		}
+		return in.eval(s, f.Body), nil
+	}})
+}
+
+// Make a routine for a routine definition in a scope.  A routine
+// returns zero.
+func (in *Interp) routine(top *scope, r *ast.RoutineDef) runtime.Word {
+	return in.procedure(&proc{top, r.Name, r.NamePos, r.Params, r.Body.Pos(), func(s *scope) (runtime.Word, *tailCall) {
+		in.exec(s, r.Body)
+		return 0, nil
+	}})
+}
+
+// A function or routine, evaluating its body in a scope binding the
+// parameters to the arguments of each call.
+type proc struct {
+	top     *scope
+	name    string
+	pos     token.Position
+	params  *ast.NameList
+	bodyPos token.Position
+	body    func(s *scope) (runtime.Word, *tailCall)
+}
+
+// A call in tail position of a function body, made by the routine of
+// the caller once its activation has ended.
+type tailCall struct {
+	proc *proc
+	args []runtime.Word
+}
+
+// Make a routine for a procedure.  The tail calls of its activations
+// replace them without nesting.
+func (in *Interp) procedure(p *proc) runtime.Word {
+	entry := in.rt.Define(func(rt *runtime.Runtime, args []runtime.Word) runtime.Word {
+		for p := p; ; {
+			val, tail := in.activate(p, args)
+			if tail == nil {
+				return val
+			}
+			p, args = tail.proc, tail.args
+		}
+	})
+	in.procs[entry] = p
+	return entry
+}
+
+// Run an activation of a procedure, returning its value or the call
+// it ends with.
+func (in *Interp) activate(p *proc, args []runtime.Word) (val runtime.Word, tail *tailCall) {
+	if len(in.frames) >= MaxDepth {
+		in.error(p.pos, "call stack overflow calling %s", p.name)
+	}
+	s := newScope(p.top)
+	if params := p.params.Names; len(params) > 0 {
+		cells := in.rt.Store.GetVec(runtime.Word(len(params) - 1))
+		if cells == 0 {
+			in.error(p.pos, "out of store calling %s", p.name)
+		}
+		defer in.rt.Store.FreeVec(cells)
+		for i, param := range params {
+			var arg runtime.Word
+			if i < len(args) {
+				arg = args[i]
+			}
+			in.rt.Store.Put(cells+runtime.Word(i), arg)
+			s.names[param.Val] = binding{addr: cells + runtime.Word(i)}
+		}
+	}
+
+	in.frames = append(in.frames, &Frame{p.name, p.top.section(), p.params, p.bodyPos, s, s})
+	defer func() {
+		in.frames = in.frames[:len(in.frames)-1]
+	}()
+	defer in.uncaught(&val)
+	in.trace(Enter, p.bodyPos)
+	return p.body(s)
+}
+
+// Report whether an expression takes the address of a name or a
+// vector element.
+func takesAddress(e ast.Expr) bool {
+	found := false
+	ast.Inspect(e, func(n ast.Node) bool {
+		if u, ok := n.(*ast.UnaryExpr); ok && u.Op == token.LV {
+			found = true
+		}
+		return !found
+	})
+	return found
+}
+
+// ----------------------------------------------------------------------------
+// Expressions
+
+// Evaluate an expression in the top-level scope.
+func (in *Interp) Eval(e ast.Expr) (runtime.Word, error) {
+	return in.protect(func() runtime.Word {
+		return in.eval(in.top, e)
+	})
+}
+
+// Run the program by calling start, with no arguments.
+func (in *Interp) Start() (runtime.Word, error) {
+	return in.protect(func() runtime.Word {
+		f := in.rt.Global(runtime.StartGlobal)
+		if f == 0 {
+			in.error(token.Position{}, "start is not defined")
+		}
+		return in.rt.Call(f)
+	})
+}
+
+// Evaluate an expression that must be a manifest constant, reporting
+// whether it is one.
+func (in *Interp) constant(s *scope, e ast.Expr) (runtime.Word, bool) {
+	switch e := e.(type) {
+	case *ast.ConstExpr:
+		return in.rt.Target.Wrap(runtime.Word(e.Contant)), true
+	case *ast.Name:
+		if b, ok := s.lookup(e.Val); ok && b.manifest {
+			return b.value, true
+		}
+	case *ast.ParenExpr:
+		return in.constant(s, e.X)
+	case *ast.UnaryExpr:
+		if e.Op == token.PLUS || e.Op == token.MINUS {
+			x, ok := in.constant(s, e.X)
+			if ok {
+				return in.unary(e, x), true
+			}
+		}
+	case *ast.BinaryExpr:
+		switch e.Op {
+		case token.PLUS, token.MINUS, token.STAR, token.DIV, token.REM:
+			x, okx := in.constant(s, e.X)
+			y, oky := in.constant(s, e.Y)
+			if okx && oky {
+				return in.binary(e, x, y), true
+			}
+		}
+	}
+	return 0, false
+}
+
+func (in *Interp) truth(b bool) runtime.Word {
+	if b {
+		return True
+	}
+	return False
+}
+
+// Return the address denoted by an expression in an lv context.
+func (in *Interp) lvalue(s *scope, e ast.Expr) runtime.Word {
+	switch e := e.(type) {
+	case *ast.Name:
+		b, ok := s.lookup(e.Val)
+		if !ok {
+			in.error(e.NamePos, "undeclared name %s", e.Val)
+		}
+		if b.manifest {
+			in.error(e.NamePos, "manifest constant %s has no address", e.Val)
+		}
+		return b.addr
+	case *ast.ParenExpr:
+		return in.lvalue(s, e.X)
+	case *ast.VecApExpr:
+		return in.rt.Target.Wrap(in.eval(s, e.X) + in.eval(s, e.Index))
+	case *ast.UnaryExpr:
+		if e.Op == token.RV {
+			return in.eval(s, e.X)
+		}
+	}
+	in.error(e.Pos(), "expression has no address")
+	return 0
+}
+
+func (in *Interp) eval(s *scope, e ast.Expr) runtime.Word {
+	switch e := e.(type) {
+	case *ast.Name:
+		b, ok := s.lookup(e.Val)
+		if !ok {
+			in.error(e.NamePos, "undeclared name %s", e.Val)
+		}
+		if b.manifest {
+			return b.value
+		}
+		return in.rt.Store.Load(b.addr)
+	case *ast.ConstExpr:
+		return in.rt.Target.Wrap(runtime.Word(e.Contant))
+	case *ast.StringExpr:
+		str, ok := in.strings[e]
+		if !ok {
+			str = in.rt.NewString(unquote(e.Lit))
+			in.strings[e] = str
+		}
+		return str
+	case *ast.BoolExpr:
+		return in.truth(e.Value)
+	case *ast.ParenExpr:
+		return in.eval(s, e.X)
+	case *ast.CallExpr:
+		in.trace(Call, e.Pos())
+		f, args := in.call(s, e)
+		val := in.rt.Call(f, args...)
+		in.trace(Return, e.Pos())
+		return val
+	case *ast.VecApExpr:
+		return in.rt.Store.Load(in.lvalue(s, e))
+	case *ast.UnaryExpr:
+		if e.Op == token.LV {
+			return in.lvalue(s, e.X)
+		}
+		return in.unary(e, in.eval(s, e.X))
+	case *ast.BinaryExpr:
+		if isRelation(e.Op) {
+			return in.relation(s, e)
+		}
+		return in.binary(e, in.eval(s, e.X), in.eval(s, e.Y))
+	case *ast.CondExpr:
+		if in.eval(s, e.Cond) != False {
+			return in.eval(s, e.Then)
+		}
+		return in.eval(s, e.Else)
+	case *ast.QueryExpr:
+		return 0
+	case *ast.MatchExpr:
+		return in.match(s, e)
+	case *ast.ValofExpr:
+		return in.valof(s, e)
+	}
+	in.error(e.Pos(), "cannot evaluate %T", e)
+	return 0
+}
+
+// Evaluate the routine and the arguments of a call.
+func (in *Interp) call(s *scope, e *ast.CallExpr) (runtime.Word, []runtime.Word) {
+	f := in.eval(s, e.Fn)
+	args := make([]runtime.Word, len(e.Args.Exprs))
+	for i, arg := range e.Args.Exprs {
+		args[i] = in.eval(s, arg)
+	}
+	return f, args
+}
+
+// Evaluate an expression in tail position of a function body.  A call
+// of a function or routine the interpreter defined is returned rather
+// than made; its Call event has no Return.
+func (in *Interp) tail(s *scope, e ast.Expr) (runtime.Word, *tailCall) {
+	switch e := e.(type) {
+	case *ast.ParenExpr:
+		return in.tail(s, e.X)
+	case *ast.CondExpr:
+		if in.eval(s, e.Cond) != False {
+			return in.tail(s, e.Then)
+		}
+		return in.tail(s, e.Else)
+	case *ast.CallExpr:
+		in.trace(Call, e.Pos())
+		f, args := in.call(s, e)
+		if p, ok := in.procs[f]; ok {
+			return 0, &tailCall{p, args}
+		}
+		val := in.rt.Call(f, args...)
+		in.trace(Return, e.Pos())
+		return val, nil
+	}
+	return in.eval(s, e), nil
+}
+
+// Evaluate a pattern matching expression.  A next in the body of an
+// arm goes on to the arms after it, and an exit leaves the expression,
+// whose value is then that of the last arm finished, or zero.
+func (in *Interp) match(s *scope, e *ast.MatchExpr) runtime.Word {
+	args := make([]runtime.Word, len(e.Args.Exprs))
+	for i, arg := range e.Args.Exprs {
+		args[i] = in.eval(s, arg)
+	}
+
+	var val runtime.Word
+	matched := false
+	exited := in.catch(token.EXIT, func() {
+		for _, arm := range e.Arms {
+			bound := make(map[string]runtime.Word)
+			if !in.matches(s, arm.Patterns.Exprs, args, bound) {
+				continue
+			}
+			var x runtime.Word
+			if in.catch(token.NEXT, func() { x = in.evalArm(s, arm, bound) }) {
+				continue
+			}
+			val, matched = x, true
+			if !e.Every {
+				break
+			}
+		}
+	})
+	if !matched && !exited && !e.Every {
+		in.error(e.Match, "no pattern matches")
+	}
+	return val
+}
+
+// Report whether patterns match arguments, recording the values of
+// the names they bind.
+func (in *Interp) matches(s *scope, patterns []ast.Expr, args []runtime.Word, bound map[string]runtime.Word) bool {
+	for i, pat := range patterns {
+		switch pat := pat.(type) {
+		case *ast.QueryExpr:
+			continue
+		case *ast.Name:
+			if b, ok := s.lookup(pat.Val); !ok || !b.manifest {
+				bound[pat.Val] = args[i]
+				continue
+			}
+		}
+		if in.eval(s, pat) != args[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Evaluate the body of a matching arm with the names its patterns
+// bind in cells of their own.
+func (in *Interp) evalArm(s *scope, arm *ast.MatchArm, bound map[string]runtime.Word) runtime.Word {
+	inner := newScope(s)
+	if len(bound) > 0 {
+		cells := in.rt.Store.GetVec(runtime.Word(len(bound) - 1))
+		if cells == 0 {
+			in.error(arm.Colon, "out of store")
+		}
+		defer in.rt.Store.FreeVec(cells)
+		addr := cells
+		for _, pat := range arm.Patterns.Exprs {
+			n, ok := pat.(*ast.Name)
+			if !ok {
+				continue
+			}
+			val, isBound := bound[n.Val]
+			if _, done := inner.names[n.Val]; !isBound || done {
+				continue
+			}
+			in.rt.Store.Put(addr, val)
+			inner.names[n.Val] = binding{addr: addr}
+			addr++
+		}
+	}
+	return in.eval(inner, arm.Body)
+}
+
+// ----------------------------------------------------------------------------
+// Commands
+
+// The signals by which commands leave the commands enclosing them,
+// raised with panic.
+type (
+	jumpSignal struct {
+		pos token.Position
+		tok token.TokenKind // token.BREAK, token.LOOP, token.ENDCASE, token.NEXT or token.EXIT.
+	}
+	returnSignal struct{}
+	resultSignal struct {
+		pos token.Position
+		val runtime.Word
+	}
+	gotoSignal struct {
+		pos   token.Position
+		label string
+	}
+)
+
+// Turn the signal of a command that nothing enclosing it caught into
+// an error as a call or evaluation ends.  A return makes *val zero.
+func (in *Interp) uncaught(val *runtime.Word) {
+	switch x := recover().(type) {
+	case nil:
+	case *returnSignal:
+		*val = 0
+	case *jumpSignal:
+		in.error(x.pos, "%s outside %s", x.tok, jumpTargets[x.tok])
+	case *resultSignal:
+		in.error(x.pos, "resultis outside valof")
+	case *gotoSignal:
+		in.error(x.pos, "no label %s in an enclosing block", x.label)
+	default:
+		panic(x)
+	}
+}
+
+// Execute a command.
+func (in *Interp) exec(s *scope, c ast.Cmd) {
+	switch c := c.(type) {
+	case *ast.BlockCmd:
+		in.block(s, c, 0)
+		return
+	case *ast.LabelCmd:
+		if c.Body != nil {
+			in.exec(s, c.Body)
+		}
+		return
+	case *ast.CaseCmd:
+		if c.Body != nil {
+			in.exec(s, c.Body)
+		}
+		return
+	}
+
+	if len(in.frames) > 0 {
+		f := in.frames[len(in.frames)-1]
+		defer func(outer *scope) {
+			f.scope = outer
+		}(f.scope)
+		f.scope = s
+	}
+	in.trace(Exec, c.Pos())
+	switch c := c.(type) {
+	case *ast.LetCmd:
+		in.define(s, c.Def)
+	case *ast.AssignCmd:
+		in.assign(s, c)
+	case *ast.ExprCmd:
+		in.eval(s, c.X)
+	case *ast.IfCmd:
+		if (in.eval(s, c.Cond) != False) != c.Unless {
+			in.exec(s, c.Body)
+		}
+	case *ast.TestCmd:
+		if in.eval(s, c.Cond) != False {
+			in.exec(s, c.Then)
+		} else {
+			in.exec(s, c.Else)
+		}
+	case *ast.WhileCmd:
+		in.loop(func() {
+			for (in.eval(s, c.Cond) != False) != c.Until {
+				in.iterate(s, c.Body)
+			}
+		})
+	case *ast.RepeatCmd:
+		in.loop(func() {
+			for {
+				in.iterate(s, c.Body)
+				switch c.Op {
+				case token.REPEATWHILE:
+					if in.eval(s, c.Cond) == False {
+						return
+					}
+				case token.REPEATUNTIL:
+					if in.eval(s, c.Cond) != False {
+						return
+					}
+				}
+			}
+		})
+	case *ast.ForCmd:
+		from, to := in.eval(s, c.From), in.eval(s, c.To)
+		step := runtime.Word(1)
+		if c.By != nil {
+			v, ok := in.constant(s, c.By)
+			if !ok {
+				in.error(c.By.Pos(), "for step is not a constant")
+			}
+			step = v
+		}
+		inner := newScope(s)
+		addr := in.cell(c.Var.NamePos, from)
+		defer in.rt.Store.FreeVec(addr)
+		inner.names[c.Var.Val] = binding{addr: addr}
+		in.loop(func() {
+			for v := in.rt.Store.Load(addr); step >= 0 && v <= to || step < 0 && v >= to; v = in.rt.Store.Load(addr) {
+				in.iterate(inner, c.Body)
+				in.rt.Store.Put(addr, in.rt.Target.Wrap(in.rt.Store.Load(addr)+step))
+			}
+		})
+	case *ast.JumpCmd:
+		switch c.Tok {
+		case token.BREAK, token.LOOP, token.ENDCASE, token.NEXT, token.EXIT:
+			panic(&jumpSignal{c.TokPos, c.Tok})
+		case token.RETURN:
+			panic(&returnSignal{})
+		case token.FINISH:
+			in.rt.Call(in.rt.Global(runtime.StopGlobal), 0)
+		}
+	case *ast.GotoCmd:
+		panic(&gotoSignal{c.Goto, c.Label.Val})
+	case *ast.ResultisCmd:
+		panic(&resultSignal{c.Resultis, in.eval(s, c.X)})
+	case *ast.SwitchonCmd:
+		in.switchon(s, c)
+	default:
+		in.error(c.Pos(), "cannot execute %T", c)
+	}
+}
+
+// Assign the values of the right hand sides to the left hand sides,
+// evaluating them all first.
+func (in *Interp) assign(s *scope, c *ast.AssignCmd) {
+	vals := make([]runtime.Word, len(c.Rhs.Exprs))
+	for i, e := range c.Rhs.Exprs {
+		vals[i] = in.eval(s, e)
+	}
+	for i, e := range c.Lhs.Exprs {
+		if n, ok := e.(*ast.Name); ok {
+			if b, ok := s.lookup(n.Val); ok && b.manifest {
+				in.error(n.NamePos, "cannot assign to manifest constant %s", n.Val)
+			}
+		}
+		in.rt.Store.Put(in.lvalue(s, e), vals[i])
+	}
+}
+
+// The commands that the jumps of each kind leave or go on with.
+var jumpTargets = map[token.TokenKind]string{
+	token.BREAK:   "a loop",
+	token.LOOP:    "a loop",
+	token.ENDCASE: "a switchon",
+	token.NEXT:    "a match",
+	token.EXIT:    "a match",
+}
+
+// Call fn, reporting whether a jump of a kind ended it.
+func (in *Interp) catch(tok token.TokenKind, fn func()) (caught bool) {
+	defer func() {
+		if x := recover(); x != nil {
+			if j, ok := x.(*jumpSignal); !ok || j.tok != tok {
+				panic(x)
+			}
+			caught = true
+		}
+	}()
+	fn()
+	return false
+}
+
+// Run a loop, which a break leaves.
+func (in *Interp) loop(fn func()) {
+	in.catch(token.BREAK, fn)
+}
+
+// Execute the body of a loop, which a loop command ends.
+func (in *Interp) iterate(s *scope, body ast.Cmd) {
+	in.catch(token.LOOP, func() {
+		in.exec(s, body)
+	})
+}
+
+// Evaluate a valof expression to the value given by resultis.
+func (in *Interp) valof(s *scope, e *ast.ValofExpr) (val runtime.Word) {
+	defer func() {
+		if x := recover(); x != nil {
+			r, ok := x.(*resultSignal)
+			if !ok {
+				panic(x)
+			}
+			val = r.val
+		}
+	}()
+	in.exec(s, e.Body)
+	in.error(e.Valof, "valof ended without resultis")
+	return 0
+}
+
+// Execute the items of a block from item i in a scope of their own,
+// whose cells are freed when the block is left.  A goto a label of
+// one of the items runs the block again from that item.
+func (in *Interp) block(s *scope, b *ast.BlockCmd, i int) {
+	inner := newScope(s)
+	defer in.free(inner)
+	labelled(b.Items, func(c ast.Cmd) bool {
+		if l, ok := c.(*ast.LabelCmd); ok {
+			inner.names[l.Label.Val] = binding{value: in.label(l), manifest: true, label: true}
+		}
+		return false
+	})
+	for {
+		g := in.catchGoto(func() {
+			for ; i < len(b.Items); i++ {
+				in.exec(inner, b.Items[i])
+			}
+		})
+		if g == nil {
+			return
+		}
+		i = labelled(b.Items, func(c ast.Cmd) bool {
+			l, ok := c.(*ast.LabelCmd)
+			return ok && l.Label.Val == g.label
+		})
+		if i < 0 {
+			panic(g)
+		}
+	}
+}
+
+// Return the value of a label, a word no other label has.
+func (in *Interp) label(l *ast.LabelCmd) runtime.Word {
+	val, ok := in.labels[l]
+	if !ok {
+		val = in.cell(l.Label.NamePos, 0)
+		in.labels[l] = val
+		in.jumps[val] = l
+	}
+	return val
+}
+
+// Call fn, returning the goto it raises, or nil.  A longjump to a
+// label at the level of the routine running is a goto the label.
+func (in *Interp) catchGoto(fn func()) (g *gotoSignal) {
+	defer func() {
+		switch x := recover().(type) {
+		case nil:
+		case *gotoSignal:
+			g = x
+		case *runtime.LongJump:
+			l, ok := in.jumps[x.Label]
+			if !ok || x.Level != in.rt.Level() {
+				panic(x)
+			}
+			g = &gotoSignal{l.Label.NamePos, l.Label.Val}
+		default:
+			panic(x)
+		}
+	}()
+	fn()
+	return nil
+}
+
+// Return the index of the first item for which match reports true of
+// the item or of a command labelled by the labels and cases prefixing
+// it, or -1.
+func labelled(items []ast.Cmd, match func(ast.Cmd) bool) int {
+	for i, item := range items {
+		for c := item; c != nil; {
+			if match(c) {
+				return i
+			}
+			switch l := c.(type) {
+			case *ast.LabelCmd:
+				c = l.Body
+			case *ast.CaseCmd:
+				c = l.Body
+			default:
+				c = nil
+			}
+		}
+	}
+	return -1
+}
+
+// Execute a switchon command from the case of the value, or from the
+// default if no case has it.  The cases are the items of its block.
+func (in *Interp) switchon(s *scope, c *ast.SwitchonCmd) {
+	x := in.eval(s, c.X)
+	b, ok := c.Body.(*ast.BlockCmd)
+	if !ok {
+		b = &ast.BlockCmd{Sectbra: c.Body.Pos(), Items: []ast.Cmd{c.Body}}
+	}
+	i := labelled(b.Items, func(c ast.Cmd) bool {
+		k, ok := c.(*ast.CaseCmd)
+		if !ok || k.Value == nil {
+			return false
+		}
+		v, ok := in.constant(s, k.Value)
+		if !ok {
+			in.error(k.Value.Pos(), "case value is not a constant")
+		}
+		return v == x
+	})
+	if i < 0 {
+		i = labelled(b.Items, func(c ast.Cmd) bool {
+			k, ok := c.(*ast.CaseCmd)
+			return ok && k.Value == nil
+		})
+	}
+	if i >= 0 {
+		in.catch(token.ENDCASE, func() {
+			in.block(s, b, i)
+		})
+	}
+}
+
+// Return the floating point number held in a word.
+func (in *Interp) float(pos token.Position, w runtime.Word) float64 {
+	f, ok := in.rt.Target.Float(w)
+	if !ok {
+		in.error(pos, "no floating point on %d-bit words", in.rt.Target.WordBits)
+	}
+	return f
+}
+
+// Return the word holding a floating point number.
+func (in *Interp) word(pos token.Position, f float64) runtime.Word {
+	w, ok := in.rt.Target.FromFloat(f)
+	if !ok {
+		in.error(pos, "no floating point on %d-bit words", in.rt.Target.WordBits)
+	}
+	return w
+}
+
+func (in *Interp) unary(e *ast.UnaryExpr, x runtime.Word) runtime.Word {
+	t, pos := in.rt.Target, e.OpPos
+	switch e.Op {
+	case token.PLUS:
+		return x
+	case token.MINUS:
+		return t.Wrap(-x)
+	case token.NOT:
+		return ^x
+	case token.RV:
+		return in.rt.Store.Load(x)
+	case token.FPLUS:
+		return x
+	case token.FMINUS:
+		return in.word(pos, -in.float(pos, x))
+	case token.FLOAT:
+		return in.word(pos, float64(x))
+	case token.FIX:
+		return t.Wrap(runtime.Word(in.float(pos, x)))
+	}
+	in.error(e.OpPos, "bad unary operator %s", e.Op)
+	return 0
+}
+
+func (in *Interp) binary(e *ast.BinaryExpr, x, y runtime.Word) runtime.Word {
+	t, pos := in.rt.Target, e.OpPos
+	switch e.Op {
+	case token.STAR:
+		return t.Wrap(x * y)
+	case token.DIV, token.REM:
+		if y == 0 {
+			in.error(e.OpPos, "division by zero")
+		}
+		if e.Op == token.DIV {
+			return t.Wrap(x / y)
+		}
+		return x % y
+	case token.PLUS:
+		return t.Wrap(x + y)
+	case token.MINUS:
+		return t.Wrap(x - y)
+	case token.LSHIFT:
+		if y < 0 {
+			return 0
+		}
+		return t.Shift(x, y)
+	case token.RSHIFT:
+		if y < 0 {
+			return 0
+		}
+		return t.Shift(x, -y)
+	case token.LOGAND:
+		return x & y
+	case token.LOGOR:
+		return x | y
+	case token.EQV:
+		return ^(x ^ y)
+	case token.NEQV:
+		return x ^ y
+	case token.PERCENT:
+		return in.rt.GetByte(x, y)
+	case token.FMUL:
+		return in.word(pos, in.float(pos, x)*in.float(pos, y))
+	case token.FDIV:
+		return in.word(pos, in.float(pos, x)/in.float(pos, y))
+	case token.FPLUS:
+		return in.word(pos, in.float(pos, x)+in.float(pos, y))
+	case token.FMINUS:
+		return in.word(pos, in.float(pos, x)-in.float(pos, y))
+	}
+	in.error(e.OpPos, "bad binary operator %s", e.Op)
+	return 0
+}
+
+func isRelation(op token.TokenKind) bool {
+	switch op {
+	case token.EQ, token.NE, token.LS, token.GR, token.LE, token.GE,
+		token.FEQ, token.FNE, token.FLS, token.FGR, token.FLE, token.FGE:
+		return true
+	}
+	return false
+}
+
+// Evaluate a relation.  Relations may be chained, so that
+// A < B <= C means A < B & B <= C, each operand being evaluated
+// once.
+func (in *Interp) relation(s *scope, e *ast.BinaryExpr) runtime.Word {
+	var ops []*ast.BinaryExpr
+	x := ast.Expr(e)
+	for {
+		b, ok := x.(*ast.BinaryExpr)
+		if !ok || !isRelation(b.Op) {
+			break
+		}
+		ops = append(ops, b)
+		x = b.X
+	}
+
+	left := in.eval(s, x)
+	result := true
+	for i := len(ops) - 1; i >= 0; i-- {
+		right := in.eval(s, ops[i].Y)
+		pos := ops[i].OpPos
+		switch ops[i].Op {
+		case token.EQ:
+			result = result && left == right
+		case token.NE:
+			result = result && left != right
+		case token.LS:
+			result = result && left < right
+		case token.GR:
+			result = result && left > right
+		case token.LE:
+			result = result && left <= right
+		case token.GE:
+			result = result && left >= right
+		case token.FEQ:
+			result = result && in.float(pos, left) == in.float(pos, right)
+		case token.FNE:
+			result = result && in.float(pos, left) != in.float(pos, right)
+		case token.FLS:
+			result = result && in.float(pos, left) < in.float(pos, right)
+		case token.FGR:
+			result = result && in.float(pos, left) > in.float(pos, right)
+		case token.FLE:
+			result = result && in.float(pos, left) <= in.float(pos, right)
+		case token.FGE:
+			result = result && in.float(pos, left) >= in.float(pos, right)
+		}
+		left = right
+	}
+	return in.truth(result)
+}
+
+// Return the characters of a string constant, translating the
+// escapes *n, *t, *s, *b, *p and **.
+func unquote(lit string) string {
+	lit = strings.TrimPrefix(lit, "\"")
+	lit = strings.TrimSuffix(lit, "\"")
+	var buf []byte
+	for i := 0; i < len(lit); i++ {
+		ch := lit[i]
+		if ch == '*' && i+1 < len(lit) {
+			i++
+			switch lit[i] {
+			case 'n', 'N':
+				ch = '\n'
+			case 't', 'T':
+				ch = '\t'
+			case 's', 'S':
+				ch = ' '
+			case 'b', 'B':
+				ch = '\b'
+			case 'p', 'P':
+				ch = '\f'
+			default:
+				ch = lit[i]
+			}
+		}
+		buf = append(buf, ch)
+	}
+	return string(buf)
+}
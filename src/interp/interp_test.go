@@ -0,0 +1,538 @@
+// Copyright 2015 Meador Inge.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package interp
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/meadori/bcpl-go/src/parser"
+	"github.com/meadori/bcpl-go/src/runtime"
+	"github.com/meadori/bcpl-go/src/token"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Helper test functions.
+
+func newTestInterp(t *testing.T, src string) (*Interp, *bytes.Buffer) {
+	var in Interp
+	var out bytes.Buffer
+	in.Init(strings.NewReader(""), &out)
+	prog, err := parser.ParseProgram([]byte(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := in.Load(prog); err != nil {
+		t.Fatal(err)
+	}
+	return &in, &out
+}
+
+func eval(in *Interp, src string) (runtime.Word, error) {
+	e, err := parser.ParseExpr([]byte(src))
+	if err != nil {
+		return 0, err
+	}
+	return in.Eval(e)
+}
+
+var test_defs_str = `global $( Counter: 200 $)
+manifest $( N = 10 $)
+
+let Fact(N) = N = 0 -> 1, N * Fact(N - 1)
+and Max(A, B) = A > B -> A, B
+let V = vec N
+and X, Y = 3, 4
+let Counter() = 42
+let Even(N) = N = 0 -> true, Odd(N - 1)
+and Odd(N) = N = 0 -> false, Even(N - 1)
+`
+
+var test_eval = []struct {
+	src string
+	val runtime.Word
+}{
+	{"1 + 2 * 3", 7},
+	{"(1 + 2) * 3", 9},
+	{"-7 / 2", -3},
+	{"-7 rem 2", -1},
+	{"N", 10},
+	{"X * Y", 12},
+	{"Fact(5)", 120},
+	{"Fact(N)", 3628800},
+	{"Max(X, Y)", 4},
+	{"Counter()", 42},
+	{"rv 200 = Counter", -1},
+	{"Even(10)", -1},
+	{"Odd(10)", 0},
+	{"1 < 2 < 3", -1},
+	{"1 < 3 < 2", 0},
+	{"!true", 0},
+	{"true & false", 0},
+	{"true | false", -1},
+	{"5 eqv 5", -1},
+	{"5 neqv 3", 6},
+	{"1 << 4", 16},
+	{"-1 >> 63", 1},
+	{"V*[0] = 0 -> 1, 2", 1},
+	{"rv lv X", 3},
+	{"lv V*[3] - V", 3},
+}
+
+func TestEval(t *testing.T) {
+	in, _ := newTestInterp(t, test_defs_str)
+	for _, test := range test_eval {
+		val, err := eval(in, test.src)
+		if err != nil {
+			t.Errorf("%s: %v", test.src, err)
+			continue
+		}
+		if val != test.val {
+			t.Errorf("%s: got %d, expected %d", test.src, val, test.val)
+		}
+	}
+}
+
+func TestLibrary(t *testing.T) {
+	in, out := newTestInterp(t, `let Hello(N) = writef("hello %n*n", N)`)
+	if _, err := eval(in, "Hello(42)"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := eval(in, `writes("a*tb*s**")`); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "hello 42\na\tb *" {
+		t.Errorf("got output %q", out.String())
+	}
+}
+
+var test_errors = []struct {
+	src string
+	msg string
+}{
+	{"Z", "1:1: error: undeclared name Z"},
+	{"1 / (X - 3)", "1:3: error: division by zero"},
+	{"lv N", "1:4: error: manifest constant N has no address"},
+	{"lv 1", "1:4: error: expression has no address"},
+	{"stop(3)", "stop(3)"},
+	{"X(1)", "fault: bad address 3"},
+}
+
+func TestErrors(t *testing.T) {
+	in, _ := newTestInterp(t, test_defs_str)
+	for _, test := range test_errors {
+		_, err := eval(in, test.src)
+		if err == nil || err.Error() != test.msg {
+			t.Errorf("%s: got error %v, expected %s", test.src, err, test.msg)
+		}
+	}
+
+	// The interpreter can still be used after an error.
+	if val, err := eval(in, "Fact(3)"); err != nil || val != 6 {
+		t.Errorf("got %d, %v after errors", val, err)
+	}
+}
+
+func TestRedefinition(t *testing.T) {
+	in, _ := newTestInterp(t, "let X = 1\nlet F() = X")
+	prog, err := parser.ParseProgram([]byte("let X = 2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := in.Load(prog); err != nil {
+		t.Fatal(err)
+	}
+	if val, _ := eval(in, "F()"); val != 2 {
+		t.Errorf("got %d, expected the redefined value 2", val)
+	}
+}
+
+var test_static_str = `static $( Count = 3; Limit = 10 $)
+let F() = Count + Limit
+let P = lv Count
+`
+
+func TestStatic(t *testing.T) {
+	in, _ := newTestInterp(t, test_static_str)
+	for _, test := range []struct {
+		src string
+		val runtime.Word
+	}{
+		{"F()", 13},
+		{"rv P", 3},
+		{"P = lv Count", True},
+		{"P >= 1000", True},
+		{"lv Count = lv Limit", False},
+	} {
+		if val, err := eval(in, test.src); err != nil || val != test.val {
+			t.Errorf("%s: got %d, %v, expected %d", test.src, val, err, test.val)
+		}
+	}
+
+	// Defining a static keeps its cell.
+	prog, err := parser.ParseProgram([]byte("let Count = 5"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := in.Load(prog); err != nil {
+		t.Fatal(err)
+	}
+	if val, _ := eval(in, "rv P + F()"); val != 20 {
+		t.Errorf("got %d, expected 20", val)
+	}
+}
+
+var test_commands_str = `manifest $( N = 10; ONE = 1 $)
+static $( Calls = 0 $)
+
+let Sum(V, N) = valof
+$( let s = 0
+   for i = 0 to N - 1 do s := s + V*[i]
+   resultis s
+$)
+
+let Fill(V, N) be
+$( let i = 0
+   Calls := Calls + 1
+   while i < N do $( V*[i] := i; i := i + 1 $)
+$)
+
+let Count(N) = valof
+$( let i, n = 0, 0
+   L: i := i + 1
+   unless i > N do $( n := n + 1; goto L $)
+   resultis n
+$)
+
+let Name(X) = valof
+$( let r = 0
+   switchon X into
+   $( case ONE: r := 1
+      case 2: r := r + 2
+              resultis r
+      default: resultis -1
+   $)
+$)
+
+let Loops() = valof
+$( let i, j = 0, 0
+   $( i := i + 1 $) repeatuntil i = 5
+   while true do $( j := j + 1; if j = 3 do break $)
+   test i = 5 do i, j := j, i or i := 0
+   resultis i * 10 + j
+$)
+
+let Early(X) be
+$( if X do return
+   Calls := 100
+$)
+
+let V = vec N
+`
+
+var test_exec = []struct {
+	src string
+	val runtime.Word
+}{
+	{"Fill(V, N)", 0},
+	{"Sum(V, N)", 45},
+	{"Calls", 1},
+	{"Count(4)", 4},
+	{"Name(1)", 3},
+	{"Name(2)", 2},
+	{"Name(7)", -1},
+	{"Loops()", 35},
+	{"valof resultis 6", 6},
+	{"Early(true)", 0},
+	{"Calls", 1},
+	{"Early(false)", 0},
+	{"Calls", 100},
+}
+
+func TestCommands(t *testing.T) {
+	in, _ := newTestInterp(t, test_commands_str)
+	for _, test := range test_exec {
+		val, err := eval(in, test.src)
+		if err != nil {
+			t.Errorf("%s: %v", test.src, err)
+			continue
+		}
+		if val != test.val {
+			t.Errorf("%s: got %d, expected %d", test.src, val, test.val)
+		}
+	}
+}
+
+var test_command_errors = []struct {
+	src string
+	msg string
+}{
+	{"let F() be break", "1:12: error: break outside a loop"},
+	{"let F() be resultis 1", "1:12: error: resultis outside valof"},
+	{"let F() be goto L", "1:12: error: no label L in an enclosing block"},
+	{"let F() = valof $( $)", "1:11: error: valof ended without resultis"},
+	{"manifest $( N = 1 $)\nlet F() be N := 2", "2:12: error: cannot assign to manifest constant N"},
+	{"let F() be finish", "stop(0)"},
+}
+
+func TestCommandErrors(t *testing.T) {
+	for _, test := range test_command_errors {
+		in, _ := newTestInterp(t, test.src)
+		_, err := eval(in, "F()")
+		if err == nil || err.Error() != test.msg {
+			t.Errorf("%s: got error %v, expected %s", test.src, err, test.msg)
+		}
+	}
+}
+
+var test_longjump_str = `global $( Log: 200 $)
+
+let Jump(P, L) be
+$( longjump(P, L)
+   Log := Log + 1
+$)
+
+let Search(N) = valof
+$( let Found = 0
+   for i = 1 to 10 do
+   $( if i = N do Jump(level(), Done)
+      Found := Found + 1
+   $)
+   resultis -1
+   Done: resultis Found * 10
+$)
+
+let Outer(D) = valof
+$( Jump(level() + D, Here)
+   Here: resultis 1
+$)
+`
+
+func TestLongjump(t *testing.T) {
+	in, _ := newTestInterp(t, test_longjump_str)
+	for _, test := range []struct {
+		src string
+		val runtime.Word
+	}{
+		{"Search(4)", 30},
+		{"Search(20)", -1},
+		{"Outer(0)", 1},
+		{"Log", 0},
+	} {
+		if val, err := eval(in, test.src); err != nil || val != test.val {
+			t.Errorf("%s: got %d, %v; expected %d", test.src, val, err, test.val)
+		}
+	}
+	for _, test := range []struct {
+		src string
+		msg string
+	}{
+		{"Outer(1)", "20:4: error: no label Here in an enclosing block"},
+		{"Outer(5)", "longjump to bad level 6"},
+	} {
+		if _, err := eval(in, test.src); err == nil || err.Error() != test.msg {
+			t.Errorf("%s: got error %v, expected %s", test.src, err, test.msg)
+		}
+	}
+	if val, _ := eval(in, "Log"); val != 0 {
+		t.Errorf("the code after a longjump ran %d times", val)
+	}
+}
+
+func TestStart(t *testing.T) {
+	in, out := newTestInterp(t, "let start() = writes(\"hello*n\")")
+	if _, err := in.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "hello\n" {
+		t.Errorf("got output %q", out.String())
+	}
+
+	in, _ = newTestInterp(t, "let F() = 1")
+	if _, err := in.Start(); err == nil || !strings.Contains(err.Error(), "start is not defined") {
+		t.Errorf("got %v, expected an error", err)
+	}
+}
+
+func TestStackOverflow(t *testing.T) {
+	in, _ := newTestInterp(t, "let F(N) = F(N + 1) + 1")
+	_, err := eval(in, "F(0)")
+	if err == nil || !strings.Contains(err.Error(), "call stack overflow calling F") {
+		t.Errorf("got %v, expected a stack overflow", err)
+	}
+	if n := len(in.Frames()); n != 0 {
+		t.Errorf("%d frames left after an error", n)
+	}
+}
+
+func TestTailCall(t *testing.T) {
+	in, _ := newTestInterp(t, `let Acc(N, A) = N = 0 -> A, Acc(N - 1, A + N)
+and Even(N) = N = 0 -> true, (Odd(N - 1))
+and Odd(N) = N = 0 -> false, Even(N - 1)
+and Addr(N, A) = N = 0 -> rv A, Addr(N - 1, lv N)`)
+	for _, test := range []struct {
+		expr string
+		val  runtime.Word
+	}{
+		{"Acc(100000, 0)", 5000050000},
+		{"Even(100001)", False},
+		{"Addr(1, 0)", 1},
+	} {
+		if val, err := eval(in, test.expr); err != nil || val != test.val {
+			t.Errorf("%s: got %d, %v, expected %d", test.expr, val, err, test.val)
+		}
+	}
+	if n := len(in.Frames()); n != 0 {
+		t.Errorf("%d frames left", n)
+	}
+}
+
+func TestTrace(t *testing.T) {
+	in, _ := newTestInterp(t, "let Sq(N) = N * N\nand F(N) = Sq(N) + 1")
+	var events []string
+	in.Trace = func(ev Event, pos token.Position) error {
+		events = append(events, fmt.Sprintf("%s %s %d", ev, pos, len(in.Frames())))
+		return nil
+	}
+	if val, err := eval(in, "F(3)"); err != nil || val != 10 {
+		t.Fatalf("got %d, %v", val, err)
+	}
+	expected := []string{
+		"call 1:1 0",
+		"enter 2:12 1",
+		"call 2:12 1",
+		"enter 1:13 2",
+		"return 2:12 1",
+		"return 1:1 0",
+	}
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("got events %v, expected %v", events, expected)
+	}
+}
+
+var test_richards_str = `SECTION "test"
+MANIFEST { Zero = 0 }
+LET Fact(n) = MATCH (n)
+  : Zero => 1
+  : m => m * Fact(m - 1)
+  .
+AND Sign(n) = MATCH (n < 0, n = 0)
+  : TRUE, ? => -1
+  : ?, TRUE => 0
+  : ? => 1
+  .
+AND Count(a, b) = EVERY (a, b)
+  : 1 => 10
+  : ?, 2 => 20
+  .
+AND Half(n) = FIX (FLOAT n #/ FLOAT 2)
+AND Byte(s, i) = s%i
+AND Second(v) = v!1
+`
+
+var test_richards_eval = []struct {
+	src string
+	val runtime.Word
+}{
+	{"Fact(5)", 120},
+	{"Sign(-3)", -1},
+	{"Sign(0)", 0},
+	{"Sign(7)", 1},
+	{"Count(1, 2)", 20},
+	{"Count(1, 3)", 10},
+	{"Count(0, 0)", 0},
+	{"Half(9)", 4},
+	{"FLOAT 3 #> FLOAT 2", -1},
+	{"FIX (#- FLOAT 3)", -3},
+	{"Byte(\"AB\", 2)", 'B'},
+	{"!@Fact = Fact", -1},
+	{"Second(@Fact - 1) = Fact", -1},
+	{"7 MOD 4", 3},
+	{"?", 0},
+}
+
+func TestRichards(t *testing.T) {
+	var in Interp
+	in.Init(strings.NewReader(""), ioutil.Discard)
+	var p parser.Parser
+	p.Dialect = token.Richards | token.Upper
+	p.Init([]byte(test_richards_str))
+	prog := p.Parse()
+	if err := p.Errors.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := in.Load(prog); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range test_richards_eval {
+		p.Init([]byte(test.src))
+		e, err := p.ParseExpr()
+		if err != nil {
+			t.Errorf("%s: %v", test.src, err)
+			continue
+		}
+		val, err := in.Eval(e)
+		if err != nil {
+			t.Errorf("%s: %v", test.src, err)
+		} else if val != test.val {
+			t.Errorf("%s: got %d, expected %d", test.src, val, test.val)
+		}
+	}
+}
+
+var test_targets = []struct {
+	target string
+	src    string
+	val    runtime.Word
+}{
+	{"16", "32767 + 1", -32768},
+	{"16", "1 << 16", 0},
+	{"16", "-1 >> 15", 1},
+	{"16", "300 * 300", 24464},
+	{"16", "65535", -1},
+	{"32", "-1 >> 31", 1},
+	{"32", "#x7FFFFFFF + 1 < 0", -1},
+	{"64", "#x7FFFFFFF + 1 < 0", 0},
+	{"32", "FIX (FLOAT 7 #/ FLOAT 2)", 3},
+	{"16be", "Byte(\"AB\", 1)", 'A'},
+}
+
+func TestTargets(t *testing.T) {
+	for _, test := range test_targets {
+		var in Interp
+		in.Target, _ = runtime.LookupTarget(test.target)
+		in.Init(strings.NewReader(""), ioutil.Discard)
+		var p parser.Parser
+		p.Dialect = token.Richards | token.Upper
+		p.Init([]byte("LET Byte(s, i) = s%i"))
+		if err := in.Load(p.Parse()); err != nil {
+			t.Fatal(err)
+		}
+		p.Init([]byte(test.src))
+		e, err := p.ParseExpr()
+		if err != nil {
+			t.Fatalf("%s: %v", test.src, err)
+		}
+		val, err := in.Eval(e)
+		if err != nil {
+			t.Errorf("%s on %s: %v", test.src, test.target, err)
+		} else if val != test.val {
+			t.Errorf("%s on %s: got %d, expected %d", test.src, test.target, val, test.val)
+		}
+	}
+
+	var in Interp
+	in.Target, _ = runtime.LookupTarget("16")
+	in.Init(strings.NewReader(""), ioutil.Discard)
+	var p parser.Parser
+	p.Dialect = token.Richards | token.Upper
+	p.Init([]byte("FLOAT 1"))
+	e, _ := p.ParseExpr()
+	if _, err := in.Eval(e); err == nil {
+		t.Errorf("FLOAT on a 16-bit target: expected an error")
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright 2015 Meador Inge.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package interp
+
+import (
+	"github.com/meadori/bcpl-go/src/ast"
+	"github.com/meadori/bcpl-go/src/runtime"
+	"github.com/meadori/bcpl-go/src/token"
+	"sort"
+)
+
+// An event in the evaluation of a program.
+type Event int
+
+const (
+	Call   Event = iota // A call is about to be evaluated.
+	Enter               // A function body is about to be evaluated.
+	Return              // A call has returned.
+	Exec                // A command is about to be executed.
+)
+
+var events = [...]string{
+	Call:   "call",
+	Enter:  "enter",
+	Return: "return",
+	Exec:   "exec",
+}
+
+func (ev Event) String() string {
+	return events[ev]
+}
+
+// A Tracer is notified of each event at the position of the call,
+// function body or command concerned, while evaluation waits.  The call
+// stack may be inspected by the tracer.  Returning an error stops
+// evaluation with that error.
+type Tracer func(ev Event, pos token.Position) error
+
+func (in *Interp) trace(ev Event, pos token.Position) {
+	if len(in.frames) > 0 {
+		in.frames[len(in.frames)-1].Pos = pos
+	}
+	if in.Trace != nil {
+		if err := in.Trace(ev, pos); err != nil {
+			in.error(pos, "%v", err)
+		}
+	}
+}
+
+// The activation of a function or routine.
+type Frame struct {
+	Name    string         // The name of the function or routine called.
+	Section *ast.Program   // The section defining it, or nil if loaded by Load.
+	Params  *ast.NameList  // Its parameters.
+	Pos     token.Position // The position of the last event.
+	scope   *scope         // The scope of the command running.
+	params  *scope         // The scope binding the parameters.
+}
+
+// A named cell or manifest constant.
+type Variable struct {
+	Name   string
+	Addr   runtime.Word // The address of the cell, or 0 for a manifest constant.
+	Value  runtime.Word
+	Global bool // A cell in the global vector.
+	Vec    int  // The number of words of a vector defined by vec, or 0.
+}
+
+// Return the active function calls, outermost first.
+func (in *Interp) Frames() []*Frame {
+	return in.frames
+}
+
+func (in *Interp) variable(name string, b binding) Variable {
+	if b.manifest {
+		return Variable{name, 0, b.value, false, 0}
+	}
+	return Variable{name, b.addr, in.rt.Store.Load(b.addr), b.addr < runtime.NumGlobals, b.vec}
+}
+
+// Return the parameters of a function call followed by the names
+// defined by let, vec and for in the scopes of the command running,
+// outermost first and ordered by name within each scope.  Labels and
+// names hidden by an inner definition are left out.
+func (in *Interp) Locals(f *Frame) []Variable {
+	var scopes []*scope
+	for s := f.scope; s != f.params.outer; s = s.outer {
+		scopes = append([]*scope{s}, scopes...)
+	}
+	var vars []Variable
+	for _, p := range f.Params.Names {
+		if in.visible(f, f.params, p.Val) {
+			vars = append(vars, in.variable(p.Val, f.params.names[p.Val]))
+		}
+	}
+	for _, s := range scopes[1:] {
+		var names []string
+		for name, b := range s.names {
+			if !b.label && in.visible(f, s, name) {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			vars = append(vars, in.variable(name, s.names[name]))
+		}
+	}
+	return vars
+}
+
+// Report whether a name of a scope of a function call is not hidden
+// by a scope nested in it.
+func (in *Interp) visible(f *Frame, outer *scope, name string) bool {
+	for s := f.scope; s != outer; s = s.outer {
+		if _, ok := s.names[name]; ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Return the names declared or defined at the top level and at the
+// top level of each section, other than the predeclared library
+// routines, ordered by name.
+func (in *Interp) Globals() []Variable {
+	var vars []Variable
+	for _, s := range append([]*scope{in.top}, in.sections...) {
+		for name, b := range s.names {
+			if !b.lib {
+				vars = append(vars, in.variable(name, b))
+			}
+		}
+	}
+	sort.SliceStable(vars, func(i, j int) bool { return vars[i].Name < vars[j].Name })
+	return vars
+}
+
+// Return the value of the cell at an address, reporting whether
+// it is in the store.
+func (in *Interp) Peek(addr runtime.Word) (runtime.Word, bool) {
+	if addr < 0 || int(addr) >= in.rt.Store.Size() {
+		return 0, false
+	}
+	return in.rt.Store.Load(addr), true
+}
+
+// Flush any buffered output of the program.
+func (in *Interp) Flush() {
+	in.rt.Flush()
+}
+
+// Evaluate an expression in the scope of a function call, or in the
+// top-level scope if f is nil.  Events are not traced.
+func (in *Interp) EvalIn(f *Frame, e ast.Expr) (runtime.Word, error) {
+	s := in.top
+	if f != nil {
+		s = f.scope
+	}
+	trace := in.Trace
+	in.Trace = nil
+	defer func() {
+		in.Trace = trace
+	}()
+	return in.protect(func() runtime.Word {
+		return in.eval(s, e)
+	})
+}
@@ -0,0 +1,1231 @@
+// Copyright 2015 Meador Inge.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package ir
+
+import (
+	"fmt"
+	"github.com/meadori/bcpl-go/src/ast"
+	"github.com/meadori/bcpl-go/src/runtime"
+	"github.com/meadori/bcpl-go/src/token"
+)
+
+// An error found while building a module.
+type Error struct {
+	Pos token.Position
+	Msg string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: error: %s", e.Pos, e.Msg)
+}
+
+// A list of errors, in the order they were found.
+type ErrorList []*Error
+
+func (list ErrorList) Error() string {
+	switch len(list) {
+	case 0:
+		return "no errors"
+	case 1:
+		return list[0].Error()
+	}
+	return fmt.Sprintf("%s (and %d more errors)", list[0], len(list)-1)
+}
+
+// Return the list as an error, or nil if it is empty.
+func (list ErrorList) Err() error {
+	if len(list) == 0 {
+		return nil
+	}
+	return list
+}
+
+// What a name denotes.
+type symKind int
+
+const (
+	symValue    symKind = iota // A value.
+	symLocal                   // A local cell at the address value.
+	symGlobal                  // Global n.
+	symStatic                  // The static cell name.
+	symManifest                // The constant n.
+)
+
+type symbol struct {
+	kind  symKind
+	value *Value
+	n     int64
+	name  string
+	fn    string // The function a global or static cell holds, or "".
+}
+
+// A scope of a function maps names to symbols.  The outermost scope
+// is the top level of the module.
+type scope struct {
+	outer *scope
+	names map[string]*symbol
+}
+
+func newScope(outer *scope) *scope {
+	return &scope{outer, make(map[string]*symbol)}
+}
+
+func (s *scope) lookup(name string) (*symbol, bool) {
+	for ; s != nil; s = s.outer {
+		if sym, ok := s.names[name]; ok {
+			return sym, true
+		}
+	}
+	return nil, false
+}
+
+// The state of the commands of the function being built.
+type funcState struct {
+	cells    map[string]bool           // The names that live in local cells.
+	labels   map[string]*Block         // The block of each label name.
+	defined  map[string]bool           // The label names defined.
+	gotos    map[string]token.Position // The first goto of each label name.
+	cases    map[*ast.CaseCmd]*Block   // The blocks of the cases of the switchons.
+	loops    []*loop                   // The enclosing loops.
+	endcases []*Block                  // The blocks following the enclosing switchons.
+	arms     []matchArm                // The enclosing arms of matches.
+	valofs   []*valof                  // The enclosing valofs.
+}
+
+// A valof or match being built: the block its resultis commands or
+// arms jump to, and the values they give, in the order of its
+// predecessors.
+type valof struct {
+	join *Block
+	vals []*Value
+}
+
+// A loop being built: the block following it, which its breaks go
+// to, and the block of its next iteration, which its loop commands go
+// to, made by the first of them if the loop has none of its own.
+type loop struct {
+	pos  token.Position
+	exit *Block
+	next *Block
+}
+
+// An arm of a match being built: the block a next in its body goes
+// to, and the join an exit goes to with the value of the match so
+// far, or nil for zero.  An every has no join until an exit needs
+// one.
+type matchArm struct {
+	next *Block
+	exit *valof
+	val  *Value
+}
+
+func newFuncState(body ast.Node) *funcState {
+	return &funcState{
+		cells:   needCells(body),
+		labels:  make(map[string]*Block),
+		defined: make(map[string]bool),
+		gotos:   make(map[string]token.Position),
+		cases:   make(map[*ast.CaseCmd]*Block),
+	}
+}
+
+type builder struct {
+	m       *Module
+	errors  ErrorList
+	top     *scope             // The top-level scope.
+	statics map[string]*Static // The statics by name.
+	funcs   map[string]int     // The number of functions made for each name.
+	names   map[ast.Def]string // The name of the function made for each definition.
+	changed map[string]bool    // The names assigned or whose address is taken.
+	f       *Func              // The function being built.
+	fs      *funcState         // The state of its commands.
+	b       *Block             // The block being built.
+}
+
+func (b *builder) error(pos token.Position, format string, args ...interface{}) {
+	panic(&Error{pos, fmt.Sprintf(format, args...)})
+}
+
+// Call fn, recording the error it raises.
+func (b *builder) protect(fn func()) (ok bool) {
+	defer func() {
+		if x := recover(); x != nil {
+			e, isErr := x.(*Error)
+			if !isErr {
+				panic(x)
+			}
+			b.errors = append(b.errors, e)
+			ok = false
+		}
+	}()
+	fn()
+	return true
+}
+
+// Build the module of a program for a target, returning an ErrorList
+// holding the errors found if there are any.  A zero target is the
+// default target.
+func Build(prog *ast.Program, target runtime.Target) (*Module, error) {
+	if target.WordBits == 0 {
+		target = runtime.DefaultTarget
+	}
+	b := &builder{
+		m:       &Module{Target: target, Globals: make(map[string]int)},
+		top:     newScope(nil),
+		statics: make(map[string]*Static),
+		funcs:   make(map[string]int),
+		names:   make(map[ast.Def]string),
+		changed: changed(prog),
+	}
+	b.top.names["start"] = &symbol{kind: symGlobal, n: runtime.StartGlobal}
+	for _, g := range runtime.Library {
+		b.top.names[g.Name] = &symbol{kind: symGlobal, n: int64(g.Number)}
+	}
+	for _, decl := range prog.Decls {
+		b.protect(func() { b.declare(decl) })
+	}
+	b.declareDefs(prog.Defs)
+
+	b.f = NewFunc(b.m, "(init)", 0)
+	b.fs = newFuncState(prog)
+	b.b = b.f.Entry
+	b.m.Init = b.f
+	for _, def := range prog.Defs {
+		if !b.protect(func() { b.define(def) }) {
+			b.b = b.f.NewBlock(def.Pos())
+		}
+	}
+	b.protect(b.checkLabels)
+	b.b.Return(b.b.NewValue(token.Position{}, OpConst, 0, ""))
+	if err := b.errors.Err(); err != nil {
+		return nil, err
+	}
+	b.m.Init.promote()
+	for _, f := range b.m.Funcs {
+		f.promote()
+	}
+	return b.m, nil
+}
+
+// ----------------------------------------------------------------------------
+// Declarations and definitions
+
+// Add a static cell or vector with a name not yet used.
+func (b *builder) newStatic(name string, size int, init int64) *Static {
+	unique := name
+	for i := 2; b.statics[unique] != nil; i++ {
+		unique = fmt.Sprintf("%s#%d", name, i)
+	}
+	s := &Static{unique, size, init}
+	b.statics[unique] = s
+	b.m.Statics = append(b.m.Statics, s)
+	return s
+}
+
+func (b *builder) declare(decl ast.Decl) {
+	for _, v := range decl.VarDecls() {
+		switch decl.(type) {
+		case *ast.GlobalDecl:
+			if v.Constant < 0 || v.Constant >= runtime.NumGlobals {
+				b.error(v.NamePos, "global number %d out of range", v.Constant)
+			}
+			b.top.names[v.Name] = &symbol{kind: symGlobal, n: int64(v.Constant)}
+			b.m.Globals[v.Name] = v.Constant
+		case *ast.ConstantDecl:
+			b.top.names[v.Name] = &symbol{kind: symManifest, n: b.wrap(int64(v.Constant))}
+		case *ast.StaticDecl:
+			s := b.newStatic(v.Name, 1, b.wrap(int64(v.Constant)))
+			b.top.names[v.Name] = &symbol{kind: symStatic, name: s.Name}
+		}
+	}
+}
+
+// Return the names assigned to, or whose address is taken, anywhere
+// in a program.
+func changed(prog *ast.Program) map[string]bool {
+	names := make(map[string]bool)
+	ast.Inspect(prog, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.AssignCmd:
+			for _, e := range n.Lhs.Exprs {
+				if name, ok := unparen(e).(*ast.Name); ok {
+					names[name.Val] = true
+				}
+			}
+		case *ast.UnaryExpr:
+			if name, ok := unparen(n.X).(*ast.Name); ok && n.Op == token.LV {
+				names[name.Val] = true
+			}
+		}
+		return true
+	})
+	return names
+}
+
+// Give each name defined at the top level a cell.  A name already
+// declared global or static keeps its cell.  A cell given its value
+// by a single function or routine definition, and never assigned to
+// or having its address taken, is known to hold that function.
+func (b *builder) declareDefs(defs []ast.Def) {
+	count := make(map[string]int)
+	fns := make(map[string]ast.Def)
+	cell := func(name string) {
+		count[name]++
+		if sym, ok := b.top.names[name]; ok && (sym.kind == symGlobal || sym.kind == symStatic) {
+			return
+		}
+		s := b.newStatic(name, 1, 0)
+		b.top.names[name] = &symbol{kind: symStatic, name: s.Name}
+	}
+	for _, def := range defs {
+		for _, d := range ast.Defs(def) {
+			switch d := d.(type) {
+			case *ast.FuncDef:
+				cell(d.Name)
+				fns[d.Name] = d
+			case *ast.RoutineDef:
+				cell(d.Name)
+				fns[d.Name] = d
+			case *ast.SimpleDef:
+				for _, n := range d.Names.Names {
+					cell(n.Val)
+				}
+			case *ast.VecDef:
+				cell(d.Name)
+			}
+		}
+	}
+	for name, d := range fns {
+		if count[name] == 1 && !b.changed[name] {
+			b.top.names[name].fn = b.funcName(d)
+		}
+	}
+}
+
+// Return the name of the function made for a function or routine
+// definition.
+func (b *builder) funcName(d ast.Def) string {
+	if name, ok := b.names[d]; ok {
+		return name
+	}
+	var def string
+	switch d := d.(type) {
+	case *ast.FuncDef:
+		def = d.Name
+	case *ast.RoutineDef:
+		def = d.Name
+	}
+	name := def
+	if n := b.funcs[def]; n > 0 {
+		name = fmt.Sprintf("%s#%d", def, n+1)
+	}
+	b.funcs[def]++
+	b.names[d] = name
+	return name
+}
+
+// Give the names of simultaneous definitions their values.  As in
+// the interpreter the functions are defined first and the other
+// values are all computed before any is stored.
+func (b *builder) define(def ast.Def) {
+	defs := ast.Defs(def)
+	for _, d := range defs {
+		switch d := d.(type) {
+		case *ast.FuncDef:
+			f := b.function(d, d.NamePos, d.Params, d.Body, func(s *scope) {
+				b.b.Return(b.expr(s, d.Body))
+			})
+			b.store(d.NamePos, d.Name, b.b.NewValue(d.NamePos, OpFunc, 0, f.Name))
+		case *ast.RoutineDef:
+			f := b.function(d, d.NamePos, d.Params, d.Body, func(s *scope) {
+				b.cmd(s, d.Body)
+				b.b.Return(b.b.NewValue(d.Body.Pos(), OpConst, 0, ""))
+			})
+			b.store(d.NamePos, d.Name, b.b.NewValue(d.NamePos, OpFunc, 0, f.Name))
+		}
+	}
+
+	type value struct {
+		pos  token.Position
+		name string
+		val  *Value
+	}
+	var values []value
+	for _, d := range defs {
+		switch d := d.(type) {
+		case *ast.SimpleDef:
+			if len(d.Names.Names) != len(d.Exprs.Exprs) {
+				b.error(d.Pos(), "%d names defined by %d values",
+					len(d.Names.Names), len(d.Exprs.Exprs))
+			}
+			for i, n := range d.Names.Names {
+				values = append(values, value{n.NamePos, n.Val, b.expr(b.top, d.Exprs.Exprs[i])})
+			}
+		case *ast.VecDef:
+			n, ok := b.constant(b.top, d.Expr)
+			if !ok {
+				b.error(d.Expr.Pos(), "vector size is not a constant")
+			}
+			if n < 0 {
+				b.error(d.Expr.Pos(), "negative vector size %d", n)
+			}
+			s := b.newStatic(d.Name+".vec", int(n)+1, 0)
+			values = append(values, value{d.NamePos, d.Name, b.b.NewValue(d.NamePos, OpStatic, 0, s.Name)})
+		}
+	}
+	for _, v := range values {
+		b.store(v.pos, v.name, v.val)
+	}
+}
+
+// Store the value of a name defined at the top level in its cell.
+func (b *builder) store(pos token.Position, name string, val *Value) {
+	b.b.NewValue(pos, OpStore, 0, "", b.addr(pos, name, b.top.names[name]), val)
+}
+
+// Make the function for a function or routine definition, whose
+// body is built, and ended, in the scope of its parameters.
+func (b *builder) function(d ast.Def, pos token.Position, params *ast.NameList, body ast.Node, build func(s *scope)) *Func {
+	f := NewFunc(b.m, b.funcName(d), len(params.Names))
+	f.Pos = pos
+	f.Entry.Pos = pos
+	outer, outerState, outerBlock := b.f, b.fs, b.b
+	b.f, b.fs, b.b = f, newFuncState(body), f.Entry
+	defer func() {
+		b.f, b.fs, b.b = outer, outerState, outerBlock
+	}()
+
+	s := newScope(b.top)
+	for i, p := range params.Names {
+		b.bind(s, p, b.b.NewValue(p.NamePos, OpParam, int64(i), ""))
+	}
+	build(s)
+	b.checkLabels()
+	b.m.Funcs = append(b.m.Funcs, f)
+	return f
+}
+
+// Return an expression without its parentheses.
+func unparen(e ast.Expr) ast.Expr {
+	for p, ok := e.(*ast.ParenExpr); ok; p, ok = e.(*ast.ParenExpr) {
+		e = p.X
+	}
+	return e
+}
+
+// Return the names of a function that need local cells: those whose
+// address is taken, that are assigned to or that are the control
+// variables of for loops and, if it has labels or a switchon, every
+// name its blocks define, as a jump may pass over their definitions.
+func needCells(body ast.Node) map[string]bool {
+	cells := make(map[string]bool)
+	jumps := false
+	var lets []string
+	ast.Inspect(body, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.UnaryExpr:
+			if name, ok := unparen(n.X).(*ast.Name); ok && n.Op == token.LV {
+				cells[name.Val] = true
+			}
+		case *ast.AssignCmd:
+			for _, e := range n.Lhs.Exprs {
+				if name, ok := unparen(e).(*ast.Name); ok {
+					cells[name.Val] = true
+				}
+			}
+		case *ast.ForCmd:
+			cells[n.Var.Val] = true
+		case *ast.LabelCmd, *ast.SwitchonCmd:
+			jumps = true
+		case *ast.LetCmd:
+			for _, d := range ast.Defs(n.Def) {
+				switch d := d.(type) {
+				case *ast.SimpleDef:
+					for _, name := range d.Names.Names {
+						lets = append(lets, name.Val)
+					}
+				case *ast.VecDef:
+					lets = append(lets, d.Name)
+				}
+			}
+		}
+		return true
+	})
+	if jumps {
+		for _, name := range lets {
+			cells[name] = true
+		}
+	}
+	return cells
+}
+
+// Bind a name in a function to a value, in a local cell if it needs
+// one.
+func (b *builder) bind(s *scope, n *ast.Name, val *Value) {
+	if !b.fs.cells[n.Val] {
+		s.names[n.Val] = &symbol{kind: symValue, value: val}
+		return
+	}
+	addr := b.b.NewValue(n.NamePos, OpLocal, b.f.NewLocal(), "")
+	b.b.NewValue(n.NamePos, OpStore, 0, "", addr, val)
+	s.names[n.Val] = &symbol{kind: symLocal, value: addr}
+}
+
+// ----------------------------------------------------------------------------
+// Expressions
+
+func (b *builder) wrap(x int64) int64 {
+	return int64(b.m.Target.Wrap(runtime.Word(x)))
+}
+
+func (b *builder) truth(x bool) int64 {
+	if x {
+		return -1
+	}
+	return 0
+}
+
+// Return the value of a constant expression, and whether it is one.
+func (b *builder) constant(s *scope, e ast.Expr) (int64, bool) {
+	switch e := e.(type) {
+	case *ast.ConstExpr:
+		return b.wrap(int64(e.Contant)), true
+	case *ast.BoolExpr:
+		return b.truth(e.Value), true
+	case *ast.Name:
+		if sym, ok := s.lookup(e.Val); ok && sym.kind == symManifest {
+			return sym.n, true
+		}
+	case *ast.ParenExpr:
+		return b.constant(s, e.X)
+	case *ast.UnaryExpr:
+		x, ok := b.constant(s, e.X)
+		switch {
+		case ok && e.Op == token.PLUS:
+			return x, true
+		case ok && e.Op == token.MINUS:
+			return b.wrap(-x), true
+		}
+	case *ast.BinaryExpr:
+		x, xok := b.constant(s, e.X)
+		y, yok := b.constant(s, e.Y)
+		if !xok || !yok {
+			break
+		}
+		switch e.Op {
+		case token.PLUS:
+			return b.wrap(x + y), true
+		case token.MINUS:
+			return b.wrap(x - y), true
+		case token.STAR:
+			return b.wrap(x * y), true
+		case token.DIV:
+			if y != 0 {
+				return b.wrap(x / y), true
+			}
+		case token.REM:
+			if y != 0 {
+				return x % y, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// Return the address of the cell denoted by a symbol.
+func (b *builder) addr(pos token.Position, name string, sym *symbol) *Value {
+	switch sym.kind {
+	case symLocal:
+		return sym.value
+	case symGlobal:
+		return b.b.NewValue(pos, OpGlobal, sym.n, "")
+	case symStatic:
+		return b.b.NewValue(pos, OpStatic, 0, sym.name)
+	case symManifest:
+		b.error(pos, "manifest constant %s has no address", name)
+	}
+	b.error(pos, "%s has no address", name)
+	return nil
+}
+
+// Return the address denoted by an expression in an lv context.
+func (b *builder) lvalue(s *scope, e ast.Expr) *Value {
+	switch e := e.(type) {
+	case *ast.Name:
+		sym, ok := s.lookup(e.Val)
+		if !ok {
+			b.error(e.NamePos, "undeclared name %s", e.Val)
+		}
+		return b.addr(e.NamePos, e.Val, sym)
+	case *ast.ParenExpr:
+		return b.lvalue(s, e.X)
+	case *ast.VecApExpr:
+		x := b.expr(s, e.X)
+		return b.b.NewValue(e.Pos(), OpAdd, 0, "", x, b.expr(s, e.Index))
+	case *ast.UnaryExpr:
+		if e.Op == token.RV {
+			return b.expr(s, e.X)
+		}
+	}
+	b.error(e.Pos(), "expression has no address")
+	return nil
+}
+
+var unaryOps = map[token.TokenKind]Op{
+	token.MINUS:  OpNeg,
+	token.NOT:    OpNot,
+	token.RV:     OpLoad,
+	token.FMINUS: OpFNeg,
+	token.FLOAT:  OpFloat,
+	token.FIX:    OpFix,
+}
+
+var binaryOps = map[token.TokenKind]Op{
+	token.STAR:    OpMul,
+	token.DIV:     OpDiv,
+	token.REM:     OpRem,
+	token.PLUS:    OpAdd,
+	token.MINUS:   OpSub,
+	token.LSHIFT:  OpShl,
+	token.RSHIFT:  OpShr,
+	token.LOGAND:  OpAnd,
+	token.LOGOR:   OpOr,
+	token.EQV:     OpEqv,
+	token.NEQV:    OpNeqv,
+	token.PERCENT: OpGetByte,
+	token.FMUL:    OpFMul,
+	token.FDIV:    OpFDiv,
+	token.FPLUS:   OpFAdd,
+	token.FMINUS:  OpFSub,
+	token.EQ:      OpEq,
+	token.NE:      OpNe,
+	token.LS:      OpLt,
+	token.GR:      OpGt,
+	token.LE:      OpLe,
+	token.GE:      OpGe,
+	token.FEQ:     OpFEq,
+	token.FNE:     OpFNe,
+	token.FLS:     OpFLt,
+	token.FGR:     OpFGt,
+	token.FLE:     OpFLe,
+	token.FGE:     OpFGe,
+}
+
+// Report whether an operation is a relation.
+func (op Op) IsRelation() bool {
+	return OpEq <= op && op <= OpGe || OpFEq <= op && op <= OpFGe
+}
+
+func (b *builder) expr(s *scope, e ast.Expr) *Value {
+	switch e := e.(type) {
+	case *ast.Name:
+		sym, ok := s.lookup(e.Val)
+		if !ok {
+			b.error(e.NamePos, "undeclared name %s", e.Val)
+		}
+		switch {
+		case sym.kind == symValue:
+			return sym.value
+		case sym.kind == symManifest:
+			return b.b.NewValue(e.NamePos, OpConst, sym.n, "")
+		case sym.fn != "":
+			return b.b.NewValue(e.NamePos, OpFunc, 0, sym.fn)
+		}
+		return b.b.NewValue(e.NamePos, OpLoad, 0, "", b.addr(e.NamePos, e.Val, sym))
+	case *ast.ConstExpr:
+		return b.b.NewValue(e.ValuePos, OpConst, b.wrap(int64(e.Contant)), "")
+	case *ast.StringExpr:
+		return b.b.NewValue(e.ValuePos, OpString, 0, e.Lit)
+	case *ast.BoolExpr:
+		return b.b.NewValue(e.ValuePos, OpConst, b.truth(e.Value), "")
+	case *ast.ParenExpr:
+		return b.expr(s, e.X)
+	case *ast.CallExpr:
+		args := []*Value{b.expr(s, e.Fn)}
+		for _, arg := range e.Args.Exprs {
+			args = append(args, b.expr(s, arg))
+		}
+		return b.b.NewValue(e.Pos(), OpCall, 0, "", args...)
+	case *ast.VecApExpr:
+		return b.b.NewValue(e.Pos(), OpLoad, 0, "", b.lvalue(s, e))
+	case *ast.UnaryExpr:
+		switch e.Op {
+		case token.LV:
+			return b.lvalue(s, e.X)
+		case token.PLUS, token.FPLUS:
+			return b.expr(s, e.X)
+		}
+		op, ok := unaryOps[e.Op]
+		if !ok {
+			b.error(e.OpPos, "bad unary operator %s", e.Op)
+		}
+		return b.b.NewValue(e.OpPos, op, 0, "", b.expr(s, e.X))
+	case *ast.BinaryExpr:
+		op, ok := binaryOps[e.Op]
+		if !ok {
+			b.error(e.OpPos, "bad binary operator %s", e.Op)
+		}
+		if op.IsRelation() {
+			return b.relation(s, e)
+		}
+		x := b.expr(s, e.X)
+		return b.b.NewValue(e.OpPos, op, 0, "", x, b.expr(s, e.Y))
+	case *ast.CondExpr:
+		cond := b.expr(s, e.Cond)
+		then, els, join := b.f.NewBlock(e.Then.Pos()), b.f.NewBlock(e.Else.Pos()), b.f.NewBlock(e.Pos())
+		b.b.If(cond, then, els)
+		b.b = then
+		x := b.expr(s, e.Then)
+		b.b.Jump(join)
+		b.b = els
+		y := b.expr(s, e.Else)
+		b.b.Jump(join)
+		b.b = join
+		return b.phi(e.Pos(), []*Value{x, y})
+	case *ast.QueryExpr:
+		return b.b.NewValue(e.Query, OpConst, 0, "")
+	case *ast.MatchExpr:
+		return b.match(s, e)
+	case *ast.ValofExpr:
+		v := &valof{join: b.f.NewBlock(e.Valof)}
+		b.fs.valofs = append(b.fs.valofs, v)
+		b.cmd(s, e.Body)
+		b.fs.valofs = b.fs.valofs[:len(b.fs.valofs)-1]
+		b.b.Fail("valof ended without resultis")
+		b.b = v.join
+		return b.phi(e.Valof, v.vals)
+	}
+	b.error(e.Pos(), "cannot compile %T", e)
+	return nil
+}
+
+// Return the value of the current block, a join, given the values
+// on its incoming edges in the order of its predecessors.
+func (b *builder) phi(pos token.Position, vals []*Value) *Value {
+	if len(vals) == 0 {
+		return b.b.NewValue(pos, OpConst, 0, "")
+	}
+	for _, v := range vals[1:] {
+		if v != vals[0] {
+			return b.b.NewValue(pos, OpPhi, 0, "", vals...)
+		}
+	}
+	return vals[0]
+}
+
+// Compute a relation.  Relations may be chained, so that
+// A < B <= C means A < B & B <= C, each operand being evaluated
+// once.
+func (b *builder) relation(s *scope, e *ast.BinaryExpr) *Value {
+	var ops []*ast.BinaryExpr
+	x := ast.Expr(e)
+	for {
+		r, ok := x.(*ast.BinaryExpr)
+		if !ok || !binaryOps[r.Op].IsRelation() {
+			break
+		}
+		ops = append(ops, r)
+		x = r.X
+	}
+
+	left := b.expr(s, x)
+	var result *Value
+	for i := len(ops) - 1; i >= 0; i-- {
+		right := b.expr(s, ops[i].Y)
+		r := b.b.NewValue(ops[i].OpPos, binaryOps[ops[i].Op], 0, "", left, right)
+		if result == nil {
+			result = r
+		} else {
+			result = b.b.NewValue(ops[i].OpPos, OpAnd, 0, "", result, r)
+		}
+		left = right
+	}
+	return result
+}
+
+// ----------------------------------------------------------------------------
+// Pattern matching
+
+// Compute a pattern matching expression.  The arms of a match are
+// tried in turn and the first to match gives the value; those of
+// an every are all tried, the value being that of the last to match.
+// A run of arms of a match on one argument whose patterns are
+// distinct constants becomes a switch.
+func (b *builder) match(s *scope, e *ast.MatchExpr) *Value {
+	var args []*Value
+	for _, arg := range e.Args.Exprs {
+		args = append(args, b.expr(s, arg))
+	}
+
+	if e.Every {
+		val := b.b.NewValue(e.Match, OpConst, 0, "")
+		done := new(valof)
+		for _, arm := range e.Arms {
+			next := b.f.NewBlock(arm.Colon)
+			bound := b.test(s, arm, args, next)
+			x := b.arm(s, arm, bound, matchArm{next, done, val})
+			body := b.b
+			b.b.Jump(next)
+			b.b = next
+			var vals []*Value
+			for _, pred := range next.Preds {
+				if pred == body {
+					vals = append(vals, x)
+				} else {
+					vals = append(vals, val)
+				}
+			}
+			val = b.phi(arm.Colon, vals)
+		}
+		if done.join == nil {
+			return val
+		}
+		done.vals = append(done.vals, val)
+		b.enter(done.join)
+		return b.phi(e.Match, done.vals)
+	}
+
+	join := &valof{join: b.f.NewBlock(e.Match)}
+	arms := e.Arms
+	if len(args) == 1 {
+		arms = b.switchArms(s, arms, args[0], join)
+	}
+	for _, arm := range arms {
+		next := b.f.NewBlock(arm.Colon)
+		bound := b.test(s, arm, args, next)
+		join.vals = append(join.vals, b.arm(s, arm, bound, matchArm{next, join, nil}))
+		b.b.Jump(join.join)
+		b.b = next
+	}
+	b.b.Fail("no pattern matches")
+	b.b = join.join
+	return b.phi(e.Match, join.vals)
+}
+
+// Make a switch for the leading arms of a match whose single patterns
+// are different constants, adding the values of the arms jumping to
+// the join, and return the arms left to try.
+func (b *builder) switchArms(s *scope, arms []*ast.MatchArm, x *Value, join *valof) []*ast.MatchArm {
+	var cases []int64
+	var bodies []*ast.MatchArm
+	seen := make(map[int64]bool)
+	n := 0
+	for ; n < len(arms); n++ {
+		pats := arms[n].Patterns.Exprs
+		if len(pats) != 1 {
+			break
+		}
+		c, ok := b.constant(s, pats[0])
+		if !ok || seen[c] {
+			break
+		}
+		seen[c] = true
+		cases = append(cases, c)
+		bodies = append(bodies, arms[n])
+	}
+	if len(cases) < 2 {
+		return arms
+	}
+
+	var targets []*Block
+	for _, arm := range bodies {
+		targets = append(targets, b.f.NewBlock(arm.Colon))
+	}
+	def := b.f.NewBlock(arms[n-1].Colon)
+	b.b.Switch(x, cases, targets, def)
+	for i, arm := range bodies {
+		b.b = targets[i]
+		join.vals = append(join.vals, b.arm(s, arm, nil, matchArm{def, join, nil}))
+		b.b.Jump(join.join)
+	}
+	b.b = def
+	return arms[n:]
+}
+
+// Test the patterns of an arm, going to fail if they do not match
+// and continuing in a new block if they do.  Return the values of
+// the names the patterns bind.
+func (b *builder) test(s *scope, arm *ast.MatchArm, args []*Value, fail *Block) map[string]*Value {
+	bound := make(map[string]*Value)
+	for i, pat := range arm.Patterns.Exprs {
+		switch pat := pat.(type) {
+		case *ast.QueryExpr:
+			continue
+		case *ast.Name:
+			if sym, ok := s.lookup(pat.Val); !ok || sym.kind != symManifest {
+				bound[pat.Val] = args[i]
+				continue
+			}
+		}
+		cond := b.b.NewValue(pat.Pos(), OpEq, 0, "", args[i], b.expr(s, pat))
+		ok := b.f.NewBlock(pat.Pos())
+		b.b.If(cond, ok, fail)
+		b.b = ok
+	}
+	return bound
+}
+
+// Compute the body of an arm with the names its patterns bind.
+func (b *builder) arm(s *scope, arm *ast.MatchArm, bound map[string]*Value, m matchArm) *Value {
+	inner := newScope(s)
+	for _, pat := range arm.Patterns.Exprs {
+		if n, ok := pat.(*ast.Name); ok && bound[n.Val] != nil {
+			if _, done := inner.names[n.Val]; !done {
+				b.bind(inner, n, bound[n.Val])
+			}
+		}
+	}
+	b.fs.arms = append(b.fs.arms, m)
+	x := b.expr(inner, arm.Body)
+	b.fs.arms = b.fs.arms[:len(b.fs.arms)-1]
+	return x
+}
+
+// ----------------------------------------------------------------------------
+// Commands
+
+// Return the block of a label name of the function being built.
+func (b *builder) labelBlock(pos token.Position, name string) *Block {
+	l, ok := b.fs.labels[name]
+	if !ok {
+		l = b.f.NewBlock(pos)
+		b.fs.labels[name] = l
+	}
+	return l
+}
+
+// Report a goto a label the function does not define.
+func (b *builder) checkLabels() {
+	var first *Error
+	for name, pos := range b.fs.gotos {
+		if !b.fs.defined[name] && (first == nil || pos.Offset < first.Pos.Offset) {
+			first = &Error{pos, fmt.Sprintf("no label %s", name)}
+		}
+	}
+	if first != nil {
+		panic(first)
+	}
+}
+
+// End the current block by jumping to another and continue in a new
+// block, which nothing reaches.
+func (b *builder) jump(pos token.Position, to *Block) {
+	b.b.Jump(to)
+	b.b = b.f.NewBlock(pos)
+}
+
+// Continue in a block, which the current block falls into.
+func (b *builder) enter(next *Block) {
+	b.b.Jump(next)
+	b.b = next
+}
+
+// Give the names of simultaneous definitions in a block their
+// values, all computed before any is bound.  The cells of a vector
+// are local cells of the frame.
+func (b *builder) defineLocal(s *scope, def ast.Def) {
+	type value struct {
+		name *ast.Name
+		val  *Value
+	}
+	var values []value
+	for _, d := range ast.Defs(def) {
+		switch d := d.(type) {
+		case *ast.SimpleDef:
+			if len(d.Names.Names) != len(d.Exprs.Exprs) {
+				b.error(d.Pos(), "%d names defined by %d values",
+					len(d.Names.Names), len(d.Exprs.Exprs))
+			}
+			for i, n := range d.Names.Names {
+				values = append(values, value{n, b.expr(s, d.Exprs.Exprs[i])})
+			}
+		case *ast.VecDef:
+			n, ok := b.constant(s, d.Expr)
+			if !ok {
+				b.error(d.Expr.Pos(), "vector size is not a constant")
+			}
+			if n < 0 {
+				b.error(d.Expr.Pos(), "negative vector size %d", n)
+			}
+			v := b.f.NewLocal()
+			for i := int64(0); i < n; i++ {
+				b.f.NewLocal()
+			}
+			name := &ast.Name{d.NamePos, d.Name}
+			values = append(values, value{name, b.b.NewValue(d.NamePos, OpLocal, v, "")})
+		default:
+			b.error(d.Pos(), "local function definitions are not supported")
+		}
+	}
+	for _, v := range values {
+		b.bind(s, v.name, v.val)
+	}
+}
+
+// Store a value in the cell of a name.
+func (b *builder) assignName(s *scope, n *ast.Name, val *Value) {
+	sym, ok := s.lookup(n.Val)
+	if !ok {
+		b.error(n.NamePos, "undeclared name %s", n.Val)
+	}
+	if sym.kind == symManifest {
+		b.error(n.NamePos, "cannot assign to manifest constant %s", n.Val)
+	}
+	b.b.NewValue(n.NamePos, OpStore, 0, "", b.addr(n.NamePos, n.Val, sym), val)
+}
+
+// Build the body of a loop.
+func (b *builder) loop(l *loop, body func()) {
+	b.fs.loops = append(b.fs.loops, l)
+	body()
+	b.fs.loops = b.fs.loops[:len(b.fs.loops)-1]
+}
+
+// Build a command.
+func (b *builder) cmd(s *scope, c ast.Cmd) {
+	switch c := c.(type) {
+	case *ast.BlockCmd:
+		inner := newScope(s)
+		for _, item := range c.Items {
+			b.cmd(inner, item)
+		}
+	case *ast.LetCmd:
+		b.defineLocal(s, c.Def)
+	case *ast.AssignCmd:
+		var vals []*Value
+		for _, e := range c.Rhs.Exprs {
+			vals = append(vals, b.expr(s, e))
+		}
+		for i, e := range c.Lhs.Exprs {
+			if n, ok := unparen(e).(*ast.Name); ok {
+				b.assignName(s, n, vals[i])
+				continue
+			}
+			b.b.NewValue(c.Ass, OpStore, 0, "", b.lvalue(s, e), vals[i])
+		}
+	case *ast.ExprCmd:
+		b.expr(s, c.X)
+	case *ast.IfCmd:
+		cond := b.expr(s, c.Cond)
+		body, join := b.f.NewBlock(c.Body.Pos()), b.f.NewBlock(c.If)
+		if c.Unless {
+			b.b.If(cond, join, body)
+		} else {
+			b.b.If(cond, body, join)
+		}
+		b.b = body
+		b.cmd(s, c.Body)
+		b.enter(join)
+	case *ast.TestCmd:
+		cond := b.expr(s, c.Cond)
+		then, els, join := b.f.NewBlock(c.Then.Pos()), b.f.NewBlock(c.Else.Pos()), b.f.NewBlock(c.Test)
+		b.b.If(cond, then, els)
+		b.b = then
+		b.cmd(s, c.Then)
+		b.b.Jump(join)
+		b.b = els
+		b.cmd(s, c.Else)
+		b.enter(join)
+	case *ast.WhileCmd:
+		head, body, exit := b.f.NewBlock(c.While), b.f.NewBlock(c.Body.Pos()), b.f.NewBlock(c.While)
+		b.enter(head)
+		cond := b.expr(s, c.Cond)
+		if c.Until {
+			b.b.If(cond, exit, body)
+		} else {
+			b.b.If(cond, body, exit)
+		}
+		b.b = body
+		b.loop(&loop{c.While, exit, head}, func() { b.cmd(s, c.Body) })
+		b.b.Jump(head)
+		b.b = exit
+	case *ast.RepeatCmd:
+		top, exit := b.f.NewBlock(c.Pos()), b.f.NewBlock(c.OpPos)
+		b.enter(top)
+		l := &loop{c.OpPos, exit, nil}
+		b.loop(l, func() { b.cmd(s, c.Body) })
+		if l.next != nil {
+			b.enter(l.next)
+		}
+		switch c.Op {
+		case token.REPEAT:
+			b.b.Jump(top)
+		case token.REPEATWHILE:
+			b.b.If(b.expr(s, c.Cond), top, exit)
+		case token.REPEATUNTIL:
+			b.b.If(b.expr(s, c.Cond), exit, top)
+		}
+		b.b = exit
+	case *ast.ForCmd:
+		step := int64(1)
+		if c.By != nil {
+			k, ok := b.constant(s, c.By)
+			if !ok {
+				b.error(c.By.Pos(), "for step is not a constant")
+			}
+			step = k
+		}
+		inner := newScope(s)
+		from := b.expr(s, c.From)
+		limit := b.expr(s, c.To)
+		b.bind(inner, c.Var, from)
+		v := inner.names[c.Var.Val].value
+		head, body, exit := b.f.NewBlock(c.For), b.f.NewBlock(c.Body.Pos()), b.f.NewBlock(c.For)
+		b.enter(head)
+		i := head.NewValue(c.For, OpLoad, 0, "", v)
+		cmp := OpLe
+		if step < 0 {
+			cmp = OpGe
+		}
+		head.If(head.NewValue(c.For, cmp, 0, "", i, limit), body, exit)
+		b.b = body
+		l := &loop{c.For, exit, nil}
+		b.loop(l, func() { b.cmd(inner, c.Body) })
+		if l.next != nil {
+			b.enter(l.next)
+		}
+		i = b.b.NewValue(c.For, OpLoad, 0, "", v)
+		inc := b.b.NewValue(c.For, OpConst, step, "")
+		b.b.NewValue(c.For, OpStore, 0, "", v, b.b.NewValue(c.For, OpAdd, 0, "", i, inc))
+		b.b.Jump(head)
+		b.b = exit
+	case *ast.JumpCmd:
+		switch c.Tok {
+		case token.BREAK, token.LOOP:
+			if len(b.fs.loops) == 0 {
+				b.error(c.TokPos, "%s outside a loop", c.Tok)
+			}
+			l := b.fs.loops[len(b.fs.loops)-1]
+			if c.Tok == token.BREAK {
+				b.jump(c.TokPos, l.exit)
+				return
+			}
+			if l.next == nil {
+				l.next = b.f.NewBlock(l.pos)
+			}
+			b.jump(c.TokPos, l.next)
+			return
+		case token.ENDCASE:
+			if len(b.fs.endcases) == 0 {
+				b.error(c.TokPos, "endcase outside a switchon")
+			}
+			b.jump(c.TokPos, b.fs.endcases[len(b.fs.endcases)-1])
+			return
+		case token.NEXT, token.EXIT:
+			if len(b.fs.arms) == 0 {
+				b.error(c.TokPos, "%s outside a match", c.Tok)
+			}
+			m := b.fs.arms[len(b.fs.arms)-1]
+			if c.Tok == token.NEXT {
+				b.jump(c.TokPos, m.next)
+				return
+			}
+			val := m.val
+			if val == nil {
+				val = b.b.NewValue(c.TokPos, OpConst, 0, "")
+			}
+			if m.exit.join == nil {
+				m.exit.join = b.f.NewBlock(c.TokPos)
+			}
+			m.exit.vals = append(m.exit.vals, val)
+			b.jump(c.TokPos, m.exit.join)
+			return
+		case token.FINISH:
+			stop := b.b.NewValue(c.TokPos, OpGlobal, runtime.StopGlobal, "")
+			b.b.NewValue(c.TokPos, OpCall, 0, "",
+				b.b.NewValue(c.TokPos, OpLoad, 0, "", stop), b.b.NewValue(c.TokPos, OpConst, 0, ""))
+		}
+		b.b.Return(b.b.NewValue(c.TokPos, OpConst, 0, ""))
+		b.b = b.f.NewBlock(c.TokPos)
+	case *ast.GotoCmd:
+		if _, ok := b.fs.gotos[c.Label.Val]; !ok {
+			b.fs.gotos[c.Label.Val] = c.Label.NamePos
+		}
+		b.jump(c.Goto, b.labelBlock(c.Label.NamePos, c.Label.Val))
+	case *ast.ResultisCmd:
+		if len(b.fs.valofs) == 0 {
+			b.error(c.Resultis, "resultis outside valof")
+		}
+		v := b.fs.valofs[len(b.fs.valofs)-1]
+		v.vals = append(v.vals, b.expr(s, c.X))
+		b.jump(c.Resultis, v.join)
+	case *ast.SwitchonCmd:
+		b.switchon(s, c)
+	case *ast.CaseCmd:
+		l, ok := b.fs.cases[c]
+		if !ok {
+			b.error(c.Case, "case outside switchon")
+		}
+		b.enter(l)
+		if c.Body != nil {
+			b.cmd(s, c.Body)
+		}
+	case *ast.LabelCmd:
+		if b.fs.defined[c.Label.Val] {
+			b.error(c.Label.NamePos, "label %s redefined", c.Label.Val)
+		}
+		b.fs.defined[c.Label.Val] = true
+		b.enter(b.labelBlock(c.Label.NamePos, c.Label.Val))
+		if c.Body != nil {
+			b.cmd(s, c.Body)
+		}
+	default:
+		b.error(c.Pos(), "cannot compile %T", c)
+	}
+}
+
+// Return the cases of a switchon, those of switchons nested in its
+// body excepted.
+func cases(c *ast.SwitchonCmd) []*ast.CaseCmd {
+	var list []*ast.CaseCmd
+	ast.Inspect(c.Body, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.CaseCmd:
+			list = append(list, n)
+		case *ast.SwitchonCmd, *ast.ValofExpr:
+			return false
+		}
+		return true
+	})
+	return list
+}
+
+// Build a switchon as a switch to the blocks of its cases, which
+// fall into each other, or to its default.
+func (b *builder) switchon(s *scope, c *ast.SwitchonCmd) {
+	x := b.expr(s, c.X)
+	exit := b.f.NewBlock(c.Switchon)
+	def := exit
+	var vals []int64
+	var targets []*Block
+	seen := make(map[int64]bool)
+	for _, k := range cases(c) {
+		l := b.f.NewBlock(k.Case)
+		b.fs.cases[k] = l
+		if k.Value == nil {
+			if def != exit {
+				b.error(k.Case, "more than one default")
+			}
+			def = l
+			continue
+		}
+		v, ok := b.constant(s, k.Value)
+		if !ok {
+			b.error(k.Value.Pos(), "case value is not a constant")
+		}
+		if seen[v] {
+			b.error(k.Value.Pos(), "duplicate case %d", v)
+		}
+		seen[v] = true
+		vals = append(vals, v)
+		targets = append(targets, l)
+	}
+	b.b.Switch(x, vals, targets, def)
+	b.b = b.f.NewBlock(c.Body.Pos())
+	b.fs.endcases = append(b.fs.endcases, exit)
+	b.cmd(s, c.Body)
+	b.fs.endcases = b.fs.endcases[:len(b.fs.endcases)-1]
+	b.enter(exit)
+}
@@ -0,0 +1,112 @@
+// Copyright 2015 Meador Inge.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package ir
+
+// Return the blocks reachable from the entry in postorder.
+func (f *Func) Postorder() []*Block {
+	seen := make([]bool, f.NumBlocks())
+	var order []*Block
+	var visit func(b *Block)
+	visit = func(b *Block) {
+		seen[b.ID] = true
+		for _, succ := range b.Succs {
+			if !seen[succ.ID] {
+				visit(succ)
+			}
+		}
+		order = append(order, b)
+	}
+	visit(f.Entry)
+	return order
+}
+
+// Return the blocks reachable from the entry in reverse postorder,
+// so that each block comes before its successors except along the
+// back edges of loops.
+func (f *Func) ReversePostorder() []*Block {
+	order := f.Postorder()
+	for i, j := 0, len(order)-1; i < j; i, j = i+1, j-1 {
+		order[i], order[j] = order[j], order[i]
+	}
+	return order
+}
+
+// The dominator tree of a function: block a dominates block b if
+// every path from the entry to b passes through a.
+type DomTree struct {
+	idom []*Block // The immediate dominator of each block, by ID.
+	num  []int    // The postorder number of each block plus one, or 0 if unreachable.
+}
+
+// Compute the dominator tree of the function by the iterative method
+// of Cooper, Harvey and Kennedy.
+func (f *Func) Dominators() *DomTree {
+	post := f.Postorder()
+	t := &DomTree{make([]*Block, f.NumBlocks()), make([]int, f.NumBlocks())}
+	for i, b := range post {
+		t.num[b.ID] = i + 1
+	}
+	t.idom[f.Entry.ID] = f.Entry
+
+	intersect := func(a, b *Block) *Block {
+		for a != b {
+			for t.num[a.ID] < t.num[b.ID] {
+				a = t.idom[a.ID]
+			}
+			for t.num[b.ID] < t.num[a.ID] {
+				b = t.idom[b.ID]
+			}
+		}
+		return a
+	}
+	for changed := true; changed; {
+		changed = false
+		for i := len(post) - 2; i >= 0; i-- {
+			b := post[i]
+			var idom *Block
+			for _, pred := range b.Preds {
+				if t.idom[pred.ID] == nil {
+					continue
+				}
+				if idom == nil {
+					idom = pred
+				} else {
+					idom = intersect(pred, idom)
+				}
+			}
+			if t.idom[b.ID] != idom {
+				t.idom[b.ID] = idom
+				changed = true
+			}
+		}
+	}
+	return t
+}
+
+// Report whether a block is reachable from the entry.
+func (t *DomTree) Reachable(b *Block) bool {
+	return t.num[b.ID] != 0
+}
+
+// Return the immediate dominator of a block, or nil for the entry
+// and unreachable blocks.
+func (t *DomTree) Idom(b *Block) *Block {
+	if d := t.idom[b.ID]; d != b {
+		return d
+	}
+	return nil
+}
+
+// Report whether block a dominates block b.  Every reachable block
+// dominates itself.
+func (t *DomTree) Dominates(a, b *Block) bool {
+	if !t.Reachable(a) || !t.Reachable(b) {
+		return false
+	}
+	for t.num[b.ID] < t.num[a.ID] {
+		b = t.idom[b.ID]
+	}
+	return a == b
+}
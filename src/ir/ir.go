@@ -0,0 +1,404 @@
+// Copyright 2015 Meador Inge.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+// Package ir defines an intermediate representation of BCPL programs
+// for the compiler's back ends.
+//
+// Each function is a control flow graph of basic blocks holding
+// values in static single assignment form.  BCPL has a single data
+// type, so every value is a word of the module's target.  Variables
+// that are assigned to or whose address is taken, the control
+// variables of for loops and, in a function with labels or a
+// switchon, the variables its blocks define live in local cells of
+// the function's frame and are reached through Load and Store; other
+// variables are plain values.  Once a function is built the cells
+// whose addresses are only loaded from and stored to are promoted to
+// values, with phis where control flow joins, so only the cells whose
+// addresses are taken remain.  The vectors blocks define are runs of
+// local cells.  A block ends by jumping to one successor, branching on a
+// condition, switching on a value, returning or making a tail call,
+// so the graph can express loops, jumps to labels and switchon as
+// well as conditional and pattern matching expressions.
+package ir
+
+import (
+	"fmt"
+	"github.com/meadori/bcpl-go/src/runtime"
+	"github.com/meadori/bcpl-go/src/token"
+)
+
+// An operation computing a value.
+type Op int
+
+const (
+	OpInvalid Op = iota
+
+	// Constants and addresses
+	OpConst  // The word Aux.
+	OpString // The address of the string constant with literal Sym.
+	OpFunc   // The routine of the function named Sym.
+	OpParam  // Parameter Aux of the function.
+	OpGlobal // The address of global Aux.
+	OpStatic // The address of the static cell or vector named Sym.
+	OpLocal  // The address of local cell Aux of the frame; consecutive cells have consecutive addresses.
+
+	// Memory and calls
+	OpLoad  // The word at address Args[0].
+	OpStore // Store Args[1] at address Args[0]; it has no value.
+	OpCall  // Call Args[0] with the arguments Args[1:].
+
+	// Joins
+	OpPhi  // The argument for the predecessor the block was entered from.
+	OpCopy // The value of Args[0].
+
+	// Word operations
+	OpNeg
+	OpNot
+	OpAdd
+	OpSub
+	OpMul
+	OpDiv
+	OpRem
+	OpShl // A logical left shift, giving 0 for a negative count.
+	OpShr // A logical right shift, giving 0 for a negative count.
+	OpAnd
+	OpOr
+	OpEqv
+	OpNeqv
+	OpGetByte // Character Args[1] of the string at Args[0].
+
+	// Relations, giving true or false
+	OpEq
+	OpNe
+	OpLt
+	OpGt
+	OpLe
+	OpGe
+
+	// Floating point operations
+	OpFNeg
+	OpFloat
+	OpFix
+	OpFAdd
+	OpFSub
+	OpFMul
+	OpFDiv
+	OpFEq
+	OpFNe
+	OpFLt
+	OpFGt
+	OpFLe
+	OpFGe
+
+	numOps
+)
+
+// The properties of an operation.
+type opInfo struct {
+	name   string
+	args   int  // The number of arguments, or -1 for any number.
+	effect bool // Whether it reads or writes memory or may fault.
+}
+
+var opInfos = [...]opInfo{
+	OpInvalid: {"Invalid", 0, false},
+	OpConst:   {"Const", 0, false},
+	OpString:  {"String", 0, false},
+	OpFunc:    {"Func", 0, false},
+	OpParam:   {"Param", 0, false},
+	OpGlobal:  {"Global", 0, false},
+	OpStatic:  {"Static", 0, false},
+	OpLocal:   {"Local", 0, false},
+	OpLoad:    {"Load", 1, true},
+	OpStore:   {"Store", 2, true},
+	OpCall:    {"Call", -1, true},
+	OpPhi:     {"Phi", -1, false},
+	OpCopy:    {"Copy", 1, false},
+	OpNeg:     {"Neg", 1, false},
+	OpNot:     {"Not", 1, false},
+	OpAdd:     {"Add", 2, false},
+	OpSub:     {"Sub", 2, false},
+	OpMul:     {"Mul", 2, false},
+	OpDiv:     {"Div", 2, true},
+	OpRem:     {"Rem", 2, true},
+	OpShl:     {"Shl", 2, false},
+	OpShr:     {"Shr", 2, false},
+	OpAnd:     {"And", 2, false},
+	OpOr:      {"Or", 2, false},
+	OpEqv:     {"Eqv", 2, false},
+	OpNeqv:    {"Neqv", 2, false},
+	OpGetByte: {"GetByte", 2, true},
+	OpEq:      {"Eq", 2, false},
+	OpNe:      {"Ne", 2, false},
+	OpLt:      {"Lt", 2, false},
+	OpGt:      {"Gt", 2, false},
+	OpLe:      {"Le", 2, false},
+	OpGe:      {"Ge", 2, false},
+	OpFNeg:    {"FNeg", 1, true},
+	OpFloat:   {"Float", 1, true},
+	OpFix:     {"Fix", 1, true},
+	OpFAdd:    {"FAdd", 2, true},
+	OpFSub:    {"FSub", 2, true},
+	OpFMul:    {"FMul", 2, true},
+	OpFDiv:    {"FDiv", 2, true},
+	OpFEq:     {"FEq", 2, true},
+	OpFNe:     {"FNe", 2, true},
+	OpFLt:     {"FLt", 2, true},
+	OpFGt:     {"FGt", 2, true},
+	OpFLe:     {"FLe", 2, true},
+	OpFGe:     {"FGe", 2, true},
+}
+
+func (op Op) String() string {
+	if 0 <= op && op < numOps {
+		return opInfos[op].name
+	}
+	return fmt.Sprintf("Op(%d)", int(op))
+}
+
+// Report whether the operation reads or writes memory or may fault,
+// so that it may not be moved, merged or removed.  Floating point
+// operations fault on targets without floating point words.
+func (op Op) HasEffect() bool {
+	return opInfos[op].effect
+}
+
+// A value computed by an operation.
+type Value struct {
+	ID    int            // The number of the value, unique in its function.
+	Op    Op             // The operation.
+	Args  []*Value       // The arguments.
+	Aux   int64          // The constant, parameter, global or local number.
+	Sym   string         // The function, static or string literal.
+	Block *Block         // The block holding the value.
+	Pos   token.Position // The position of the source it was made from.
+}
+
+func (v *Value) String() string {
+	return fmt.Sprintf("v%d", v.ID)
+}
+
+// Make the value a constant.
+func (v *Value) SetConst(c int64) {
+	v.Op, v.Aux, v.Sym, v.Args = OpConst, c, "", nil
+}
+
+// Make the value a copy of another.
+func (v *Value) SetCopy(x *Value) {
+	v.Op, v.Aux, v.Sym, v.Args = OpCopy, 0, "", []*Value{x}
+}
+
+// The kind of control transfer that ends a block.
+type BlockKind int
+
+const (
+	BlockInvalid  BlockKind = iota
+	BlockPlain              // Jump to Succs[0].
+	BlockIf                 // Go to Succs[0] if Control is not false and to Succs[1] otherwise.
+	BlockSwitch             // Go to Succs[i] if Control is Cases[i], or to the last successor.
+	BlockReturn             // Return Control.
+	BlockFail               // Stop with the error Msg.
+	BlockTailCall           // Return the result of Control, the last value, a call reusing the frame.
+)
+
+var blockKinds = [...]string{
+	BlockInvalid:  "Invalid",
+	BlockPlain:    "Jump",
+	BlockIf:       "If",
+	BlockSwitch:   "Switch",
+	BlockReturn:   "Return",
+	BlockFail:     "Fail",
+	BlockTailCall: "TailCall",
+}
+
+func (k BlockKind) String() string {
+	if 0 <= k && int(k) < len(blockKinds) {
+		return blockKinds[k]
+	}
+	return fmt.Sprintf("BlockKind(%d)", int(k))
+}
+
+// A basic block: a sequence of values ended by a control transfer.
+// Phi values come first.
+type Block struct {
+	ID      int            // The number of the block, unique in its function.
+	Kind    BlockKind      // How the block ends.
+	Values  []*Value       // The values, in order.
+	Control *Value         // The value tested or returned.
+	Cases   []int64        // The cases of a switch.
+	Msg     string         // The error of a failing block.
+	Succs   []*Block       // The successors.
+	Preds   []*Block       // The predecessors, in the order of the arguments of phis.
+	Func    *Func          // The function holding the block.
+	Pos     token.Position // The position of the source it was made from.
+}
+
+func (b *Block) String() string {
+	return fmt.Sprintf("b%d", b.ID)
+}
+
+// Add a value to the end of the block.
+func (b *Block) NewValue(pos token.Position, op Op, aux int64, sym string, args ...*Value) *Value {
+	v := b.Func.newValue(pos, op, aux, sym, args)
+	v.Block = b
+	b.Values = append(b.Values, v)
+	return v
+}
+
+// Add an edge from the block to a successor.
+func (b *Block) AddSucc(succ *Block) {
+	b.Succs = append(b.Succs, succ)
+	succ.Preds = append(succ.Preds, b)
+}
+
+// Remove the edge to successor i of the block, and the arguments of
+// the phis of the successor for the edge.
+func (b *Block) RemoveSucc(i int) {
+	succ := b.Succs[i]
+	k := 0 // The number of earlier edges from b to succ.
+	for _, s := range b.Succs[:i] {
+		if s == succ {
+			k++
+		}
+	}
+	b.Succs = append(b.Succs[:i:i], b.Succs[i+1:]...)
+	for j, pred := range succ.Preds {
+		if pred != b {
+			continue
+		}
+		if k > 0 {
+			k--
+			continue
+		}
+		succ.Preds = append(succ.Preds[:j:j], succ.Preds[j+1:]...)
+		for _, v := range succ.Values {
+			if v.Op == OpPhi {
+				v.Args = append(v.Args[:j:j], v.Args[j+1:]...)
+			}
+		}
+		return
+	}
+}
+
+// End the block with a jump.
+func (b *Block) Jump(to *Block) {
+	b.Kind = BlockPlain
+	b.AddSucc(to)
+}
+
+// End the block with a branch on a condition.
+func (b *Block) If(cond *Value, then, els *Block) {
+	b.Kind = BlockIf
+	b.Control = cond
+	b.AddSucc(then)
+	b.AddSucc(els)
+}
+
+// End the block with a switch on a value.  The targets are in the
+// order of the cases, followed by the default.
+func (b *Block) Switch(x *Value, cases []int64, targets []*Block, def *Block) {
+	b.Kind = BlockSwitch
+	b.Control = x
+	b.Cases = cases
+	for _, t := range targets {
+		b.AddSucc(t)
+	}
+	b.AddSucc(def)
+}
+
+// End the block by returning a value.
+func (b *Block) Return(x *Value) {
+	b.Kind = BlockReturn
+	b.Control = x
+}
+
+// End the block by returning the result of a call, its last value,
+// reusing the frame of the function for the call.
+func (b *Block) TailCall(call *Value) {
+	b.Kind = BlockTailCall
+	b.Control = call
+}
+
+// End the block by stopping with an error.
+func (b *Block) Fail(msg string) {
+	b.Kind = BlockFail
+	b.Msg = msg
+}
+
+// A function.
+type Func struct {
+	Name    string // The name of the function, unique in its module.
+	Params  int    // The number of parameters.
+	Locals  int    // The number of local cells in the frame.
+	Blocks  []*Block
+	Entry   *Block
+	Module  *Module
+	Pos     token.Position
+	nextVal int
+	nextBlk int
+}
+
+// Make a function with an empty entry block.
+func NewFunc(m *Module, name string, params int) *Func {
+	f := &Func{Name: name, Params: params, Module: m}
+	f.Entry = f.NewBlock(token.Position{})
+	return f
+}
+
+// Add an empty block to the function.
+func (f *Func) NewBlock(pos token.Position) *Block {
+	b := &Block{ID: f.nextBlk, Func: f, Pos: pos}
+	f.nextBlk++
+	f.Blocks = append(f.Blocks, b)
+	return b
+}
+
+// Allocate a local cell in the frame, returning its number.
+func (f *Func) NewLocal() int64 {
+	f.Locals++
+	return int64(f.Locals - 1)
+}
+
+func (f *Func) newValue(pos token.Position, op Op, aux int64, sym string, args []*Value) *Value {
+	v := &Value{ID: f.nextVal, Op: op, Args: args, Aux: aux, Sym: sym, Pos: pos}
+	f.nextVal++
+	return v
+}
+
+// The number of value numbers used, an upper bound on the IDs of
+// the function's values.
+func (f *Func) NumValues() int {
+	return f.nextVal
+}
+
+// The number of block numbers used.
+func (f *Func) NumBlocks() int {
+	return f.nextBlk
+}
+
+// A static cell or vector.
+type Static struct {
+	Name string // The name, unique in its module.
+	Size int    // The number of words.
+	Init int64  // The initial value of the first word.
+}
+
+// A module: the functions and statics of a program or section.
+type Module struct {
+	Target  runtime.Target // The target machine.
+	Globals map[string]int // The global numbers of the declared globals.
+	Statics []*Static
+	Funcs   []*Func // The functions, in the order they are defined.
+	Init    *Func   // Gives the top-level names their values, in order.
+}
+
+// Return the function with a name, or nil if there is none.
+func (m *Module) Func(name string) *Func {
+	for _, f := range m.Funcs {
+		if f.Name == name {
+			return f
+		}
+	}
+	return nil
+}
@@ -0,0 +1,490 @@
+// Copyright 2015 Meador Inge.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package ir
+
+import (
+	"github.com/meadori/bcpl-go/src/ast"
+	"github.com/meadori/bcpl-go/src/parser"
+	"github.com/meadori/bcpl-go/src/runtime"
+	"github.com/meadori/bcpl-go/src/token"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var test_program_str = `manifest $( Red = 1; Green = 2 $)
+global $( Fact: 200 $)
+static $( Count = 3 $)
+
+let Fact(N) = N = 0 -> 1, N * Fact(N - 1)
+let Name(C) = match (C) : Red => "red" : Green => "green" : ? => "other" .
+let Last(X, Y) = every (X, Y) : 1, ? => 10 : ?, Z => Z + 1 .
+let Addr(N) = (lv N)!0 + Count
+let V = vec 10
+let Ordered(A, B, C) = A < B <= C
+let Find(V, N, X) = valof
+$( let I = 0
+   L: if I >= N resultis -1
+   if V!I = X resultis I
+   I := I + 1
+   goto L
+$)
+let Kind(X) be switchon X into
+$( case Red: writes("red")
+   case Green: writes("green"); return
+   default: finish
+$)
+`
+
+func newTestModule(t *testing.T, src string) *Module {
+	var p parser.Parser
+	p.Dialect = token.Richards
+	p.Init([]byte(src))
+	prog := p.Parse()
+	if len(p.Errors) > 0 {
+		t.Fatal(p.Errors)
+	}
+	m, err := Build(prog, runtime.Target{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Verify(); err != nil {
+		t.Fatalf("%v\n%s", err, m)
+	}
+	return m
+}
+
+var test_funcs = []struct {
+	name string
+	dump string
+}{
+	{"Fact", `func Fact(1)
+b0:
+	v0 = Param [0]
+	v1 = Const [0]
+	v2 = Eq v0 v1
+	If v2 -> b1 b2
+b1: <- b0
+	v3 = Const [1]
+	Jump -> b3
+b2: <- b0
+	v4 = Func {Fact}
+	v5 = Const [1]
+	v6 = Sub v0 v5
+	v7 = Call v4 v6
+	v8 = Mul v0 v7
+	Jump -> b3
+b3: <- b1 b2
+	v9 = Phi v3 v8
+	Return v9
+`},
+	{"Name", `func Name(1)
+b0:
+	v0 = Param [0]
+	Switch v0 1:b2 2:b3 -> b4
+b1: <- b2 b3 b4
+	v4 = Phi v1 v2 v3
+	Return v4
+b2: <- b0
+	v1 = String {"red"}
+	Jump -> b1
+b3: <- b0
+	v2 = String {"green"}
+	Jump -> b1
+b4: <- b0
+	v3 = String {"other"}
+	Jump -> b1
+b5:
+	Fail "no pattern matches"
+`},
+	{"Last", `func Last(2)
+b0:
+	v0 = Param [0]
+	v1 = Param [1]
+	v2 = Const [0]
+	v3 = Const [1]
+	v4 = Eq v0 v3
+	If v4 -> b2 b1
+b1: <- b0 b2
+	v6 = Phi v2 v5
+	v7 = Const [1]
+	v8 = Add v1 v7
+	Jump -> b3
+b2: <- b0
+	v5 = Const [10]
+	Jump -> b1
+b3: <- b1
+	Return v8
+`},
+	{"Addr", `func Addr(1) locals 1
+b0:
+	v0 = Param [0]
+	v1 = Local [0]
+	Store v1 v0
+	v3 = Const [0]
+	v4 = Add v1 v3
+	v5 = Load v4
+	v6 = Static {Count}
+	v7 = Load v6
+	v8 = Add v5 v7
+	Return v8
+`},
+	{"Ordered", `func Ordered(3)
+b0:
+	v0 = Param [0]
+	v1 = Param [1]
+	v2 = Param [2]
+	v3 = Lt v0 v1
+	v4 = Le v1 v2
+	v5 = And v3 v4
+	Return v5
+`},
+	{"Find", `func Find(3)
+b0:
+	v0 = Param [0]
+	v1 = Param [1]
+	v2 = Param [2]
+	v3 = Const [0]
+	Jump -> b2
+b1: <- b3 b6
+	v19 = Phi v9 v20
+	Return v19
+b2: <- b0 b7
+	v20 = Phi v3 v17
+	v7 = Ge v20 v1
+	If v7 -> b3 b4
+b3: <- b2
+	v8 = Const [1]
+	v9 = Neg v8
+	Jump -> b1
+b4: <- b2 b5
+	v11 = Add v0 v20
+	v12 = Load v11
+	v13 = Eq v12 v2
+	If v13 -> b6 b7
+b5:
+	Jump -> b4
+b6: <- b4
+	Jump -> b1
+b7: <- b4 b8
+	v16 = Const [1]
+	v17 = Add v20 v16
+	Jump -> b2
+b8:
+	Jump -> b7
+b9:
+	Fail "valof ended without resultis"
+`},
+	{"Kind", `func Kind(1)
+b0:
+	v0 = Param [0]
+	Switch v0 1:b2 2:b3 -> b4
+b1: <- b7
+	v15 = Const [0]
+	Return v15
+b2: <- b0 b5
+	v1 = Global [11]
+	v2 = Load v1
+	v3 = String {"red"}
+	v4 = Call v2 v3
+	Jump -> b3
+b3: <- b0 b2
+	v5 = Global [11]
+	v6 = Load v5
+	v7 = String {"green"}
+	v8 = Call v6 v7
+	v9 = Const [0]
+	Return v9
+b4: <- b0 b6
+	v10 = Global [2]
+	v11 = Load v10
+	v12 = Const [0]
+	v13 = Call v11 v12
+	v14 = Const [0]
+	Return v14
+b5:
+	Jump -> b2
+b6:
+	Jump -> b4
+b7:
+	Jump -> b1
+`},
+}
+
+func TestBuild(t *testing.T) {
+	m := newTestModule(t, test_program_str)
+	for _, test := range test_funcs {
+		f := m.Func(test.name)
+		if f == nil {
+			t.Errorf("%s: no such function", test.name)
+		} else if f.String() != test.dump {
+			t.Errorf("%s: got\n%s\nexpected\n%s", test.name, f, test.dump)
+		}
+	}
+	if m.Globals["Fact"] != 200 {
+		t.Errorf("Fact is global %d, expected 200", m.Globals["Fact"])
+	}
+	init := m.Init.String()
+	for _, s := range []string{"v1 = Global [200]\n\tStore v1 v0\n", "v12 = Static {V.vec}\n"} {
+		if !strings.Contains(init, s) {
+			t.Errorf("expected %q in\n%s", s, init)
+		}
+	}
+}
+
+var test_build_errors = []struct {
+	src string
+	msg string
+}{
+	{"let F() = G", "1:11: error: undeclared name G"},
+	{"manifest $( M = 1 $)\nlet F() = lv M", "2:14: error: manifest constant M has no address"},
+	{"let F(X) = lv (X + 1)", "1:16: error: expression has no address"},
+	{"let V = vec Q", "1:13: error: vector size is not a constant"},
+	{"let F() be break", "1:12: error: break outside a loop"},
+	{"let F() = valof $( resultis 1 $) + valof resultis 2\nlet G() be resultis 3", "2:12: error: resultis outside valof"},
+	{"let F() be $( goto L; M: $)", "1:20: error: no label L"},
+	{"let F() be $( L: L: $)", "1:18: error: label L redefined"},
+	{"manifest $( N = 1 $)\nlet F() be N := 2", "2:12: error: cannot assign to manifest constant N"},
+	{"let F(X) be switchon X into $( case 1: case X: $)", "1:45: error: case value is not a constant"},
+	{"let F(X) be switchon X into $( case 1: case 1: $)", "1:45: error: duplicate case 1"},
+}
+
+func TestBuildErrors(t *testing.T) {
+	for _, test := range test_build_errors {
+		prog, err := parser.ParseProgram([]byte(test.src))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Build(prog, runtime.Target{}); err == nil || err.Error() != test.msg {
+			t.Errorf("%q: got %v, expected %q", test.src, err, test.msg)
+		}
+	}
+}
+
+var test_loop_str = `let Sum(N) = valof
+$( let S, I = 0, 1
+   while I <= N do S, I := S + (I rem 2 = 0 -> I, 0), I + 1
+   resultis S
+$)
+`
+
+// Build a function summing the even numbers from 1 to its argument
+// with a loop, returning it with its blocks and values by ID.
+func newLoop(t *testing.T) (*Func, []*Block, map[int]*Value) {
+	f := newTestModule(t, test_loop_str).Func("Sum")
+	values := make(map[int]*Value)
+	for _, b := range f.Blocks {
+		for _, v := range b.Values {
+			values[v.ID] = v
+		}
+	}
+	return f, f.Blocks, values
+}
+
+func TestLoop(t *testing.T) {
+	f, blocks, _ := newLoop(t)
+	expected := `func Sum(1)
+b0:
+	v0 = Param [0]
+	v1 = Const [0]
+	v2 = Const [1]
+	Jump -> b2
+b1: <- b4
+	Return v25
+b2: <- b0 b7
+	v25 = Phi v1 v18
+	v26 = Phi v2 v21
+	v8 = Le v26 v0
+	If v8 -> b3 b4
+b3: <- b2
+	v11 = Const [2]
+	v12 = Rem v26 v11
+	v13 = Const [0]
+	v14 = Eq v12 v13
+	If v14 -> b5 b6
+b4: <- b2
+	Jump -> b1
+b5: <- b3
+	Jump -> b7
+b6: <- b3
+	v16 = Const [0]
+	Jump -> b7
+b7: <- b5 b6
+	v17 = Phi v26 v16
+	v18 = Add v25 v17
+	v20 = Const [1]
+	v21 = Add v26 v20
+	Jump -> b2
+b8:
+	Fail "valof ended without resultis"
+`
+	if f.String() != expected {
+		t.Errorf("got\n%s\nexpected\n%s", f, expected)
+	}
+
+	dom := f.Dominators()
+	entry, head, body, exit, join := blocks[0], blocks[2], blocks[3], blocks[4], blocks[7]
+	if dom.Idom(head) != entry || dom.Idom(body) != head || dom.Idom(exit) != head || dom.Idom(join) != body {
+		t.Errorf("bad immediate dominators")
+	}
+	if !dom.Dominates(head, join) || dom.Dominates(body, exit) || dom.Idom(entry) != nil {
+		t.Errorf("bad dominance")
+	}
+}
+
+// The cells of a vector keep their frame cells, renumbered after the
+// variable promoted, and a variable a jump passes the definition of
+// is zero.
+var test_promote_str = `let F(X) = valof
+$( let V = vec 2
+   let I = 0
+   I := X
+   V!I := I
+   resultis V!0
+$)
+let G(X) = valof
+$( if X goto L
+   $( let Y = 1
+   L: resultis Y
+   $)
+$)
+`
+
+var test_promote = []struct {
+	name string
+	dump string
+}{
+	{"F", `func F(1) locals 3
+b0:
+	v0 = Param [0]
+	v1 = Local [0]
+	v2 = Const [0]
+	v8 = Add v1 v0
+	Store v8 v0
+	v10 = Const [0]
+	v11 = Add v1 v10
+	v12 = Load v11
+	Jump -> b1
+b1: <- b0
+	Return v12
+b2:
+	Fail "valof ended without resultis"
+`},
+	{"G", `func G(1)
+b0:
+	v6 = Const [0]
+	v0 = Param [0]
+	If v0 -> b2 b3
+b1: <- b4
+	Return v5
+b2: <- b0
+	Jump -> b4
+b3: <- b0 b5
+	v1 = Const [1]
+	Jump -> b4
+b4: <- b2 b3
+	v5 = Phi v6 v1
+	Jump -> b1
+b5:
+	Jump -> b3
+b6:
+	Fail "valof ended without resultis"
+`},
+}
+
+func TestPromote(t *testing.T) {
+	m := newTestModule(t, test_promote_str)
+	for _, test := range test_promote {
+		if f := m.Func(test.name); f.String() != test.dump {
+			t.Errorf("%s: got\n%s\nexpected\n%s", test.name, f, test.dump)
+		}
+	}
+}
+
+var test_verify = []struct {
+	breakIt func(blocks []*Block, values map[int]*Value)
+	msg     string
+}{
+	{
+		func(blocks []*Block, values map[int]*Value) { blocks[4].Kind = BlockInvalid },
+		"func Sum: b4: block is not ended",
+	},
+	{
+		func(blocks []*Block, values map[int]*Value) { values[17].Args = values[17].Args[:1] },
+		"func Sum: b7: v17 = Phi v26: 1 arguments",
+	},
+	{
+		func(blocks []*Block, values map[int]*Value) { values[0].Aux = 1 },
+		"func Sum: b0: v0 = Param [1]: no such parameter",
+	},
+	{
+		func(blocks []*Block, values map[int]*Value) { values[17].Args[0] = values[16] },
+		"func Sum: b7: v17 = Phi v16 v16: v16 does not dominate predecessor b5",
+	},
+	{
+		func(blocks []*Block, values map[int]*Value) { blocks[1].Control = values[18] },
+		"func Sum: b1: control value v18 is used before it is defined",
+	},
+	{
+		func(blocks []*Block, values map[int]*Value) { blocks[7].Succs = nil },
+		"func Sum: b2: edge from b7 is not recorded",
+	},
+	{
+		func(blocks []*Block, values map[int]*Value) {
+			b := blocks[7]
+			b.Values[2], b.Values[3] = b.Values[3], b.Values[2]
+		},
+		"func Sum: b7: v21 = Add v26 v20: v20 is used before it is defined",
+	},
+}
+
+func TestVerify(t *testing.T) {
+	for _, test := range test_verify {
+		f, blocks, values := newLoop(t)
+		test.breakIt(blocks, values)
+		if err := f.Verify(); err == nil || err.Error() != test.msg {
+			t.Errorf("got %v, expected %q", err, test.msg)
+		}
+	}
+}
+
+// Parse a program of the corpus, those in testdata/richards being in
+// the Richards dialect.
+func parseTestdata(file string, src []byte) (*ast.Program, error) {
+	var p parser.Parser
+	if filepath.Base(filepath.Dir(file)) == "richards" {
+		p.Dialect = token.Richards
+	}
+	p.Init(src)
+	prog := p.Parse()
+	return prog, p.Errors.Err()
+}
+
+func TestBuildTestdata(t *testing.T) {
+	files, _ := filepath.Glob("../../testdata/*.b")
+	if len(files) == 0 {
+		t.Fatal("no test programs")
+	}
+	richards, _ := filepath.Glob("../../testdata/richards/*.b")
+	for _, file := range append(files, richards...) {
+		src, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		prog, err := parseTestdata(file, src)
+		if err != nil {
+			continue
+		}
+		m, err := Build(prog, runtime.Target{})
+		if err != nil {
+			t.Errorf("%s: %v", file, err)
+			continue
+		}
+		if err := m.Verify(); err != nil {
+			t.Errorf("%s: %v", file, err)
+		}
+	}
+}
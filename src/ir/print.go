@@ -0,0 +1,149 @@
+// Copyright 2015 Meador Inge.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package ir
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// The textual form of a module lists its globals by number, its
+// statics and its functions, the initializing function first:
+//
+//	global Square 200
+//	static Count 1 = 3
+//
+//	func Square(1)
+//	b0:
+//		v0 = Param [0]
+//		v1 = Mul v0 v0
+//		Return v1
+//
+// A block lists its predecessors after the arrow "<-".
+
+// Return the value as it is defined, like "v2 = Add v0 v1".  A store
+// has no value, so it is written without one.
+func (v *Value) LongString() string {
+	var buf bytes.Buffer
+	if v.Op != OpStore {
+		fmt.Fprintf(&buf, "%s = ", v)
+	}
+	buf.WriteString(v.Op.String())
+	switch v.Op {
+	case OpConst, OpParam, OpGlobal, OpLocal:
+		fmt.Fprintf(&buf, " [%d]", v.Aux)
+	case OpString, OpFunc, OpStatic:
+		fmt.Fprintf(&buf, " {%s}", v.Sym)
+	}
+	for _, arg := range v.Args {
+		fmt.Fprintf(&buf, " %s", arg)
+	}
+	return buf.String()
+}
+
+// Return the control transfer ending the block, like "If v2 -> b1 b2".
+func (b *Block) LongString() string {
+	var buf bytes.Buffer
+	buf.WriteString(b.Kind.String())
+	if b.Control != nil {
+		fmt.Fprintf(&buf, " %s", b.Control)
+	}
+	switch b.Kind {
+	case BlockFail:
+		fmt.Fprintf(&buf, " %q", b.Msg)
+	case BlockSwitch:
+		for i, c := range b.Cases {
+			if i < len(b.Succs) {
+				fmt.Fprintf(&buf, " %d:%s", c, b.Succs[i])
+			}
+		}
+		if len(b.Succs) > 0 {
+			fmt.Fprintf(&buf, " -> %s", b.Succs[len(b.Succs)-1])
+		}
+	default:
+		if len(b.Succs) > 0 {
+			buf.WriteString(" ->")
+		}
+		for _, succ := range b.Succs {
+			fmt.Fprintf(&buf, " %s", succ)
+		}
+	}
+	return buf.String()
+}
+
+// Write the textual form of a function.
+func (f *Func) Fprint(w io.Writer) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "func %s(%d)", f.Name, f.Params)
+	if f.Locals > 0 {
+		fmt.Fprintf(&buf, " locals %d", f.Locals)
+	}
+	buf.WriteByte('\n')
+	for _, b := range f.Blocks {
+		fmt.Fprintf(&buf, "%s:", b)
+		if len(b.Preds) > 0 {
+			buf.WriteString(" <-")
+			for _, pred := range b.Preds {
+				fmt.Fprintf(&buf, " %s", pred)
+			}
+		}
+		buf.WriteByte('\n')
+		for _, v := range b.Values {
+			fmt.Fprintf(&buf, "\t%s\n", v.LongString())
+		}
+		fmt.Fprintf(&buf, "\t%s\n", b.LongString())
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func (f *Func) String() string {
+	var buf bytes.Buffer
+	f.Fprint(&buf)
+	return buf.String()
+}
+
+// Write the textual form of a module.
+func (m *Module) Fprint(w io.Writer) error {
+	var buf bytes.Buffer
+	var names []string
+	for name := range m.Globals {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		gi, gj := m.Globals[names[i]], m.Globals[names[j]]
+		return gi < gj || gi == gj && names[i] < names[j]
+	})
+	for _, name := range names {
+		fmt.Fprintf(&buf, "global %s %d\n", name, m.Globals[name])
+	}
+	for _, s := range m.Statics {
+		fmt.Fprintf(&buf, "static %s %d", s.Name, s.Size)
+		if s.Init != 0 {
+			fmt.Fprintf(&buf, " = %d", s.Init)
+		}
+		buf.WriteByte('\n')
+	}
+	funcs := m.Funcs
+	if m.Init != nil {
+		funcs = append([]*Func{m.Init}, funcs...)
+	}
+	for _, f := range funcs {
+		if buf.Len() > 0 {
+			buf.WriteByte('\n')
+		}
+		f.Fprint(&buf)
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func (m *Module) String() string {
+	var buf bytes.Buffer
+	m.Fprint(&buf)
+	return buf.String()
+}
@@ -0,0 +1,315 @@
+// Copyright 2015 Meador Inge.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package ir
+
+import (
+	"github.com/meadori/bcpl-go/src/token"
+)
+
+// Return the local cells of a function, by number, reporting for
+// each whether it can be promoted to values: whether its address is
+// only loaded from and stored to, and never stored, passed, compared
+// or computed on.
+func (f *Func) promotable() map[int64]bool {
+	cells := make(map[int64]bool)
+	for _, b := range f.Blocks {
+		for _, v := range b.Values {
+			if _, seen := cells[v.Aux]; v.Op == OpLocal && !seen {
+				cells[v.Aux] = true
+			}
+		}
+	}
+	escape := func(v *Value) {
+		if v != nil && v.Op == OpLocal {
+			cells[v.Aux] = false
+		}
+	}
+	for _, b := range f.Blocks {
+		for _, v := range b.Values {
+			for i, arg := range v.Args {
+				if i > 0 || v.Op != OpLoad && v.Op != OpStore {
+					escape(arg)
+				}
+			}
+		}
+		escape(b.Control)
+	}
+	return cells
+}
+
+// Return the dominance frontier of each reachable block, by ID: the
+// blocks it does not strictly dominate that have a predecessor it
+// dominates.
+func frontiers(f *Func, dom *DomTree) [][]*Block {
+	df := make([][]*Block, f.NumBlocks())
+	for _, b := range f.Blocks {
+		if len(b.Preds) < 2 || !dom.Reachable(b) {
+			continue
+		}
+		for _, pred := range b.Preds {
+			for p := pred; dom.Reachable(p) && p != dom.Idom(b); p = dom.Idom(p) {
+				if n := len(df[p.ID]); n == 0 || df[p.ID][n-1] != b {
+					df[p.ID] = append(df[p.ID], b)
+				}
+			}
+		}
+	}
+	return df
+}
+
+// Promote the local cells whose addresses are only loaded from and
+// stored to into values, giving the function the SSA form of its
+// variables.  A phi for a cell is placed in each block of the
+// iterated dominance frontier of the blocks storing to it, and each
+// load is replaced by the value stored last on the way through the
+// dominator tree, or by zero before any store.  The phis left
+// trivial or unused are removed, and the remaining cells renumbered.
+func (f *Func) promote() {
+	cells := f.promotable()
+	promoted := func(addr *Value) bool {
+		return addr.Op == OpLocal && cells[addr.Aux]
+	}
+	var order []int64 // The cells promoted, in order.
+	for n := int64(0); n < int64(f.Locals); n++ {
+		if cells[n] {
+			order = append(order, n)
+		}
+	}
+	if len(order) == 0 {
+		return
+	}
+
+	// Place the phis.
+	dom := f.Dominators()
+	df := frontiers(f, dom)
+	stores := make(map[int64][]*Block)
+	for _, b := range f.Blocks {
+		for _, v := range b.Values {
+			if v.Op == OpStore && promoted(v.Args[0]) && dom.Reachable(b) {
+				stores[v.Args[0].Aux] = append(stores[v.Args[0].Aux], b)
+			}
+		}
+	}
+	var placed []*Value
+	phis := make(map[*Value]int64) // The cell of each phi placed.
+	for _, cell := range order {
+		has := make(map[*Block]bool)
+		work := stores[cell]
+		for len(work) > 0 {
+			b := work[len(work)-1]
+			work = work[:len(work)-1]
+			for _, d := range df[b.ID] {
+				if has[d] {
+					continue
+				}
+				has[d] = true
+				phi := f.newValue(d.Pos, OpPhi, 0, "", make([]*Value, len(d.Preds)))
+				phi.Block = d
+				i := 0
+				for i < len(d.Values) && d.Values[i].Op == OpPhi {
+					i++
+				}
+				d.Values = append(d.Values[:i], append([]*Value{phi}, d.Values[i:]...)...)
+				placed = append(placed, phi)
+				phis[phi] = cell
+				work = append(work, d)
+			}
+		}
+	}
+
+	// Rename the loads along the dominator tree.
+	var zero *Value
+	undefined := func() *Value {
+		if zero == nil {
+			zero = f.newValue(token.Position{}, OpConst, 0, "", nil)
+			zero.Block = f.Entry
+		}
+		return zero
+	}
+	children := make([][]*Block, f.NumBlocks())
+	for _, b := range f.Blocks {
+		if idom := dom.Idom(b); idom != nil {
+			children[idom.ID] = append(children[idom.ID], b)
+		}
+	}
+	repl := make(map[*Value]*Value)
+	current := make(map[int64]*Value)
+	load := func(cell int64) *Value {
+		if v, ok := current[cell]; ok {
+			return v
+		}
+		return undefined()
+	}
+	var rename func(b *Block)
+	rename = func(b *Block) {
+		saved := make(map[int64]*Value, len(current))
+		for cell, v := range current {
+			saved[cell] = v
+		}
+		values := b.Values[:0]
+		for _, v := range b.Values {
+			if cell, ok := phis[v]; ok {
+				current[cell] = v
+			} else if v.Op == OpLoad && promoted(v.Args[0]) {
+				repl[v] = load(v.Args[0].Aux)
+				continue
+			} else if v.Op == OpStore && promoted(v.Args[0]) {
+				current[v.Args[0].Aux] = v.Args[1]
+				continue
+			} else if promoted(v) {
+				continue
+			}
+			values = append(values, v)
+		}
+		b.Values = values
+		for _, succ := range b.Succs {
+			for i, pred := range succ.Preds {
+				if pred != b {
+					continue
+				}
+				for _, phi := range succ.Values {
+					if cell, ok := phis[phi]; ok {
+						phi.Args[i] = load(cell)
+					}
+				}
+			}
+		}
+		for _, c := range children[b.ID] {
+			rename(c)
+		}
+		current = saved
+	}
+	rename(f.Entry)
+
+	// The blocks that cannot be reached read zero from the cells,
+	// and the phis zero along their edges.
+	for _, b := range f.Blocks {
+		if dom.Reachable(b) {
+			continue
+		}
+		values := b.Values[:0]
+		for _, v := range b.Values {
+			switch {
+			case v.Op == OpLoad && promoted(v.Args[0]):
+				repl[v] = undefined()
+				continue
+			case v.Op == OpStore && promoted(v.Args[0]), promoted(v):
+				continue
+			}
+			values = append(values, v)
+		}
+		b.Values = values
+	}
+	for _, phi := range placed {
+		for i, arg := range phi.Args {
+			if arg == nil {
+				phi.Args[i] = undefined()
+			}
+		}
+	}
+
+	find := func(v *Value) *Value {
+		for repl[v] != nil {
+			v = repl[v]
+		}
+		return v
+	}
+
+	// Replace the phis whose arguments are all one value, or the phi
+	// itself, by that value.
+	for changed := true; changed; {
+		changed = false
+		for _, phi := range placed {
+			if repl[phi] != nil {
+				continue
+			}
+			var same *Value
+			for _, arg := range phi.Args {
+				if arg = find(arg); arg == phi || arg == same {
+					continue
+				}
+				if same != nil {
+					same = nil
+					break
+				}
+				same = arg
+			}
+			if same != nil {
+				repl[phi] = same
+				changed = true
+			}
+		}
+	}
+
+	// Remove the phis used only by other phis placed.
+	live := make(map[*Value]bool)
+	var work []*Value
+	use := func(v *Value) {
+		if v = find(v); !live[v] {
+			live[v] = true
+			if _, ok := phis[v]; ok {
+				work = append(work, v)
+			}
+		}
+	}
+	for _, b := range f.Blocks {
+		for _, v := range b.Values {
+			if _, ok := phis[v]; !ok {
+				for _, arg := range v.Args {
+					use(arg)
+				}
+			}
+		}
+		if b.Control != nil {
+			use(b.Control)
+		}
+	}
+	for len(work) > 0 {
+		phi := work[len(work)-1]
+		work = work[:len(work)-1]
+		for _, arg := range phi.Args {
+			use(arg)
+		}
+	}
+
+	for _, b := range f.Blocks {
+		values := b.Values[:0]
+		for _, v := range b.Values {
+			if _, ok := phis[v]; ok && (repl[v] != nil || !live[v]) {
+				continue
+			}
+			for i, arg := range v.Args {
+				v.Args[i] = find(arg)
+			}
+			values = append(values, v)
+		}
+		b.Values = values
+		if b.Control != nil {
+			b.Control = find(b.Control)
+		}
+	}
+	if live[zero] {
+		f.Entry.Values = append([]*Value{zero}, f.Entry.Values...)
+	}
+
+	// Number the cells left in order, keeping the cells of each
+	// vector together.
+	number := make([]int64, f.Locals)
+	n := int64(0)
+	for i := range number {
+		number[i] = n
+		if !cells[int64(i)] {
+			n++
+		}
+	}
+	for _, b := range f.Blocks {
+		for _, v := range b.Values {
+			if v.Op == OpLocal {
+				v.Aux = number[v.Aux]
+			}
+		}
+	}
+	f.Locals = int(n)
+}
@@ -0,0 +1,249 @@
+// Copyright 2015 Meador Inge.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package ir
+
+import (
+	"fmt"
+	"github.com/meadori/bcpl-go/src/runtime"
+)
+
+// Check that a module is well formed, returning an error describing
+// the first problem found.
+func (m *Module) Verify() error {
+	names := make(map[string]bool)
+	for _, f := range m.Funcs {
+		if names[f.Name] {
+			return fmt.Errorf("func %s: defined twice", f.Name)
+		}
+		names[f.Name] = true
+	}
+	statics := make(map[string]bool)
+	for _, s := range m.Statics {
+		if statics[s.Name] || s.Size < 1 {
+			return fmt.Errorf("static %s: bad static", s.Name)
+		}
+		statics[s.Name] = true
+	}
+	funcs := m.Funcs
+	if m.Init != nil {
+		funcs = append([]*Func{m.Init}, funcs...)
+	}
+	for _, f := range funcs {
+		if err := f.verify(names, statics); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Check that a function is well formed on its own, returning an error
+// describing the first problem found.  The functions and statics it
+// refers to are not checked.
+func (f *Func) Verify() error {
+	return f.verify(nil, nil)
+}
+
+type verifyError struct {
+	f   *Func
+	b   *Block
+	v   *Value
+	msg string
+}
+
+func (e *verifyError) Error() string {
+	switch {
+	case e.v != nil:
+		return fmt.Sprintf("func %s: %s: %s: %s", e.f.Name, e.b, e.v.LongString(), e.msg)
+	case e.b != nil:
+		return fmt.Sprintf("func %s: %s: %s", e.f.Name, e.b, e.msg)
+	}
+	return fmt.Sprintf("func %s: %s", e.f.Name, e.msg)
+}
+
+// The numbers of successors of the kinds of block, or -1 if it varies.
+var blockSuccs = [...]int{
+	BlockInvalid:  0,
+	BlockPlain:    1,
+	BlockIf:       2,
+	BlockSwitch:   -1,
+	BlockReturn:   0,
+	BlockFail:     0,
+	BlockTailCall: 0,
+}
+
+func (f *Func) verify(funcs, statics map[string]bool) (err error) {
+	fail := func(b *Block, v *Value, format string, args ...interface{}) {
+		panic(&verifyError{f, b, v, fmt.Sprintf(format, args...)})
+	}
+	defer func() {
+		if x := recover(); x != nil {
+			e, ok := x.(*verifyError)
+			if !ok {
+				panic(x)
+			}
+			err = e
+		}
+	}()
+
+	// The blocks and values and the edges between the blocks.
+	if f.Entry == nil || len(f.Entry.Preds) > 0 {
+		fail(nil, nil, "entry block missing or has predecessors")
+	}
+	blocks := make(map[*Block]bool)
+	for _, b := range f.Blocks {
+		if b.Func != f || b.ID < 0 || b.ID >= f.NumBlocks() || blocks[b] {
+			fail(b, nil, "block does not belong to the function")
+		}
+		blocks[b] = true
+	}
+	if !blocks[f.Entry] {
+		fail(f.Entry, nil, "entry block not in the function")
+	}
+	ids := make(map[int]bool)
+	for _, b := range f.Blocks {
+		if ids[b.ID] {
+			fail(b, nil, "duplicate block ID")
+		}
+		ids[b.ID] = true
+	}
+	values := make(map[*Value]bool)
+	ids = make(map[int]bool)
+	for _, b := range f.Blocks {
+		for _, v := range b.Values {
+			if v.Block != b || ids[v.ID] || v.ID < 0 || v.ID >= f.NumValues() {
+				fail(b, v, "value does not belong to the block")
+			}
+			values[v] = true
+			ids[v.ID] = true
+		}
+	}
+	count := func(list []*Block, b *Block) (n int) {
+		for _, x := range list {
+			if x == b {
+				n++
+			}
+		}
+		return n
+	}
+	for _, b := range f.Blocks {
+		n := blockSuccs[b.Kind]
+		switch {
+		case b.Kind <= BlockInvalid || int(b.Kind) >= len(blockSuccs):
+			fail(b, nil, "block is not ended")
+		case b.Kind == BlockSwitch:
+			n = len(b.Cases) + 1
+			seen := make(map[int64]bool)
+			for _, c := range b.Cases {
+				if seen[c] {
+					fail(b, nil, "duplicate case %d", c)
+				}
+				seen[c] = true
+			}
+		}
+		if len(b.Succs) != n {
+			fail(b, nil, "%s block has %d successors", b.Kind, len(b.Succs))
+		}
+		hasControl := b.Kind == BlockIf || b.Kind == BlockSwitch || b.Kind == BlockReturn || b.Kind == BlockTailCall
+		if hasControl != (b.Control != nil) {
+			fail(b, nil, "%s block has a bad control value", b.Kind)
+		}
+		if b.Kind == BlockTailCall && (b.Control.Op != OpCall || len(b.Values) == 0 || b.Values[len(b.Values)-1] != b.Control) {
+			fail(b, nil, "tail call %s is not the last value of the block", b.Control)
+		}
+		if b.Control != nil && !values[b.Control] {
+			fail(b, nil, "control value %s is not in the function", b.Control)
+		}
+		for _, succ := range b.Succs {
+			if !blocks[succ] || count(succ.Preds, b) != count(b.Succs, succ) {
+				fail(b, nil, "edge to %s is not recorded", succ)
+			}
+		}
+		for _, pred := range b.Preds {
+			if !blocks[pred] || count(pred.Succs, b) != count(b.Preds, pred) {
+				fail(b, nil, "edge from %s is not recorded", pred)
+			}
+		}
+	}
+
+	// The values and their arguments.
+	for _, b := range f.Blocks {
+		phis := true
+		for _, v := range b.Values {
+			if v.Op <= OpInvalid || v.Op >= numOps {
+				fail(b, v, "bad operation")
+			}
+			n := opInfos[v.Op].args
+			if v.Op == OpPhi {
+				if !phis {
+					fail(b, v, "phi after other values")
+				}
+				n = len(b.Preds)
+			} else {
+				phis = false
+			}
+			if n >= 0 && len(v.Args) != n || v.Op == OpCall && len(v.Args) == 0 {
+				fail(b, v, "%d arguments", len(v.Args))
+			}
+			for _, arg := range v.Args {
+				if arg == nil || !values[arg] {
+					fail(b, v, "argument is not in the function")
+				}
+				if arg.Op == OpStore {
+					fail(b, v, "store used as a value")
+				}
+			}
+			switch v.Op {
+			case OpParam:
+				if v.Aux < 0 || v.Aux >= int64(f.Params) {
+					fail(b, v, "no such parameter")
+				}
+			case OpLocal:
+				if v.Aux < 0 || v.Aux >= int64(f.Locals) {
+					fail(b, v, "no such local cell")
+				}
+			case OpGlobal:
+				if v.Aux < 0 || v.Aux >= runtime.NumGlobals {
+					fail(b, v, "no such global")
+				}
+			case OpFunc:
+				if funcs != nil && !funcs[v.Sym] {
+					fail(b, v, "no such function")
+				}
+			case OpStatic:
+				if statics != nil && !statics[v.Sym] {
+					fail(b, v, "no such static")
+				}
+			}
+		}
+		if b.Control != nil && b.Control.Op == OpStore {
+			fail(b, nil, "store used as a value")
+		}
+	}
+
+	// Each value is defined before it is used.
+	dom := f.Dominators()
+	for _, b := range f.Blocks {
+		if !dom.Reachable(b) {
+			continue
+		}
+		defined := make(map[*Value]bool)
+		for _, v := range b.Values {
+			for i, arg := range v.Args {
+				if v.Op == OpPhi {
+					if pred := b.Preds[i]; dom.Reachable(pred) && !dom.Dominates(arg.Block, pred) {
+						fail(b, v, "%s does not dominate predecessor %s", arg, pred)
+					}
+				} else if arg.Block == b && !defined[arg] || arg.Block != b && !dom.Dominates(arg.Block, b) {
+					fail(b, v, "%s is used before it is defined", arg)
+				}
+			}
+			defined[v] = true
+		}
+		if c := b.Control; c != nil && !defined[c] && !dom.Dominates(c.Block, b) {
+			fail(b, nil, "control value %s is used before it is defined", c)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,246 @@
+// Copyright 2015 Meador Inge.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+// Package link combines separately compiled sections of a BCPL
+// program into a single image.
+//
+// Sections communicate only through the global vector: each section
+// declares the globals it uses with global $( NAME: N $), in addition
+// to those of the library, and defines the routines and values of
+// some of them at its top level.  The linker checks that the sections
+// agree on the names and numbers of their globals and that no global
+// is defined by more than one section.  A section may replace a
+// library routine.
+package link
+
+import (
+	"fmt"
+	"github.com/meadori/bcpl-go/src/ast"
+	"github.com/meadori/bcpl-go/src/interp"
+	"github.com/meadori/bcpl-go/src/runtime"
+	"github.com/meadori/bcpl-go/src/token"
+	"sort"
+)
+
+// The name of the section holding the library routines.
+const Library = "LIBHDR"
+
+// A separately compiled section.
+type Section struct {
+	Name string       // The name of the section, usually its file name.
+	Prog *ast.Program // The syntax tree of the section.
+}
+
+// A global of a linked program.
+type Global struct {
+	Number  int            // The global number.
+	Name    string         // The name the global is declared with.
+	Section string         // The section defining it, Library, or "" if undefined.
+	Pos     token.Position // The position of its definition in the section.
+}
+
+// A link error at a position in a section.
+type Error struct {
+	Section string
+	Pos     token.Position
+	Msg     string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s:%s: error: %s", e.Section, e.Pos, e.Msg)
+}
+
+// A list of link errors, in the order they were found.
+type ErrorList []*Error
+
+func (list ErrorList) Error() string {
+	switch len(list) {
+	case 0:
+		return "no errors"
+	case 1:
+		return list[0].Error()
+	}
+	return fmt.Sprintf("%s (and %d more errors)", list[0], len(list)-1)
+}
+
+// Return the list as an error, or nil if it is empty.
+func (list ErrorList) Err() error {
+	if len(list) == 0 {
+		return nil
+	}
+	return list
+}
+
+// A linked program.
+type Image struct {
+	Sections []Section // The sections, in the order they are loaded.
+	Globals  []Global  // The globals, ordered by number.
+}
+
+// Where a global name was first declared.
+type declaration struct {
+	number  int
+	section string
+	pos     token.Position
+}
+
+type linker struct {
+	errors  ErrorList
+	names   map[string]declaration // The first declaration of each name.
+	globals map[int]*Global        // The globals by number.
+}
+
+func (l *linker) error(section string, pos token.Position, format string, args ...interface{}) {
+	l.errors = append(l.errors, &Error{section, pos, fmt.Sprintf(format, args...)})
+}
+
+// Record the declaration of a global name, reporting whether it
+// agrees with the other declarations.
+func (l *linker) declare(section string, pos token.Position, name string, n int) bool {
+	if d, ok := l.names[name]; ok && d.number != n {
+		l.error(section, pos, "global %s is %d here but %d in %s", name, n, d.number, d.section)
+		return false
+	}
+	if g, ok := l.globals[n]; ok && g.Name != name {
+		l.error(section, pos, "global %d is %s here but %s in %s", n, name, g.Name, l.names[g.Name].section)
+		return false
+	}
+	if _, ok := l.names[name]; !ok {
+		l.names[name] = declaration{n, section, pos}
+	}
+	if _, ok := l.globals[n]; !ok {
+		l.globals[n] = &Global{Number: n, Name: name}
+	}
+	return true
+}
+
+// Record the definition of a global by a section.
+func (l *linker) define(section string, pos token.Position, name string, n int) {
+	g := l.globals[n]
+	if g.Section != "" && g.Section != Library {
+		l.error(section, pos, "global %d (%s) is also defined at %s:%s", n, name, g.Section, g.Pos)
+		return
+	}
+	g.Section, g.Pos = section, pos
+}
+
+// Check the declarations and definitions of a section.
+func (l *linker) section(s Section) {
+	numbers := make(map[string]int) // The globals declared by the section.
+	numbers["start"] = runtime.StartGlobal
+	for _, g := range runtime.Library {
+		numbers[g.Name] = g.Number
+	}
+	for _, decl := range s.Prog.Decls {
+		for _, v := range decl.VarDecls() {
+			if _, ok := decl.(*ast.GlobalDecl); !ok {
+				delete(numbers, v.Name)
+				continue
+			}
+			if v.Constant < 0 || v.Constant >= runtime.NumGlobals {
+				l.error(s.Name, v.NamePos, "global number %d out of range", v.Constant)
+				continue
+			}
+			if l.declare(s.Name, v.NamePos, v.Name, v.Constant) {
+				numbers[v.Name] = v.Constant
+			}
+		}
+	}
+
+	define := func(pos token.Position, name string) {
+		if n, ok := numbers[name]; ok {
+			l.define(s.Name, pos, name, n)
+		}
+	}
+	for _, def := range s.Prog.Defs {
+		for _, d := range ast.Defs(def) {
+			switch d := d.(type) {
+			case *ast.FuncDef:
+				define(d.NamePos, d.Name)
+			case *ast.RoutineDef:
+				define(d.NamePos, d.Name)
+			case *ast.VecDef:
+				define(d.NamePos, d.Name)
+			case *ast.SimpleDef:
+				for _, n := range d.Names.Names {
+					define(n.NamePos, n.Val)
+				}
+			}
+		}
+	}
+}
+
+// Link sections into an image, returning an ErrorList holding the
+// link errors if there are any.
+func Link(sections []Section) (*Image, error) {
+	l := linker{names: make(map[string]declaration), globals: make(map[int]*Global)}
+	l.declare(Library, token.Position{}, "start", runtime.StartGlobal)
+	for _, g := range runtime.Library {
+		l.declare(Library, token.Position{}, g.Name, g.Number)
+		l.globals[g.Number].Section = Library
+	}
+	for _, s := range sections {
+		l.section(s)
+	}
+	if err := l.errors.Err(); err != nil {
+		return nil, err
+	}
+
+	img := &Image{Sections: sections}
+	for _, g := range l.globals {
+		img.Globals = append(img.Globals, *g)
+	}
+	sort.Slice(img.Globals, func(i, j int) bool { return img.Globals[i].Number < img.Globals[j].Number })
+	return img, nil
+}
+
+// Return the globals that are declared but defined by no section.
+func (img *Image) Undefined() []Global {
+	var undefined []Global
+	for _, g := range img.Globals {
+		if g.Section == "" {
+			undefined = append(undefined, g)
+		}
+	}
+	return undefined
+}
+
+// Load the sections of the image into an initialized interpreter,
+// filling in its global vector.  Each section keeps its other names
+// to itself.
+func (img *Image) Load(in *interp.Interp) error {
+	for _, s := range img.Sections {
+		if err := in.LoadSection(s.Prog); err != nil {
+			if e, ok := err.(*interp.Error); ok {
+				return img.error(e, s.Name)
+			}
+			return fmt.Errorf("%s: %v", s.Name, err)
+		}
+	}
+	return nil
+}
+
+// Run the image loaded into an interpreter by calling start, naming
+// the section of the function that reports an error.
+func (img *Image) Start(in *interp.Interp) (runtime.Word, error) {
+	val, err := in.Start()
+	if e, ok := err.(*interp.Error); ok {
+		return val, img.error(e, "")
+	}
+	return val, err
+}
+
+// Return an error of the interpreter naming its section, or the
+// given one if it was raised outside the functions of the sections.
+func (img *Image) error(e *interp.Error, section string) error {
+	for _, s := range img.Sections {
+		if s.Prog == e.Section {
+			section = s.Name
+		}
+	}
+	if section == "" {
+		return e
+	}
+	return &Error{section, e.Pos, e.Msg}
+}
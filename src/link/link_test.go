@@ -0,0 +1,123 @@
+// Copyright 2015 Meador Inge.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package link
+
+import (
+	"bytes"
+	"github.com/meadori/bcpl-go/src/interp"
+	"github.com/meadori/bcpl-go/src/parser"
+	"strings"
+	"testing"
+)
+
+var test_main_str = `global $( Square: 200; Total: 201 $)
+static $( Count = 2 $)
+
+let start() = writen(Square(Count) + Total)
+`
+
+var test_square_str = `global $( Square: 200; Total: 201 $)
+static $( Count = 10 $)
+
+let Square(N) = N * N + Count
+and Total = 100
+`
+
+func newTestSections(t *testing.T, srcs ...string) []Section {
+	var sections []Section
+	for i, src := range srcs {
+		prog, err := parser.ParseProgram([]byte(src))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sections = append(sections, Section{string('a'+rune(i)) + ".b", prog})
+	}
+	return sections
+}
+
+func TestLink(t *testing.T) {
+	img, err := Link(newTestSections(t, test_main_str, test_square_str))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defined := make(map[string]string)
+	for _, g := range img.Globals {
+		defined[g.Name] = g.Section
+	}
+	for name, section := range map[string]string{"start": "a.b", "Square": "b.b", "Total": "b.b", "writen": Library} {
+		if defined[name] != section {
+			t.Errorf("%s: defined in %q, expected %q", name, defined[name], section)
+		}
+	}
+	if u := img.Undefined(); len(u) != 0 {
+		t.Errorf("undefined globals %v", u)
+	}
+
+	var in interp.Interp
+	var out bytes.Buffer
+	in.Init(strings.NewReader(""), &out)
+	if err := img.Load(&in); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := in.Start(); err != nil {
+		t.Fatal(err)
+	}
+	in.Flush()
+	// Each section sees its own Count.
+	if out.String() != "114" {
+		t.Errorf("got %q, expected \"114\"", out.String())
+	}
+}
+
+var test_link_errors = []struct {
+	srcs []string
+	msg  string
+}{
+	{
+		[]string{"global $( F: 200 $)\nlet F() = 1", "global $( F: 200 $)\nlet F() = 2"},
+		"b.b:2:5: error: global 200 (F) is also defined at a.b:2:5",
+	},
+	{
+		[]string{"global $( F: 200 $)", "global $( F: 201 $)"},
+		"b.b:1:11: error: global F is 201 here but 200 in a.b",
+	},
+	{
+		[]string{"global $( F: 200 $)", "global $( G: 200 $)"},
+		"b.b:1:11: error: global 200 is G here but F in a.b",
+	},
+	{
+		[]string{"global $( writes: 12 $)"},
+		"a.b:1:11: error: global writes is 12 here but 11 in LIBHDR",
+	},
+	{
+		[]string{"global $( F: 1000 $)"},
+		"a.b:1:11: error: global number 1000 out of range",
+	},
+}
+
+func TestLinkErrors(t *testing.T) {
+	for _, test := range test_link_errors {
+		_, err := Link(newTestSections(t, test.srcs...))
+		if err == nil || err.Error() != test.msg {
+			t.Errorf("%q: got %v, expected %q", test.srcs, err, test.msg)
+		}
+	}
+}
+
+func TestReplaceLibrary(t *testing.T) {
+	img, err := Link(newTestSections(t, "global $( wrch: 9 $)\nlet wrch(C) = 0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, g := range img.Globals {
+		if g.Name == "wrch" && g.Section != "a.b" {
+			t.Errorf("wrch defined in %q, expected \"a.b\"", g.Section)
+		}
+	}
+	if u := img.Undefined(); len(u) != 1 || u[0].Name != "start" {
+		t.Errorf("got undefined globals %v, expected start", u)
+	}
+}
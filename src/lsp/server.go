@@ -0,0 +1,675 @@
+// Copyright 2015 Meador Inge.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+// Package lsp implements a Language Server Protocol server for BCPL.
+// It publishes syntax errors, and the diagnostics of the analyzers of
+// bclvet, with code actions making the fixes they suggest, and offers
+// go-to-definition, hover, document symbols and semantic tokens for the
+// names declared by let, global and manifest.
+package lsp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/meadori/bcpl-go/src/analysis/multichecker"
+	"github.com/meadori/bcpl-go/src/analysis/passes"
+	"github.com/meadori/bcpl-go/src/ast"
+	"github.com/meadori/bcpl-go/src/edit"
+	"github.com/meadori/bcpl-go/src/link"
+	"github.com/meadori/bcpl-go/src/parser"
+	"github.com/meadori/bcpl-go/src/scanner"
+	"github.com/meadori/bcpl-go/src/token"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// The semantic token types, indexed by the values in the data.
+var tokenTypes = []string{"keyword", "variable", "number", "string", "comment", "operator"}
+
+const (
+	typeKeyword = iota
+	typeVariable
+	typeNumber
+	typeString
+	typeComment
+	typeOperator
+)
+
+// Serve returned because the client sent exit without shutdown.
+var ErrNoShutdown = errors.New("lsp: exit without shutdown")
+
+// An open document.
+type document struct {
+	src   []byte           // The current text.
+	lines []int            // The offsets where the lines of the text start.
+	toks  []*token.Token   // The tokens of the text, including comments.
+	prog  *ast.Program     // The last text that parsed, or nil.
+	errs  parser.ErrorList // The syntax errors in the current text.
+	diags []diagnostic     // The diagnostics published for the current text.
+}
+
+// A published diagnostic and the fixes suggested for it.
+type diagnostic struct {
+	diag  Diagnostic
+	fixes []edit.Fix
+}
+
+// A declared name.
+type symbol struct {
+	name   string
+	kind   int            // The LSP symbol kind.
+	pos    token.Position // Where the name is declared.
+	detail string         // The declaration, for hovers.
+}
+
+type Server struct {
+	Dialect     token.Dialect        // The dialect of the documents.
+	in          *bufio.Reader        // The stream of client messages.
+	out         io.Writer            // The stream of server messages.
+	docs        map[string]*document // The open documents by URI.
+	initialized bool                 // Whether initialize has been received.
+	shutdown    bool                 // Whether shutdown has been received.
+}
+
+func (s *Server) Init(in io.Reader, out io.Writer) {
+	s.in = bufio.NewReader(in)
+	s.out = out
+	s.docs = make(map[string]*document)
+	s.initialized = false
+	s.shutdown = false
+}
+
+// Serve client messages until the client sends exit.
+func (s *Server) Serve() error {
+	for {
+		body, err := readMessage(s.in)
+		if err != nil {
+			return err
+		}
+
+		var req request
+		if err := json.Unmarshal(body, &req); err != nil {
+			s.reply(nil, nil, &responseError{parseError, err.Error()})
+			continue
+		}
+		if req.Method == "exit" {
+			if !s.shutdown {
+				return ErrNoShutdown
+			}
+			return nil
+		}
+
+		result, rerr := s.handle(&req)
+		if req.ID != nil {
+			if err := s.reply(req.ID, result, rerr); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (s *Server) reply(id *json.RawMessage, result interface{}, err *responseError) error {
+	return writeMessage(s.out, &response{"2.0", id, result, err})
+}
+
+func (s *Server) notify(method string, params interface{}) error {
+	return writeMessage(s.out, &notification{"2.0", method, params})
+}
+
+// Handle a request or notification, returning the result.
+func (s *Server) handle(req *request) (interface{}, *responseError) {
+	if !s.initialized && req.Method != "initialize" {
+		return nil, &responseError{serverNotInitialized, "server not initialized"}
+	}
+
+	params := func(v interface{}) *responseError {
+		if err := json.Unmarshal(req.Params, v); err != nil {
+			return &responseError{invalidParams, err.Error()}
+		}
+		return nil
+	}
+
+	switch req.Method {
+	case "initialize":
+		s.initialized = true
+		return &InitializeResult{
+			ServerCapabilities{
+				TextDocumentSync:       syncFull,
+				DefinitionProvider:     true,
+				HoverProvider:          true,
+				DocumentSymbolProvider: true,
+				SemanticTokensProvider: SemanticTokensOptions{
+					SemanticTokensLegend{tokenTypes, []string{}}, true,
+				},
+				CodeActionProvider: true,
+			},
+			ServerInfo{"bclang-lsp"},
+		}, nil
+	case "initialized":
+		return nil, nil
+	case "shutdown":
+		s.shutdown = true
+		return nil, nil
+	case "textDocument/didOpen":
+		var p DidOpenTextDocumentParams
+		if err := params(&p); err != nil {
+			return nil, err
+		}
+		s.update(p.TextDocument.URI, []byte(p.TextDocument.Text))
+		return nil, nil
+	case "textDocument/didChange":
+		var p DidChangeTextDocumentParams
+		if err := params(&p); err != nil {
+			return nil, err
+		}
+		if n := len(p.ContentChanges); n > 0 {
+			s.update(p.TextDocument.URI, []byte(p.ContentChanges[n-1].Text))
+		}
+		return nil, nil
+	case "textDocument/didClose":
+		var p DidCloseTextDocumentParams
+		if err := params(&p); err != nil {
+			return nil, err
+		}
+		delete(s.docs, p.TextDocument.URI)
+		s.notify("textDocument/publishDiagnostics",
+			&PublishDiagnosticsParams{p.TextDocument.URI, []Diagnostic{}})
+		return nil, nil
+	case "textDocument/definition":
+		var p TextDocumentPositionParams
+		if err := params(&p); err != nil {
+			return nil, err
+		}
+		return s.definition(&p), nil
+	case "textDocument/hover":
+		var p TextDocumentPositionParams
+		if err := params(&p); err != nil {
+			return nil, err
+		}
+		return s.hover(&p), nil
+	case "textDocument/documentSymbol":
+		var p DocumentSymbolParams
+		if err := params(&p); err != nil {
+			return nil, err
+		}
+		return s.documentSymbols(p.TextDocument.URI), nil
+	case "textDocument/semanticTokens/full":
+		var p SemanticTokensParams
+		if err := params(&p); err != nil {
+			return nil, err
+		}
+		return s.semanticTokens(p.TextDocument.URI), nil
+	case "textDocument/codeAction":
+		var p CodeActionParams
+		if err := params(&p); err != nil {
+			return nil, err
+		}
+		return s.codeActions(&p), nil
+	}
+
+	if req.ID == nil {
+		// Ignore unknown notifications.
+		return nil, nil
+	}
+	return nil, &responseError{methodNotFound, fmt.Sprintf("method not found: %s", req.Method)}
+}
+
+// Rescan and reparse a document and publish its diagnostics.
+func (s *Server) update(uri string, src []byte) {
+	doc, ok := s.docs[uri]
+	if !ok {
+		doc = new(document)
+		s.docs[uri] = doc
+	}
+	doc.src = src
+	doc.lines = append(doc.lines[:0], 0)
+	for off, c := range src {
+		if c == '\n' {
+			doc.lines = append(doc.lines, off+1)
+		}
+	}
+	doc.toks = doc.toks[:0]
+
+	var scan scanner.Scanner
+	scan.Init(src)
+	scan.Dialect = s.Dialect
+	for {
+		tok := scan.Next()
+		doc.toks = append(doc.toks, tok)
+		if tok.Kind == token.EOF {
+			break
+		}
+	}
+
+	// Keep the last good tree so that names can still be
+	// found while the user is typing.
+	var p parser.Parser
+	p.Dialect = s.Dialect
+	p.Init(src)
+	prog := p.Parse()
+	doc.errs = p.Errors
+	if len(doc.errs) == 0 {
+		doc.prog = prog
+	}
+
+	// The analyzers are run only over a text that parses.
+	doc.diags = doc.diags[:0]
+	for _, err := range doc.errs {
+		doc.diags = append(doc.diags, diagnostic{Diagnostic{
+			Range:    doc.rangeAt(err.Pos),
+			Severity: SeverityError,
+			Source:   "bclang",
+			Message:  err.Msg,
+		}, err.Fixes})
+	}
+	if len(doc.errs) == 0 {
+		vet, _ := multichecker.Run([]link.Section{{uri, prog}}, passes.Analyzers)
+		for _, d := range vet {
+			doc.diags = append(doc.diags, diagnostic{Diagnostic{
+				Range:    doc.rangeAt(d.Pos),
+				Severity: SeverityWarning,
+				Source:   "bclvet",
+				Message:  d.Analyzer.Name + ": " + d.Message,
+			}, d.Fixes})
+		}
+	}
+	diags := []Diagnostic{}
+	for _, d := range doc.diags {
+		diags = append(diags, d.diag)
+	}
+	s.notify("textDocument/publishDiagnostics", &PublishDiagnosticsParams{uri, diags})
+}
+
+// Return the number of UTF-16 code units encoding a text, the unit
+// LSP counts the characters of a line in.
+func utf16Len(text string) int {
+	n := 0
+	for _, r := range text {
+		n += utf16.RuneLen(r)
+	}
+	return n
+}
+
+// Return the LSP position of a byte offset of the source.
+func (doc *document) position(off int) Position {
+	line := bytes.Count(doc.src[:off], []byte("\n"))
+	return Position{line, utf16Len(string(doc.src[doc.lines[line]:off]))}
+}
+
+// Report whether a position comes before another.
+func before(a, b Position) bool {
+	return a.Line < b.Line || a.Line == b.Line && a.Character < b.Character
+}
+
+// Return the code actions making the fixes of the diagnostics in a
+// range.
+func (s *Server) codeActions(p *CodeActionParams) []CodeAction {
+	actions := []CodeAction{}
+	doc, ok := s.docs[p.TextDocument.URI]
+	if !ok {
+		return actions
+	}
+	for _, d := range doc.diags {
+		if before(p.Range.End, d.diag.Range.Start) || before(d.diag.Range.End, p.Range.Start) {
+			continue
+		}
+		for _, fix := range d.fixes {
+			var edits []TextEdit
+			for _, e := range fix.Edits {
+				edits = append(edits, TextEdit{Range{doc.position(e.Pos), doc.position(e.End)}, e.New})
+			}
+			actions = append(actions, CodeAction{
+				Title:       fix.Message,
+				Kind:        codeActionQuickFix,
+				Diagnostics: []Diagnostic{d.diag},
+				Edit:        &WorkspaceEdit{map[string][]TextEdit{p.TextDocument.URI: edits}},
+			})
+		}
+	}
+	return actions
+}
+
+// Convert a source position to an LSP position, counting the
+// characters before it on its line of the current text.  The
+// position may be in an older text, whose tree is kept.
+func (doc *document) lspPosition(pos token.Position) Position {
+	line, col := pos.Line-1, pos.Column-1
+	if line >= len(doc.lines) {
+		return Position{line, col}
+	}
+	start := doc.lines[line]
+	if start+col > len(doc.src) {
+		return Position{line, col}
+	}
+	return Position{line, utf16Len(string(doc.src[start : start+col]))}
+}
+
+// Return the range of a name declared at pos.
+func (doc *document) nameRange(pos token.Position, name string) Range {
+	start := doc.lspPosition(pos)
+	return Range{start, Position{start.Line, start.Character + utf16Len(name)}}
+}
+
+// Report whether the token really appears in the source, rather
+// than having been inserted by the scanner.
+func (doc *document) inSource(tok *token.Token) bool {
+	off := tok.Pos.Offset
+	return tok.Kind != token.EOF && off < len(doc.src) &&
+		bytes.HasPrefix(doc.src[off:], []byte(tok.Lit))
+}
+
+// Return the first line of the token.
+func firstLine(tok *token.Token) string {
+	if i := strings.IndexByte(tok.Lit, '\n'); i >= 0 {
+		return tok.Lit[:i]
+	}
+	return tok.Lit
+}
+
+// Return the range of the token starting at pos.
+func (doc *document) rangeAt(pos token.Position) Range {
+	for _, tok := range doc.toks {
+		if tok.Pos.Offset == pos.Offset && doc.inSource(tok) {
+			return doc.nameRange(pos, firstLine(tok))
+		}
+	}
+	return doc.nameRange(pos, "")
+}
+
+// Return the name token at an LSP position, or nil.
+func (doc *document) nameAt(pos Position) *token.Token {
+	for _, tok := range doc.toks {
+		if tok.Kind != token.NAME || !doc.inSource(tok) {
+			continue
+		}
+		start := doc.lspPosition(tok.Pos)
+		if start.Line == pos.Line && start.Character <= pos.Character &&
+			pos.Character <= start.Character+utf16Len(tok.Lit) {
+			return tok
+		}
+	}
+	return nil
+}
+
+// Return the names declared by a program.
+func symbols(prog *ast.Program) []symbol {
+	var syms []symbol
+	for _, decl := range prog.Decls {
+		for _, v := range decl.VarDecls() {
+			switch decl.(type) {
+			case *ast.GlobalDecl:
+				syms = append(syms, symbol{v.Name, SymbolVariable, v.NamePos,
+					fmt.Sprintf("global %s: %d", v.Name, v.Constant)})
+			case *ast.ConstantDecl:
+				syms = append(syms, symbol{v.Name, SymbolConstant, v.NamePos,
+					fmt.Sprintf("manifest %s = %d", v.Name, v.Constant)})
+			case *ast.StaticDecl:
+				syms = append(syms, symbol{v.Name, SymbolVariable, v.NamePos,
+					fmt.Sprintf("static %s = %d", v.Name, v.Constant)})
+			}
+		}
+	}
+	for _, def := range prog.Defs {
+		syms = append(syms, defSymbols(def)...)
+	}
+	return syms
+}
+
+// Return the names defined by a definition.
+func defSymbols(def ast.Def) []symbol {
+	var syms []symbol
+	for _, d := range ast.Defs(def) {
+		switch d := d.(type) {
+		case *ast.SimpleDef:
+			for i, n := range d.Names.Names {
+				detail := "let " + n.Val
+				if c, ok := d.Exprs.Exprs[i].(*ast.ConstExpr); ok {
+					detail += " = " + strconv.Itoa(c.Contant)
+				}
+				syms = append(syms, symbol{n.Val, SymbolVariable, n.NamePos, detail})
+			}
+		case *ast.VecDef:
+			detail := "let " + d.Name + " = vec"
+			if c, ok := d.Expr.(*ast.ConstExpr); ok {
+				detail += " " + strconv.Itoa(c.Contant)
+			}
+			syms = append(syms, symbol{d.Name, SymbolArray, d.NamePos, detail})
+		case *ast.FuncDef:
+			var params []string
+			for _, n := range d.Params.Names {
+				params = append(params, n.Val)
+			}
+			detail := fmt.Sprintf("let %s(%s)", d.Name, strings.Join(params, ", "))
+			syms = append(syms, symbol{d.Name, SymbolFunction, d.NamePos, detail})
+		case *ast.RoutineDef:
+			var params []string
+			for _, n := range d.Params.Names {
+				params = append(params, n.Val)
+			}
+			detail := fmt.Sprintf("let %s(%s) be", d.Name, strings.Join(params, ", "))
+			syms = append(syms, symbol{d.Name, SymbolFunction, d.NamePos, detail})
+		}
+	}
+	return syms
+}
+
+// Return the nodes enclosing the name at an offset of a program,
+// outermost first and ending with the name or the vec definition
+// naming it, or nil if there is no name at the offset.
+func enclosing(prog *ast.Program, off int) []ast.Node {
+	var path, stack []ast.Node
+	ast.Inspect(prog, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case nil:
+			stack = stack[:len(stack)-1]
+			return true
+		case *ast.Name, *ast.VecDef:
+			if path == nil && n.Pos().Offset == off {
+				path = append(append(path, stack...), n)
+			}
+		}
+		stack = append(stack, n)
+		return path == nil
+	})
+	return path
+}
+
+// Return the local declaration of the name at an offset of a program:
+// the parameter, let or vec definition, for variable or label of the
+// innermost function, block or for command enclosing the name that
+// declares it.  The names a block defines by let are in scope from
+// their definition to the end of the block, and its labels
+// throughout it.
+func local(prog *ast.Program, name string, off int) (symbol, bool) {
+	path := enclosing(prog, off)
+	for i := len(path) - 2; i >= 0; i-- {
+		switch n := path[i].(type) {
+		case *ast.FuncDef:
+			if sym, ok := param(n.Name, n.Params, name); ok {
+				return sym, true
+			}
+		case *ast.RoutineDef:
+			if sym, ok := param(n.Name, n.Params, name); ok {
+				return sym, true
+			}
+		case *ast.ForCmd:
+			if n.Var.Val == name {
+				return symbol{name, SymbolVariable, n.Var.NamePos, "for " + name}, true
+			}
+		case *ast.BlockCmd:
+			if sym, ok := blockSymbol(n, path[i+1], name); ok {
+				return sym, true
+			}
+		}
+	}
+	return symbol{}, false
+}
+
+// Return the parameter of a function or routine with a name.
+func param(fn string, params *ast.NameList, name string) (symbol, bool) {
+	for _, p := range params.Names {
+		if p.Val == name {
+			return symbol{name, SymbolVariable, p.NamePos, "parameter " + name + " of " + fn}, true
+		}
+	}
+	return symbol{}, false
+}
+
+// Return the declaration of a name in scope at an item of a block:
+// the last definition of it by a let up to the item, or else a
+// label of the block.
+func blockSymbol(b *ast.BlockCmd, item ast.Node, name string) (symbol, bool) {
+	at := len(b.Items) - 1
+	for i, c := range b.Items {
+		if ast.Node(c) == item {
+			at = i
+		}
+	}
+	for i := at; i >= 0; i-- {
+		let, ok := b.Items[i].(*ast.LetCmd)
+		if !ok {
+			continue
+		}
+		syms := defSymbols(let.Def)
+		for j := len(syms) - 1; j >= 0; j-- {
+			if syms[j].name == name {
+				return syms[j], true
+			}
+		}
+	}
+	for _, c := range b.Items {
+		for c != nil {
+			switch l := c.(type) {
+			case *ast.LabelCmd:
+				if l.Label.Val == name {
+					return symbol{name, SymbolConstant, l.Label.NamePos, "label " + name}, true
+				}
+				c = l.Body
+			case *ast.CaseCmd:
+				c = l.Body
+			default:
+				c = nil
+			}
+		}
+	}
+	return symbol{}, false
+}
+
+// Return the declarations of the name at a position: the local
+// declaration of it in scope there, or else the names declared at
+// the top level.
+func (s *Server) lookup(p *TextDocumentPositionParams) (*token.Token, []symbol) {
+	doc, ok := s.docs[p.TextDocument.URI]
+	if !ok || doc.prog == nil {
+		return nil, nil
+	}
+	tok := doc.nameAt(p.Position)
+	if tok == nil {
+		return nil, nil
+	}
+	if sym, ok := local(doc.prog, tok.Lit, tok.Pos.Offset); ok {
+		return tok, []symbol{sym}
+	}
+	var found []symbol
+	for _, sym := range symbols(doc.prog) {
+		if sym.name == tok.Lit {
+			found = append(found, sym)
+		}
+	}
+	return tok, found
+}
+
+func (s *Server) definition(p *TextDocumentPositionParams) []Location {
+	locs := []Location{}
+	_, syms := s.lookup(p)
+	doc := s.docs[p.TextDocument.URI]
+	for _, sym := range syms {
+		locs = append(locs, Location{p.TextDocument.URI, doc.nameRange(sym.pos, sym.name)})
+	}
+	return locs
+}
+
+func (s *Server) hover(p *TextDocumentPositionParams) *Hover {
+	tok, syms := s.lookup(p)
+	if len(syms) == 0 {
+		return nil
+	}
+	var text bytes.Buffer
+	text.WriteString("```bcpl\n")
+	for _, sym := range syms {
+		text.WriteString(sym.detail + "\n")
+	}
+	text.WriteString("```")
+	doc := s.docs[p.TextDocument.URI]
+	return &Hover{MarkupContent{"markdown", text.String()}, doc.nameRange(tok.Pos, tok.Lit)}
+}
+
+func (s *Server) documentSymbols(uri string) []DocumentSymbol {
+	result := []DocumentSymbol{}
+	doc, ok := s.docs[uri]
+	if !ok || doc.prog == nil {
+		return result
+	}
+	for _, sym := range symbols(doc.prog) {
+		r := doc.nameRange(sym.pos, sym.name)
+		result = append(result, DocumentSymbol{
+			Name:           sym.name,
+			Detail:         sym.detail,
+			Kind:           sym.kind,
+			Range:          r,
+			SelectionRange: r,
+		})
+	}
+	return result
+}
+
+// Return the semantic token type of a token kind, or -1.
+func tokenType(kind token.TokenKind) int {
+	switch {
+	case kind == token.NAME:
+		return typeVariable
+	case kind == token.NUMBER:
+		return typeNumber
+	case kind == token.STRINGCONST:
+		return typeString
+	case kind == token.COMMENT:
+		return typeComment
+	case kind.IsKeyword():
+		return typeKeyword
+	case kind.IsOperator():
+		return typeOperator
+	}
+	return -1
+}
+
+func (s *Server) semanticTokens(uri string) *SemanticTokens {
+	result := &SemanticTokens{[]int{}}
+	doc, ok := s.docs[uri]
+	if !ok {
+		return result
+	}
+
+	// Each token is five integers: the line and start relative
+	// to the previous token, the length, the type and modifiers.
+	line, char := 0, 0
+	for _, tok := range doc.toks {
+		typ := tokenType(tok.Kind)
+		if typ < 0 || !doc.inSource(tok) {
+			continue
+		}
+		pos := doc.lspPosition(tok.Pos)
+		if pos.Line != line {
+			char = 0
+		}
+		result.Data = append(result.Data,
+			pos.Line-line, pos.Character-char, utf16Len(firstLine(tok)), typ, 0)
+		line, char = pos.Line, pos.Character
+	}
+	return result
+}
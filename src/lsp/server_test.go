@@ -0,0 +1,384 @@
+// Copyright 2015 Meador Inge.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package lsp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Helper test functions.
+
+type testMessage struct {
+	ID     *int            `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+	Result json.RawMessage `json:"result"`
+	Error  *responseError  `json:"error"`
+}
+
+// Run the server over a script of client messages and return
+// the server's messages.
+func runScript(t *testing.T, script []interface{}) []testMessage {
+	var in, out bytes.Buffer
+	for _, msg := range script {
+		if err := writeMessage(&in, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var s Server
+	s.Init(&in, &out)
+	if err := s.Serve(); err != nil {
+		t.Fatalf("Serve: %v", err)
+	}
+
+	var msgs []testMessage
+	r := bufio.NewReader(&out)
+	for {
+		body, err := readMessage(r)
+		if err != nil {
+			break
+		}
+		var msg testMessage
+		if err := json.Unmarshal(body, &msg); err != nil {
+			t.Fatal(err)
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+func call(id int, method string, params interface{}) interface{} {
+	return map[string]interface{}{"jsonrpc": "2.0", "id": id, "method": method, "params": params}
+}
+
+func notify(method string, params interface{}) interface{} {
+	return map[string]interface{}{"jsonrpc": "2.0", "method": method, "params": params}
+}
+
+func at(uri string, line, char int) interface{} {
+	return map[string]interface{}{
+		"textDocument": map[string]string{"uri": uri},
+		"position":     map[string]int{"line": line, "character": char},
+	}
+}
+
+func result(t *testing.T, msgs []testMessage, id int, v interface{}) {
+	for _, msg := range msgs {
+		if msg.ID != nil && *msg.ID == id {
+			if msg.Error != nil {
+				t.Fatalf("request %d failed: %s", id, msg.Error.Message)
+			}
+			if err := json.Unmarshal(msg.Result, v); err != nil {
+				t.Fatal(err)
+			}
+			return
+		}
+	}
+	t.Fatalf("no response to request %d", id)
+}
+
+const test_uri = "file:///test.b"
+
+var test_src = `global $(
+        COUNT: 200
+        ALL: 13
+$)
+
+manifest $( N = 20000 $)
+
+// Definitions.
+let X, COUNT = 1, 2
+and V = vec 5
+and F(A, B) = A + B
+`
+
+func openScript(text string, requests ...interface{}) []interface{} {
+	script := []interface{}{
+		call(1, "initialize", map[string]interface{}{}),
+		notify("initialized", map[string]interface{}{}),
+		notify("textDocument/didOpen", map[string]interface{}{
+			"textDocument": map[string]interface{}{
+				"uri": test_uri, "languageId": "bcpl", "version": 1, "text": text,
+			},
+		}),
+	}
+	script = append(script, requests...)
+	return append(script, call(99, "shutdown", nil), notify("exit", nil))
+}
+
+func TestDiagnostics(t *testing.T) {
+	msgs := runScript(t, openScript("global $( FOO 42 $)\nlet X =\nlet Y = 1\n"))
+
+	for _, msg := range msgs {
+		if msg.Method != "textDocument/publishDiagnostics" {
+			continue
+		}
+		var p PublishDiagnosticsParams
+		if err := json.Unmarshal(msg.Params, &p); err != nil {
+			t.Fatal(err)
+		}
+		if len(p.Diagnostics) != 2 {
+			t.Fatalf("expected 2 diagnostics, got %d", len(p.Diagnostics))
+		}
+		d := p.Diagnostics[0]
+		if d.Range != (Range{Position{0, 14}, Position{0, 16}}) {
+			t.Errorf("bad diagnostic range %v", d.Range)
+		}
+		if !strings.Contains(d.Message, "expected '=' or ':'") {
+			t.Errorf("bad diagnostic message %q", d.Message)
+		}
+		if d := p.Diagnostics[1]; d.Range.Start != (Position{2, 0}) {
+			t.Errorf("bad second diagnostic range %v", d.Range)
+		}
+		return
+	}
+	t.Errorf("no diagnostics published")
+}
+
+func TestDefinition(t *testing.T) {
+	msgs := runScript(t, openScript(test_src, call(2, "textDocument/definition", at(test_uri, 8, 8))))
+
+	var locs []Location
+	result(t, msgs, 2, &locs)
+	expected := []Location{
+		{test_uri, Range{Position{1, 8}, Position{1, 13}}},
+		{test_uri, Range{Position{8, 7}, Position{8, 12}}},
+	}
+	if !reflect.DeepEqual(locs, expected) {
+		t.Errorf("got %v, expected %v", locs, expected)
+	}
+}
+
+// A parameter hides the names declared at the top level in the body
+// of its function.
+func TestDefinitionParam(t *testing.T) {
+	src := "let N = 1\nlet Sum(N) = N + Twice(N)\nand Twice(X) be writen(X + N)\n"
+	msgs := runScript(t, openScript(src,
+		call(2, "textDocument/definition", at(test_uri, 1, 13)),
+		call(3, "textDocument/definition", at(test_uri, 2, 23)),
+		call(4, "textDocument/definition", at(test_uri, 2, 27)),
+		call(5, "textDocument/hover", at(test_uri, 1, 8))))
+
+	for _, test := range []struct {
+		id    int
+		start Position
+	}{{2, Position{1, 8}}, {3, Position{2, 10}}, {4, Position{0, 4}}} {
+		var locs []Location
+		result(t, msgs, test.id, &locs)
+		expected := []Location{{test_uri, Range{test.start, Position{test.start.Line, test.start.Character + 1}}}}
+		if !reflect.DeepEqual(locs, expected) {
+			t.Errorf("request %d: got %v, expected %v", test.id, locs, expected)
+		}
+	}
+	var hover Hover
+	result(t, msgs, 5, &hover)
+	if !strings.Contains(hover.Contents.Value, "parameter N of Sum") {
+		t.Errorf("bad hover %q", hover.Contents.Value)
+	}
+}
+
+// Names declared in a block shadow the top-level declarations from
+// their definition to the end of the block.
+func TestDefinitionLocal(t *testing.T) {
+	src := "global $( J: 200 $)\n" +
+		"let Start() be $(\n" +
+		"   writen(J)\n" +
+		"   let J = 1\n" +
+		"   for I = 1 to J do writen(I + J)\n" +
+		"   let V = vec 3\n" +
+		"   writen(V + J); goto L\n" +
+		"L: writen(V) $)\n"
+	msgs := runScript(t, openScript(src,
+		call(2, "textDocument/definition", at(test_uri, 2, 10)),
+		call(3, "textDocument/definition", at(test_uri, 4, 16)),
+		call(4, "textDocument/definition", at(test_uri, 4, 29)),
+		call(5, "textDocument/definition", at(test_uri, 6, 10)),
+		call(6, "textDocument/definition", at(test_uri, 6, 23)),
+		call(7, "textDocument/hover", at(test_uri, 6, 14))))
+
+	for _, test := range []struct {
+		id    int
+		start Position
+	}{{2, Position{0, 10}}, {3, Position{3, 7}}, {4, Position{4, 7}}, {5, Position{5, 7}}, {6, Position{7, 0}}} {
+		var locs []Location
+		result(t, msgs, test.id, &locs)
+		expected := []Location{{test_uri, Range{test.start, Position{test.start.Line, test.start.Character + 1}}}}
+		if !reflect.DeepEqual(locs, expected) {
+			t.Errorf("request %d: got %v, expected %v", test.id, locs, expected)
+		}
+	}
+	var hover Hover
+	result(t, msgs, 7, &hover)
+	if !strings.Contains(hover.Contents.Value, "let J = 1") {
+		t.Errorf("bad hover %q", hover.Contents.Value)
+	}
+}
+
+// Columns are counted in UTF-16 code units: "é" is one and the
+// emoji two.
+func TestUTF16(t *testing.T) {
+	src := "let N = 1\nlet S = \"é😀\" + N\n"
+	msgs := runScript(t, openScript(src,
+		call(2, "textDocument/definition", at(test_uri, 1, 16)),
+		call(3, "textDocument/hover", at(test_uri, 1, 16)),
+		call(4, "textDocument/semanticTokens/full",
+			map[string]interface{}{"textDocument": map[string]string{"uri": test_uri}})))
+
+	var locs []Location
+	result(t, msgs, 2, &locs)
+	if expected := []Location{{test_uri, Range{Position{0, 4}, Position{0, 5}}}}; !reflect.DeepEqual(locs, expected) {
+		t.Errorf("got %v, expected %v", locs, expected)
+	}
+	var hover Hover
+	result(t, msgs, 3, &hover)
+	if hover.Range != (Range{Position{1, 16}, Position{1, 17}}) {
+		t.Errorf("bad hover range %v", hover.Range)
+	}
+	var toks SemanticTokens
+	result(t, msgs, 4, &toks)
+	expected := []int{
+		0, 2, 5, typeString, 0, // "é😀"
+		0, 6, 1, typeOperator, 0, // +
+		0, 2, 1, typeVariable, 0, // N
+	}
+	if data := toks.Data; len(data) < len(expected) || !reflect.DeepEqual(data[len(data)-len(expected):], expected) {
+		t.Errorf("got %v, expected to end with %v", toks.Data, expected)
+	}
+}
+
+func TestHover(t *testing.T) {
+	msgs := runScript(t, openScript(test_src,
+		call(2, "textDocument/hover", at(test_uri, 2, 9)),
+		call(3, "textDocument/hover", at(test_uri, 5, 12)),
+		call(4, "textDocument/hover", at(test_uri, 7, 5))))
+
+	var hover Hover
+	result(t, msgs, 2, &hover)
+	if !strings.Contains(hover.Contents.Value, "global ALL: 13") {
+		t.Errorf("bad hover %q", hover.Contents.Value)
+	}
+	result(t, msgs, 3, &hover)
+	if !strings.Contains(hover.Contents.Value, "manifest N = 20000") {
+		t.Errorf("bad hover %q", hover.Contents.Value)
+	}
+
+	var none *Hover
+	result(t, msgs, 4, &none)
+	if none != nil {
+		t.Errorf("expected no hover in a comment, got %v", none)
+	}
+}
+
+func TestDocumentSymbols(t *testing.T) {
+	msgs := runScript(t, openScript(test_src, call(2, "textDocument/documentSymbol",
+		map[string]interface{}{"textDocument": map[string]string{"uri": test_uri}})))
+
+	var syms []DocumentSymbol
+	result(t, msgs, 2, &syms)
+	var names []string
+	for _, sym := range syms {
+		names = append(names, sym.Name)
+	}
+	expected := []string{"COUNT", "ALL", "N", "X", "COUNT", "V", "F"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("got symbols %v, expected %v", names, expected)
+	}
+	if syms[2].Kind != SymbolConstant || syms[5].Kind != SymbolArray {
+		t.Errorf("bad symbol kinds %d and %d", syms[2].Kind, syms[5].Kind)
+	}
+	if syms[6].Kind != SymbolFunction || syms[6].Detail != "let F(A, B)" {
+		t.Errorf("bad function symbol %v", syms[6])
+	}
+}
+
+func TestSemanticTokens(t *testing.T) {
+	msgs := runScript(t, openScript("global $( A: 1\n  B: 2 $) // c\n",
+		call(2, "textDocument/semanticTokens/full",
+			map[string]interface{}{"textDocument": map[string]string{"uri": test_uri}})))
+
+	var toks SemanticTokens
+	result(t, msgs, 2, &toks)
+	expected := []int{
+		0, 0, 6, typeKeyword, 0, // global
+		0, 7, 2, typeOperator, 0, // $(
+		0, 3, 1, typeVariable, 0, // A
+		0, 1, 1, typeOperator, 0, // :
+		0, 2, 1, typeNumber, 0, // 1
+		1, 2, 1, typeVariable, 0, // B (after an inserted semicolon)
+		0, 1, 1, typeOperator, 0, // :
+		0, 2, 1, typeNumber, 0, // 2
+		0, 2, 2, typeOperator, 0, // $)
+		0, 3, 4, typeComment, 0, // // c
+	}
+	if !reflect.DeepEqual(toks.Data, expected) {
+		t.Errorf("got %v, expected %v", toks.Data, expected)
+	}
+}
+
+func TestNotInitialized(t *testing.T) {
+	msgs := runScript(t, []interface{}{
+		call(1, "textDocument/hover", at(test_uri, 0, 0)),
+		call(2, "initialize", map[string]interface{}{}),
+		call(3, "bogus", nil),
+		call(4, "shutdown", nil),
+		notify("exit", nil),
+	})
+	if len(msgs) != 4 || msgs[0].Error == nil || msgs[0].Error.Code != serverNotInitialized {
+		t.Fatalf("expected a not initialized error, got %v", msgs)
+	}
+	if msgs[2].Error == nil || msgs[2].Error.Code != methodNotFound {
+		t.Errorf("expected a method not found error, got %v", msgs[2])
+	}
+}
+
+func codeAction(id int, r Range) interface{} {
+	return call(id, "textDocument/codeAction", map[string]interface{}{
+		"textDocument": map[string]string{"uri": test_uri},
+		"range":        r,
+		"context":      map[string]interface{}{"diagnostics": []interface{}{}},
+	})
+}
+
+func TestCodeActions(t *testing.T) {
+	// The fix of a diagnostic of an analyzer.
+	msgs := runScript(t, openScript("let F(X) be\n$( X = 1 $)\n", codeAction(2, Range{Position{1, 5}, Position{1, 5}}), codeAction(3, Range{Position{0, 0}, Position{0, 3}})))
+	var actions []CodeAction
+	result(t, msgs, 2, &actions)
+	expected := []CodeAction{{
+		Title: "replace = with :=",
+		Kind:  codeActionQuickFix,
+		Diagnostics: []Diagnostic{{
+			Range:    Range{Position{1, 5}, Position{1, 6}},
+			Severity: SeverityWarning,
+			Source:   "bclvet",
+			Message:  "assign: comparison used as a command: did you mean := for assignment?",
+		}},
+		Edit: &WorkspaceEdit{map[string][]TextEdit{test_uri: {{Range{Position{1, 5}, Position{1, 6}}, ":="}}}},
+	}}
+	if !reflect.DeepEqual(actions, expected) {
+		t.Errorf("got %+v, expected %+v", actions, expected)
+	}
+	result(t, msgs, 3, &actions)
+	if len(actions) != 0 {
+		t.Errorf("got %+v away from the diagnostic", actions)
+	}
+
+	// The fix of a syntax error.
+	msgs = runScript(t, openScript("let F() = (1 + 2\nlet G() = 3\n", codeAction(2, Range{Position{0, 0}, Position{1, 0}})))
+	result(t, msgs, 2, &actions)
+	if len(actions) != 1 || actions[0].Title != "insert missing ')'" || actions[0].Diagnostics[0].Source != "bclang" {
+		t.Fatalf("got %+v, expected the fix of a syntax error", actions)
+	}
+	insert := []TextEdit{{Range{Position{0, 16}, Position{0, 16}}, ")"}}
+	if edits := actions[0].Edit.Changes[test_uri]; !reflect.DeepEqual(edits, insert) {
+		t.Errorf("got edits %+v, expected %+v", edits, insert)
+	}
+}
@@ -0,0 +1,1114 @@
+// Copyright 2015 Meador Inge.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package ocode
+
+import (
+	"fmt"
+	"github.com/meadori/bcpl-go/src/ast"
+	"github.com/meadori/bcpl-go/src/runtime"
+	"github.com/meadori/bcpl-go/src/token"
+	"strings"
+)
+
+// An error found while compiling or running a program.
+type Error struct {
+	Pos token.Position
+	Msg string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: error: %s", e.Pos, e.Msg)
+}
+
+// A list of errors, in the order they were found.
+type ErrorList []*Error
+
+func (list ErrorList) Error() string {
+	switch len(list) {
+	case 0:
+		return "no errors"
+	case 1:
+		return list[0].Error()
+	}
+	return fmt.Sprintf("%s (and %d more errors)", list[0], len(list)-1)
+}
+
+// Return the list as an error, or nil if it is empty.
+func (list ErrorList) Err() error {
+	if len(list) == 0 {
+		return nil
+	}
+	return list
+}
+
+// What a name denotes.
+type symKind int
+
+const (
+	symCell     symKind = iota // Cell n of the frame.
+	symGlobal                  // Global n.
+	symStatic                  // The static cell name.
+	symManifest                // The constant n.
+)
+
+type symbol struct {
+	kind symKind
+	n    int64
+	name string
+	fn   string // The procedure a global or static cell holds, or "".
+}
+
+// A scope of a procedure maps names to symbols.  The outermost scope
+// is the top level of the program.
+type scope struct {
+	outer *scope
+	names map[string]*symbol
+}
+
+func newScope(outer *scope) *scope {
+	return &scope{outer, make(map[string]*symbol)}
+}
+
+func (s *scope) lookup(name string) (*symbol, bool) {
+	for ; s != nil; s = s.outer {
+		if sym, ok := s.names[name]; ok {
+			return sym, true
+		}
+	}
+	return nil, false
+}
+
+// The state of the commands of the procedure being generated.
+type procState struct {
+	labels   map[string]int64          // The label of each label name.
+	defined  map[string]bool           // The label names defined.
+	gotos    map[string]token.Position // The first goto of each label name.
+	cases    map[*ast.CaseCmd]int64    // The labels of the cases of the switchons.
+	breaks   []int64                   // The labels ending the enclosing loops.
+	loops    []int64                   // The labels of the next iterations of the enclosing loops.
+	endcases []int64                   // The labels ending the enclosing switchons.
+	arms     []armLabels               // The labels of the arms of the enclosing matches.
+	results  []int64                   // The labels ending the enclosing valofs.
+	scratch  int64                     // The cell discarded values are stored in, or -1.
+}
+
+// The labels a next in the body of an arm of a match jumps to, and
+// an exit, after loading the value of the match.
+type armLabels struct {
+	next, exit int64
+	val        int64 // The cell of the value of an every, or -1.
+}
+
+func newProcState() *procState {
+	return &procState{
+		labels:  make(map[string]int64),
+		defined: make(map[string]bool),
+		gotos:   make(map[string]token.Position),
+		cases:   make(map[*ast.CaseCmd]int64),
+		scratch: -1,
+	}
+}
+
+type generator struct {
+	p       *Program
+	errors  ErrorList
+	top     *scope             // The top-level scope.
+	statics map[string]*Static // The statics by name.
+	procs   map[string]int     // The number of procedures made for each name.
+	names   map[ast.Def]string // The name of the procedure made for each definition.
+	proc    *Proc              // The procedure being generated.
+	ps      *procState         // The state of its commands.
+	labels  int64              // The number of labels made.
+	changed map[string]bool    // The names assigned or whose address is taken.
+}
+
+func (g *generator) error(pos token.Position, format string, args ...interface{}) {
+	panic(&Error{pos, fmt.Sprintf(format, args...)})
+}
+
+// Call fn, recording the error it raises.
+func (g *generator) protect(fn func()) (ok bool) {
+	defer func() {
+		if x := recover(); x != nil {
+			e, isErr := x.(*Error)
+			if !isErr {
+				panic(x)
+			}
+			g.errors = append(g.errors, e)
+			ok = false
+		}
+	}()
+	fn()
+	return true
+}
+
+// Generate the stack code of a program for a target, returning an
+// ErrorList holding the errors found if there are any.  A zero
+// target is the default target.
+func Generate(prog *ast.Program, target runtime.Target) (*Program, error) {
+	if target.WordBits == 0 {
+		target = runtime.DefaultTarget
+	}
+	g := &generator{
+		p:       &Program{Target: target, Globals: make(map[string]int)},
+		top:     newScope(nil),
+		statics: make(map[string]*Static),
+		procs:   make(map[string]int),
+		names:   make(map[ast.Def]string),
+		changed: changed(prog),
+	}
+	g.top.names["start"] = &symbol{kind: symGlobal, n: runtime.StartGlobal}
+	for _, lib := range runtime.Library {
+		g.top.names[lib.Name] = &symbol{kind: symGlobal, n: int64(lib.Number)}
+	}
+	for _, decl := range prog.Decls {
+		g.protect(func() { g.declare(decl) })
+	}
+	g.declareDefs(prog.Defs)
+
+	g.proc = &Proc{Name: "(init)"}
+	g.ps = newProcState()
+	g.p.Init = g.proc
+	for _, def := range prog.Defs {
+		mark := len(g.proc.Code)
+		if !g.protect(func() { g.define(def) }) {
+			g.proc.Code = g.proc.Code[:mark]
+		}
+	}
+	g.protect(g.checkLabels)
+	g.emit(token.Position{}, LN, 0, "")
+	g.emit(token.Position{}, FNRN, 0, "")
+	if err := g.errors.Err(); err != nil {
+		return nil, err
+	}
+	return g.p, nil
+}
+
+// Add an instruction to the procedure being generated.
+func (g *generator) emit(pos token.Position, op Op, n int64, s string) {
+	g.proc.Code = append(g.proc.Code, Instr{op, n, s, pos})
+}
+
+// Return a new label.
+func (g *generator) label() int64 {
+	g.labels++
+	return g.labels
+}
+
+// Return a new cell of the frame of the procedure being generated.
+func (g *generator) cell() int64 {
+	g.proc.Frame++
+	return int64(g.proc.Frame - 1)
+}
+
+// ----------------------------------------------------------------------------
+// Declarations and definitions
+
+// Add a static cell or vector with a name not yet used.
+func (g *generator) newStatic(name string, size int, init int64) *Static {
+	unique := name
+	for i := 2; g.statics[unique] != nil; i++ {
+		unique = fmt.Sprintf("%s#%d", name, i)
+	}
+	s := &Static{unique, size, init}
+	g.statics[unique] = s
+	g.p.Statics = append(g.p.Statics, s)
+	return s
+}
+
+func (g *generator) declare(decl ast.Decl) {
+	for _, v := range decl.VarDecls() {
+		switch decl.(type) {
+		case *ast.GlobalDecl:
+			if v.Constant < 0 || v.Constant >= runtime.NumGlobals {
+				g.error(v.NamePos, "global number %d out of range", v.Constant)
+			}
+			g.top.names[v.Name] = &symbol{kind: symGlobal, n: int64(v.Constant)}
+			g.p.Globals[v.Name] = v.Constant
+		case *ast.ConstantDecl:
+			g.top.names[v.Name] = &symbol{kind: symManifest, n: g.wrap(int64(v.Constant))}
+		case *ast.StaticDecl:
+			s := g.newStatic(v.Name, 1, g.wrap(int64(v.Constant)))
+			g.top.names[v.Name] = &symbol{kind: symStatic, name: s.Name}
+		}
+	}
+}
+
+// Return the names assigned to, or whose address is taken, anywhere
+// in a program.
+func changed(prog *ast.Program) map[string]bool {
+	names := make(map[string]bool)
+	ast.Inspect(prog, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.AssignCmd:
+			for _, e := range n.Lhs.Exprs {
+				if name, ok := e.(*ast.Name); ok {
+					names[name.Val] = true
+				}
+			}
+		case *ast.UnaryExpr:
+			if name, ok := n.X.(*ast.Name); ok && n.Op == token.LV {
+				names[name.Val] = true
+			}
+		}
+		return true
+	})
+	return names
+}
+
+// Give each name defined at the top level a cell.  A name already
+// declared global or static keeps its cell.  A cell given its value
+// by a single function or routine definition, and never assigned to
+// or having its address taken, is known to hold that procedure.
+func (g *generator) declareDefs(defs []ast.Def) {
+	count := make(map[string]int)
+	fns := make(map[string]ast.Def)
+	cell := func(name string) {
+		count[name]++
+		if sym, ok := g.top.names[name]; ok && (sym.kind == symGlobal || sym.kind == symStatic) {
+			return
+		}
+		s := g.newStatic(name, 1, 0)
+		g.top.names[name] = &symbol{kind: symStatic, name: s.Name}
+	}
+	for _, def := range defs {
+		for _, d := range ast.Defs(def) {
+			switch d := d.(type) {
+			case *ast.FuncDef:
+				cell(d.Name)
+				fns[d.Name] = d
+			case *ast.RoutineDef:
+				cell(d.Name)
+				fns[d.Name] = d
+			case *ast.SimpleDef:
+				for _, n := range d.Names.Names {
+					cell(n.Val)
+				}
+			case *ast.VecDef:
+				cell(d.Name)
+			}
+		}
+	}
+	for name, d := range fns {
+		if count[name] == 1 && !g.changed[name] {
+			g.top.names[name].fn = g.procName(d)
+		}
+	}
+}
+
+// Return the name of the procedure made for a function or routine
+// definition.
+func (g *generator) procName(d ast.Def) string {
+	if name, ok := g.names[d]; ok {
+		return name
+	}
+	var def string
+	switch d := d.(type) {
+	case *ast.FuncDef:
+		def = d.Name
+	case *ast.RoutineDef:
+		def = d.Name
+	}
+	name := def
+	if n := g.procs[def]; n > 0 {
+		name = fmt.Sprintf("%s#%d", def, n+1)
+	}
+	g.procs[def]++
+	g.names[d] = name
+	return name
+}
+
+// Give the names of simultaneous definitions their values.  As in
+// the interpreter the functions are defined first and the other
+// values are all computed, on the stack, before any is stored.
+func (g *generator) define(def ast.Def) {
+	defs := ast.Defs(def)
+	for _, d := range defs {
+		switch d := d.(type) {
+		case *ast.FuncDef:
+			proc := g.function(d, d.NamePos, d.Params, func(s *scope) {
+				g.expr(s, d.Body)
+				g.emit(d.Body.Pos(), FNRN, 0, "")
+			})
+			g.emit(d.NamePos, LF, 0, proc.Name)
+			g.store(d.NamePos, d.Name)
+		case *ast.RoutineDef:
+			proc := g.function(d, d.NamePos, d.Params, func(s *scope) {
+				g.cmd(s, d.Body)
+				g.emit(d.Body.Pos(), LN, 0, "")
+				g.emit(d.Body.Pos(), FNRN, 0, "")
+			})
+			g.emit(d.NamePos, LF, 0, proc.Name)
+			g.store(d.NamePos, d.Name)
+		}
+	}
+
+	type value struct {
+		pos  token.Position
+		name string
+	}
+	var values []value
+	for _, d := range defs {
+		switch d := d.(type) {
+		case *ast.SimpleDef:
+			if len(d.Names.Names) != len(d.Exprs.Exprs) {
+				g.error(d.Pos(), "%d names defined by %d values",
+					len(d.Names.Names), len(d.Exprs.Exprs))
+			}
+			for i, n := range d.Names.Names {
+				g.expr(g.top, d.Exprs.Exprs[i])
+				values = append(values, value{n.NamePos, n.Val})
+			}
+		case *ast.VecDef:
+			n, ok := g.constant(g.top, d.Expr)
+			if !ok {
+				g.error(d.Expr.Pos(), "vector size is not a constant")
+			}
+			if n < 0 {
+				g.error(d.Expr.Pos(), "negative vector size %d", n)
+			}
+			s := g.newStatic(d.Name+".vec", int(n)+1, 0)
+			g.emit(d.NamePos, LLL, 0, s.Name)
+			values = append(values, value{d.NamePos, d.Name})
+		}
+	}
+	for i := len(values) - 1; i >= 0; i-- {
+		g.store(values[i].pos, values[i].name)
+	}
+}
+
+// Pop the value of a name defined at the top level into its cell.
+func (g *generator) store(pos token.Position, name string) {
+	sym := g.top.names[name]
+	if sym.kind == symGlobal {
+		g.emit(pos, SG, sym.n, "")
+	} else {
+		g.emit(pos, SL, 0, sym.name)
+	}
+}
+
+// Make the procedure for a function or routine definition, whose
+// body is generated in the scope of its parameters.
+func (g *generator) function(d ast.Def, pos token.Position, params *ast.NameList, body func(s *scope)) *Proc {
+	proc := &Proc{Name: g.procName(d), Params: len(params.Names), Pos: pos}
+	outer, outerState := g.proc, g.ps
+	g.proc, g.ps = proc, newProcState()
+	defer func() {
+		g.proc, g.ps = outer, outerState
+	}()
+
+	s := newScope(g.top)
+	for _, p := range params.Names {
+		s.names[p.Val] = &symbol{kind: symCell, n: g.cell()}
+	}
+	body(s)
+	g.checkLabels()
+	g.p.Procs = append(g.p.Procs, proc)
+	return proc
+}
+
+// ----------------------------------------------------------------------------
+// Expressions
+
+func (g *generator) wrap(x int64) int64 {
+	return int64(g.p.Target.Wrap(runtime.Word(x)))
+}
+
+// Return the value of a constant expression, and whether it is one.
+func (g *generator) constant(s *scope, e ast.Expr) (int64, bool) {
+	switch e := e.(type) {
+	case *ast.ConstExpr:
+		return g.wrap(int64(e.Contant)), true
+	case *ast.Name:
+		if sym, ok := s.lookup(e.Val); ok && sym.kind == symManifest {
+			return sym.n, true
+		}
+	case *ast.ParenExpr:
+		return g.constant(s, e.X)
+	case *ast.UnaryExpr:
+		x, ok := g.constant(s, e.X)
+		switch {
+		case ok && e.Op == token.PLUS:
+			return x, true
+		case ok && e.Op == token.MINUS:
+			return g.wrap(-x), true
+		}
+	case *ast.BinaryExpr:
+		x, xok := g.constant(s, e.X)
+		y, yok := g.constant(s, e.Y)
+		if !xok || !yok {
+			break
+		}
+		switch e.Op {
+		case token.PLUS:
+			return g.wrap(x + y), true
+		case token.MINUS:
+			return g.wrap(x - y), true
+		case token.STAR:
+			return g.wrap(x * y), true
+		case token.DIV:
+			if y != 0 {
+				return g.wrap(x / y), true
+			}
+		case token.REM:
+			if y != 0 {
+				return x % y, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// Push the address of the cell denoted by a name.
+func (g *generator) addr(pos token.Position, name string, sym *symbol) {
+	switch sym.kind {
+	case symCell:
+		g.emit(pos, LLP, sym.n, "")
+	case symGlobal:
+		g.emit(pos, LLG, sym.n, "")
+	case symStatic:
+		g.emit(pos, LLL, 0, sym.name)
+	case symManifest:
+		g.error(pos, "manifest constant %s has no address", name)
+	}
+}
+
+// Push the address denoted by an expression in an lv context.
+func (g *generator) lvalue(s *scope, e ast.Expr) {
+	switch e := e.(type) {
+	case *ast.Name:
+		sym, ok := s.lookup(e.Val)
+		if !ok {
+			g.error(e.NamePos, "undeclared name %s", e.Val)
+		}
+		g.addr(e.NamePos, e.Val, sym)
+		return
+	case *ast.ParenExpr:
+		g.lvalue(s, e.X)
+		return
+	case *ast.VecApExpr:
+		g.expr(s, e.X)
+		g.expr(s, e.Index)
+		g.emit(e.Pos(), PLUS, 0, "")
+		return
+	case *ast.UnaryExpr:
+		if e.Op == token.RV {
+			g.expr(s, e.X)
+			return
+		}
+	}
+	g.error(e.Pos(), "expression has no address")
+}
+
+var unaryOps = map[token.TokenKind]Op{
+	token.MINUS:  NEG,
+	token.NOT:    NOT,
+	token.RV:     RV,
+	token.FMINUS: FNEG,
+	token.FLOAT:  FLOAT,
+	token.FIX:    FIX,
+}
+
+var binaryOps = map[token.TokenKind]Op{
+	token.STAR:    MULT,
+	token.DIV:     DIV,
+	token.REM:     REM,
+	token.PLUS:    PLUS,
+	token.MINUS:   MINUS,
+	token.LSHIFT:  LSHIFT,
+	token.RSHIFT:  RSHIFT,
+	token.LOGAND:  LOGAND,
+	token.LOGOR:   LOGOR,
+	token.EQV:     EQV,
+	token.NEQV:    NEQV,
+	token.PERCENT: GETBYTE,
+	token.FMUL:    FMULT,
+	token.FDIV:    FDIV,
+	token.FPLUS:   FPLUS,
+	token.FMINUS:  FMINUS,
+	token.EQ:      EQ,
+	token.NE:      NE,
+	token.LS:      LS,
+	token.GR:      GR,
+	token.LE:      LE,
+	token.GE:      GE,
+	token.FEQ:     FEQ,
+	token.FNE:     FNE,
+	token.FLS:     FLS,
+	token.FGR:     FGR,
+	token.FLE:     FLE,
+	token.FGE:     FGE,
+}
+
+// Push the value of an expression.
+func (g *generator) expr(s *scope, e ast.Expr) {
+	switch e := e.(type) {
+	case *ast.Name:
+		sym, ok := s.lookup(e.Val)
+		if !ok {
+			g.error(e.NamePos, "undeclared name %s", e.Val)
+		}
+		switch {
+		case sym.kind == symCell:
+			g.emit(e.NamePos, LP, sym.n, "")
+		case sym.kind == symManifest:
+			g.emit(e.NamePos, LN, sym.n, "")
+		case sym.fn != "":
+			g.emit(e.NamePos, LF, 0, sym.fn)
+		case sym.kind == symGlobal:
+			g.emit(e.NamePos, LG, sym.n, "")
+		default:
+			g.emit(e.NamePos, LL, 0, sym.name)
+		}
+	case *ast.ConstExpr:
+		g.emit(e.ValuePos, LN, g.wrap(int64(e.Contant)), "")
+	case *ast.StringExpr:
+		g.emit(e.ValuePos, LSTR, 0, unquote(e.Lit))
+	case *ast.BoolExpr:
+		if e.Value {
+			g.emit(e.ValuePos, TRUE, 0, "")
+		} else {
+			g.emit(e.ValuePos, FALSE, 0, "")
+		}
+	case *ast.ParenExpr:
+		g.expr(s, e.X)
+	case *ast.CallExpr:
+		g.expr(s, e.Fn)
+		for _, arg := range e.Args.Exprs {
+			g.expr(s, arg)
+		}
+		g.emit(e.Pos(), FNAP, int64(len(e.Args.Exprs)), "")
+	case *ast.VecApExpr:
+		g.lvalue(s, e)
+		g.emit(e.Pos(), RV, 0, "")
+	case *ast.UnaryExpr:
+		switch e.Op {
+		case token.LV:
+			g.lvalue(s, e.X)
+			return
+		case token.PLUS, token.FPLUS:
+			g.expr(s, e.X)
+			return
+		}
+		op, ok := unaryOps[e.Op]
+		if !ok {
+			g.error(e.OpPos, "bad unary operator %s", e.Op)
+		}
+		g.expr(s, e.X)
+		g.emit(e.OpPos, op, 0, "")
+	case *ast.BinaryExpr:
+		op, ok := binaryOps[e.Op]
+		if !ok {
+			g.error(e.OpPos, "bad binary operator %s", e.Op)
+		}
+		if op.IsRelation() {
+			g.relation(s, e)
+			return
+		}
+		g.expr(s, e.X)
+		g.expr(s, e.Y)
+		g.emit(e.OpPos, op, 0, "")
+	case *ast.CondExpr:
+		els, end := g.label(), g.label()
+		g.expr(s, e.Cond)
+		g.emit(e.Pos(), JF, els, "")
+		g.expr(s, e.Then)
+		g.emit(e.Pos(), JUMP, end, "")
+		g.emit(e.Else.Pos(), LAB, els, "")
+		g.expr(s, e.Else)
+		g.emit(e.Pos(), LAB, end, "")
+	case *ast.QueryExpr:
+		g.emit(e.Query, LN, 0, "")
+	case *ast.MatchExpr:
+		g.match(s, e)
+	case *ast.ValofExpr:
+		end := g.label()
+		g.ps.results = append(g.ps.results, end)
+		g.cmd(s, e.Body)
+		g.ps.results = g.ps.results[:len(g.ps.results)-1]
+		g.emit(e.Valof, FAIL, 0, "valof ended without resultis")
+		g.emit(e.Valof, LAB, end, "")
+	default:
+		g.error(e.Pos(), "cannot compile %T", e)
+	}
+}
+
+// Push the value of a relation.  Relations may be chained, so that
+// A < B <= C means A < B & B <= C, each operand being evaluated
+// once: the operands after the first are kept in a cell of the
+// frame until they are compared with the next.
+func (g *generator) relation(s *scope, e *ast.BinaryExpr) {
+	var ops []*ast.BinaryExpr
+	x := ast.Expr(e)
+	for {
+		r, ok := x.(*ast.BinaryExpr)
+		if !ok || !binaryOps[r.Op].IsRelation() {
+			break
+		}
+		ops = append(ops, r)
+		x = r.X
+	}
+
+	g.expr(s, x)
+	var t int64
+	if len(ops) > 1 {
+		t = g.cell()
+	}
+	for i := len(ops) - 1; i >= 0; i-- {
+		pos := ops[i].OpPos
+		if i < len(ops)-1 {
+			g.emit(pos, LP, t, "")
+		}
+		g.expr(s, ops[i].Y)
+		if i > 0 {
+			g.emit(pos, SP, t, "")
+			g.emit(pos, LP, t, "")
+		}
+		g.emit(pos, binaryOps[ops[i].Op], 0, "")
+		if i < len(ops)-1 {
+			g.emit(pos, LOGAND, 0, "")
+		}
+	}
+}
+
+// ----------------------------------------------------------------------------
+// Pattern matching
+
+// Push the value of a pattern matching expression.  The arguments
+// are kept in cells of the frame, where the names the patterns bind
+// denote them.  The arms of a match are tried in turn and the first
+// to match gives the value; those of an every are all tried, the
+// value being that of the last to match.
+func (g *generator) match(s *scope, e *ast.MatchExpr) {
+	var args []int64
+	for _, arg := range e.Args.Exprs {
+		g.expr(s, arg)
+		args = append(args, g.cell())
+		g.emit(arg.Pos(), SP, args[len(args)-1], "")
+	}
+
+	val := int64(-1)
+	if e.Every {
+		val = g.cell()
+		g.emit(e.Match, LN, 0, "")
+		g.emit(e.Match, SP, val, "")
+	}
+	end := g.label()
+	for _, arm := range e.Arms {
+		next := g.label()
+		inner := newScope(s)
+		for i, pat := range arm.Patterns.Exprs {
+			switch pat := pat.(type) {
+			case *ast.QueryExpr:
+				continue
+			case *ast.Name:
+				if sym, ok := s.lookup(pat.Val); !ok || sym.kind != symManifest {
+					if _, done := inner.names[pat.Val]; !done && i < len(args) {
+						inner.names[pat.Val] = &symbol{kind: symCell, n: args[i]}
+					}
+					continue
+				}
+			}
+			if i >= len(args) {
+				g.error(pat.Pos(), "no argument for pattern")
+			}
+			g.emit(pat.Pos(), LP, args[i], "")
+			g.expr(s, pat)
+			g.emit(pat.Pos(), EQ, 0, "")
+			g.emit(pat.Pos(), JF, next, "")
+		}
+		g.ps.arms = append(g.ps.arms, armLabels{next, end, val})
+		g.expr(inner, arm.Body)
+		g.ps.arms = g.ps.arms[:len(g.ps.arms)-1]
+		if e.Every {
+			g.emit(arm.Colon, SP, val, "")
+		} else {
+			g.emit(arm.Colon, JUMP, end, "")
+		}
+		g.emit(arm.Colon, LAB, next, "")
+	}
+	if e.Every {
+		g.emit(e.Match, LP, val, "")
+	} else {
+		g.emit(e.Match, FAIL, 0, "no pattern matches")
+	}
+	g.emit(e.Match, LAB, end, "")
+}
+
+// ----------------------------------------------------------------------------
+// Commands
+
+// Return the label of a label name of the procedure being generated.
+func (g *generator) nameLabel(name string) int64 {
+	l, ok := g.ps.labels[name]
+	if !ok {
+		l = g.label()
+		g.ps.labels[name] = l
+	}
+	return l
+}
+
+// Report a goto a label the procedure does not define.
+func (g *generator) checkLabels() {
+	var first *Error
+	for name, pos := range g.ps.gotos {
+		if !g.ps.defined[name] && (first == nil || pos.Offset < first.Pos.Offset) {
+			first = &Error{pos, fmt.Sprintf("no label %s", name)}
+		}
+	}
+	if first != nil {
+		panic(first)
+	}
+}
+
+// Pop a value into the cell of a name.
+func (g *generator) storeName(s *scope, n *ast.Name) {
+	sym, ok := s.lookup(n.Val)
+	if !ok {
+		g.error(n.NamePos, "undeclared name %s", n.Val)
+	}
+	switch sym.kind {
+	case symCell:
+		g.emit(n.NamePos, SP, sym.n, "")
+	case symGlobal:
+		g.emit(n.NamePos, SG, sym.n, "")
+	case symStatic:
+		g.emit(n.NamePos, SL, 0, sym.name)
+	case symManifest:
+		g.error(n.NamePos, "cannot assign to manifest constant %s", n.Val)
+	}
+}
+
+// Pop a value into a new cell of the frame for a name of a scope.
+func (g *generator) bind(s *scope, pos token.Position, name string) {
+	n := g.cell()
+	g.emit(pos, SP, n, "")
+	s.names[name] = &symbol{kind: symCell, n: n}
+}
+
+// Give the names of simultaneous definitions in a block cells of the
+// frame holding their values, all computed before any is stored.  The
+// cells of a vector are in the frame too.
+func (g *generator) defineLocal(s *scope, def ast.Def) {
+	type value struct {
+		pos  token.Position
+		name string
+	}
+	var values []value
+	for _, d := range ast.Defs(def) {
+		switch d := d.(type) {
+		case *ast.SimpleDef:
+			if len(d.Names.Names) != len(d.Exprs.Exprs) {
+				g.error(d.Pos(), "%d names defined by %d values",
+					len(d.Names.Names), len(d.Exprs.Exprs))
+			}
+			for i, n := range d.Names.Names {
+				g.expr(s, d.Exprs.Exprs[i])
+				values = append(values, value{n.NamePos, n.Val})
+			}
+		case *ast.VecDef:
+			n, ok := g.constant(s, d.Expr)
+			if !ok {
+				g.error(d.Expr.Pos(), "vector size is not a constant")
+			}
+			if n < 0 {
+				g.error(d.Expr.Pos(), "negative vector size %d", n)
+			}
+			v := g.cell()
+			for i := int64(0); i < n; i++ {
+				g.cell()
+			}
+			g.emit(d.NamePos, LLP, v, "")
+			values = append(values, value{d.NamePos, d.Name})
+		default:
+			g.error(d.Pos(), "local function definitions are not supported")
+		}
+	}
+	for i := len(values) - 1; i >= 0; i-- {
+		g.bind(s, values[i].pos, values[i].name)
+	}
+}
+
+// Generate the code of a loop, whose breaks jump to its end label
+// and whose loop commands jump to the label of its next iteration.
+func (g *generator) loop(next, end int64, body func()) {
+	g.ps.breaks = append(g.ps.breaks, end)
+	g.ps.loops = append(g.ps.loops, next)
+	body()
+	g.ps.breaks = g.ps.breaks[:len(g.ps.breaks)-1]
+	g.ps.loops = g.ps.loops[:len(g.ps.loops)-1]
+}
+
+// Generate the code of a command.
+func (g *generator) cmd(s *scope, c ast.Cmd) {
+	switch c := c.(type) {
+	case *ast.BlockCmd:
+		inner := newScope(s)
+		for _, item := range c.Items {
+			g.cmd(inner, item)
+		}
+	case *ast.LetCmd:
+		g.defineLocal(s, c.Def)
+	case *ast.AssignCmd:
+		for _, e := range c.Rhs.Exprs {
+			g.expr(s, e)
+		}
+		for i := len(c.Lhs.Exprs) - 1; i >= 0; i-- {
+			if n, ok := c.Lhs.Exprs[i].(*ast.Name); ok {
+				g.storeName(s, n)
+				continue
+			}
+			g.lvalue(s, c.Lhs.Exprs[i])
+			g.emit(c.Ass, STIND, 0, "")
+		}
+	case *ast.ExprCmd:
+		g.expr(s, c.X)
+		if g.ps.scratch < 0 {
+			g.ps.scratch = g.cell()
+		}
+		g.emit(c.Pos(), SP, g.ps.scratch, "")
+	case *ast.IfCmd:
+		end := g.label()
+		g.expr(s, c.Cond)
+		if c.Unless {
+			g.emit(c.If, JT, end, "")
+		} else {
+			g.emit(c.If, JF, end, "")
+		}
+		g.cmd(s, c.Body)
+		g.emit(c.If, LAB, end, "")
+	case *ast.TestCmd:
+		els, end := g.label(), g.label()
+		g.expr(s, c.Cond)
+		g.emit(c.Test, JF, els, "")
+		g.cmd(s, c.Then)
+		g.emit(c.Test, JUMP, end, "")
+		g.emit(c.Else.Pos(), LAB, els, "")
+		g.cmd(s, c.Else)
+		g.emit(c.Test, LAB, end, "")
+	case *ast.WhileCmd:
+		top, end := g.label(), g.label()
+		g.emit(c.While, LAB, top, "")
+		g.expr(s, c.Cond)
+		if c.Until {
+			g.emit(c.While, JT, end, "")
+		} else {
+			g.emit(c.While, JF, end, "")
+		}
+		g.loop(top, end, func() { g.cmd(s, c.Body) })
+		g.emit(c.While, JUMP, top, "")
+		g.emit(c.While, LAB, end, "")
+	case *ast.RepeatCmd:
+		top, next, end := g.label(), g.label(), g.label()
+		g.emit(c.Pos(), LAB, top, "")
+		g.loop(next, end, func() { g.cmd(s, c.Body) })
+		g.emit(c.OpPos, LAB, next, "")
+		switch c.Op {
+		case token.REPEAT:
+			g.emit(c.OpPos, JUMP, top, "")
+		case token.REPEATWHILE:
+			g.expr(s, c.Cond)
+			g.emit(c.OpPos, JT, top, "")
+		case token.REPEATUNTIL:
+			g.expr(s, c.Cond)
+			g.emit(c.OpPos, JF, top, "")
+		}
+		g.emit(c.OpPos, LAB, end, "")
+	case *ast.ForCmd:
+		top, next, end := g.label(), g.label(), g.label()
+		step := int64(1)
+		if c.By != nil {
+			v, ok := g.constant(s, c.By)
+			if !ok {
+				g.error(c.By.Pos(), "for step is not a constant")
+			}
+			step = v
+		}
+		inner := newScope(s)
+		g.expr(s, c.From)
+		g.bind(inner, c.Var.NamePos, c.Var.Val)
+		v := inner.names[c.Var.Val].n
+		g.expr(s, c.To)
+		limit := g.cell()
+		g.emit(c.For, SP, limit, "")
+		g.emit(c.For, LAB, top, "")
+		g.emit(c.For, LP, v, "")
+		g.emit(c.For, LP, limit, "")
+		if step < 0 {
+			g.emit(c.For, GE, 0, "")
+		} else {
+			g.emit(c.For, LE, 0, "")
+		}
+		g.emit(c.For, JF, end, "")
+		g.loop(next, end, func() { g.cmd(inner, c.Body) })
+		g.emit(c.For, LAB, next, "")
+		g.emit(c.For, LP, v, "")
+		g.emit(c.For, LN, step, "")
+		g.emit(c.For, PLUS, 0, "")
+		g.emit(c.For, SP, v, "")
+		g.emit(c.For, JUMP, top, "")
+		g.emit(c.For, LAB, end, "")
+	case *ast.JumpCmd:
+		switch c.Tok {
+		case token.BREAK:
+			if len(g.ps.breaks) == 0 {
+				g.error(c.TokPos, "break outside a loop")
+			}
+			g.emit(c.TokPos, JUMP, g.ps.breaks[len(g.ps.breaks)-1], "")
+		case token.LOOP:
+			if len(g.ps.loops) == 0 {
+				g.error(c.TokPos, "loop outside a loop")
+			}
+			g.emit(c.TokPos, JUMP, g.ps.loops[len(g.ps.loops)-1], "")
+		case token.ENDCASE:
+			if len(g.ps.endcases) == 0 {
+				g.error(c.TokPos, "endcase outside a switchon")
+			}
+			g.emit(c.TokPos, JUMP, g.ps.endcases[len(g.ps.endcases)-1], "")
+		case token.NEXT, token.EXIT:
+			if len(g.ps.arms) == 0 {
+				g.error(c.TokPos, "%s outside a match", c.Tok)
+			}
+			arm := g.ps.arms[len(g.ps.arms)-1]
+			if c.Tok == token.NEXT {
+				g.emit(c.TokPos, JUMP, arm.next, "")
+				break
+			}
+			if arm.val < 0 {
+				g.emit(c.TokPos, LN, 0, "")
+			} else {
+				g.emit(c.TokPos, LP, arm.val, "")
+			}
+			g.emit(c.TokPos, JUMP, arm.exit, "")
+		case token.RETURN:
+			g.emit(c.TokPos, LN, 0, "")
+			g.emit(c.TokPos, FNRN, 0, "")
+		case token.FINISH:
+			g.emit(c.TokPos, LG, runtime.StopGlobal, "")
+			g.emit(c.TokPos, LN, 0, "")
+			g.emit(c.TokPos, FNAP, 1, "")
+			g.emit(c.TokPos, FNRN, 0, "")
+		}
+	case *ast.GotoCmd:
+		if _, ok := g.ps.gotos[c.Label.Val]; !ok {
+			g.ps.gotos[c.Label.Val] = c.Label.NamePos
+		}
+		g.emit(c.Goto, JUMP, g.nameLabel(c.Label.Val), "")
+	case *ast.ResultisCmd:
+		if len(g.ps.results) == 0 {
+			g.error(c.Resultis, "resultis outside valof")
+		}
+		g.expr(s, c.X)
+		g.emit(c.Resultis, JUMP, g.ps.results[len(g.ps.results)-1], "")
+	case *ast.SwitchonCmd:
+		g.switchon(s, c)
+	case *ast.CaseCmd:
+		l, ok := g.ps.cases[c]
+		if !ok {
+			g.error(c.Case, "case outside switchon")
+		}
+		g.emit(c.Case, LAB, l, "")
+		if c.Body != nil {
+			g.cmd(s, c.Body)
+		}
+	case *ast.LabelCmd:
+		if g.ps.defined[c.Label.Val] {
+			g.error(c.Label.NamePos, "label %s redefined", c.Label.Val)
+		}
+		g.ps.defined[c.Label.Val] = true
+		g.emit(c.Label.NamePos, LAB, g.nameLabel(c.Label.Val), "")
+		if c.Body != nil {
+			g.cmd(s, c.Body)
+		}
+	default:
+		g.error(c.Pos(), "cannot compile %T", c)
+	}
+}
+
+// Return the cases of a switchon, those of switchons nested in its
+// body excepted.
+func cases(c *ast.SwitchonCmd) []*ast.CaseCmd {
+	var list []*ast.CaseCmd
+	ast.Inspect(c.Body, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.CaseCmd:
+			list = append(list, n)
+		case *ast.SwitchonCmd, *ast.ValofExpr:
+			return false
+		}
+		return true
+	})
+	return list
+}
+
+// Generate the code of a switchon, which compares the value, kept in
+// a cell of the frame, with each case in turn and jumps to the first
+// that has it, or to the default.
+func (g *generator) switchon(s *scope, c *ast.SwitchonCmd) {
+	end := g.label()
+	g.expr(s, c.X)
+	x := g.cell()
+	g.emit(c.Switchon, SP, x, "")
+	deflt := end
+	seen := make(map[int64]bool)
+	for _, k := range cases(c) {
+		l := g.label()
+		g.ps.cases[k] = l
+		if k.Value == nil {
+			if deflt != end {
+				g.error(k.Case, "more than one default")
+			}
+			deflt = l
+			continue
+		}
+		v, ok := g.constant(s, k.Value)
+		if !ok {
+			g.error(k.Value.Pos(), "case value is not a constant")
+		}
+		if seen[v] {
+			g.error(k.Value.Pos(), "duplicate case %d", v)
+		}
+		seen[v] = true
+		g.emit(k.Case, LP, x, "")
+		g.emit(k.Case, LN, v, "")
+		g.emit(k.Case, EQ, 0, "")
+		g.emit(k.Case, JT, l, "")
+	}
+	g.emit(c.Switchon, JUMP, deflt, "")
+	g.ps.endcases = append(g.ps.endcases, end)
+	g.cmd(s, c.Body)
+	g.ps.endcases = g.ps.endcases[:len(g.ps.endcases)-1]
+	g.emit(c.Switchon, LAB, end, "")
+}
+
+// Return the characters of a string constant, translating the
+// escapes *n, *t, *s, *b, *p and **.
+func unquote(lit string) string {
+	lit = strings.TrimPrefix(lit, "\"")
+	lit = strings.TrimSuffix(lit, "\"")
+	var buf []byte
+	for i := 0; i < len(lit); i++ {
+		ch := lit[i]
+		if ch == '*' && i+1 < len(lit) {
+			i++
+			switch lit[i] {
+			case 'n', 'N':
+				ch = '\n'
+			case 't', 'T':
+				ch = '\t'
+			case 's', 'S':
+				ch = ' '
+			case 'b', 'B':
+				ch = '\b'
+			case 'p', 'P':
+				ch = '\f'
+			default:
+				ch = lit[i]
+			}
+		}
+		buf = append(buf, ch)
+	}
+	return string(buf)
+}
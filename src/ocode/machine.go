@@ -0,0 +1,371 @@
+// Copyright 2015 Meador Inge.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package ocode
+
+import (
+	"fmt"
+	"github.com/meadori/bcpl-go/src/runtime"
+	"github.com/meadori/bcpl-go/src/token"
+	"io"
+)
+
+// A machine runs stack code against the store of a runtime.
+type Machine struct {
+	Target  runtime.Target // The target machine, used by Init.
+	Steps   int64          // The number of instructions run.
+	rt      runtime.Runtime
+	depth   int // The number of active procedure calls.
+	statics map[string]runtime.Word
+	entries map[string]runtime.Word  // The routines of the procedures.
+	loaded  map[runtime.Word]*loaded // The procedures, by routine.
+}
+
+// The maximum depth of nested procedure calls.
+const MaxDepth = 10000
+
+// A procedure ready to run: its code with the jumps resolved.
+type loaded struct {
+	proc    *Proc
+	targets []int                // The index of the label each jump goes to.
+	strings map[int]runtime.Word // The strings pushed by LSTR, by index.
+	tail    []bool               // Whether each FNAP is a tail call.
+}
+
+// Initialize the machine with a fresh runtime for the target, reading
+// from input and writing to output.
+func (m *Machine) Init(input io.Reader, output io.Writer) {
+	m.rt.Target = m.Target
+	m.rt.Init(input, output)
+	m.Steps = 0
+	m.depth = 0
+	m.statics = make(map[string]runtime.Word)
+	m.entries = make(map[string]runtime.Word)
+	m.loaded = make(map[runtime.Word]*loaded)
+}
+
+func (m *Machine) error(pos token.Position, format string, args ...interface{}) {
+	panic(&Error{pos, fmt.Sprintf(format, args...)})
+}
+
+// Evaluate fn, turning the errors it raises and the calls of stop and
+// faults in the routines it calls into an error.
+func (m *Machine) protect(fn func() runtime.Word) (val runtime.Word, err error) {
+	defer func() {
+		if x := recover(); x != nil {
+			e, ok := x.(*Error)
+			if !ok {
+				panic(x)
+			}
+			val, err = 0, e
+		}
+	}()
+	return m.rt.Protect(fn)
+}
+
+// Load a program: allocate its statics, give its procedures routines
+// and run its initialization.
+func (m *Machine) Load(p *Program) error {
+	_, err := m.protect(func() runtime.Word {
+		for _, s := range p.Statics {
+			addr := m.rt.Store.GetVec(runtime.Word(s.Size - 1))
+			if addr == 0 {
+				m.error(token.Position{}, "out of store")
+			}
+			m.rt.Store.Put(addr, runtime.Word(s.Init))
+			m.statics[s.Name] = addr
+		}
+		for _, proc := range p.Procs {
+			l := m.load(proc)
+			m.entries[proc.Name] = m.rt.Define(func(rt *runtime.Runtime, args []runtime.Word) runtime.Word {
+				return m.run(l, args)
+			})
+			m.loaded[m.entries[proc.Name]] = l
+		}
+		if p.Init == nil {
+			return 0
+		}
+		return m.run(m.load(p.Init), nil)
+	})
+	return err
+}
+
+// Run the program by calling start, with no arguments.
+func (m *Machine) Start() (runtime.Word, error) {
+	return m.protect(func() runtime.Word {
+		f := m.rt.Global(runtime.StartGlobal)
+		if f == 0 {
+			m.error(token.Position{}, "start is not defined")
+		}
+		return m.rt.Call(f)
+	})
+}
+
+// Resolve the jumps of a procedure and find its tail calls: the calls
+// whose result it returns, when it never takes the address of a cell
+// of its frame, which might then outlive the frame.
+func (m *Machine) load(proc *Proc) *loaded {
+	labels := make(map[int64]int)
+	escapes := false
+	for i, in := range proc.Code {
+		switch in.Op {
+		case LAB:
+			labels[in.N] = i
+		case LLP:
+			escapes = true
+		}
+	}
+	l := &loaded{proc, make([]int, len(proc.Code)), make(map[int]runtime.Word), make([]bool, len(proc.Code))}
+	for i, in := range proc.Code {
+		if in.Op.IsJump() {
+			to, ok := labels[in.N]
+			if !ok {
+				m.error(in.Pos, "no label L%d in %s", in.N, proc.Name)
+			}
+			l.targets[i] = to
+		}
+		if in.Op == FNAP && !escapes {
+			next := i + 1
+			for next < len(proc.Code) && proc.Code[next].Op == LAB {
+				next++
+			}
+			l.tail[i] = next < len(proc.Code) && proc.Code[next].Op == FNRN
+		}
+	}
+	return l
+}
+
+func (m *Machine) float(in *Instr, w runtime.Word) float64 {
+	f, ok := m.rt.Target.Float(w)
+	if !ok {
+		m.error(in.Pos, "no floating point on %d-bit words", m.rt.Target.WordBits)
+	}
+	return f
+}
+
+func (m *Machine) word(in *Instr, f float64) runtime.Word {
+	w, ok := m.rt.Target.FromFloat(f)
+	if !ok {
+		m.error(in.Pos, "no floating point on %d-bit words", m.rt.Target.WordBits)
+	}
+	return w
+}
+
+func (m *Machine) truth(b bool) runtime.Word {
+	if b {
+		return -1
+	}
+	return 0
+}
+
+// Run a procedure with the given arguments, returning its result.  A
+// tail call of another procedure replaces the activation making it.
+func (m *Machine) run(l *loaded, args []runtime.Word) runtime.Word {
+	for {
+		val, next, nextArgs := m.activate(l, args)
+		if next == nil {
+			return val
+		}
+		l, args = next, nextArgs
+	}
+}
+
+// Run an activation of a procedure, returning its result, or the
+// procedure and arguments of the tail call it ends with.
+func (m *Machine) activate(l *loaded, args []runtime.Word) (runtime.Word, *loaded, []runtime.Word) {
+	proc, t, store := l.proc, m.rt.Target, m.rt.Store
+	if m.depth >= MaxDepth {
+		m.error(proc.Pos, "call stack overflow calling %s", proc.Name)
+	}
+	m.depth++
+	defer func() {
+		m.depth--
+	}()
+
+	var frame runtime.Word
+	if proc.Frame > 0 {
+		frame = store.GetVec(runtime.Word(proc.Frame - 1))
+		if frame == 0 {
+			m.error(proc.Pos, "out of store calling %s", proc.Name)
+		}
+		defer store.FreeVec(frame)
+		for i := 0; i < proc.Frame; i++ {
+			var arg runtime.Word
+			if i < proc.Params && i < len(args) {
+				arg = args[i]
+			}
+			store.Put(frame+runtime.Word(i), arg)
+		}
+	}
+
+	var stack []runtime.Word
+	push := func(w runtime.Word) {
+		stack = append(stack, w)
+	}
+	pop := func() runtime.Word {
+		w := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		return w
+	}
+	for pc := 0; pc < len(proc.Code); pc++ {
+		in := &proc.Code[pc]
+		m.Steps++
+		switch in.Op {
+		case LP:
+			push(store.Load(frame + runtime.Word(in.N)))
+		case LG:
+			push(m.rt.Global(int(in.N)))
+		case LL:
+			push(store.Load(m.statics[in.S]))
+		case LN:
+			push(runtime.Word(in.N))
+		case LSTR:
+			s, ok := l.strings[pc]
+			if !ok {
+				s = m.rt.NewString(in.S)
+				l.strings[pc] = s
+			}
+			push(s)
+		case LF:
+			push(m.entries[in.S])
+		case TRUE:
+			push(-1)
+		case FALSE:
+			push(0)
+		case LLP:
+			push(frame + runtime.Word(in.N))
+		case LLG:
+			push(runtime.Word(in.N))
+		case LLL:
+			push(m.statics[in.S])
+		case DUP:
+			push(stack[len(stack)-1])
+		case SP:
+			store.Put(frame+runtime.Word(in.N), pop())
+		case SG:
+			m.rt.SetGlobal(int(in.N), pop())
+		case SL:
+			store.Put(m.statics[in.S], pop())
+		case STIND:
+			addr := pop()
+			store.Put(addr, pop())
+		case RV:
+			push(store.Load(pop()))
+		case NEG:
+			push(t.Wrap(-pop()))
+		case NOT:
+			push(^pop())
+		case FNEG:
+			push(m.word(in, -m.float(in, pop())))
+		case FLOAT:
+			push(m.word(in, float64(pop())))
+		case FIX:
+			push(t.Wrap(runtime.Word(m.float(in, pop()))))
+		case FNAP:
+			n := len(stack) - int(in.N)
+			args := append([]runtime.Word(nil), stack[n:]...)
+			f := stack[n-1]
+			stack = stack[:n-1]
+			if next, ok := m.loaded[f]; ok && l.tail[pc] {
+				return 0, next, args
+			}
+			push(m.rt.Call(f, args...))
+		case FNRN:
+			return pop(), nil, nil
+		case JUMP:
+			pc = l.targets[pc]
+		case JT:
+			if pop() != 0 {
+				pc = l.targets[pc]
+			}
+		case JF:
+			if pop() == 0 {
+				pc = l.targets[pc]
+			}
+		case LAB:
+		case FAIL:
+			m.error(in.Pos, "%s", in.S)
+		default:
+			y := pop()
+			x := pop()
+			push(m.binary(in, x, y))
+		}
+	}
+	m.error(proc.Pos, "%s ends without returning", proc.Name)
+	return 0, nil, nil
+}
+
+func (m *Machine) binary(in *Instr, x, y runtime.Word) runtime.Word {
+	t := m.rt.Target
+	switch in.Op {
+	case MULT:
+		return t.Wrap(x * y)
+	case DIV, REM:
+		if y == 0 {
+			m.error(in.Pos, "division by zero")
+		}
+		if in.Op == DIV {
+			return t.Wrap(x / y)
+		}
+		return x % y
+	case PLUS:
+		return t.Wrap(x + y)
+	case MINUS:
+		return t.Wrap(x - y)
+	case LSHIFT:
+		if y < 0 {
+			return 0
+		}
+		return t.Shift(x, y)
+	case RSHIFT:
+		if y < 0 {
+			return 0
+		}
+		return t.Shift(x, -y)
+	case LOGAND:
+		return x & y
+	case LOGOR:
+		return x | y
+	case EQV:
+		return ^(x ^ y)
+	case NEQV:
+		return x ^ y
+	case GETBYTE:
+		return m.rt.GetByte(x, y)
+	case FMULT:
+		return m.word(in, m.float(in, x)*m.float(in, y))
+	case FDIV:
+		return m.word(in, m.float(in, x)/m.float(in, y))
+	case FPLUS:
+		return m.word(in, m.float(in, x)+m.float(in, y))
+	case FMINUS:
+		return m.word(in, m.float(in, x)-m.float(in, y))
+	case EQ:
+		return m.truth(x == y)
+	case NE:
+		return m.truth(x != y)
+	case LS:
+		return m.truth(x < y)
+	case GR:
+		return m.truth(x > y)
+	case LE:
+		return m.truth(x <= y)
+	case GE:
+		return m.truth(x >= y)
+	case FEQ:
+		return m.truth(m.float(in, x) == m.float(in, y))
+	case FNE:
+		return m.truth(m.float(in, x) != m.float(in, y))
+	case FLS:
+		return m.truth(m.float(in, x) < m.float(in, y))
+	case FGR:
+		return m.truth(m.float(in, x) > m.float(in, y))
+	case FLE:
+		return m.truth(m.float(in, x) <= m.float(in, y))
+	case FGE:
+		return m.truth(m.float(in, x) >= m.float(in, y))
+	}
+	m.error(in.Pos, "bad instruction %s", in)
+	return 0
+}
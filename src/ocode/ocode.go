@@ -0,0 +1,326 @@
+// Copyright 2015 Meador Inge.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+// Package ocode compiles programs to stack code, in the manner of the
+// OCODE of the classic BCPL compilers, improves the code with a
+// peephole optimizer and runs it on a simple stack machine.
+//
+// Each function or routine is a procedure whose frame holds its
+// parameters followed by the cells it needs for the names and vectors
+// its blocks define, the control variables and limits of its for
+// loops, the values of switchons and pattern matches and chained
+// relations.  Its instructions work on a stack of words:
+// the loads push a word, the stores pop one and the operators replace
+// their operands by their result.  A call pushes the routine and the
+// arguments, FNAP pops them and pushes the result.  The machine makes
+// a call followed by FNRN in place of the activation making it, unless
+// the procedure takes the address of a cell of its frame.
+package ocode
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/meadori/bcpl-go/src/runtime"
+	"github.com/meadori/bcpl-go/src/token"
+	"io"
+	"sort"
+)
+
+// An operation of the stack code.
+type Op int
+
+const (
+	OpInvalid Op = iota
+
+	// Loads.
+	LP    // Push cell N of the frame.
+	LG    // Push global N.
+	LL    // Push the static cell S.
+	LN    // Push the number N.
+	LSTR  // Push the string S.
+	LF    // Push the routine of procedure S.
+	TRUE  // Push true.
+	FALSE // Push false.
+	LLP   // Push the address of cell N of the frame.
+	LLG   // Push the address of global N.
+	LLL   // Push the address of the static cell S.
+	DUP   // Push the word on top of the stack.
+
+	// Stores.
+	SP    // Pop cell N of the frame.
+	SG    // Pop global N.
+	SL    // Pop the static cell S.
+	STIND // Pop an address, then a word, and store the word at the address.
+
+	// Operators.
+	RV
+	NEG
+	NOT
+	FNEG
+	FLOAT
+	FIX
+	MULT
+	DIV
+	REM
+	PLUS
+	MINUS
+	LSHIFT
+	RSHIFT
+	LOGAND
+	LOGOR
+	EQV
+	NEQV
+	GETBYTE
+	FMULT
+	FDIV
+	FPLUS
+	FMINUS
+	EQ
+	NE
+	LS
+	GR
+	LE
+	GE
+	FEQ
+	FNE
+	FLS
+	FGR
+	FLE
+	FGE
+
+	// Control.
+	FNAP // Call a routine with N arguments.
+	FNRN // Return the word on top of the stack.
+	JUMP // Jump to label N.
+	JT   // Pop a word and jump to label N if it is true.
+	JF   // Pop a word and jump to label N if it is false.
+	LAB  // Label N.
+	FAIL // Stop with the error S.
+
+	numOps
+
+	// Any matches every operation in the pattern of a peephole rule.
+	Any Op = -1
+)
+
+var opNames = [...]string{
+	OpInvalid: "INVALID",
+	LP:        "LP",
+	LG:        "LG",
+	LL:        "LL",
+	LN:        "LN",
+	LSTR:      "LSTR",
+	LF:        "LF",
+	TRUE:      "TRUE",
+	FALSE:     "FALSE",
+	LLP:       "LLP",
+	LLG:       "LLG",
+	LLL:       "LLL",
+	DUP:       "DUP",
+	SP:        "SP",
+	SG:        "SG",
+	SL:        "SL",
+	STIND:     "STIND",
+	RV:        "RV",
+	NEG:       "NEG",
+	NOT:       "NOT",
+	FNEG:      "FNEG",
+	FLOAT:     "FLOAT",
+	FIX:       "FIX",
+	MULT:      "MULT",
+	DIV:       "DIV",
+	REM:       "REM",
+	PLUS:      "PLUS",
+	MINUS:     "MINUS",
+	LSHIFT:    "LSHIFT",
+	RSHIFT:    "RSHIFT",
+	LOGAND:    "LOGAND",
+	LOGOR:     "LOGOR",
+	EQV:       "EQV",
+	NEQV:      "NEQV",
+	GETBYTE:   "GETBYTE",
+	FMULT:     "FMULT",
+	FDIV:      "FDIV",
+	FPLUS:     "FPLUS",
+	FMINUS:    "FMINUS",
+	EQ:        "EQ",
+	NE:        "NE",
+	LS:        "LS",
+	GR:        "GR",
+	LE:        "LE",
+	GE:        "GE",
+	FEQ:       "FEQ",
+	FNE:       "FNE",
+	FLS:       "FLS",
+	FGR:       "FGR",
+	FLE:       "FLE",
+	FGE:       "FGE",
+	FNAP:      "FNAP",
+	FNRN:      "FNRN",
+	JUMP:      "JUMP",
+	JT:        "JT",
+	JF:        "JF",
+	LAB:       "LAB",
+	FAIL:      "FAIL",
+}
+
+func (op Op) String() string {
+	if op == Any {
+		return "*"
+	}
+	if op < 0 || op >= numOps {
+		return fmt.Sprintf("Op(%d)", int(op))
+	}
+	return opNames[op]
+}
+
+// Lookup the operation with the given name, returning OpInvalid if
+// there is none.
+func LookupOp(name string) Op {
+	for op, str := range opNames {
+		if str == name && Op(op) != OpInvalid {
+			return Op(op)
+		}
+	}
+	return OpInvalid
+}
+
+// Report whether an operation is a jump to a label.
+func (op Op) IsJump() bool {
+	return op == JUMP || op == JT || op == JF
+}
+
+// Report whether an operation is a relation.
+func (op Op) IsRelation() bool {
+	return EQ <= op && op <= GE || FEQ <= op && op <= FGE
+}
+
+// An instruction.  N is the number or label operand and S the name or
+// string operand, as the operation needs.
+type Instr struct {
+	Op  Op
+	N   int64
+	S   string
+	Pos token.Position
+}
+
+func (in Instr) String() string {
+	switch in.Op {
+	case LP, LG, LN, LLP, LLG, SP, SG, FNAP:
+		return fmt.Sprintf("%s %d", in.Op, in.N)
+	case JUMP, JT, JF, LAB:
+		return fmt.Sprintf("%s L%d", in.Op, in.N)
+	case LL, LF, LLL, SL:
+		return fmt.Sprintf("%s %s", in.Op, in.S)
+	case LSTR, FAIL:
+		return fmt.Sprintf("%s %q", in.Op, in.S)
+	}
+	return in.Op.String()
+}
+
+// A procedure.
+type Proc struct {
+	Name   string // The name of the procedure, unique in its program.
+	Params int    // The number of parameters.
+	Frame  int    // The number of cells in the frame.
+	Code   []Instr
+	Pos    token.Position
+}
+
+// A static cell or vector.
+type Static struct {
+	Name string
+	Size int   // The number of words.
+	Init int64 // The initial value of the first word.
+}
+
+// A compiled program.  Running the initialization procedure defines
+// the names of the top level.
+type Program struct {
+	Target  runtime.Target
+	Globals map[string]int // The global numbers by name.
+	Statics []*Static
+	Procs   []*Proc
+	Init    *Proc
+}
+
+// Return the procedure with the given name, or nil if there is none.
+func (p *Program) Proc(name string) *Proc {
+	for _, proc := range p.Procs {
+		if proc.Name == name {
+			return proc
+		}
+	}
+	return nil
+}
+
+// The textual form of a program lists its globals by number, its
+// statics and its procedures, the initializing procedure first:
+//
+//	global Square 200
+//	static Count 1 = 3
+//
+//	proc Square(1) frame 1
+//		LP 0
+//		LP 0
+//		MULT
+//		FNRN
+
+// Write the textual form of a procedure.
+func (proc *Proc) Fprint(w io.Writer) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "proc %s(%d) frame %d\n", proc.Name, proc.Params, proc.Frame)
+	for _, in := range proc.Code {
+		fmt.Fprintf(&buf, "\t%s\n", in)
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func (proc *Proc) String() string {
+	var buf bytes.Buffer
+	proc.Fprint(&buf)
+	return buf.String()
+}
+
+// Write the textual form of a program.
+func (p *Program) Fprint(w io.Writer) error {
+	var buf bytes.Buffer
+	var names []string
+	for name := range p.Globals {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		gi, gj := p.Globals[names[i]], p.Globals[names[j]]
+		return gi < gj || gi == gj && names[i] < names[j]
+	})
+	for _, name := range names {
+		fmt.Fprintf(&buf, "global %s %d\n", name, p.Globals[name])
+	}
+	for _, s := range p.Statics {
+		fmt.Fprintf(&buf, "static %s %d", s.Name, s.Size)
+		if s.Init != 0 {
+			fmt.Fprintf(&buf, " = %d", s.Init)
+		}
+		buf.WriteByte('\n')
+	}
+	procs := p.Procs
+	if p.Init != nil {
+		procs = append([]*Proc{p.Init}, procs...)
+	}
+	for _, proc := range procs {
+		if buf.Len() > 0 {
+			buf.WriteByte('\n')
+		}
+		proc.Fprint(&buf)
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func (p *Program) String() string {
+	var buf bytes.Buffer
+	p.Fprint(&buf)
+	return buf.String()
+}
@@ -0,0 +1,393 @@
+// Copyright 2015 Meador Inge.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package ocode
+
+import (
+	"bytes"
+	"github.com/meadori/bcpl-go/src/ast"
+	"github.com/meadori/bcpl-go/src/parser"
+	"github.com/meadori/bcpl-go/src/runtime"
+	"github.com/meadori/bcpl-go/src/token"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func parse(t testing.TB, src string) *ast.Program {
+	var p parser.Parser
+	p.Dialect = token.Richards
+	p.Init([]byte(src))
+	prog := p.Parse()
+	if len(p.Errors) > 0 {
+		t.Fatal(p.Errors)
+	}
+	return prog
+}
+
+func generate(t testing.TB, src string) *Program {
+	p, err := Generate(parse(t, src), runtime.Target{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// Parse code written as instructions separated by semicolons, like
+// "LP 0; JF L1".
+func parseCode(t *testing.T, src string) []Instr {
+	var code []Instr
+	for _, str := range strings.Split(src, ";") {
+		fields := strings.SplitN(strings.TrimSpace(str), " ", 2)
+		if fields[0] == "" {
+			continue
+		}
+		in := Instr{Op: LookupOp(fields[0])}
+		if in.Op == OpInvalid {
+			t.Fatalf("bad instruction %q", str)
+		}
+		if len(fields) == 2 {
+			arg := fields[1]
+			if in.Op.IsJump() || in.Op == LAB {
+				arg = strings.TrimPrefix(arg, "L")
+			}
+			if n, err := strconv.ParseInt(arg, 10, 64); err == nil {
+				in.N = n
+			} else if s, err := strconv.Unquote(arg); err == nil {
+				in.S = s
+			} else {
+				in.S = arg
+			}
+		}
+		code = append(code, in)
+	}
+	return code
+}
+
+func formatCode(code []Instr) string {
+	var strs []string
+	for _, in := range code {
+		strs = append(strs, in.String())
+	}
+	return strings.Join(strs, "; ")
+}
+
+var test_rules = []struct {
+	rule     string
+	code     string
+	expected string
+}{
+	{"fold-compare", "LN 1; LN 2; LS; FNRN", "TRUE; FNRN"},
+	{"fold-compare", "LN 1; LN 2; PLUS; FNRN", "LN 1; LN 2; PLUS; FNRN"},
+	{"fold-jump", "TRUE; JT L1; LN 0; FNRN; LAB L1; LN 1; FNRN", "JUMP L1; LN 0; FNRN; LAB L1; LN 1; FNRN"},
+	{"fold-jump", "TRUE; JF L1; LN 0; FNRN; LAB L1; LN 1; FNRN", "LN 0; FNRN; LAB L1; LN 1; FNRN"},
+	{"drop-store-load", "LP 0; SP 1; LP 1; LN 2; EQ; FNRN", "LP 0; LN 2; EQ; FNRN"},
+	{"drop-store-load", "LP 0; SP 1; LP 1; LP 1; EQ; FNRN", "LP 0; SP 1; LP 1; LP 1; EQ; FNRN"},
+	{"store-load", "LP 0; SP 1; LP 1; LP 1; EQ; FNRN", "LP 0; DUP; DUP; SP 1; EQ; FNRN"},
+	{"drop-load-store", "LP 0; SP 0; LP 0; FNRN", "LP 0; FNRN"},
+	{"jump-jump", "LP 0; JF L1; LN 1; FNRN; LAB L1; JUMP L2; LAB L2; LN 2; FNRN", "LP 0; JF L2; LN 1; FNRN; LAB L1; JUMP L2; LAB L2; LN 2; FNRN"},
+	{"jump-jump", "LAB L1; JUMP L2; LAB L2; JUMP L1", "LAB L1; JUMP L2; LAB L2; JUMP L1"},
+	{"jump-return", "LN 1; JUMP L1; LAB L1; FNRN", "LN 1; FNRN; LAB L1; FNRN"},
+	{"jump-next", "LN 1; JUMP L1; LAB L1; LN 2; PLUS; FNRN", "LN 1; LAB L1; LN 2; PLUS; FNRN"},
+	{"dead-code", "LN 1; FNRN; LN 2; FNRN; LAB L1; FNRN", "LN 1; FNRN; LAB L1; FNRN"},
+	{"unused-label", "LN 1; LAB L1; FNRN", "LN 1; FNRN"},
+}
+
+func TestRules(t *testing.T) {
+	for _, test := range test_rules {
+		r := LookupRule(test.rule)
+		if r == nil {
+			t.Fatalf("no rule %s", test.rule)
+		}
+		code, _ := peephole(parseCode(t, test.code), []Rule{*r})
+		if str := formatCode(code); str != test.expected {
+			t.Errorf("%s: %s: got %s, expected %s", test.rule, test.code, str, test.expected)
+		}
+	}
+}
+
+var test_program_str = `manifest $( Debug = 0; Red = 1; Green = 2 $)
+
+let Name(C) = match (C) : Red => "red" : Green => "green" : ? => "grey" .
+let Between(A, B, C) = A < B < C
+let Trace(X) = Debug = 1 -> writen(X), X
+`
+
+var test_generate = []struct {
+	name     string
+	code     string
+	peephole string
+}{
+	{"Name", `proc Name(1) frame 2
+	LP 0
+	SP 1
+	LP 1
+	LN 1
+	EQ
+	JF L2
+	LSTR "red"
+	JUMP L1
+	LAB L2
+	LP 1
+	LN 2
+	EQ
+	JF L3
+	LSTR "green"
+	JUMP L1
+	LAB L3
+	LSTR "grey"
+	JUMP L1
+	LAB L4
+	FAIL "no pattern matches"
+	LAB L1
+	FNRN
+`, `proc Name(1) frame 2
+	LP 0
+	DUP
+	SP 1
+	LN 1
+	EQ
+	JF L2
+	LSTR "red"
+	FNRN
+	LAB L2
+	LP 1
+	LN 2
+	EQ
+	JF L3
+	LSTR "green"
+	FNRN
+	LAB L3
+	LSTR "grey"
+	FNRN
+`},
+	{"Between", `proc Between(3) frame 4
+	LP 0
+	LP 1
+	SP 3
+	LP 3
+	LS
+	LP 3
+	LP 2
+	LS
+	LOGAND
+	FNRN
+`, `proc Between(3) frame 4
+	LP 0
+	LP 1
+	DUP
+	SP 3
+	LS
+	LP 3
+	LP 2
+	LS
+	LOGAND
+	FNRN
+`},
+	{"Trace", `proc Trace(1) frame 1
+	LN 0
+	LN 1
+	EQ
+	JF L5
+	LG 12
+	LP 0
+	FNAP 1
+	JUMP L6
+	LAB L5
+	LP 0
+	LAB L6
+	FNRN
+`, `proc Trace(1) frame 1
+	LP 0
+	FNRN
+`},
+}
+
+func TestGenerate(t *testing.T) {
+	p := generate(t, test_program_str)
+	for _, test := range test_generate {
+		if proc := p.Proc(test.name); proc.String() != test.code {
+			t.Errorf("%s: got\n%s\nexpected\n%s", test.name, proc, test.code)
+		}
+	}
+	Peephole(p, Rules)
+	for _, test := range test_generate {
+		if proc := p.Proc(test.name); proc.String() != test.peephole {
+			t.Errorf("%s after peephole: got\n%s\nexpected\n%s", test.name, proc, test.peephole)
+		}
+	}
+}
+
+func TestGenerateErrors(t *testing.T) {
+	_, err := Generate(parse(t, "let F(X) = Y\nlet G() = lv Red\nmanifest $( Red = 1 $)"), runtime.Target{})
+	expected := "1:12: error: undeclared name Y (and 1 more errors)"
+	if err == nil || err.Error() != expected {
+		t.Errorf("got %v, expected %s", err, expected)
+	}
+}
+
+func TestGenerateCommandErrors(t *testing.T) {
+	for _, test := range []struct {
+		src string
+		err string
+	}{
+		{"let F() be break", "1:12: error: break outside a loop"},
+		{"let F() be loop", "1:12: error: loop outside a loop"},
+		{"let F() be endcase", "1:12: error: endcase outside a switchon"},
+		{"let F() be exit", "1:12: error: exit outside a match"},
+		{"let F() be resultis 1", "1:12: error: resultis outside valof"},
+		{"let F() be $( goto L; M: $)", "1:20: error: no label L"},
+		{"let F() be $( L: L: $)", "1:18: error: label L redefined"},
+		{"manifest $( N = 1 $)\nlet F() be N := 2", "2:12: error: cannot assign to manifest constant N"},
+		{"let F(X) be switchon X into $( case 1: case 1: $)", "1:45: error: duplicate case 1"},
+	} {
+		_, err := Generate(parse(t, test.src), runtime.Target{})
+		if err == nil || err.Error() != test.err {
+			t.Errorf("%s: got %v, expected %s", test.src, err, test.err)
+		}
+	}
+}
+
+// Run a program on a machine, returning its output, the number of
+// instructions run and the error stopping it.
+func run(t testing.TB, p *Program, input []byte) (string, int64, error) {
+	var m Machine
+	var out bytes.Buffer
+	m.Init(bytes.NewReader(input), &out)
+	if err := m.Load(p); err != nil {
+		t.Fatal(err)
+	}
+	_, err := m.Start()
+	return out.String(), m.Steps, err
+}
+
+// Parse a program of the corpus, those in testdata/richards being in
+// the Richards dialect.
+func parseTestdata(file string, src []byte) (*ast.Program, error) {
+	var p parser.Parser
+	if filepath.Base(filepath.Dir(file)) == "richards" {
+		p.Dialect = token.Richards
+	}
+	p.Init(src)
+	prog := p.Parse()
+	return prog, p.Errors.Err()
+}
+
+// The programs of the corpus run as they do in the interpreter,
+// with fewer instructions run after the peephole optimizer.
+func TestRunTestdata(t *testing.T) {
+	files, _ := filepath.Glob("../../testdata/*.b")
+	richards, _ := filepath.Glob("../../testdata/richards/*.b")
+	for _, file := range append(files, richards...) {
+		src, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		base := strings.TrimSuffix(file, ".b")
+		expected, err := ioutil.ReadFile(base + ".out")
+		if err != nil {
+			continue
+		}
+		input, _ := ioutil.ReadFile(base + ".in")
+		prog, err := parseTestdata(file, src)
+		if err != nil {
+			t.Fatalf("%s: %v", file, err)
+		}
+		p, err := Generate(prog, runtime.Target{})
+		if err != nil {
+			t.Fatalf("%s: %v", file, err)
+		}
+		out, steps, runErr := run(t, p, input)
+		Peephole(p, Rules)
+		out2, steps2, runErr2 := run(t, p, input)
+		if out != string(expected) || out2 != out {
+			t.Errorf("%s: got %q and %q after peephole, expected %q", file, out, out2, expected)
+		}
+		if (runErr == nil) != (runErr2 == nil) || runErr != nil && runErr.Error() != runErr2.Error() {
+			t.Errorf("%s: got error %v and %v after peephole", file, runErr, runErr2)
+		}
+		if steps2 > steps {
+			t.Errorf("%s: %d instructions run after peephole, %d before", file, steps2, steps)
+		}
+	}
+}
+
+func TestRunErrors(t *testing.T) {
+	for _, test := range []struct {
+		src string
+		err string
+	}{
+		{"let start() = 1 / 0", "1:17: error: division by zero"},
+		{"let start() = match (3) : 1 => 1 .", "1:15: error: no pattern matches"},
+		{"let F(N) = F(N + 1) + 1\nlet start() = F(0)", "1:5: error: call stack overflow calling F"},
+		{"let start() = stop(3)", "stop(3)"},
+		{"let start() be finish", "stop(0)"},
+		{"let start() = valof $( $)", "1:15: error: valof ended without resultis"},
+	} {
+		p := generate(t, test.src)
+		Peephole(p, Rules)
+		if _, _, err := run(t, p, nil); err == nil || err.Error() != test.err {
+			t.Errorf("%s: got %v, expected %s", test.src, err, test.err)
+		}
+	}
+}
+
+func TestRunTailCalls(t *testing.T) {
+	for _, test := range []struct {
+		src string
+		out string
+	}{
+		{"let Acc(N, A) = N = 0 -> A, Acc(N - 1, A + N)\nlet start() be writen(Acc(100000, 0))", "5000050000"},
+		{"let Even(N) = N = 0 -> true, Odd(N - 1)\nand Odd(N) = N = 0 -> false, Even(N - 1)\nlet start() be writen(Even(100001))", "0"},
+		{"let Addr(N, A) = N = 0 -> rv A, Addr(N - 1, lv N)\nlet start() be writen(Addr(1, 0))", "1"},
+	} {
+		p := generate(t, test.src)
+		Peephole(p, Rules)
+		if out, _, err := run(t, p, nil); err != nil || out != test.out {
+			t.Errorf("%s: got %q, %v, expected %s", test.src, out, err, test.out)
+		}
+	}
+}
+
+var bench_program_str = `manifest $( Zero = 0; One = 1; N = 16 $)
+
+let Fib(N) = match (N) : Zero => 0 : One => 1 : ? => Fib(N - 1) + Fib(N - 2) .
+let Sign(X) = X < 0 -> -1, X = 0 -> 0, 1
+let Count(I, Lo, Hi) = I > N -> 0, (Lo <= I <= Hi -> 1, 0) + Sign(I) + Count(I + 1, Lo, Hi)
+let start() = Fib(N) + Count(0, 4, 10)
+`
+
+func BenchmarkGenerate(b *testing.B) {
+	prog := parse(b, bench_program_str)
+	for i := 0; i < b.N; i++ {
+		Generate(prog, runtime.Target{})
+	}
+}
+
+func BenchmarkPeephole(b *testing.B) {
+	prog := parse(b, bench_program_str)
+	for i := 0; i < b.N; i++ {
+		p, _ := Generate(prog, runtime.Target{})
+		Peephole(p, Rules)
+	}
+}
+
+func benchmarkRun(b *testing.B, rules []Rule) {
+	p := generate(b, bench_program_str)
+	Peephole(p, rules)
+	var steps int64
+	for i := 0; i < b.N; i++ {
+		_, n, err := run(b, p, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		steps = n
+	}
+	b.ReportMetric(float64(steps), "instrs/op")
+}
+
+func BenchmarkRun(b *testing.B)         { benchmarkRun(b, nil) }
+func BenchmarkRunPeephole(b *testing.B) { benchmarkRun(b, Rules) }
@@ -0,0 +1,307 @@
+// Copyright 2015 Meador Inge.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package ocode
+
+// A peephole rule rewrites a short sequence of instructions.  The
+// sequence must have the operations of the pattern, and Rewrite
+// returns its replacement and whether the rule applies.
+type Rule struct {
+	Name    string
+	Pattern []Op
+	Rewrite func(c *Context, ins []Instr) ([]Instr, bool)
+}
+
+// The rules, in the order they are tried.
+var Rules = []Rule{
+	{"fold-compare", []Op{LN, LN, Any}, foldCompare},
+	{"fold-jump", []Op{Any, Any}, foldJump},
+	{"drop-store-load", []Op{SP, LP}, dropStoreLoad},
+	{"store-load", []Op{SP, LP}, storeLoad},
+	{"drop-load-store", []Op{LP, SP}, dropLoadStore},
+	{"jump-jump", []Op{Any}, jumpJump},
+	{"jump-return", []Op{JUMP}, jumpReturn},
+	{"jump-next", []Op{JUMP, LAB}, jumpNext},
+	{"dead-code", []Op{Any, Any}, deadCode},
+	{"unused-label", []Op{LAB}, unusedLabel},
+}
+
+// The most times the rules are tried over the code of a procedure.
+const MaxRounds = 10
+
+// Lookup the rule with the given name, or nil if there is none.
+func LookupRule(name string) *Rule {
+	for i := range Rules {
+		if Rules[i].Name == name {
+			return &Rules[i]
+		}
+	}
+	return nil
+}
+
+// A context gives the rules what they need to know of the code
+// around the instructions they rewrite.
+type Context struct {
+	code   []Instr
+	valid  bool
+	labels map[int64]int // The index of each label.
+	refs   map[int64]int // The number of jumps to each label.
+	loads  map[int64]int // The number of loads of each frame cell.
+}
+
+func (c *Context) update() {
+	if c.valid {
+		return
+	}
+	c.labels = make(map[int64]int)
+	c.refs = make(map[int64]int)
+	c.loads = make(map[int64]int)
+	for i, in := range c.code {
+		switch {
+		case in.Op == LAB:
+			c.labels[in.N] = i
+		case in.Op.IsJump():
+			c.refs[in.N]++
+		case in.Op == LP || in.Op == LLP:
+			c.loads[in.N]++
+		}
+	}
+	c.valid = true
+}
+
+// Return the first instruction run after jumping to a label, or nil
+// if there is none.
+func (c *Context) Target(label int64) *Instr {
+	c.update()
+	i, ok := c.labels[label]
+	if !ok {
+		return nil
+	}
+	for ; i < len(c.code); i++ {
+		if c.code[i].Op != LAB {
+			return &c.code[i]
+		}
+	}
+	return nil
+}
+
+// Return the number of jumps to a label.
+func (c *Context) Refs(label int64) int {
+	c.update()
+	return c.refs[label]
+}
+
+// Return the number of instructions loading a frame cell or taking
+// its address.
+func (c *Context) Loads(cell int64) int {
+	c.update()
+	return c.loads[cell]
+}
+
+// Improve the code of the procedures of a program with the rules,
+// returning the number of rewrites made.
+func Peephole(p *Program, rules []Rule) int {
+	procs := p.Procs
+	if p.Init != nil {
+		procs = append([]*Proc{p.Init}, procs...)
+	}
+	n := 0
+	for _, proc := range procs {
+		var k int
+		proc.Code, k = peephole(proc.Code, rules)
+		n += k
+	}
+	return n
+}
+
+// Rewrite code with the rules until none applies.  After a rewrite
+// the rules are tried again from far enough back to see sequences
+// the rewrite made.
+func peephole(code []Instr, rules []Rule) ([]Instr, int) {
+	longest := 0
+	for _, r := range rules {
+		if len(r.Pattern) > longest {
+			longest = len(r.Pattern)
+		}
+	}
+	c := &Context{code: code}
+	n := 0
+	for round, changed := 0, true; changed && round < MaxRounds; round++ {
+		changed = false
+		for i := 0; i < len(c.code); i++ {
+			for _, r := range rules {
+				ins, ok := match(c.code[i:], r.Pattern)
+				if !ok {
+					continue
+				}
+				repl, ok := r.Rewrite(c, ins)
+				if !ok {
+					continue
+				}
+				rest := append(repl[:len(repl):len(repl)], c.code[i+len(ins):]...)
+				c.code = append(c.code[:i], rest...)
+				c.valid = false
+				changed = true
+				n++
+				i -= longest
+				if i < -1 {
+					i = -1
+				}
+				break
+			}
+		}
+	}
+	return c.code, n
+}
+
+// Return the leading instructions of code matching a pattern, and
+// whether they do.
+func match(code []Instr, pattern []Op) ([]Instr, bool) {
+	if len(code) < len(pattern) {
+		return nil, false
+	}
+	for i, op := range pattern {
+		if op != Any && code[i].Op != op {
+			return nil, false
+		}
+	}
+	return code[:len(pattern)], true
+}
+
+// Return the truth value instruction for a boolean.
+func truth(b bool, in Instr) Instr {
+	if b {
+		return Instr{TRUE, 0, "", in.Pos}
+	}
+	return Instr{FALSE, 0, "", in.Pos}
+}
+
+// LN a; LN b; EQ becomes TRUE or FALSE, as do the other comparisons
+// of integers.
+func foldCompare(c *Context, ins []Instr) ([]Instr, bool) {
+	x, y := ins[0].N, ins[1].N
+	var b bool
+	switch ins[2].Op {
+	case EQ:
+		b = x == y
+	case NE:
+		b = x != y
+	case LS:
+		b = x < y
+	case GR:
+		b = x > y
+	case LE:
+		b = x <= y
+	case GE:
+		b = x >= y
+	default:
+		return nil, false
+	}
+	return []Instr{truth(b, ins[2])}, true
+}
+
+// TRUE; JT L becomes JUMP L and TRUE; JF L nothing, and the reverse
+// for FALSE.
+func foldJump(c *Context, ins []Instr) ([]Instr, bool) {
+	cond, jump := ins[0].Op, ins[1].Op
+	if cond != TRUE && cond != FALSE || jump != JT && jump != JF {
+		return nil, false
+	}
+	if (cond == TRUE) == (jump == JT) {
+		return []Instr{{JUMP, ins[1].N, "", ins[1].Pos}}, true
+	}
+	return nil, true
+}
+
+// SP n; LP n becomes nothing when nothing else loads cell n: the value
+// stays on the stack.
+func dropStoreLoad(c *Context, ins []Instr) ([]Instr, bool) {
+	if ins[0].N != ins[1].N || c.Loads(ins[0].N) != 1 {
+		return nil, false
+	}
+	return nil, true
+}
+
+// SP n; LP n becomes DUP; SP n, keeping the value rather than loading
+// it again.
+func storeLoad(c *Context, ins []Instr) ([]Instr, bool) {
+	if ins[0].N != ins[1].N {
+		return nil, false
+	}
+	return []Instr{{DUP, 0, "", ins[1].Pos}, ins[0]}, true
+}
+
+// LP n; SP n, storing a cell in itself, becomes nothing.
+func dropLoadStore(c *Context, ins []Instr) ([]Instr, bool) {
+	if ins[0].N != ins[1].N {
+		return nil, false
+	}
+	return nil, true
+}
+
+// A jump to a jump goes to where the second jump goes.  A chain of
+// jumps ending in a loop is left alone.
+func jumpJump(c *Context, ins []Instr) ([]Instr, bool) {
+	if !ins[0].Op.IsJump() {
+		return nil, false
+	}
+	label := ins[0].N
+	seen := map[int64]bool{label: true}
+	for {
+		next := c.Target(label)
+		if next == nil || next.Op != JUMP {
+			break
+		}
+		if seen[next.N] {
+			return nil, false
+		}
+		seen[next.N] = true
+		label = next.N
+	}
+	if label == ins[0].N {
+		return nil, false
+	}
+	in := ins[0]
+	in.N = label
+	return []Instr{in}, true
+}
+
+// A jump to a return or a failure becomes a copy of it.
+func jumpReturn(c *Context, ins []Instr) ([]Instr, bool) {
+	next := c.Target(ins[0].N)
+	if next == nil || next.Op != FNRN && next.Op != FAIL {
+		return nil, false
+	}
+	return []Instr{*next}, true
+}
+
+// JUMP L; LAB L becomes LAB L.
+func jumpNext(c *Context, ins []Instr) ([]Instr, bool) {
+	if ins[0].N != ins[1].N {
+		return nil, false
+	}
+	return ins[1:], true
+}
+
+// The instructions after a jump, return or failure up to the next
+// label cannot be run, so they are removed.
+func deadCode(c *Context, ins []Instr) ([]Instr, bool) {
+	switch ins[0].Op {
+	case JUMP, FNRN, FAIL:
+	default:
+		return nil, false
+	}
+	if ins[1].Op == LAB {
+		return nil, false
+	}
+	return ins[:1], true
+}
+
+// A label with no jumps to it is removed.
+func unusedLabel(c *Context, ins []Instr) ([]Instr, bool) {
+	if c.Refs(ins[0].N) > 0 {
+		return nil, false
+	}
+	return nil, true
+}
@@ -0,0 +1,238 @@
+// Copyright 2015 Meador Inge.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package opt
+
+import (
+	"github.com/meadori/bcpl-go/src/ir"
+	"github.com/meadori/bcpl-go/src/runtime"
+)
+
+// Return the target of the function's module.
+func target(f *ir.Func) runtime.Target {
+	if f.Module == nil || f.Module.Target.WordBits == 0 {
+		return runtime.DefaultTarget
+	}
+	return f.Module.Target
+}
+
+func truth(b bool) int64 {
+	if b {
+		return -1
+	}
+	return 0
+}
+
+// Fold the operations whose arguments are constants, the identities
+// like X + 0, and the branches and switches on constants.  Manifest
+// constants are constants of the representation, so they fold too.
+func fold(f *ir.Func) bool {
+	t := target(f)
+	changed := false
+	for _, b := range f.Blocks {
+		for _, v := range b.Values {
+			if c, ok := foldValue(t, v); ok {
+				v.SetConst(c)
+				changed = true
+			} else if x := identity(v); x != nil {
+				v.SetCopy(x)
+				changed = true
+			}
+		}
+		if foldBlock(b) {
+			changed = true
+		}
+	}
+	return changed
+}
+
+// Return the constant value of an operation, and whether it has one.
+func foldValue(t runtime.Target, v *ir.Value) (int64, bool) {
+	if v.Op == ir.OpConst || v.Op == ir.OpPhi || len(v.Args) == 0 || len(v.Args) > 2 {
+		return 0, false
+	}
+	var args [2]int64
+	for i, arg := range v.Args {
+		if arg.Op != ir.OpConst {
+			return 0, false
+		}
+		args[i] = arg.Aux
+	}
+	x, y := runtime.Word(args[0]), runtime.Word(args[1])
+	var w runtime.Word
+	switch v.Op {
+	case ir.OpCopy:
+		w = x
+	case ir.OpNeg:
+		w = t.Wrap(-x)
+	case ir.OpNot:
+		w = ^x
+	case ir.OpAdd:
+		w = t.Wrap(x + y)
+	case ir.OpSub:
+		w = t.Wrap(x - y)
+	case ir.OpMul:
+		w = t.Wrap(x * y)
+	case ir.OpDiv:
+		if y == 0 {
+			return 0, false
+		}
+		w = t.Wrap(x / y)
+	case ir.OpRem:
+		if y == 0 {
+			return 0, false
+		}
+		w = x % y
+	case ir.OpShl:
+		if y >= 0 {
+			w = t.Shift(x, y)
+		}
+	case ir.OpShr:
+		if y >= 0 {
+			w = t.Shift(x, -y)
+		}
+	case ir.OpAnd:
+		w = x & y
+	case ir.OpOr:
+		w = x | y
+	case ir.OpEqv:
+		w = ^(x ^ y)
+	case ir.OpNeqv:
+		w = x ^ y
+	case ir.OpEq:
+		return truth(x == y), true
+	case ir.OpNe:
+		return truth(x != y), true
+	case ir.OpLt:
+		return truth(x < y), true
+	case ir.OpGt:
+		return truth(x > y), true
+	case ir.OpLe:
+		return truth(x <= y), true
+	case ir.OpGe:
+		return truth(x >= y), true
+	default:
+		return foldFloat(t, v.Op, x, y)
+	}
+	return int64(w), true
+}
+
+// Fold a floating point operation, if the target has floating point
+// words.
+func foldFloat(t runtime.Target, op ir.Op, x, y runtime.Word) (int64, bool) {
+	fx, ok := t.Float(x)
+	if !ok {
+		return 0, false
+	}
+	fy, _ := t.Float(y)
+	var f float64
+	switch op {
+	case ir.OpFNeg:
+		f = -fx
+	case ir.OpFloat:
+		f = float64(x)
+	case ir.OpFix:
+		return int64(t.Wrap(runtime.Word(fx))), true
+	case ir.OpFAdd:
+		f = fx + fy
+	case ir.OpFSub:
+		f = fx - fy
+	case ir.OpFMul:
+		f = fx * fy
+	case ir.OpFDiv:
+		f = fx / fy
+	case ir.OpFEq:
+		return truth(fx == fy), true
+	case ir.OpFNe:
+		return truth(fx != fy), true
+	case ir.OpFLt:
+		return truth(fx < fy), true
+	case ir.OpFGt:
+		return truth(fx > fy), true
+	case ir.OpFLe:
+		return truth(fx <= fy), true
+	case ir.OpFGe:
+		return truth(fx >= fy), true
+	default:
+		return 0, false
+	}
+	w, _ := t.FromFloat(f)
+	return int64(w), true
+}
+
+// Return the argument an operation is an identity of, like X in
+// X + 0, or nil if it is not one.
+func identity(v *ir.Value) *ir.Value {
+	if len(v.Args) != 2 {
+		return nil
+	}
+	x, y := v.Args[0], v.Args[1]
+	isConst := func(v *ir.Value, c int64) bool {
+		return v.Op == ir.OpConst && v.Aux == c
+	}
+	switch v.Op {
+	case ir.OpAdd, ir.OpOr, ir.OpNeqv:
+		if isConst(y, 0) {
+			return x
+		}
+		if isConst(x, 0) {
+			return y
+		}
+	case ir.OpSub, ir.OpShl, ir.OpShr:
+		if isConst(y, 0) {
+			return x
+		}
+	case ir.OpMul:
+		if isConst(y, 1) {
+			return x
+		}
+		if isConst(x, 1) {
+			return y
+		}
+	case ir.OpAnd, ir.OpEqv:
+		if isConst(y, -1) {
+			return x
+		}
+		if isConst(x, -1) {
+			return y
+		}
+	case ir.OpDiv:
+		if isConst(y, 1) {
+			return x
+		}
+	}
+	return nil
+}
+
+// Turn a branch or switch on a constant into a jump.
+func foldBlock(b *ir.Block) bool {
+	c := b.Control
+	if c == nil || c.Op != ir.OpConst {
+		return false
+	}
+	var keep int
+	switch b.Kind {
+	case ir.BlockIf:
+		keep = 1
+		if c.Aux != 0 {
+			keep = 0
+		}
+	case ir.BlockSwitch:
+		keep = len(b.Cases)
+		for i, x := range b.Cases {
+			if x == c.Aux {
+				keep = i
+			}
+		}
+	default:
+		return false
+	}
+	for i := len(b.Succs) - 1; i >= 0; i-- {
+		if i != keep {
+			b.RemoveSucc(i)
+		}
+	}
+	b.Kind, b.Control, b.Cases = ir.BlockPlain, nil, nil
+	return true
+}
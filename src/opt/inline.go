@@ -0,0 +1,211 @@
+// Copyright 2015 Meador Inge.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package opt
+
+import "github.com/meadori/bcpl-go/src/ir"
+
+// The most values and blocks a function may have to be inlined.
+const InlineSize = 40
+
+// The most values and blocks a function may grow to by inlining.
+const MaxInlinedSize = 2000
+
+// Return the size of a function for the cost model: the number of
+// its values and blocks.
+func size(f *ir.Func) int {
+	n := len(f.Blocks)
+	for _, b := range f.Blocks {
+		n += len(b.Values)
+	}
+	return n
+}
+
+// Return the functions of a module that may be inlined: those small
+// enough that do not call themselves and whose routines are only
+// called directly.  The routine of such a function is only stored
+// in the static cell defined for it, and the address of the cell is
+// not taken.  A function stored in a global may be replaced by
+// another section, so it is never inlined.
+func inlinable(m *ir.Module) map[string]*ir.Func {
+	funcs := make(map[string]*ir.Func)
+	for _, f := range m.Funcs {
+		if size(f) <= InlineSize {
+			funcs[f.Name] = f
+		}
+	}
+	all := m.Funcs
+	if m.Init != nil {
+		all = append([]*ir.Func{m.Init}, all...)
+	}
+	cells := make(map[string]string) // The static cells holding the functions.
+	stores := make(map[*ir.Value]bool)
+	for _, f := range all {
+		for _, b := range f.Blocks {
+			for _, v := range b.Values {
+				for i, arg := range v.Args {
+					if arg.Op != ir.OpFunc {
+						continue
+					}
+					switch {
+					case v.Op == ir.OpCall && i == 0:
+						if arg.Sym == f.Name {
+							delete(funcs, arg.Sym)
+						}
+					case v.Op == ir.OpStore && i == 1 && v.Args[0].Op == ir.OpStatic && cells[arg.Sym] == "":
+						cells[arg.Sym] = v.Args[0].Sym
+						stores[v.Args[0]] = true
+					default:
+						delete(funcs, arg.Sym)
+					}
+				}
+			}
+			if c := b.Control; c != nil && c.Op == ir.OpFunc {
+				delete(funcs, c.Sym)
+			}
+		}
+	}
+
+	taken := make(map[string]bool)
+	for _, f := range all {
+		for _, b := range f.Blocks {
+			for _, v := range b.Values {
+				if v.Op == ir.OpStatic && !stores[v] {
+					taken[v.Sym] = true
+				}
+			}
+		}
+	}
+	for name := range funcs {
+		if cell, ok := cells[name]; !ok || taken[cell] {
+			delete(funcs, name)
+		}
+	}
+	return funcs
+}
+
+// Inline the direct calls of small functions.  The body of a BCPL
+// function refers only to its parameters and to static, global and
+// manifest names, never to the variables of its caller, so the
+// copied body means what it meant in the callee.  Each return of the
+// callee becomes a jump to the rest of the caller, like a resultis
+// ending a valof, and the values returned are joined by a phi.
+func inline(f *ir.Func) bool {
+	if f.Module == nil {
+		return false
+	}
+	funcs := inlinable(f.Module)
+	var calls []*ir.Value
+	for _, b := range f.Blocks {
+		for _, v := range b.Values {
+			if v.Op == ir.OpCall && v.Args[0].Op == ir.OpFunc && v.Args[0].Sym != f.Name && funcs[v.Args[0].Sym] != nil {
+				calls = append(calls, v)
+			}
+		}
+	}
+	changed := false
+	for _, call := range calls {
+		if size(f) > MaxInlinedSize {
+			break
+		}
+		inlineCall(f, call, funcs[call.Args[0].Sym])
+		changed = true
+	}
+	return changed
+}
+
+// Replace a call by a copy of the body of the function called.
+func inlineCall(f *ir.Func, call *ir.Value, g *ir.Func) {
+	// Split the block at the call.
+	b := call.Block
+	rest := f.NewBlock(call.Pos)
+	i := 0
+	for b.Values[i] != call {
+		i++
+	}
+	for _, v := range b.Values[i+1:] {
+		v.Block = rest
+		rest.Values = append(rest.Values, v)
+	}
+	b.Values = b.Values[:i]
+	moveEnd(b, rest)
+
+	// The arguments of the call, a missing argument being zero.
+	args := call.Args[1:]
+	for len(args) < g.Params {
+		args = append(args, b.NewValue(call.Pos, ir.OpConst, 0, ""))
+	}
+
+	// Copy the blocks and values.
+	blocks := make(map[*ir.Block]*ir.Block)
+	values := make(map[*ir.Value]*ir.Value)
+	locals := int64(f.Locals)
+	f.Locals += g.Locals
+	for _, gb := range g.Blocks {
+		blocks[gb] = f.NewBlock(gb.Pos)
+	}
+	for _, gb := range g.Blocks {
+		nb := blocks[gb]
+		for _, v := range gb.Values {
+			if v.Op == ir.OpParam {
+				values[v] = args[v.Aux]
+				continue
+			}
+			aux := v.Aux
+			if v.Op == ir.OpLocal {
+				aux += locals
+			}
+			values[v] = nb.NewValue(v.Pos, v.Op, aux, v.Sym)
+		}
+	}
+	var results []*ir.Value
+	for _, gb := range g.Blocks {
+		nb := blocks[gb]
+		for _, v := range gb.Values {
+			if v.Op == ir.OpParam {
+				continue
+			}
+			nv := values[v]
+			for _, arg := range v.Args {
+				nv.Args = append(nv.Args, values[arg])
+			}
+		}
+		for _, p := range gb.Preds {
+			nb.Preds = append(nb.Preds, blocks[p])
+		}
+		switch gb.Kind {
+		case ir.BlockReturn, ir.BlockTailCall:
+			results = append(results, values[gb.Control])
+			nb.Jump(rest)
+			continue
+		case ir.BlockFail:
+			nb.Fail(gb.Msg)
+			continue
+		}
+		nb.Kind, nb.Cases = gb.Kind, append([]int64(nil), gb.Cases...)
+		if gb.Control != nil {
+			nb.Control = values[gb.Control]
+		}
+		for _, s := range gb.Succs {
+			nb.Succs = append(nb.Succs, blocks[s])
+		}
+	}
+	b.Jump(blocks[g.Entry])
+
+	// The result of the call.
+	var result *ir.Value
+	switch len(results) {
+	case 0:
+		result = rest.NewValue(call.Pos, ir.OpConst, 0, "")
+	case 1:
+		result = results[0]
+	default:
+		result = rest.NewValue(call.Pos, ir.OpPhi, 0, "", results...)
+	}
+	if n := len(rest.Values); result.Block == rest && n > 1 {
+		copy(rest.Values[1:], rest.Values[:n-1])
+		rest.Values[0] = result
+	}
+	replace(f, map[*ir.Value]*ir.Value{call: result})
+}
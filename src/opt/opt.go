@@ -0,0 +1,131 @@
+// Copyright 2015 Meador Inge.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+// Package opt optimizes the intermediate representation of a program.
+//
+// The optimizer runs a sequence of passes over each function until
+// none of them changes it.  The passes run depend on the
+// optimization level, and each may be enabled or disabled by name:
+//
+//	fold         fold constants, constant branches and identities
+//	copyprop     replace copies and redundant phis by their values
+//	forward      replace loads by the values stored or loaded before them
+//	inline       inline the calls of small functions (level 2)
+//	cse          merge common subexpressions (level 2)
+//	unreachable  remove the blocks that cannot be reached
+//	dce          remove the values that are not used
+//	tailcall     turn calls in tail position into jumps (level 2)
+//
+// Level 0 runs no passes, level 1 all but inline, cse and tailcall,
+// and level 2 all of them.
+package opt
+
+import (
+	"fmt"
+	"github.com/meadori/bcpl-go/src/ir"
+	"strings"
+)
+
+// A pass transforms a function, reporting whether it changed it.
+type Pass struct {
+	Name  string
+	Level int // The lowest optimization level running the pass.
+	Run   func(f *ir.Func) bool
+}
+
+// The passes, in the order they are run.
+var Passes = []Pass{
+	{"fold", 1, fold},
+	{"copyprop", 1, copyprop},
+	{"forward", 1, forward},
+	{"inline", 2, inline},
+	{"cse", 2, cse},
+	{"unreachable", 1, unreachable},
+	{"dce", 1, dce},
+	{"tailcall", 2, tailcall},
+}
+
+// The highest optimization level.
+const MaxLevel = 2
+
+// The most times the passes are run over a function.
+const MaxRounds = 10
+
+// Options select the passes run by Optimize.
+type Options struct {
+	Level   int             // The optimization level.
+	Enable  map[string]bool // Passes to run whatever the level.
+	Disable map[string]bool // Passes not to run whatever the level.
+	Verify  bool            // Whether to verify each function after each pass.
+}
+
+// Parse a comma separated list of pass names, like "cse,dce".
+func ParsePasses(list string) (map[string]bool, error) {
+	names := make(map[string]bool)
+	for _, name := range strings.Split(list, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		if LookupPass(name) == nil {
+			return nil, fmt.Errorf("unknown pass %q", name)
+		}
+		names[name] = true
+	}
+	return names, nil
+}
+
+// Lookup the pass with the given name, or nil if there is none.
+func LookupPass(name string) *Pass {
+	for i := range Passes {
+		if Passes[i].Name == name {
+			return &Passes[i]
+		}
+	}
+	return nil
+}
+
+// Return the names of the passes the options run, in order.
+func (opts Options) Passes() []string {
+	var names []string
+	for _, p := range Passes {
+		if !opts.Disable[p.Name] && (p.Level <= opts.Level || opts.Enable[p.Name]) {
+			names = append(names, p.Name)
+		}
+	}
+	return names
+}
+
+// Optimize the functions of a module.  If the options ask for it,
+// an error is returned for the first pass leaving a function
+// malformed.
+func Optimize(m *ir.Module, opts Options) error {
+	var passes []*Pass
+	for _, name := range opts.Passes() {
+		passes = append(passes, LookupPass(name))
+	}
+	if len(passes) == 0 {
+		return nil
+	}
+	funcs := m.Funcs
+	if m.Init != nil {
+		funcs = append([]*ir.Func{m.Init}, funcs...)
+	}
+	for _, f := range funcs {
+		for round, changed := 0, true; changed && round < MaxRounds; round++ {
+			changed = false
+			for _, p := range passes {
+				if p.Run(f) {
+					changed = true
+				}
+				if !opts.Verify {
+					continue
+				}
+				if err := f.Verify(); err != nil {
+					return fmt.Errorf("after %s: %v", p.Name, err)
+				}
+			}
+		}
+	}
+	return nil
+}
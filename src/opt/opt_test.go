@@ -0,0 +1,390 @@
+// Copyright 2015 Meador Inge.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package opt
+
+import (
+	"github.com/meadori/bcpl-go/src/ast"
+	"github.com/meadori/bcpl-go/src/ir"
+	"github.com/meadori/bcpl-go/src/parser"
+	"github.com/meadori/bcpl-go/src/runtime"
+	"github.com/meadori/bcpl-go/src/token"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+var test_program_str = `manifest $( Size = 10; Debug = 0; Red = 1; Green = 2 $)
+global $( Count: 200 $)
+
+let Scale(X) = Size * 4 + X * 1 + 0
+let Trace(X) = Debug -> X + 1, X
+let Square(A, B) = (A + B) * (B + A)
+let Colour() = match (Green) : Red => "red" : Green => "green" .
+let Shifts(X) = (X << 0) + (1 << 3) + (-1 >> 60)
+let Assign() = valof $( let x = 5; x := x + 1; resultis x * 2 $)
+let Forward() = valof $( Count := 5; Count := Count + 1; resultis Count * 2 $)
+let Alias(V) = valof $( Count := 1; V!0 := 2; resultis Count + Count $)
+`
+
+func newTestModule(t *testing.T, src string) *ir.Module {
+	var p parser.Parser
+	p.Dialect = token.Richards
+	p.Init([]byte(src))
+	prog := p.Parse()
+	if len(p.Errors) > 0 {
+		t.Fatal(p.Errors)
+	}
+	m, err := ir.Build(prog, runtime.Target{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+var test_optimize = []struct {
+	level int
+	name  string
+	dump  string
+}{
+	{0, "Scale", `func Scale(1)
+b0:
+	v0 = Param [0]
+	v1 = Const [10]
+	v2 = Const [4]
+	v3 = Mul v1 v2
+	v4 = Const [1]
+	v5 = Mul v0 v4
+	v6 = Add v3 v5
+	v7 = Const [0]
+	v8 = Add v6 v7
+	Return v8
+`},
+	{1, "Scale", `func Scale(1)
+b0:
+	v0 = Param [0]
+	v3 = Const [40]
+	v6 = Add v3 v0
+	Return v6
+`},
+	{1, "Trace", `func Trace(1)
+b0:
+	v0 = Param [0]
+	Jump -> b2
+b2: <- b0
+	Jump -> b3
+b3: <- b2
+	Return v0
+`},
+	{1, "Square", `func Square(2)
+b0:
+	v0 = Param [0]
+	v1 = Param [1]
+	v2 = Add v0 v1
+	v3 = Add v1 v0
+	v4 = Mul v2 v3
+	Return v4
+`},
+	{2, "Square", `func Square(2)
+b0:
+	v0 = Param [0]
+	v1 = Param [1]
+	v2 = Add v0 v1
+	v4 = Mul v2 v2
+	Return v4
+`},
+	{1, "Colour", `func Colour(0)
+b0:
+	Jump -> b3
+b1: <- b3
+	Return v2
+b3: <- b0
+	v2 = String {"green"}
+	Jump -> b1
+`},
+	{1, "Shifts", `func Shifts(1)
+b0:
+	v0 = Param [0]
+	v5 = Const [8]
+	v6 = Add v0 v5
+	v10 = Const [15]
+	v11 = Add v6 v10
+	Return v11
+`},
+	{2, "Assign", `func Assign(0)
+b0:
+	v9 = Const [12]
+	Return v9
+`},
+	{1, "Forward", `func Forward(0)
+b0:
+	v0 = Const [5]
+	v1 = Global [200]
+	Store v1 v0
+	v6 = Const [6]
+	v7 = Global [200]
+	Store v7 v6
+	v12 = Const [12]
+	Jump -> b1
+b1: <- b0
+	Return v12
+`},
+	// A store through a computed address may change any cell.
+	{1, "Alias", `func Alias(1)
+b0:
+	v0 = Param [0]
+	v1 = Const [1]
+	v2 = Global [200]
+	Store v2 v1
+	v4 = Const [2]
+	Store v0 v4
+	v8 = Global [200]
+	v9 = Load v8
+	v12 = Add v9 v9
+	Jump -> b1
+b1: <- b0
+	Return v12
+`},
+}
+
+func TestOptimize(t *testing.T) {
+	for _, test := range test_optimize {
+		m := newTestModule(t, test_program_str)
+		if err := Optimize(m, Options{Level: test.level, Verify: true}); err != nil {
+			t.Fatal(err)
+		}
+		if f := m.Func(test.name); f.String() != test.dump {
+			t.Errorf("-O%d %s: got\n%s\nexpected\n%s", test.level, test.name, f, test.dump)
+		}
+	}
+}
+
+func TestPassFlags(t *testing.T) {
+	enable, err := ParsePasses("cse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	disable, err := ParsePasses("fold, dce")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParsePasses("cse,gvn"); err == nil || err.Error() != `unknown pass "gvn"` {
+		t.Errorf("got %v, expected an unknown pass", err)
+	}
+
+	for _, test := range []struct {
+		opts   Options
+		passes []string
+	}{
+		{Options{Level: 0}, nil},
+		{Options{Level: 1}, []string{"fold", "copyprop", "forward", "unreachable", "dce"}},
+		{Options{Level: 2}, []string{"fold", "copyprop", "forward", "inline", "cse", "unreachable", "dce", "tailcall"}},
+		{Options{Level: 0, Enable: enable}, []string{"cse"}},
+		{Options{Level: 2, Disable: disable}, []string{"copyprop", "forward", "inline", "cse", "unreachable", "tailcall"}},
+	} {
+		if passes := test.opts.Passes(); !reflect.DeepEqual(passes, test.passes) {
+			t.Errorf("%+v: got %v, expected %v", test.opts, passes, test.passes)
+		}
+	}
+
+	// Only common subexpressions are merged.
+	m := newTestModule(t, test_program_str)
+	if err := Optimize(m, Options{Enable: enable, Verify: true}); err != nil {
+		t.Fatal(err)
+	}
+	expected := `func Square(2)
+b0:
+	v0 = Param [0]
+	v1 = Param [1]
+	v2 = Add v0 v1
+	v4 = Mul v2 v2
+	Return v4
+`
+	if f := m.Func("Square"); f.String() != expected {
+		t.Errorf("got\n%s\nexpected\n%s", f, expected)
+	}
+}
+
+// Parse a program of the corpus, those in testdata/richards being in
+// the Richards dialect.
+func parseTestdata(file string, src []byte) (*ast.Program, error) {
+	var p parser.Parser
+	if filepath.Base(filepath.Dir(file)) == "richards" {
+		p.Dialect = token.Richards
+	}
+	p.Init(src)
+	prog := p.Parse()
+	return prog, p.Errors.Err()
+}
+
+func TestOptimizeTestdata(t *testing.T) {
+	files, _ := filepath.Glob("../../testdata/*.b")
+	richards, _ := filepath.Glob("../../testdata/richards/*.b")
+	for _, file := range append(files, richards...) {
+		src, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		prog, err := parseTestdata(file, src)
+		if err != nil {
+			continue
+		}
+		m, err := ir.Build(prog, runtime.Target{})
+		if err != nil {
+			t.Fatalf("%s: %v", file, err)
+		}
+		if err := Optimize(m, Options{Level: MaxLevel, Verify: true}); err != nil {
+			t.Errorf("%s: %v", file, err)
+		} else if err := m.Verify(); err != nil {
+			t.Errorf("%s: %v", file, err)
+		}
+	}
+}
+
+var test_calls_str = `global $( Hook: 200 $)
+
+let Sq(X) = X * X
+let Sum(X, Y) = X < Y -> Y, X
+let F(Y) = Sq(Y + 1) + Sum(Sq(2), Y)
+let Hook(X) = X + 1
+let Escapes(X) = X - 1
+let Taken(X) = X * 2
+let G(X) = Hook(X) + Escapes(X) + Taken(X) + aptovec(Escapes, 3)
+let H() = lv Taken
+let Loop(N, Acc) = N = 0 -> Acc, Loop(N - 1, Acc + N)
+let Even(N) = N = 0 -> true, Odd(N - 1)
+let Odd(N) = N = 0 -> false, Even(N - 1)
+`
+
+// Evaluate a call of a function of a module using only parameters,
+// constants and direct calls, returning the result and the greatest
+// depth of the calls made.  Tail calls reuse the frame.
+func evalFunc(t *testing.T, m *ir.Module, f *ir.Func, args []int64, depth int) (int64, int) {
+	max := depth
+	for {
+		values := make(map[*ir.Value]int64)
+		var prev *ir.Block
+		b := f.Entry
+	blocks:
+		for {
+			for _, v := range b.Values {
+				switch v.Op {
+				case ir.OpParam:
+					values[v] = args[v.Aux]
+				case ir.OpConst, ir.OpFunc:
+					values[v] = v.Aux
+				case ir.OpPhi:
+					for i, p := range b.Preds {
+						if p == prev {
+							values[v] = values[v.Args[i]]
+						}
+					}
+				case ir.OpCall:
+					if v == b.Control && b.Kind == ir.BlockTailCall {
+						break blocks
+					}
+					var d int
+					values[v], d = evalFunc(t, m, m.Func(v.Args[0].Sym), callArgs(values, v), depth+1)
+					if d > max {
+						max = d
+					}
+				default:
+					w := &ir.Value{Op: v.Op}
+					for _, arg := range v.Args {
+						w.Args = append(w.Args, &ir.Value{Op: ir.OpConst, Aux: values[arg]})
+					}
+					c, ok := foldValue(target(f), w)
+					if !ok {
+						t.Fatalf("%s: cannot evaluate %s", f.Name, v.LongString())
+					}
+					values[v] = c
+				}
+			}
+			prev = b
+			switch b.Kind {
+			case ir.BlockPlain:
+				b = b.Succs[0]
+			case ir.BlockIf:
+				if values[b.Control] != 0 {
+					b = b.Succs[0]
+				} else {
+					b = b.Succs[1]
+				}
+			case ir.BlockReturn:
+				return values[b.Control], max
+			default:
+				t.Fatalf("%s: cannot evaluate %s block", f.Name, b.Kind)
+			}
+		}
+		call := b.Control
+		f, args = m.Func(call.Args[0].Sym), callArgs(values, call)
+	}
+}
+
+func callArgs(values map[*ir.Value]int64, call *ir.Value) []int64 {
+	args := make([]int64, 10)
+	for i, arg := range call.Args[1:] {
+		args[i] = values[arg]
+	}
+	return args
+}
+
+func TestInline(t *testing.T) {
+	m := newTestModule(t, test_calls_str)
+	before, _ := evalFunc(t, m, m.Func("F"), []int64{5}, 0)
+	if err := Optimize(m, Options{Level: 2, Verify: true}); err != nil {
+		t.Fatal(err)
+	}
+	after, depth := evalFunc(t, m, m.Func("F"), []int64{5}, 0)
+	if before != 41 || after != before || depth != 0 {
+		t.Errorf("F(5) = %d before and %d after at depth %d, expected 41 at depth 0", before, after, depth)
+	}
+
+	// Functions in globals or whose routines escape are still called,
+	// and those whose cells may be assigned through their addresses
+	// are called through their cells.
+	called := make(map[string]bool)
+	for _, b := range m.Func("G").Blocks {
+		for _, v := range b.Values {
+			if v.Op != ir.OpCall {
+				continue
+			}
+			switch fn := v.Args[0]; {
+			case fn.Op == ir.OpFunc:
+				called[fn.Sym] = true
+			case fn.Op == ir.OpLoad && fn.Args[0].Op == ir.OpStatic:
+				called["cell "+fn.Args[0].Sym] = true
+			}
+		}
+	}
+	if !called["Escapes"] || !called["cell Taken"] {
+		t.Errorf("G: got calls of %v, expected Escapes and cell Taken", called)
+	}
+}
+
+func TestTailCall(t *testing.T) {
+	m := newTestModule(t, test_calls_str)
+	before, _ := evalFunc(t, m, m.Func("Loop"), []int64{100, 0}, 0)
+	if err := Optimize(m, Options{Level: 2, Disable: map[string]bool{"inline": true}, Verify: true}); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name   string
+		args   []int64
+		result int64
+	}{
+		{"Loop", []int64{100, 0}, before},
+		{"Even", []int64{1000}, -1},
+		{"Odd", []int64{1000}, 0},
+	} {
+		result, depth := evalFunc(t, m, m.Func(test.name), test.args, 0)
+		if result != test.result || depth != 0 {
+			t.Errorf("%s%v = %d at depth %d, expected %d at depth 0", test.name, test.args, result, depth, test.result)
+		}
+	}
+	if before != 5050 {
+		t.Errorf("Loop(100, 0) = %d before optimizing, expected 5050", before)
+	}
+}
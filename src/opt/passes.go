@@ -0,0 +1,252 @@
+// Copyright 2015 Meador Inge.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package opt
+
+import (
+	"fmt"
+	"github.com/meadori/bcpl-go/src/ir"
+)
+
+// Replace the uses of values by others, following chains of
+// replacements, and remove the values replaced.
+func replace(f *ir.Func, repl map[*ir.Value]*ir.Value) {
+	find := func(v *ir.Value) *ir.Value {
+		for i := 0; repl[v] != nil && i <= len(repl); i++ {
+			v = repl[v]
+		}
+		return v
+	}
+	for _, b := range f.Blocks {
+		values := b.Values[:0]
+		for _, v := range b.Values {
+			if repl[v] != nil {
+				continue
+			}
+			for i, arg := range v.Args {
+				v.Args[i] = find(arg)
+			}
+			values = append(values, v)
+		}
+		b.Values = values
+		if b.Control != nil {
+			b.Control = find(b.Control)
+		}
+	}
+}
+
+// Replace copies, and phis whose arguments are all one value or the
+// phi itself, by that value.  Constants are propagated by replacing
+// copies of them.
+func copyprop(f *ir.Func) bool {
+	repl := make(map[*ir.Value]*ir.Value)
+	for _, b := range f.Blocks {
+		for _, v := range b.Values {
+			switch v.Op {
+			case ir.OpCopy:
+				repl[v] = v.Args[0]
+			case ir.OpPhi:
+				var same *ir.Value
+				for _, arg := range v.Args {
+					if arg == v || arg == same {
+						continue
+					}
+					if same != nil {
+						same = nil
+						break
+					}
+					same = arg
+				}
+				if same != nil {
+					repl[v] = same
+				}
+			}
+		}
+	}
+	if len(repl) == 0 {
+		return false
+	}
+	replace(f, repl)
+	return true
+}
+
+// Return a key naming the cell at an address: the same for addresses
+// known to be equal, and saying whether the address is that of a
+// global, static or local cell, which no other such address reaches.
+// A computed address may reach any cell.
+func cellKey(addr *ir.Value) (key string, named bool) {
+	switch addr.Op {
+	case ir.OpGlobal, ir.OpStatic, ir.OpLocal:
+		return fmt.Sprint(addr.Op, addr.Aux, addr.Sym), true
+	}
+	return fmt.Sprint(addr.ID), false
+}
+
+// Replace each load by the value last stored at, or loaded from, the
+// same address before it, in its block or in the blocks that are the
+// only way into it.  A store may change the cell at any computed
+// address, and a call any cell at all.  The loads kept may fault, so
+// dce leaves them alone.
+func forward(f *ir.Func) bool {
+	// The known value of a cell, and whether its address names it.
+	type known struct {
+		val   *ir.Value
+		named bool
+	}
+	type memory map[string]known
+	end := make(map[*ir.Block]memory)
+	repl := make(map[*ir.Value]*ir.Value)
+	for _, b := range f.ReversePostorder() {
+		mem := make(memory)
+		if len(b.Preds) == 1 && end[b.Preds[0]] != nil {
+			for key, c := range end[b.Preds[0]] {
+				mem[key] = c
+			}
+		}
+		for _, v := range b.Values {
+			switch v.Op {
+			case ir.OpLoad:
+				key, named := cellKey(v.Args[0])
+				if c, ok := mem[key]; ok {
+					repl[v] = c.val
+				} else {
+					mem[key] = known{v, named}
+				}
+			case ir.OpStore:
+				key, named := cellKey(v.Args[0])
+				for k, c := range mem {
+					if !named || !c.named || k == key {
+						delete(mem, k)
+					}
+				}
+				mem[key] = known{v.Args[1], named}
+			case ir.OpCall:
+				mem = make(memory)
+			}
+		}
+		end[b] = mem
+	}
+	if len(repl) == 0 {
+		return false
+	}
+	replace(f, repl)
+	return true
+}
+
+// Report whether the order of an operation's arguments does not
+// matter.
+func commutative(op ir.Op) bool {
+	switch op {
+	case ir.OpAdd, ir.OpMul, ir.OpAnd, ir.OpOr, ir.OpEqv, ir.OpNeqv, ir.OpEq, ir.OpNe:
+		return true
+	}
+	return false
+}
+
+// Replace each value computing what a value in a dominating position
+// computes by that value.  Only operations without effects are
+// merged, and string constants are not, as each denotes a vector of
+// its own.
+func cse(f *ir.Func) bool {
+	dom := f.Dominators()
+	seen := make(map[string][]*ir.Value)
+	repl := make(map[*ir.Value]*ir.Value)
+	for _, b := range f.ReversePostorder() {
+		for _, v := range b.Values {
+			if v.Op.HasEffect() || v.Op == ir.OpPhi || v.Op == ir.OpString || v.Op == ir.OpCopy {
+				continue
+			}
+			args := make([]int, len(v.Args))
+			for i, arg := range v.Args {
+				if r := repl[arg]; r != nil {
+					arg = r
+				}
+				args[i] = arg.ID
+			}
+			if commutative(v.Op) && args[0] > args[1] {
+				args[0], args[1] = args[1], args[0]
+			}
+			key := fmt.Sprint(v.Op, v.Aux, v.Sym, args)
+			for _, w := range seen[key] {
+				if dom.Dominates(w.Block, b) {
+					repl[v] = w
+					break
+				}
+			}
+			if repl[v] == nil {
+				seen[key] = append(seen[key], v)
+			}
+		}
+	}
+	if len(repl) == 0 {
+		return false
+	}
+	replace(f, repl)
+	return true
+}
+
+// Remove the blocks that cannot be reached from the entry.
+func unreachable(f *ir.Func) bool {
+	reachable := make([]bool, f.NumBlocks())
+	for _, b := range f.Postorder() {
+		reachable[b.ID] = true
+	}
+	blocks := f.Blocks[:0]
+	changed := false
+	for _, b := range f.Blocks {
+		if reachable[b.ID] {
+			blocks = append(blocks, b)
+			continue
+		}
+		for i := len(b.Succs) - 1; i >= 0; i-- {
+			b.RemoveSucc(i)
+		}
+		changed = true
+	}
+	f.Blocks = blocks
+	return changed
+}
+
+// Remove the values that are neither used nor have effects.
+func dce(f *ir.Func) bool {
+	live := make(map[*ir.Value]bool)
+	var work []*ir.Value
+	mark := func(v *ir.Value) {
+		if !live[v] {
+			live[v] = true
+			work = append(work, v)
+		}
+	}
+	for _, b := range f.Blocks {
+		for _, v := range b.Values {
+			if v.Op.HasEffect() {
+				mark(v)
+			}
+		}
+		if b.Control != nil {
+			mark(b.Control)
+		}
+	}
+	for len(work) > 0 {
+		v := work[len(work)-1]
+		work = work[:len(work)-1]
+		for _, arg := range v.Args {
+			mark(arg)
+		}
+	}
+
+	changed := false
+	for _, b := range f.Blocks {
+		values := b.Values[:0]
+		for _, v := range b.Values {
+			if live[v] {
+				values = append(values, v)
+			} else {
+				changed = true
+			}
+		}
+		b.Values = values
+	}
+	return changed
+}
@@ -0,0 +1,178 @@
+// Copyright 2015 Meador Inge.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package opt
+
+import "github.com/meadori/bcpl-go/src/ir"
+
+// Return the call a block ends with, or nil if its last value is not
+// a call.
+func lastCall(b *ir.Block) *ir.Value {
+	if len(b.Values) == 0 {
+		return nil
+	}
+	if v := b.Values[len(b.Values)-1]; v.Op == ir.OpCall {
+		return v
+	}
+	return nil
+}
+
+// Eliminate the calls in tail position: those whose results the
+// function returns at once.  A function calling itself jumps back to
+// its start with new parameters instead, making a loop; other calls
+// become tail calls, reusing the frame, so mutually recursive
+// functions run in constant space.  A function with local cells is
+// left alone, as a callee may hold the address of one.
+func tailcall(f *ir.Func) bool {
+	if f.Locals > 0 || f.Module != nil && f == f.Module.Init {
+		return false
+	}
+	changed := false
+
+	// Return from the blocks jumping to a block that only returns,
+	// so that calls whose results are joined by a phi, or passed on
+	// through empty blocks, end the blocks making them.
+	for again := true; again; {
+		again = false
+		for _, r := range f.Blocks {
+			if r.Kind != ir.BlockReturn || len(r.Preds) == 0 {
+				continue
+			}
+			phi := r.Control
+			if len(r.Values) > 1 || len(r.Values) == 1 && (r.Values[0] != phi || phi.Op != ir.OpPhi) {
+				continue
+			}
+			for i := len(r.Preds) - 1; i >= 0; i-- {
+				p := r.Preds[i]
+				if p.Kind != ir.BlockPlain {
+					continue
+				}
+				x := phi
+				if len(r.Values) == 1 {
+					x = phi.Args[i]
+				}
+				p.RemoveSucc(0)
+				p.Return(x)
+				again, changed = true, true
+			}
+		}
+	}
+
+	var self []*ir.Block
+	for _, b := range f.Blocks {
+		call := lastCall(b)
+		if b.Kind != ir.BlockReturn || call == nil || b.Control != call {
+			continue
+		}
+		if fn := call.Args[0]; fn.Op == ir.OpFunc && fn.Sym == f.Name {
+			self = append(self, b)
+		} else {
+			b.TailCall(call)
+		}
+		changed = true
+	}
+	if len(self) > 0 {
+		loop(f, self)
+	}
+	return changed
+}
+
+// Turn the calls of a function to itself ending blocks into jumps
+// to a loop head whose phis take the parameters.
+func loop(f *ir.Func, blocks []*ir.Block) {
+	entry := f.Entry
+	head := f.NewBlock(entry.Pos)
+
+	// The entry keeps the parameters and jumps to the head, which
+	// takes the rest of the entry.
+	params := make([]*ir.Value, f.Params)
+	var rest []*ir.Value
+	for _, v := range entry.Values {
+		if v.Op == ir.OpParam && params[v.Aux] == nil {
+			params[v.Aux] = v
+		} else {
+			rest = append(rest, v)
+		}
+	}
+	entry.Values = entry.Values[:0]
+	for i, p := range params {
+		if p == nil {
+			params[i] = entry.NewValue(entry.Pos, ir.OpParam, int64(i), "")
+		} else {
+			entry.Values = append(entry.Values, p)
+		}
+	}
+	moveEnd(entry, head)
+	entry.Jump(head)
+
+	phis := make([]*ir.Value, f.Params)
+	isPhi := make(map[*ir.Value]bool)
+	for i, p := range params {
+		phis[i] = head.NewValue(p.Pos, ir.OpPhi, 0, "", p)
+		isPhi[phis[i]] = true
+	}
+	for _, v := range rest {
+		v.Block = head
+		head.Values = append(head.Values, v)
+	}
+
+	// Every use of a parameter becomes a use of its phi.
+	repl := make(map[*ir.Value]*ir.Value)
+	for _, b := range f.Blocks {
+		for _, v := range b.Values {
+			if v.Op == ir.OpParam {
+				repl[v] = phis[v.Aux]
+			}
+		}
+	}
+	for _, b := range f.Blocks {
+		for _, v := range b.Values {
+			if isPhi[v] {
+				continue
+			}
+			for i, arg := range v.Args {
+				if r := repl[arg]; r != nil {
+					v.Args[i] = r
+				}
+			}
+		}
+		if r := repl[b.Control]; r != nil {
+			b.Control = r
+		}
+	}
+
+	for _, b := range blocks {
+		if b == entry {
+			b = head
+		}
+		call := b.Control
+		b.Values = b.Values[:len(b.Values)-1]
+		for i, phi := range phis {
+			var arg *ir.Value
+			if i+1 < len(call.Args) {
+				arg = call.Args[i+1]
+			} else {
+				arg = b.NewValue(call.Pos, ir.OpConst, 0, "")
+			}
+			phi.Args = append(phi.Args, arg)
+		}
+		b.Kind, b.Control = ir.BlockInvalid, nil
+		b.Jump(head)
+	}
+}
+
+// Move the end of block a, its control transfer and successors, to
+// block b.
+func moveEnd(a, b *ir.Block) {
+	b.Kind, b.Control, b.Cases, b.Msg = a.Kind, a.Control, a.Cases, a.Msg
+	b.Succs = a.Succs
+	for _, succ := range b.Succs {
+		for i, pred := range succ.Preds {
+			if pred == a {
+				succ.Preds[i] = b
+			}
+		}
+	}
+	a.Kind, a.Control, a.Cases, a.Msg, a.Succs = ir.BlockInvalid, nil, nil, "", nil
+}
@@ -0,0 +1,64 @@
+// Copyright 2015 Meador Inge.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package parser
+
+import (
+	"github.com/meadori/bcpl-go/src/ast"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func FuzzParse(f *testing.F) {
+	f.Add(test_decl_str)
+	f.Add(test_simple_def_str)
+	f.Add(test_doc_str)
+	f.Add(test_semi_comment_str)
+	for _, test := range test_exprs {
+		f.Add(test.src)
+	}
+	files, err := filepath.Glob(filepath.Join("..", "..", "testdata", "*.b"))
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, file := range files {
+		src, err := ioutil.ReadFile(file)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(string(src))
+	}
+
+	f.Fuzz(func(t *testing.T, str string) {
+		src := []byte(str)
+
+		// Syntax errors are recorded, not panicked, and lie within
+		// the source.
+		var p Parser
+		p.Init(src)
+		prog := p.Parse()
+		for _, e := range p.Errors {
+			if e.Pos.Offset < 0 || e.Pos.Offset > len(src) {
+				t.Fatalf("error %q at offset %d outside the source", e.Msg, e.Pos.Offset)
+			}
+		}
+
+		// Whatever was parsed can be walked and its nodes lie within
+		// the source.
+		ast.Inspect(prog, func(n ast.Node) bool {
+			if n != nil && n != ast.Node(prog) {
+				if off := n.Pos().Offset; off < 0 || off > len(src) {
+					t.Fatalf("%T at offset %d outside the source", n, off)
+				}
+			}
+			return true
+		})
+
+		if _, err := ParseProgram(src); (err == nil) != (len(p.Errors) == 0) {
+			t.Fatalf("ParseProgram error %v, Parse errors %v", err, p.Errors)
+		}
+		ParseExpr(src)
+	})
+}
@@ -7,55 +7,183 @@ package parser
 import (
 	"fmt"
 	"github.com/meadori/bcpl-go/src/ast"
+	"github.com/meadori/bcpl-go/src/edit"
 	"github.com/meadori/bcpl-go/src/scanner"
 	"github.com/meadori/bcpl-go/src/token"
 	"strconv"
+	"strings"
 )
 
 type Parser struct {
-	scan scanner.Scanner // The scanner.
-	tok  *token.Token    // The current token produced by the scanner.
+	Dialect  token.Dialect       // The dialect of the source, used by Init.
+	Errors   ErrorList           // The syntax errors found by Parse.
+	scan     scanner.Scanner     // The scanner.
+	tok      *token.Token        // The current token produced by the scanner.
+	end      int                 // The offset of the end of the previous token.
+	depth    int                 // The number of blocks being parsed.
+	comments []*ast.CommentGroup // The comment groups seen so far.
+	lead     *ast.CommentGroup   // The comment group just before the current token.
+}
+
+// A syntax error at a position in the source.
+type Error struct {
+	Pos   token.Position
+	Msg   string
+	Fixes []edit.Fix // Suggested fixes, if any.
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: error: %s", e.Pos, e.Msg)
+}
+
+// A list of syntax errors, in source order.
+type ErrorList []*Error
+
+func (list ErrorList) Error() string {
+	switch len(list) {
+	case 0:
+		return "no errors"
+	case 1:
+		return list[0].Error()
+	}
+	return fmt.Sprintf("%s (and %d more errors)", list[0], len(list)-1)
+}
+
+// Return the edits of the first fix suggested by each error.
+func (list ErrorList) Edits() []edit.Edit {
+	var edits []edit.Edit
+	for _, e := range list {
+		edits = append(edits, edit.First(e.Fixes)...)
+	}
+	return edits
+}
+
+// Return the list as an error, or nil if it is empty.
+func (list ErrorList) Err() error {
+	if len(list) == 0 {
+		return nil
+	}
+	return list
 }
 
 func (p *Parser) error(msg string) {
-	panic("error: " + msg)
+	p.errorAt(p.tok.Pos, msg)
+}
+
+func (p *Parser) errorAt(pos token.Position, msg string) {
+	panic(&Error{pos, msg, nil})
+}
+
+// Advance to the next token, collecting any comments on the way.
+func (p *Parser) next() {
+	prev := p.tok
+	if prev != nil {
+		p.end = prev.Pos.Offset + len(prev.Lit)
+	}
+	p.tok = p.scan.Next()
+	p.lead = nil
+
+	var group *ast.CommentGroup
+	line := 0
+	for p.tok.Kind == token.COMMENT {
+		c := &ast.Comment{p.tok.Pos, strings.TrimRight(p.tok.Lit, "\r\n")}
+		if group == nil || c.Slash.Line > line+1 {
+			group = new(ast.CommentGroup)
+			p.comments = append(p.comments, group)
+		}
+		group.List = append(group.List, c)
+		line = c.Slash.Line
+		p.tok = p.scan.Next()
+	}
+
+	// A group is a lead comment if it starts on a line of its
+	// own and ends on the line before the current token.
+	if group != nil && line+1 == p.tok.Pos.Line &&
+		(prev == nil || prev.Pos.Line < group.Pos().Line) {
+		p.lead = group
+	}
 }
 
 func (p *Parser) match(kind token.TokenKind) bool {
 	if kind == p.tok.Kind {
-		p.tok = p.scan.Next()
+		p.next()
 		return true
 	} else {
-		p.error(fmt.Sprintf("expected '%s' found '%s'.", kind, p.tok))
-		return false
+		panic(&Error{p.tok.Pos, fmt.Sprintf("expected '%s' found '%s'.", kind.In(p.scan.Dialect), p.tok), p.closeFixes(kind)})
+	}
+}
+
+// Return the fixes of a missing token: a closing bracket is inserted
+// after the previous token if the current token cannot continue the
+// construct it closes.
+func (p *Parser) closeFixes(kind token.TokenKind) []edit.Fix {
+	switch kind {
+	case token.RKET, token.SKET, token.SECTKET:
+	default:
+		return nil
+	}
+	if !isItemStart(p.tok.Kind) && p.tok.Kind != token.EOF {
+		return nil
+	}
+	text := kind.String()
+	if kind == token.SECTKET {
+		text = " " + text
+	}
+	return []edit.Fix{{fmt.Sprintf("insert missing '%s'", kind), []edit.Edit{{p.end, p.end, text}}}}
+}
+
+// Return the value of the number at pos, reporting one too large for
+// a word.  The Richards dialect also writes numbers in hexadecimal
+// (#X1F), octal (#O17 or #17) and binary (#B101).
+func (p *Parser) parseNumber(pos token.Position, lit string) int {
+	text := lit
+	base := 10
+	if strings.HasPrefix(lit, "#") {
+		lit, base = lit[1:], 8
+		switch lit[0] {
+		case 'X', 'x':
+			lit, base = lit[1:], 16
+		case 'O', 'o':
+			lit = lit[1:]
+		case 'B', 'b':
+			lit, base = lit[1:], 2
+		}
+	}
+	n, err := strconv.ParseInt(lit, base, 64)
+	if err != nil {
+		if e, ok := err.(*strconv.NumError); ok && e.Err == strconv.ErrRange {
+			p.errorAt(pos, fmt.Sprintf("number %s out of range.", text))
+		}
+		p.errorAt(pos, fmt.Sprintf("malformed number %s.", text))
 	}
+	return int(n)
 }
 
 func (p *Parser) parseSingleDecl() *ast.VarDecl {
-	name, constant := p.tok.Lit, 0
+	pos, name, constant := p.tok.Pos, p.tok.Lit, 0
 	p.match(token.NAME)
 
 	switch p.tok.Kind {
 	case token.EQ, token.COLON:
 		p.match(p.tok.Kind)
-		lit := p.tok.Lit
+		numPos, lit := p.tok.Pos, p.tok.Lit
 		p.match(token.NUMBER)
-		constant, _ = strconv.Atoi(lit)
+		constant = p.parseNumber(numPos, lit)
 	default:
 		p.error("expected '=' or ':'.")
 	}
 
-	return &ast.VarDecl{name, constant}
+	return &ast.VarDecl{pos, name, constant}
 }
 
 func (p *Parser) parseDecl() ast.Decl {
-	// constdef := < manifest | global >
+	// constdef := < manifest | global | static >
 	//          $( <name> < '=' | ':' > <constant>
 	//             [';' <name> <'=' | ':'> <constant>]* $)
 
-	// We know we have a MANIFEST or GLOBAL.
-	haveGlobal := p.tok.Kind == token.GLOBAL
-	p.match(p.tok.Kind)
+	// We know we have a MANIFEST, GLOBAL or STATIC.
+	doc, pos, kind := p.lead, p.tok.Pos, p.tok.Kind
+	p.match(kind)
 
 	// Build up the list of declarations.
 	p.match(token.SECTBRA)
@@ -65,22 +193,253 @@ func (p *Parser) parseDecl() ast.Decl {
 		p.match(token.SEMICOLON)
 		decls = append(decls, p.parseSingleDecl())
 	}
+	end := p.tok.Pos
 	p.match(token.SECTKET)
 
 	// Build the declaration node.
-	if haveGlobal {
-		return &ast.GlobalDecl{decls}
-	} else {
-		return &ast.ConstantDecl{decls}
+	switch kind {
+	case token.GLOBAL:
+		return &ast.GlobalDecl{doc, pos, decls, end}
+	case token.STATIC:
+		return &ast.StaticDecl{doc, pos, decls, end}
+	default:
+		return &ast.ConstantDecl{doc, pos, decls, end}
 	}
 }
 
+func (p *Parser) parsePrimary() ast.Expr {
+	// primary := <name> | <number> | <stringconst> | true | false
+	//          | '(' <expr> ')' | '?' | <match> | valof <command>
+
+	pos, lit := p.tok.Pos, p.tok.Lit
+	switch p.tok.Kind {
+	case token.NAME:
+		p.match(token.NAME)
+		return &ast.Name{pos, lit}
+	case token.NUMBER:
+		p.match(token.NUMBER)
+		return &ast.ConstExpr{pos, p.parseNumber(pos, lit), lit}
+	case token.STRINGCONST:
+		p.match(token.STRINGCONST)
+		return &ast.StringExpr{pos, lit}
+	case token.TRUE, token.FALSE:
+		value := p.tok.Kind == token.TRUE
+		p.match(p.tok.Kind)
+		return &ast.BoolExpr{pos, value}
+	case token.RBRA:
+		p.match(token.RBRA)
+		x := p.parseExpr()
+		p.match(token.RKET)
+		return &ast.ParenExpr{pos, x}
+	case token.QUERY:
+		p.match(token.QUERY)
+		return &ast.QueryExpr{pos}
+	case token.MATCH, token.EVERY:
+		return p.parseMatch()
+	case token.VALOF:
+		p.match(token.VALOF)
+		return &ast.ValofExpr{pos, p.parseCommand()}
+	case token.ILLEGAL:
+		if strings.HasPrefix(lit, "\"") {
+			p.error("unterminated string.")
+		}
+	}
+
+	p.error(fmt.Sprintf("expected expression found '%s'.", p.tok))
+	return nil
+}
+
+func (p *Parser) parsePattern() ast.Expr {
+	// pattern := <name> | <number> | '-' <number> | true | false | '?'
+
+	switch p.tok.Kind {
+	case token.NAME, token.NUMBER, token.TRUE, token.FALSE, token.QUERY:
+		return p.parsePrimary()
+	case token.MINUS:
+		pos := p.tok.Pos
+		p.match(token.MINUS)
+		numPos, lit := p.tok.Pos, p.tok.Lit
+		p.match(token.NUMBER)
+		return &ast.UnaryExpr{pos, token.MINUS, &ast.ConstExpr{numPos, p.parseNumber(numPos, lit), lit}}
+	}
+	p.error(fmt.Sprintf("expected pattern found '%s'.", p.tok))
+	return nil
+}
+
+func (p *Parser) parseMatch() ast.Expr {
+	// match := < match | every > '(' <exprlist> ')'
+	//          [ ':' <pattern> [',' <pattern>]* '=>' <expr> ]+ [ '.' ]
+
+	pos, every := p.tok.Pos, p.tok.Kind == token.EVERY
+	p.match(p.tok.Kind)
+	p.match(token.RBRA)
+	args := p.parseExprList()
+	p.match(token.RKET)
+
+	m := &ast.MatchExpr{pos, every, args, nil}
+	for len(m.Arms) == 0 || p.tok.Kind == token.COLON {
+		colon := p.tok.Pos
+		p.match(token.COLON)
+		patterns := &ast.ExprList{[]ast.Expr{p.parsePattern()}}
+		for p.tok.Kind == token.COMMA {
+			p.match(token.COMMA)
+			patterns.Exprs = append(patterns.Exprs, p.parsePattern())
+		}
+		if len(patterns.Exprs) > len(args.Exprs) {
+			p.errorAt(colon, fmt.Sprintf("%d patterns for %d arguments", len(patterns.Exprs), len(args.Exprs)))
+		}
+		p.match(token.ARROW)
+		m.Arms = append(m.Arms, &ast.MatchArm{colon, patterns, p.parseExpr()})
+	}
+	if p.tok.Kind == token.DOT {
+		p.match(token.DOT)
+	}
+	return m
+}
+
+func (p *Parser) parseCall() ast.Expr {
+	// call := <primary> [ '(' [<exprlist>] ')' | < '!' | '%' > <primary> ]*
+
+	x := p.parsePrimary()
+	for {
+		switch p.tok.Kind {
+		case token.RBRA:
+			p.match(token.RBRA)
+			args := &ast.ExprList{}
+			if p.tok.Kind != token.RKET {
+				args = p.parseExprList()
+			}
+			p.match(token.RKET)
+			x = &ast.CallExpr{x, args}
+		case token.BANG:
+			p.match(token.BANG)
+			x = &ast.VecApExpr{x, p.parsePrimary()}
+		case token.PERCENT:
+			pos := p.tok.Pos
+			p.match(token.PERCENT)
+			x = &ast.BinaryExpr{x, pos, token.PERCENT, p.parsePrimary()}
+		default:
+			return x
+		}
+	}
+}
+
+func (p *Parser) parseUnary() ast.Expr {
+	// unary := < '+' | '-' | lv | rv | '!' | '#+' | '#-' | float | fix >
+	//          <unary> | <call>
+
+	switch p.tok.Kind {
+	case token.PLUS, token.MINUS, token.LV, token.RV,
+		token.FPLUS, token.FMINUS, token.FLOAT, token.FIX:
+		pos, op := p.tok.Pos, p.tok.Kind
+		p.match(op)
+		return &ast.UnaryExpr{pos, op, p.parseUnary()}
+	case token.BANG:
+		// Indirection, written rv in the 1967 language.
+		pos := p.tok.Pos
+		p.match(token.BANG)
+		return &ast.UnaryExpr{pos, token.RV, p.parseUnary()}
+	}
+	return p.parseCall()
+}
+
+// Apply a vector subscript to an operand.  Vector application binds
+// more tightly than the unary operators, but is only recognized once
+// the '[' after the '*' is seen, so it is pushed inside them here.
+func applyIndex(x, index ast.Expr) ast.Expr {
+	if u, ok := x.(*ast.UnaryExpr); ok {
+		return &ast.UnaryExpr{u.OpPos, u.Op, applyIndex(u.X, index)}
+	}
+	return &ast.VecApExpr{x, index}
+}
+
+func (p *Parser) parseTerm() ast.Expr {
+	// term := <unary> [ < '*' | '/' | rem | '#*' | '#/' > <unary>
+	//                  | '*' '[' <expr> ']' ]*
+
+	x := p.parseUnary()
+	for {
+		pos, op := p.tok.Pos, p.tok.Kind
+		switch op {
+		case token.STAR, token.DIV, token.REM, token.FMUL, token.FDIV:
+			p.match(op)
+			if op == token.STAR && p.tok.Kind == token.SBRA {
+				p.match(token.SBRA)
+				index := p.parseExpr()
+				p.match(token.SKET)
+				x = applyIndex(x, index)
+			} else {
+				x = &ast.BinaryExpr{x, pos, op, p.parseUnary()}
+			}
+		default:
+			return x
+		}
+	}
+}
+
+// Parse a left associative sequence of operands separated by
+// the operators of one precedence level.
+func (p *Parser) parseBinary(operand func() ast.Expr, ops ...token.TokenKind) ast.Expr {
+	x := operand()
+	for {
+		pos, op, found := p.tok.Pos, p.tok.Kind, false
+		for _, kind := range ops {
+			found = found || op == kind
+		}
+		if !found {
+			return x
+		}
+		p.match(op)
+		x = &ast.BinaryExpr{x, pos, op, operand()}
+	}
+}
+
+func (p *Parser) parseSum() ast.Expr {
+	return p.parseBinary(p.parseTerm, token.PLUS, token.MINUS, token.FPLUS, token.FMINUS)
+}
+
+func (p *Parser) parseRelation() ast.Expr {
+	return p.parseBinary(p.parseSum,
+		token.EQ, token.NE, token.LS, token.GR, token.LE, token.GE,
+		token.FEQ, token.FNE, token.FLS, token.FGR, token.FLE, token.FGE)
+}
+
+func (p *Parser) parseShift() ast.Expr {
+	return p.parseBinary(p.parseRelation, token.LSHIFT, token.RSHIFT)
+}
+
+func (p *Parser) parseNot() ast.Expr {
+	if p.tok.Kind == token.NOT {
+		pos := p.tok.Pos
+		p.match(token.NOT)
+		return &ast.UnaryExpr{pos, token.NOT, p.parseNot()}
+	}
+	return p.parseShift()
+}
+
+func (p *Parser) parseAnd() ast.Expr {
+	return p.parseBinary(p.parseNot, token.LOGAND)
+}
+
+func (p *Parser) parseOr() ast.Expr {
+	return p.parseBinary(p.parseAnd, token.LOGOR)
+}
+
+func (p *Parser) parseEqv() ast.Expr {
+	return p.parseBinary(p.parseOr, token.EQV, token.NEQV)
+}
+
 func (p *Parser) parseExpr() ast.Expr {
-	lit := p.tok.Lit
-	p.match(token.NUMBER)
-	constant, _ := strconv.Atoi(lit)
+	// expr := <eqv> [ '->' <expr> ',' <expr> ]
 
-	return &ast.ConstExpr{constant}
+	x := p.parseEqv()
+	if p.tok.Kind == token.COND {
+		p.match(token.COND)
+		then := p.parseExpr()
+		p.match(token.COMMA)
+		return &ast.CondExpr{x, then, p.parseExpr()}
+	}
+	return x
 }
 
 func (p *Parser) parseExprList() *ast.ExprList {
@@ -95,13 +454,216 @@ func (p *Parser) parseExprList() *ast.ExprList {
 	return &ast.ExprList{exprlist}
 }
 
-func (p *Parser) parseVarDef(name string) ast.Def {
+// Report whether an expression may be assigned to.
+func isAssignable(e ast.Expr) bool {
+	switch e := e.(type) {
+	case *ast.Name, *ast.VecApExpr:
+		return true
+	case *ast.ParenExpr:
+		return isAssignable(e.X)
+	case *ast.UnaryExpr:
+		return e.Op == token.RV
+	}
+	return false
+}
+
+// Skip the "do" of a conditional or repetitive command, which may be
+// left out.  The Richards dialect also writes it "then".
+func (p *Parser) parseDo() {
+	if p.tok.Kind == token.DO || p.tok.Kind == token.THEN {
+		p.match(p.tok.Kind)
+	}
+}
+
+// Report whether a token ends a block or the command list of a
+// label.
+func isCommandListEnd(kind token.TokenKind) bool {
+	return kind == token.SECTKET || kind == token.SEMICOLON || kind == token.EOF
+}
+
+// Parse the command of a label, which may be left out at the end of
+// a block.
+func (p *Parser) parseLabelled() ast.Cmd {
+	if isCommandListEnd(p.tok.Kind) {
+		return nil
+	}
+	return p.parseCommand()
+}
+
+func (p *Parser) parseBlock() *ast.BlockCmd {
+	// block := '$(' [ <let> | <command> ] [ [';'] < <let> | <command> > ]* '$)'
+
+	pos := p.tok.Pos
+	p.match(token.SECTBRA)
+	p.depth++
+	block := &ast.BlockCmd{Sectbra: pos}
+	for p.tok.Kind != token.SECTKET && p.tok.Kind != token.EOF {
+		if p.tok.Kind == token.SEMICOLON {
+			p.match(token.SEMICOLON)
+			continue
+		}
+		if p.tok.Kind != token.LET {
+			block.Items = append(block.Items, p.parseCommand())
+			continue
+		}
+		let := p.tok.Pos
+		def := p.parseDef()
+		for _, d := range ast.Defs(def) {
+			switch d.(type) {
+			case *ast.FuncDef, *ast.RoutineDef:
+				p.errorAt(d.Pos(), "local function definitions are not supported.")
+			}
+		}
+		block.Items = append(block.Items, &ast.LetCmd{let, def})
+	}
+	block.Sectket = p.tok.Pos
+	p.match(token.SECTKET)
+	p.depth--
+	return block
+}
+
+func (p *Parser) parseSimpleCommand() ast.Cmd {
+	// simple := <exprlist> ':=' <exprlist> | <expr> | <block>
+	//         | goto <name> | resultis <expr> | break | return | finish
+	//         | loop | endcase | next | exit
+
+	pos := p.tok.Pos
+	switch p.tok.Kind {
+	case token.SECTBRA:
+		return p.parseBlock()
+	case token.GOTO:
+		p.match(token.GOTO)
+		label := &ast.Name{p.tok.Pos, p.tok.Lit}
+		p.match(token.NAME)
+		return &ast.GotoCmd{pos, label}
+	case token.RESULTIS:
+		p.match(token.RESULTIS)
+		return &ast.ResultisCmd{pos, p.parseExpr()}
+	case token.BREAK, token.RETURN, token.FINISH, token.LOOP,
+		token.ENDCASE, token.NEXT, token.EXIT:
+		kind := p.tok.Kind
+		p.match(kind)
+		return &ast.JumpCmd{pos, kind}
+	}
+
+	lhs := p.parseExprList()
+	if p.tok.Kind == token.ASS {
+		ass := p.tok.Pos
+		p.match(token.ASS)
+		rhs := p.parseExprList()
+		for _, e := range lhs.Exprs {
+			if !isAssignable(e) {
+				p.errorAt(e.Pos(), "cannot assign to expression.")
+			}
+		}
+		if len(lhs.Exprs) != len(rhs.Exprs) {
+			p.errorAt(ass, "assignment count mismatch")
+		}
+		return &ast.AssignCmd{lhs, ass, rhs}
+	}
+	if len(lhs.Exprs) > 1 {
+		p.error(fmt.Sprintf("expected ':=' found '%s'.", p.tok))
+	}
+	return &ast.ExprCmd{lhs.Exprs[0]}
+}
+
+func (p *Parser) parseCommand() ast.Cmd {
+	// command := < if | unless > <expr> [do] <command>
+	//          | test <expr> [do] <command> < or | else > <command>
+	//          | < while | until > <expr> [do] <command>
+	//          | for <name> '=' <expr> to <expr> [by <expr>] [do] <command>
+	//          | switchon <expr> into <command>
+	//          | case <expr> ':' [<command>] | default ':' [<command>]
+	//          | <name> ':' [<command>]
+	//          | <simple> [ repeat | < repeatwhile | repeatuntil > <expr> ]*
+
+	pos := p.tok.Pos
+	switch p.tok.Kind {
+	case token.IF, token.UNLESS:
+		unless := p.tok.Kind == token.UNLESS
+		p.match(p.tok.Kind)
+		cond := p.parseExpr()
+		p.parseDo()
+		return &ast.IfCmd{pos, unless, cond, p.parseCommand()}
+	case token.TEST:
+		p.match(token.TEST)
+		cond := p.parseExpr()
+		p.parseDo()
+		then := p.parseCommand()
+		if p.tok.Kind == token.ELSE {
+			p.match(token.ELSE)
+		} else {
+			p.match(token.OR)
+		}
+		return &ast.TestCmd{pos, cond, then, p.parseCommand()}
+	case token.WHILE, token.UNTIL:
+		until := p.tok.Kind == token.UNTIL
+		p.match(p.tok.Kind)
+		cond := p.parseExpr()
+		p.parseDo()
+		return &ast.WhileCmd{pos, until, cond, p.parseCommand()}
+	case token.FOR:
+		p.match(token.FOR)
+		v := &ast.Name{p.tok.Pos, p.tok.Lit}
+		p.match(token.NAME)
+		p.match(token.EQ)
+		from := p.parseExpr()
+		p.match(token.TO)
+		to := p.parseExpr()
+		var by ast.Expr
+		if p.tok.Kind == token.BY {
+			p.match(token.BY)
+			by = p.parseExpr()
+		}
+		p.parseDo()
+		return &ast.ForCmd{pos, v, from, to, by, p.parseCommand()}
+	case token.SWITCHON:
+		p.match(token.SWITCHON)
+		x := p.parseExpr()
+		p.match(token.INTO)
+		return &ast.SwitchonCmd{pos, x, p.parseCommand()}
+	case token.CASE:
+		p.match(token.CASE)
+		value := p.parseExpr()
+		p.match(token.COLON)
+		return &ast.CaseCmd{pos, value, p.parseLabelled()}
+	case token.DEFAULT:
+		p.match(token.DEFAULT)
+		p.match(token.COLON)
+		return &ast.CaseCmd{pos, nil, p.parseLabelled()}
+	}
+
+	cmd := p.parseSimpleCommand()
+	if e, ok := cmd.(*ast.ExprCmd); ok && p.tok.Kind == token.COLON {
+		name, ok := e.X.(*ast.Name)
+		if !ok {
+			p.error("expected label name before ':'.")
+		}
+		p.match(token.COLON)
+		return &ast.LabelCmd{name, p.parseLabelled()}
+	}
+	for {
+		opPos, op := p.tok.Pos, p.tok.Kind
+		switch op {
+		case token.REPEAT:
+			p.match(op)
+			cmd = &ast.RepeatCmd{cmd, opPos, op, nil}
+		case token.REPEATWHILE, token.REPEATUNTIL:
+			p.match(op)
+			cmd = &ast.RepeatCmd{cmd, opPos, op, p.parseExpr()}
+		default:
+			return cmd
+		}
+	}
+}
+
+func (p *Parser) parseVarDef(doc *ast.CommentGroup, name *ast.Name) ast.Def {
 	var namelist []*ast.Name
-	namelist = append(namelist, &ast.Name{name})
+	namelist = append(namelist, name)
 
 	for p.tok.Kind == token.COMMA {
 		p.match(token.COMMA)
-		namelist = append(namelist, &ast.Name{p.tok.Lit})
+		namelist = append(namelist, &ast.Name{p.tok.Pos, p.tok.Lit})
 		p.match(token.NAME)
 	}
 
@@ -109,36 +671,66 @@ func (p *Parser) parseVarDef(name string) ast.Def {
 
 	if p.tok.Kind == token.VEC {
 		p.match(token.VEC)
-		return &ast.VecDef{name, p.parseExpr()}
+		return &ast.VecDef{doc, name.NamePos, name.Val, p.parseExpr()}
 	} else {
 		exprlist := p.parseExprList()
 		if len(namelist) != len(exprlist.Exprs) {
-			p.error("assignment count mismatch")
+			p.errorAt(name.NamePos, "assignment count mismatch")
 		}
-		return &ast.SimpleDef{&ast.NameList{namelist}, exprlist}
+		return &ast.SimpleDef{doc, &ast.NameList{namelist}, exprlist}
 	}
 }
 
-func (p *Parser) parseSingleDef() (def ast.Def) {
-	name := p.tok.Lit
+func (p *Parser) parseFuncDef(doc *ast.CommentGroup, name *ast.Name) ast.Def {
+	// funcdef := <name> '(' [<name> [',' <name>]*] ')'
+	//            < '=' <expr> | be <command> >
+
+	p.match(token.RBRA)
+	params := &ast.NameList{}
+	if p.tok.Kind == token.NAME {
+		params.Names = append(params.Names, &ast.Name{p.tok.Pos, p.tok.Lit})
+		p.match(token.NAME)
+		for p.tok.Kind == token.COMMA {
+			p.match(token.COMMA)
+			params.Names = append(params.Names, &ast.Name{p.tok.Pos, p.tok.Lit})
+			p.match(token.NAME)
+		}
+	}
+	p.match(token.RKET)
+
+	if p.tok.Kind == token.BE {
+		p.match(token.BE)
+		return &ast.RoutineDef{doc, name.NamePos, name.Val, params, p.parseCommand()}
+	}
+	p.match(token.EQ)
+	return &ast.FuncDef{doc, name.NamePos, name.Val, params, p.parseExpr()}
+}
+
+func (p *Parser) parseSingleDef(doc *ast.CommentGroup) (def ast.Def) {
+	name := &ast.Name{p.tok.Pos, p.tok.Lit}
 	p.match(token.NAME)
 
 	switch p.tok.Kind {
 	case token.COMMA:
-		def = p.parseVarDef(name)
+		def = p.parseVarDef(doc, name)
 	case token.EQ:
-		def = p.parseVarDef(name)
+		def = p.parseVarDef(doc, name)
+	case token.RBRA:
+		def = p.parseFuncDef(doc, name)
+	default:
+		p.error(fmt.Sprintf("expected ',', '=' or '(' found '%s'.", p.tok))
 	}
 
 	return
 }
 
-func (p *Parser) parseSimulDef() (def ast.Def) {
-	def = p.parseSingleDef()
+func (p *Parser) parseSimulDef(doc *ast.CommentGroup) (def ast.Def) {
+	def = p.parseSingleDef(doc)
 
 	for p.tok.Kind == token.AND {
+		doc = p.lead
 		p.match(token.AND)
-		rhsDef := p.parseSingleDef()
+		rhsDef := p.parseSingleDef(doc)
 		def = &ast.AndDef{def, rhsDef}
 	}
 
@@ -146,30 +738,132 @@ func (p *Parser) parseSimulDef() (def ast.Def) {
 }
 
 func (p *Parser) parseDef() ast.Def {
+	doc := p.lead
 	p.match(token.LET)
-	return p.parseSimulDef()
+	return p.parseSimulDef(doc)
 }
 
-func (p *Parser) Parse() *ast.Program {
-	var decls []ast.Decl
-	var defs []ast.Def
-	for {
-		switch p.tok.Kind {
-		case token.MANIFEST, token.GLOBAL:
-			decls = append(decls, p.parseDecl())
-		case token.LET:
-			defs = append(defs, p.parseDef())
-		case token.EOF:
-			goto done
-		default:
-			p.error(fmt.Sprintf("expected definition found '%s'.", p.tok))
+// Report whether a token starts a directive, declaration or
+// definition.
+func isItemStart(kind token.TokenKind) bool {
+	switch kind {
+	case token.MANIFEST, token.GLOBAL, token.LET,
+		token.SECTION, token.NEEDS, token.GET, token.STATIC:
+		return true
+	}
+	return false
+}
+
+func (p *Parser) parseDirective() *ast.Directive {
+	// directive := < section | needs | get > <stringconst>
+
+	doc, pos, key := p.lead, p.tok.Pos, p.tok.Kind
+	p.match(key)
+	name := &ast.StringExpr{p.tok.Pos, p.tok.Lit}
+	p.match(token.STRINGCONST)
+	return &ast.Directive{doc, pos, key, name}
+}
+
+// Parse one directive, declaration or definition, adding it to the
+// program.  A syntax error is recorded and the tokens up to the start
+// of the next item outside the blocks being parsed are skipped.
+func (p *Parser) parseItem(prog *ast.Program) {
+	start := p.tok
+	p.depth = 0
+	defer func() {
+		if x := recover(); x != nil {
+			e, ok := x.(*Error)
+			if !ok {
+				panic(x)
+			}
+			p.Errors = append(p.Errors, e)
+			if p.tok == start {
+				p.next()
+			}
+			for p.depth > 0 || !isItemStart(p.tok.Kind) {
+				switch p.tok.Kind {
+				case token.EOF:
+					return
+				case token.SECTBRA:
+					p.depth++
+				case token.SECTKET:
+					if p.depth > 0 {
+						p.depth--
+					}
+				}
+				p.next()
+			}
 		}
+	}()
+
+	switch p.tok.Kind {
+	case token.SECTION, token.NEEDS, token.GET:
+		prog.Directives = append(prog.Directives, p.parseDirective())
+	case token.MANIFEST, token.GLOBAL, token.STATIC:
+		prog.Decls = append(prog.Decls, p.parseDecl())
+	case token.LET:
+		prog.Defs = append(prog.Defs, p.parseDef())
+	default:
+		p.error(fmt.Sprintf("expected definition found '%s'.", p.tok))
 	}
-done:
-	return &ast.Program{decls, defs}
+}
+
+// Parse a whole program.  The syntax errors are recorded in Errors;
+// the declarations and definitions containing them are left out of
+// the program.
+func (p *Parser) Parse() *ast.Program {
+	prog := new(ast.Program)
+	for p.tok.Kind != token.EOF {
+		p.parseItem(prog)
+	}
+	prog.Comments = p.comments
+	return prog
+}
+
+// Parse the source of a whole program, returning an ErrorList
+// holding the syntax errors if there are any.
+func ParseProgram(src []byte) (*ast.Program, error) {
+	var p Parser
+	p.Init(src)
+	prog := p.Parse()
+	if err := p.Errors.Err(); err != nil {
+		return nil, err
+	}
+	return prog, nil
+}
+
+// Parse the whole source as a single expression, returning the
+// first syntax error rather than panicking.
+func (p *Parser) ParseExpr() (expr ast.Expr, err error) {
+	defer func() {
+		if x := recover(); x != nil {
+			e, ok := x.(*Error)
+			if !ok {
+				panic(x)
+			}
+			expr, err = nil, e
+		}
+	}()
+
+	expr = p.parseExpr()
+	p.match(token.EOF)
+	return expr, nil
+}
+
+// Parse the source of a single expression, returning the first
+// syntax error rather than panicking.
+func ParseExpr(src []byte) (ast.Expr, error) {
+	var p Parser
+	p.Init(src)
+	return p.ParseExpr()
 }
 
 func (p *Parser) Init(src []byte) {
 	p.scan.Init(src)
-	p.tok = p.scan.Next()
+	p.scan.Mode = scanner.ScanComments
+	p.scan.Dialect = p.Dialect
+	p.Errors = nil
+	p.tok = nil
+	p.comments = nil
+	p.next()
 }
@@ -5,9 +5,43 @@
 package parser
 
 import (
+	"bytes"
+	"flag"
+	"github.com/meadori/bcpl-go/src/ast"
+	"github.com/meadori/bcpl-go/src/edit"
+	"github.com/meadori/bcpl-go/src/token"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
 )
 
+var update = flag.Bool("update", false, "update the golden files")
+
+// Compare the dump of a node against a golden file in testdata.
+func checkGolden(t *testing.T, name string, node interface{}) {
+	var buf bytes.Buffer
+	if err := ast.Fprint(&buf, node, ast.NotNilFilter); err != nil {
+		t.Fatal(err)
+	}
+
+	golden := filepath.Join("testdata", name)
+	if *update {
+		if err := ioutil.WriteFile(golden, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	expected, err := ioutil.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), expected) {
+		t.Errorf("%s differs:\ngot:\n%s\nexpected:\n%s", golden, buf.Bytes(), expected)
+	}
+}
+
 var test_decl_str = `global $(
         COUNT: 200;
         ALL = 13
@@ -79,5 +113,300 @@ and	V = vec 5
 func TestSimpleDefs(t *testing.T) {
 	var p Parser
 	p.Init([]byte(test_simple_def_str))
-	p.Parse()
+	m := p.Parse()
+	checkGolden(t, "simple_defs.golden", m.Defs)
+}
+
+var test_doc_str = `// Doc for the globals.
+global $( FOO: 1 $) // not a doc comment
+
+// Not attached: a blank line follows.
+
+// Doc for X.
+let X = 1
+// Doc for V.
+and V = vec 5
+`
+
+func TestDocComments(t *testing.T) {
+	var p Parser
+	p.Init([]byte(test_doc_str))
+	m := p.Parse()
+
+	if len(m.Comments) != 5 {
+		t.Errorf("Expected 5 comment groups, got %d.", len(m.Comments))
+	}
+
+	g := m.Decls[0].(*ast.GlobalDecl)
+	if g.Doc.Text() != "Doc for the globals.\n" {
+		t.Errorf("Bad global doc %q.", g.Doc.Text())
+	}
+
+	and := m.Defs[0].(*ast.AndDef)
+	if doc := and.Lhs.(*ast.SimpleDef).Doc.Text(); doc != "Doc for X.\n" {
+		t.Errorf("Bad definition doc %q.", doc)
+	}
+	if doc := and.Rhs.(*ast.VecDef).Doc.Text(); doc != "Doc for V.\n" {
+		t.Errorf("Bad definition doc %q.", doc)
+	}
+}
+
+var test_semi_comment_str = `global $(
+        COUNT: 200 // the count
+        ALL: 201
+$)
+`
+
+func TestCommentSemiInsertion(t *testing.T) {
+	var p Parser
+	p.Init([]byte(test_semi_comment_str))
+	m := p.Parse()
+	if n := len(m.Decls[0].VarDecls()); n != 2 {
+		t.Errorf("Expected 2 declarations, got %d.", n)
+	}
+}
+
+var test_commands = []struct {
+	src  string
+	kind string
+}{
+	{"X := 1", "AssignCmd"},
+	{"X, Y := Y, X", "AssignCmd"},
+	{"F(X)", "ExprCmd"},
+	{"$( let X = 1; X := 2 $)", "BlockCmd"},
+	{"if X do Y := 1", "IfCmd"},
+	{"unless X Y := 1", "IfCmd"},
+	{"test X do Y := 1 or Y := 2", "TestCmd"},
+	{"while X do X := X - 1", "WhileCmd"},
+	{"until X do X := X + 1", "WhileCmd"},
+	{"for I = 1 to 10 do F(I)", "ForCmd"},
+	{"X := X + 1 repeatuntil X > 5", "RepeatCmd"},
+	{"switchon X into $( case 1: return; default: finish $)", "SwitchonCmd"},
+	{"L: goto L", "LabelCmd"},
+	{"resultis 1", "ResultisCmd"},
+	{"break", "JumpCmd"},
+}
+
+func TestCommands(t *testing.T) {
+	for _, test := range test_commands {
+		prog, err := ParseProgram([]byte("let F(X, Y) be " + test.src))
+		if err != nil {
+			t.Errorf("%s: %v", test.src, err)
+			continue
+		}
+		r, ok := prog.Defs[0].(*ast.RoutineDef)
+		if !ok {
+			t.Errorf("%s: got %T, expected a routine", test.src, prog.Defs[0])
+			continue
+		}
+		if kind := r.Body.Kind().String(); kind != test.kind {
+			t.Errorf("%s: got %s, expected %s", test.src, kind, test.kind)
+		}
+	}
+}
+
+var test_command_errors = []struct {
+	src string
+	msg string
+}{
+	{"let F() be 1 := 2", "cannot assign to expression"},
+	{"let F() be X, Y := 1", "assignment count mismatch"},
+	{"let F() be X, Y", "expected ':=' found"},
+	{"let F() be F(): X := 1", "expected label name before ':'"},
+	{"let F() be $( let G() = 1 $)", "local function definitions are not supported"},
+}
+
+func TestCommandErrors(t *testing.T) {
+	for _, test := range test_command_errors {
+		_, err := ParseProgram([]byte(test.src))
+		if err == nil || !strings.Contains(err.Error(), test.msg) {
+			t.Errorf("%s: got %v, expected %q", test.src, err, test.msg)
+		}
+	}
+}
+
+// Return an expression with every operation parenthesized.
+func parenthesize(e ast.Expr) string {
+	switch e := e.(type) {
+	case *ast.Name:
+		return e.Val
+	case *ast.ConstExpr:
+		return strconv.Itoa(e.Contant)
+	case *ast.ParenExpr:
+		return parenthesize(e.X)
+	case *ast.CallExpr:
+		var args []string
+		for _, arg := range e.Args.Exprs {
+			args = append(args, parenthesize(arg))
+		}
+		return parenthesize(e.Fn) + "(" + strings.Join(args, ", ") + ")"
+	case *ast.VecApExpr:
+		return "(" + parenthesize(e.X) + "*[" + parenthesize(e.Index) + "])"
+	case *ast.UnaryExpr:
+		return "(" + e.Op.String() + " " + parenthesize(e.X) + ")"
+	case *ast.BinaryExpr:
+		return "(" + parenthesize(e.X) + " " + e.Op.String() + " " + parenthesize(e.Y) + ")"
+	case *ast.CondExpr:
+		return "(" + parenthesize(e.Cond) + " -> " + parenthesize(e.Then) + ", " + parenthesize(e.Else) + ")"
+	}
+	return "?"
+}
+
+var test_exprs = []struct {
+	src      string
+	expected string
+}{
+	{"A + B * C", "(A + (B * C))"},
+	{"A - B - C", "((A - B) - C)"},
+	{"-A * B", "((- A) * B)"},
+	{"lv V*[3] - V", "((lv (V*[3])) - V)"},
+	{"rv P*[1]*[2]", "(rv ((P*[1])*[2]))"},
+	{"F(A, B)(C)", "F(A, B)(C)"},
+	{"A < B = C", "((A < B) = C)"},
+	{"A << 1 & B", "((A << 1) & B)"},
+	{"! A & B | C", "(((! A) & B) | C)"},
+	{"A eqv B | C", "(A eqv (B | C))"},
+	{"A -> B, C -> D, E", "(A -> B, (C -> D, E))"},
+}
+
+func TestExprs(t *testing.T) {
+	for _, test := range test_exprs {
+		e, err := ParseExpr([]byte(test.src))
+		if err != nil {
+			t.Errorf("%s: %v", test.src, err)
+			continue
+		}
+		if str := parenthesize(e); str != test.expected {
+			t.Errorf("%s: got %s, expected %s", test.src, str, test.expected)
+		}
+	}
+}
+
+var test_richards_str = `SECTION "demo"
+NEEDS "lib"
+MANIFEST { Mask = #377 }
+LET f(v, n) = !v + v!n!1 MOD 2
+AND g(x) = FLOAT x #* 2 #< #- 1
+AND fact(n) = MATCH (n)
+  : 0 => 1
+  : m => m * fact(m - 1)
+  .
+`
+
+func TestRichards(t *testing.T) {
+	var p Parser
+	p.Dialect = token.Richards | token.Upper
+	p.Init([]byte(test_richards_str))
+	m := p.Parse()
+	if len(p.Errors) > 0 {
+		t.Fatal(p.Errors)
+	}
+
+	if len(m.Directives) != 2 || m.Directives[0].Key != token.SECTION || m.Directives[1].Name.Lit != `"lib"` {
+		t.Errorf("Bad directives %v.", m.Directives)
+	}
+	if c := m.Decls[0].VarDecls()[0].Constant; c != 255 {
+		t.Errorf("Expected Mask = 255, got %d.", c)
+	}
+
+	var funcs []*ast.FuncDef
+	ast.Inspect(m.Defs[0], func(n ast.Node) bool {
+		if f, ok := n.(*ast.FuncDef); ok {
+			funcs = append(funcs, f)
+		}
+		return true
+	})
+	if len(funcs) != 3 {
+		t.Fatalf("Expected 3 functions, got %d.", len(funcs))
+	}
+	for i, expected := range []string{
+		"((rv v) + (((v*[n])*[1]) rem 2))",
+		"(((float x) #* 2) #< (#- 1))",
+	} {
+		if got := parenthesize(funcs[i].Body); got != expected {
+			t.Errorf("%s: got %s, expected %s", funcs[i].Name, got, expected)
+		}
+	}
+	match, ok := funcs[2].Body.(*ast.MatchExpr)
+	if !ok || match.Every || len(match.Arms) != 2 {
+		t.Fatalf("Bad match expression %#v.", funcs[2].Body)
+	}
+	if got := parenthesize(match.Arms[1].Body); got != "(m * fact((m - 1)))" {
+		t.Errorf("Bad second arm %s.", got)
+	}
+}
+
+var test_static_str = `// The counters.
+static $( Count = 0; Limit = #20 $)
+`
+
+func TestStaticDecl(t *testing.T) {
+	var p Parser
+	p.Dialect = token.Richards
+	p.Init([]byte(test_static_str))
+	m := p.Parse()
+	if len(p.Errors) > 0 {
+		t.Fatal(p.Errors)
+	}
+	s, ok := m.Decls[0].(*ast.StaticDecl)
+	if !ok {
+		t.Fatalf("Expected a static declaration, got %T.", m.Decls[0])
+	}
+	if s.Doc.Text() != "The counters.\n" {
+		t.Errorf("Bad static doc %q.", s.Doc.Text())
+	}
+	items := s.VarDecls()
+	if len(items) != 2 || items[0].Name != "Count" || items[1].Constant != 16 {
+		t.Errorf("Bad static items %v.", items)
+	}
+}
+
+var test_fixes = []struct {
+	src, fixed string
+}{
+	{"let F() = (1 + 2\nlet G() = 3", "let F() = (1 + 2)\nlet G() = 3"},
+	{"global $( G: 1; H: 2", "global $( G: 1; H: 2 $)"},
+	{"let F() = G(1, 2 // Two.\n", "let F() = G(1, 2) // Two.\n"},
+	{"let F() = V*[1 + 2\nlet G() = 3", "let F() = V*[1 + 2]\nlet G() = 3"},
+	{"let F() = G(1 2)", "let F() = G(1 2)"},
+}
+
+func TestFixes(t *testing.T) {
+	for _, test := range test_fixes {
+		var p Parser
+		p.Init([]byte(test.src))
+		p.Parse()
+		fixed, err := edit.Apply([]byte(test.src), p.Errors.Edits())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(fixed) != test.fixed {
+			t.Errorf("%q: got %q, expected %q", test.src, fixed, test.fixed)
+		}
+	}
+}
+
+var test_number_errors = []struct {
+	src, err string
+}{
+	{"let X = 9223372036854775807", ""},
+	{"let X = 9223372036854775808", "1:9: error: number 9223372036854775808 out of range."},
+	{"manifest $( M = #XFFFFFFFFFFFFFFFFF $)", "1:17: error: number #XFFFFFFFFFFFFFFFFF out of range."},
+	{"let F(X) = match (X) : -99999999999999999999 => 1 .", "1:25: error: number 99999999999999999999 out of range."},
+}
+
+func TestNumberErrors(t *testing.T) {
+	for _, test := range test_number_errors {
+		var p Parser
+		p.Dialect = token.Richards
+		p.Init([]byte(test.src))
+		p.Parse()
+		var got string
+		if len(p.Errors) > 0 {
+			got = p.Errors[0].Error()
+		}
+		if got != test.err {
+			t.Errorf("%q: got error %q, expected %q", test.src, got, test.err)
+		}
+	}
 }
@@ -0,0 +1,615 @@
+// Copyright 2015 Meador Inge.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+// Package printer renders BCPL syntax trees back to source
+// in a canonical layout.
+package printer
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/meadori/bcpl-go/src/ast"
+	"github.com/meadori/bcpl-go/src/parser"
+	"github.com/meadori/bcpl-go/src/token"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type printer struct {
+	buf      bytes.Buffer   // The formatted output.
+	err      error          // The first error encountered.
+	comments []*ast.Comment // All comments, in source order.
+	cindex   int            // The index of the next comment to print.
+	line     int            // The source line of the last thing printed.
+	indent   string         // The indentation of the lines of the current block.
+	dialect  token.Dialect  // The dialect whose words are printed.
+}
+
+func (p *printer) print(args ...string) {
+	for _, arg := range args {
+		p.buf.WriteString(arg)
+	}
+}
+
+// Return the spelling of a token kind in the dialect.
+func (p *printer) word(kind token.TokenKind) string {
+	return kind.In(p.dialect)
+}
+
+func (p *printer) unsupported(node interface{}) {
+	if p.err == nil {
+		p.err = fmt.Errorf("printer: unsupported node %T", node)
+	}
+}
+
+// Report whether the output is empty or ends in a blank line.
+func (p *printer) blank() bool {
+	out := p.buf.Bytes()
+	return len(out) == 0 || bytes.HasSuffix(out, []byte("\n\n"))
+}
+
+// Print the comments that come before pos, each on a line of its
+// own.  A blank line between comments, or between the last comment
+// and pos, is kept.
+func (p *printer) leading(pos token.Position, indent string) {
+	printed := false
+	for p.cindex < len(p.comments) && p.comments[p.cindex].Slash.Offset < pos.Offset {
+		c := p.comments[p.cindex]
+		if p.line > 0 && c.Slash.Line > p.line+1 && !p.blank() {
+			p.print("\n")
+		}
+		p.print(indent, c.Text, "\n")
+		p.line = c.Slash.Line
+		p.cindex++
+		printed = true
+	}
+	if printed && pos.IsValid() && pos.Line > p.line+1 {
+		p.print("\n")
+	}
+}
+
+// Print the comments on the given source line that come before
+// next, which end the current output line.  The comments after next
+// belong to the node at next.  An invalid next takes every comment on
+// the line.
+func (p *printer) trailing(line int, next token.Position) {
+	for p.cindex < len(p.comments) && p.comments[p.cindex].Slash.Line == line &&
+		(!next.IsValid() || p.comments[p.cindex].Slash.Offset < next.Offset) {
+		p.print(" ", p.comments[p.cindex].Text)
+		p.cindex++
+	}
+}
+
+// Report whether there are comments to print before pos.
+func (p *printer) hasComments(pos token.Position) bool {
+	return p.cindex < len(p.comments) && p.comments[p.cindex].Slash.Offset < pos.Offset
+}
+
+func (p *printer) expr(e ast.Expr) {
+	switch e := e.(type) {
+	case *ast.Name:
+		p.print(e.Val)
+	case *ast.ConstExpr:
+		p.print(strconv.Itoa(e.Contant))
+	case *ast.StringExpr:
+		p.print(e.Lit)
+	case *ast.BoolExpr:
+		if e.Value {
+			p.print(p.word(token.TRUE))
+		} else {
+			p.print(p.word(token.FALSE))
+		}
+	case *ast.ParenExpr:
+		p.print("(")
+		p.expr(e.X)
+		p.print(")")
+	case *ast.CallExpr:
+		p.expr(e.Fn)
+		p.print("(")
+		p.exprList(e.Args)
+		p.print(")")
+	case *ast.VecApExpr:
+		if p.dialect&token.Richards != 0 {
+			// Written v!i, binding as tightly as a call.
+			p.operand(e.X, isCallOperand)
+			p.print("!")
+			p.operand(e.Index, isPrimary)
+			break
+		}
+		p.expr(e.X)
+		p.print("*[")
+		p.expr(e.Index)
+		p.print("]")
+	case *ast.UnaryExpr:
+		p.print(p.word(e.Op))
+		if e.Op.IsKeyword() {
+			p.print(" ")
+		}
+		p.expr(e.X)
+	case *ast.BinaryExpr:
+		p.expr(e.X)
+		p.print(" ", p.word(e.Op), " ")
+		p.expr(e.Y)
+	case *ast.CondExpr:
+		p.expr(e.Cond)
+		p.print(" -> ")
+		p.expr(e.Then)
+		p.print(", ")
+		p.expr(e.Else)
+	case *ast.QueryExpr:
+		p.print("?")
+	case *ast.MatchExpr:
+		if e.Every {
+			p.print(p.word(token.EVERY), " (")
+		} else {
+			p.print(p.word(token.MATCH), " (")
+		}
+		p.exprList(e.Args)
+		p.print(")")
+		for _, arm := range e.Arms {
+			p.print(" : ")
+			p.exprList(arm.Patterns)
+			p.print(" => ")
+			p.expr(arm.Body)
+		}
+		p.print(" .")
+	case *ast.ValofExpr:
+		p.print(p.word(token.VALOF), " ")
+		p.cmd(e.Body)
+	default:
+		p.unsupported(e)
+	}
+}
+
+// Report whether an expression is a primary, which needs no
+// parentheses as the subscript of a vector application.
+func isPrimary(e ast.Expr) bool {
+	switch e.(type) {
+	case *ast.Name, *ast.ConstExpr, *ast.StringExpr, *ast.BoolExpr,
+		*ast.ParenExpr, *ast.QueryExpr:
+		return true
+	}
+	return false
+}
+
+// Report whether an expression needs no parentheses as the operand
+// of a call or vector application.
+func isCallOperand(e ast.Expr) bool {
+	switch e := e.(type) {
+	case *ast.CallExpr, *ast.VecApExpr:
+		return true
+	case *ast.BinaryExpr:
+		return e.Op == token.PERCENT
+	}
+	return isPrimary(e)
+}
+
+// Print an operand, in parentheses unless ok reports it needs none.
+func (p *printer) operand(e ast.Expr, ok func(ast.Expr) bool) {
+	if ok(e) {
+		p.expr(e)
+		return
+	}
+	p.print("(")
+	p.expr(e)
+	p.print(")")
+}
+
+func (p *printer) exprList(list *ast.ExprList) {
+	for i, e := range list.Exprs {
+		if i > 0 {
+			p.print(", ")
+		}
+		p.expr(e)
+	}
+}
+
+func (p *printer) decl(d ast.Decl) {
+	// Globals are written "NAME: N" and manifests "NAME = N", with
+	// the values of a multi-line declaration lined up in a column.
+	var keyword token.TokenKind
+	var end token.Position
+	switch d := d.(type) {
+	case *ast.GlobalDecl:
+		keyword, end = token.GLOBAL, d.Sectket
+	case *ast.ConstantDecl:
+		keyword, end = token.MANIFEST, d.Sectket
+	case *ast.StaticDecl:
+		keyword, end = token.STATIC, d.Sectket
+	default:
+		p.unsupported(d)
+		return
+	}
+	global := keyword == token.GLOBAL
+	entry := func(v *ast.VarDecl, width int) {
+		value := strconv.Itoa(v.Constant)
+		pad := strings.Repeat(" ", width-len(v.Name))
+		if global {
+			p.print(v.Name, ":", pad, " ", value)
+		} else {
+			p.print(v.Name, pad, " = ", value)
+		}
+	}
+
+	items := d.VarDecls()
+	p.line = d.Pos().Line
+	if len(items) == 1 && !p.hasComments(end) {
+		p.print(p.word(keyword), " $( ")
+		entry(items[0], len(items[0].Name))
+		p.print(" $)")
+		p.line = end.Line
+		p.trailing(p.line, token.Position{})
+		return
+	}
+
+	width := 0
+	for _, v := range items {
+		if len(v.Name) > width {
+			width = len(v.Name)
+		}
+	}
+	p.print(p.word(keyword), " $(")
+	p.trailing(p.line, items[0].Pos())
+	p.print("\n")
+	for i, v := range items {
+		p.leading(v.Pos(), "\t")
+		p.print("\t")
+		entry(v, width)
+		p.line = v.Pos().Line
+		after := end
+		if i+1 < len(items) {
+			after = items[i+1].Pos()
+		}
+		p.trailing(p.line, after)
+		p.print("\n")
+	}
+	p.leading(end, "\t")
+	p.print("$)")
+	p.line = end.Line
+	p.trailing(p.line, token.Position{})
+}
+
+// Return the last source line of a node: the line of the last node
+// it contains, or of the closing "$)" of its last block.
+func lastLine(n ast.Node) int {
+	line := n.Pos().Line
+	ast.Inspect(n, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case nil:
+		case *ast.BlockCmd:
+			if n.Sectket.Line > line {
+				line = n.Sectket.Line
+			}
+		default:
+			if n.Pos().Line > line {
+				line = n.Pos().Line
+			}
+		}
+		return true
+	})
+	return line
+}
+
+// Report whether a command must be separated from the one before it
+// by a semicolon: a newline gives no semicolon before an operator,
+// which would instead continue the expression ending the command
+// before it.
+func needsSemi(c ast.Cmd) bool {
+	var x ast.Expr
+	switch c := c.(type) {
+	case *ast.ExprCmd:
+		x = c.X
+	case *ast.AssignCmd:
+		x = c.Lhs.Exprs[0]
+	case *ast.RepeatCmd:
+		return needsSemi(c.Body)
+	default:
+		return false
+	}
+	for {
+		switch e := x.(type) {
+		case *ast.CallExpr:
+			x = e.Fn
+		case *ast.VecApExpr:
+			x = e.X
+		case *ast.BinaryExpr:
+			x = e.X
+		case *ast.CondExpr:
+			x = e.Cond
+		case *ast.UnaryExpr:
+			return !e.Op.IsKeyword()
+		default:
+			return false
+		}
+	}
+}
+
+func (p *printer) block(b *ast.BlockCmd) {
+	if len(b.Items) == 0 && !p.hasComments(b.Sectket) {
+		p.print("$( $)")
+		return
+	}
+	outer := p.indent
+	p.indent += "\t"
+	p.print("$(")
+	p.line = b.Sectbra.Line
+	after := b.Sectket
+	if len(b.Items) > 0 {
+		after = b.Items[0].Pos()
+	}
+	p.trailing(p.line, after)
+	for i, item := range b.Items {
+		p.print("\n")
+		if !p.hasComments(item.Pos()) && item.Pos().Line > p.line+1 {
+			p.print("\n")
+		}
+		p.leading(item.Pos(), p.indent)
+		p.print(p.indent)
+		p.cmd(item)
+		p.line = lastLine(item)
+		after = b.Sectket
+		if i+1 < len(b.Items) {
+			after = b.Items[i+1].Pos()
+			// The separator goes before any comments ending the line.
+			if needsSemi(b.Items[i+1]) || bytes.HasSuffix(p.buf.Bytes(), []byte(".")) {
+				p.print(";")
+			} else if bytes.HasSuffix(p.buf.Bytes(), []byte(":")) {
+				// A label without a command would otherwise
+				// label the item after it.
+				p.print(" ;")
+			}
+		}
+		p.trailing(p.line, after)
+	}
+	p.print("\n")
+	p.leading(b.Sectket, p.indent)
+	p.indent = outer
+	p.print(p.indent, "$)")
+	p.line = b.Sectket.Line
+}
+
+// Print a command, or nothing for the missing command of a label.
+func (p *printer) cmd(c ast.Cmd) {
+	switch c := c.(type) {
+	case nil:
+	case *ast.AssignCmd:
+		p.exprList(c.Lhs)
+		p.print(" := ")
+		p.exprList(c.Rhs)
+	case *ast.ExprCmd:
+		p.expr(c.X)
+	case *ast.IfCmd:
+		if c.Unless {
+			p.print(p.word(token.UNLESS), " ")
+		} else {
+			p.print(p.word(token.IF), " ")
+		}
+		p.expr(c.Cond)
+		p.print(" ", p.then(), " ")
+		p.cmd(c.Body)
+	case *ast.TestCmd:
+		p.print(p.word(token.TEST), " ")
+		p.expr(c.Cond)
+		p.print(" ", p.then(), " ")
+		p.cmd(c.Then)
+		if p.dialect&token.Richards != 0 {
+			p.print(" ", p.word(token.ELSE), " ")
+		} else {
+			p.print(" ", p.word(token.OR), " ")
+		}
+		p.cmd(c.Else)
+	case *ast.WhileCmd:
+		if c.Until {
+			p.print(p.word(token.UNTIL), " ")
+		} else {
+			p.print(p.word(token.WHILE), " ")
+		}
+		p.expr(c.Cond)
+		p.print(" ", p.word(token.DO), " ")
+		p.cmd(c.Body)
+	case *ast.RepeatCmd:
+		p.cmd(c.Body)
+		p.print(" ", p.word(c.Op))
+		if c.Cond != nil {
+			p.print(" ")
+			p.expr(c.Cond)
+		}
+	case *ast.ForCmd:
+		p.print(p.word(token.FOR), " ", c.Var.Val, " = ")
+		p.expr(c.From)
+		p.print(" ", p.word(token.TO), " ")
+		p.expr(c.To)
+		if c.By != nil {
+			p.print(" ", p.word(token.BY), " ")
+			p.expr(c.By)
+		}
+		p.print(" ", p.word(token.DO), " ")
+		p.cmd(c.Body)
+	case *ast.JumpCmd:
+		p.print(p.word(c.Tok))
+	case *ast.GotoCmd:
+		p.print(p.word(token.GOTO), " ", c.Label.Val)
+	case *ast.ResultisCmd:
+		p.print(p.word(token.RESULTIS), " ")
+		p.expr(c.X)
+	case *ast.SwitchonCmd:
+		p.print(p.word(token.SWITCHON), " ")
+		p.expr(c.X)
+		p.print(" ", p.word(token.INTO), " ")
+		p.cmd(c.Body)
+	case *ast.CaseCmd:
+		if c.Value == nil {
+			p.print(p.word(token.DEFAULT), ":")
+		} else {
+			p.print(p.word(token.CASE), " ")
+			p.expr(c.Value)
+			p.print(":")
+		}
+		p.labelled(c.Body)
+	case *ast.LabelCmd:
+		p.print(c.Label.Val, ":")
+		p.labelled(c.Body)
+	case *ast.BlockCmd:
+		p.block(c)
+	case *ast.LetCmd:
+		p.def(c.Def)
+	default:
+		p.unsupported(c)
+	}
+}
+
+// Return the word after the condition of an if, unless or test:
+// then in the Richards dialect, and do in the 1967 one.
+func (p *printer) then() string {
+	if p.dialect&token.Richards != 0 {
+		return p.word(token.THEN)
+	}
+	return p.word(token.DO)
+}
+
+// Print the command of a label or case, on the line of the label
+// unless it is itself labelled.
+func (p *printer) labelled(c ast.Cmd) {
+	switch c.(type) {
+	case nil:
+		return
+	case *ast.LabelCmd, *ast.CaseCmd:
+		p.print("\n", p.indent)
+	default:
+		p.print(" ")
+	}
+	p.cmd(c)
+}
+
+func (p *printer) singleDef(d ast.Def) {
+	switch d := d.(type) {
+	case *ast.SimpleDef:
+		for i, n := range d.Names.Names {
+			if i > 0 {
+				p.print(", ")
+			}
+			p.print(n.Val)
+		}
+		p.print(" = ")
+		p.exprList(d.Exprs)
+	case *ast.VecDef:
+		p.print(d.Name, " = ", p.word(token.VEC), " ")
+		p.expr(d.Expr)
+	case *ast.FuncDef:
+		p.print(d.Name, "(")
+		for i, n := range d.Params.Names {
+			if i > 0 {
+				p.print(", ")
+			}
+			p.print(n.Val)
+		}
+		p.print(") = ")
+		p.expr(d.Body)
+	case *ast.RoutineDef:
+		p.print(d.Name, "(")
+		for i, n := range d.Params.Names {
+			if i > 0 {
+				p.print(", ")
+			}
+			p.print(n.Val)
+		}
+		p.print(") ", p.word(token.BE), " ")
+		p.cmd(d.Body)
+	default:
+		p.unsupported(d)
+	}
+}
+
+func (p *printer) def(d ast.Def) {
+	defs := ast.Defs(d)
+	for i, d := range defs {
+		if i == 0 {
+			p.print(p.word(token.LET), " ")
+		} else {
+			p.print("\n")
+			p.leading(d.Pos(), p.indent)
+			p.print(p.indent, p.word(token.AND), " ")
+		}
+		p.singleDef(d)
+		p.line = lastLine(d)
+		var after token.Position
+		if i+1 < len(defs) {
+			after = defs[i+1].Pos()
+		}
+		p.trailing(p.line, after)
+	}
+}
+
+func (p *printer) program(prog *ast.Program) {
+	for _, g := range prog.Comments {
+		p.comments = append(p.comments, g.List...)
+	}
+
+	// Directives, declarations and definitions are kept apart in
+	// the tree, so merge them back into source order.
+	var nodes []ast.Node
+	for _, d := range prog.Directives {
+		nodes = append(nodes, d)
+	}
+	for _, d := range prog.Decls {
+		nodes = append(nodes, d)
+	}
+	for _, d := range prog.Defs {
+		nodes = append(nodes, d)
+	}
+	sort.SliceStable(nodes, func(i, j int) bool {
+		return nodes[i].Pos().Offset < nodes[j].Pos().Offset
+	})
+
+	for i, node := range nodes {
+		if i > 0 {
+			p.print("\n")
+		}
+		p.leading(node.Pos(), "")
+		switch node := node.(type) {
+		case *ast.Directive:
+			p.print(p.word(node.Key), " ", node.Name.Lit)
+			p.line = node.Pos().Line
+			p.trailing(p.line, token.Position{})
+		case ast.Decl:
+			p.decl(node)
+		case ast.Def:
+			p.def(node)
+		}
+		p.print("\n")
+	}
+	p.leading(token.Position{Offset: math.MaxInt32}, "")
+}
+
+// Print the program to w in canonical form, spelling its words as
+// the dialect does.
+func Fprint(w io.Writer, prog *ast.Program, dialect token.Dialect) error {
+	var p printer
+	p.dialect = dialect
+	p.program(prog)
+	if p.err != nil {
+		return p.err
+	}
+	_, err := w.Write(p.buf.Bytes())
+	return err
+}
+
+// Parse the source in the dialect and return it in canonical form.
+func Source(src []byte, dialect token.Dialect) ([]byte, error) {
+	var p parser.Parser
+	p.Dialect = dialect
+	p.Init(src)
+	prog := p.Parse()
+	if err := p.Errors.Err(); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := Fprint(&buf, prog, dialect); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,319 @@
+// Copyright 2015 Meador Inge.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package printer
+
+import (
+	"bytes"
+	"flag"
+	"github.com/meadori/bcpl-go/src/token"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update the golden files")
+
+var test_format_str = `global $(
+        COUNT: 200;
+        ALL = 13
+	fizz: 1234
+$)
+
+let	X, Y, Z = 1, 2, 3
+and	W, S = 4, 5
+and	V = vec 5
+manifest $(
+        N = 20000
+        PI: 314;
+	X = 1010
+$)
+global $( FOO = 42 $)
+`
+
+var test_format_expected = `global $(
+	COUNT: 200
+	ALL:   13
+	fizz:  1234
+$)
+
+let X, Y, Z = 1, 2, 3
+and W, S = 4, 5
+and V = vec 5
+
+manifest $(
+	N  = 20000
+	PI = 314
+	X  = 1010
+$)
+
+global $( FOO: 42 $)
+`
+
+func TestFormat(t *testing.T) {
+	out, err := Source([]byte(test_format_str), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != test_format_expected {
+		t.Errorf("got:\n%s\nexpected:\n%s", out, test_format_expected)
+	}
+}
+
+func TestIdempotent(t *testing.T) {
+	once, err := Source([]byte(test_format_str), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	twice, err := Source(once, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(once) != string(twice) {
+		t.Errorf("formatting is not idempotent:\n%s\nthen:\n%s", once, twice)
+	}
+}
+
+func TestSyntaxError(t *testing.T) {
+	if _, err := Source([]byte("global $( FOO 42 $)"), 0); err == nil {
+		t.Errorf("expected a syntax error")
+	}
+}
+
+var test_comments_str = `// The library globals.
+// See LIBHDR.
+global $( // first entry follows
+        COUNT: 200 // a counter
+	// the total
+        ALL = 13
+$)
+
+// Sizes.
+manifest $( N = 20000 $) // trailing
+
+let X = 1 // one
+// the vector
+and V = vec 5
+
+// Stray comment at the end.
+`
+
+var test_comments_expected = `// The library globals.
+// See LIBHDR.
+global $( // first entry follows
+	COUNT: 200 // a counter
+	// the total
+	ALL:   13
+$)
+
+// Sizes.
+manifest $( N = 20000 $) // trailing
+
+let X = 1 // one
+// the vector
+and V = vec 5
+
+// Stray comment at the end.
+`
+
+func TestComments(t *testing.T) {
+	out, err := Source([]byte(test_comments_str), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != test_comments_expected {
+		t.Errorf("got:\n%s\nexpected:\n%s", out, test_comments_expected)
+	}
+	again, err := Source(out, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(again) != string(out) {
+		t.Errorf("formatting is not idempotent:\n%s\nthen:\n%s", out, again)
+	}
+}
+
+var test_commands_str = `let Sum(V, N) = valof
+$( let s = 0
+   for i = 0 to N - 1 do s := s + V*[i]
+   resultis s
+$)
+let Fill(V, N) be
+$( let i = 0
+   while i < N do $( V*[i] := i; i := i + 1 $)
+   L: unless i = 0 do $( i := i - 1; goto L $)
+   switchon N into
+   $( case 1: return
+      default: finish
+   $)
+   test N > 1 do i := 1 or i := 2
+   i := i + 1 repeatuntil i > 10
+$)
+`
+
+var test_commands_expected = `let Sum(V, N) = valof $(
+	let s = 0
+	for i = 0 to N - 1 do s := s + V*[i]
+	resultis s
+$)
+
+let Fill(V, N) be $(
+	let i = 0
+	while i < N do $(
+		V*[i] := i
+		i := i + 1
+	$)
+	L: unless i = 0 do $(
+		i := i - 1
+		goto L
+	$)
+	switchon N into $(
+		case 1: return
+		default: finish
+	$)
+	test N > 1 do i := 1 or i := 2
+	i := i + 1 repeatuntil i > 10
+$)
+`
+
+func TestCommands(t *testing.T) {
+	out, err := Source([]byte(test_commands_str), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != test_commands_expected {
+		t.Errorf("got:\n%s\nexpected:\n%s", out, test_commands_expected)
+	}
+	again, err := Source(out, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(again) != string(out) {
+		t.Errorf("formatting is not idempotent:\n%s\nthen:\n%s", out, again)
+	}
+}
+
+var test_expr_str = `manifest $( N = 10 $)
+let	Fact(N) = N = 0 -> 1, N * Fact(N - 1)
+and	V = vec N + 1
+let	B = !true | false & A eqv (-X << 2) >= rv lv Y
+and	S = writes("hi*n") + V*[2] rem 3
+and	Nil() = 0
+`
+
+var test_expr_expected = `manifest $( N = 10 $)
+
+let Fact(N) = N = 0 -> 1, N * Fact(N - 1)
+and V = vec N + 1
+
+let B = !true | false & A eqv (-X << 2) >= rv lv Y
+and S = writes("hi*n") + V*[2] rem 3
+and Nil() = 0
+`
+
+func TestExpressions(t *testing.T) {
+	out, err := Source([]byte(test_expr_str), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != test_expr_expected {
+		t.Errorf("got:\n%s\nexpected:\n%s", out, test_expr_expected)
+	}
+}
+
+var test_richards_str = `SECTION "demo"
+LET Fact(n) = MATCH (n) : 0 => 1 : m => m * Fact(m-1) .
+AND G(v, i) = FLOAT v!i #+ FLOAT (v%i) MOD 2 #>= ?
+`
+
+var test_richards_expected = `SECTION "demo"
+
+LET Fact(n) = MATCH (n) : 0 => 1 : m => m * Fact(m - 1) .
+AND G(v, i) = FLOAT v!i #+ FLOAT (v % i) MOD 2 #>= ?
+`
+
+func TestRichards(t *testing.T) {
+	dialect := token.Richards | token.Upper
+	out, err := Source([]byte(test_richards_str), dialect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != test_richards_expected {
+		t.Errorf("got:\n%s\nexpected:\n%s", out, test_richards_expected)
+	}
+	if again, err := Source(out, dialect); err != nil || !bytes.Equal(again, out) {
+		t.Errorf("not idempotent: got %v\n%s", err, again)
+	}
+}
+
+// Sources in each dialect, formatted in the words of that dialect.
+var test_dialects = []struct {
+	dialect token.Dialect
+	src     string
+	out     string
+}{
+	{token.Upper, "LET f(x) BE TEST x = 0 DO f(1) OR FOR i = 1 TO x DO f(i)\n",
+		"LET f(x) BE TEST x = 0 DO f(1) OR FOR i = 1 TO x DO f(i)\n"},
+	{token.IgnoreCase, "Let F(X) = Valof Resultis X Rem 2\n",
+		"let f(x) = valof resultis x rem 2\n"},
+	{token.Richards, "LET f(v, i) BE TEST ~ v!(i+1) ~= i THEN f(v, @i!0) ELSE IF i THEN LOOP\n",
+		"let f(v, i) be test ~v!(i + 1) ~= i then f(v, lv i!0) else if i then loop\n"},
+	{token.Richards, "let f(v) = v*[1 xor 2] + (f(v))!v\n",
+		"let f(v) = v!(1 xor 2) + (f(v))!v\n"},
+}
+
+func TestDialects(t *testing.T) {
+	for _, test := range test_dialects {
+		out, err := Source([]byte(test.src), test.dialect)
+		if err != nil {
+			t.Errorf("%s: %v", test.src, err)
+			continue
+		}
+		if string(out) != test.out {
+			t.Errorf("%s: got\n%s\nexpected\n%s", test.src, out, test.out)
+		}
+		if again, err := Source(out, test.dialect); err != nil || !bytes.Equal(again, out) {
+			t.Errorf("%s: not idempotent: got %v\n%s", test.src, err, again)
+		}
+	}
+}
+
+// Format each testdata/name.input, comparing the result with
+// testdata/name.golden, and check that the golden file is already
+// formatted.
+func TestGolden(t *testing.T) {
+	inputs, err := filepath.Glob(filepath.Join("testdata", "*.input"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, input := range inputs {
+		src, err := ioutil.ReadFile(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := Source(src, 0)
+		if err != nil {
+			t.Errorf("%s: %v", input, err)
+			continue
+		}
+		golden := strings.TrimSuffix(input, ".input") + ".golden"
+		if *update {
+			if err := ioutil.WriteFile(golden, out, 0644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		expected, err := ioutil.ReadFile(golden)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out, expected) {
+			t.Errorf("%s differs:\ngot:\n%s\nexpected:\n%s", golden, out, expected)
+		}
+		if again, err := Source(expected, 0); err != nil || !bytes.Equal(again, expected) {
+			t.Errorf("%s is not idempotent: got %v:\n%s", golden, err, again)
+		}
+	}
+}
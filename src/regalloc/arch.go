@@ -0,0 +1,87 @@
+// Copyright 2015 Meador Inge.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package regalloc
+
+// A register of a machine.
+type Register struct {
+	Name        string
+	CalleeSaved bool // Whether a call leaves the register unchanged.
+}
+
+// The registers and frame layout of a machine.
+type Arch struct {
+	Name string
+	Regs []Register // The registers the allocator may use.
+
+	// The number of cells at the start of a BCPL frame holding the
+	// linkage of the call, before the parameters.
+	FrameHeader int
+}
+
+var AMD64 = &Arch{
+	Name: "amd64",
+	Regs: []Register{
+		{"rax", false},
+		{"rcx", false},
+		{"rdx", false},
+		{"rsi", false},
+		{"rdi", false},
+		{"r8", false},
+		{"r9", false},
+		{"r10", false},
+		{"r11", false},
+		{"rbx", true},
+		{"r12", true},
+		{"r13", true},
+		{"r14", true},
+		{"r15", true},
+	},
+	FrameHeader: 3,
+}
+
+var ARM64 = &Arch{
+	Name: "arm64",
+	Regs: []Register{
+		{"x0", false},
+		{"x1", false},
+		{"x2", false},
+		{"x3", false},
+		{"x4", false},
+		{"x5", false},
+		{"x6", false},
+		{"x7", false},
+		{"x9", false},
+		{"x10", false},
+		{"x11", false},
+		{"x12", false},
+		{"x13", false},
+		{"x14", false},
+		{"x15", false},
+		{"x19", true},
+		{"x20", true},
+		{"x21", true},
+		{"x22", true},
+		{"x23", true},
+		{"x24", true},
+		{"x25", true},
+		{"x26", true},
+		{"x27", true},
+		{"x28", true},
+	},
+	FrameHeader: 3,
+}
+
+// The machines known to the allocator.
+var Archs = []*Arch{AMD64, ARM64}
+
+// Lookup the machine with the given name, or nil if there is none.
+func LookupArch(name string) *Arch {
+	for _, a := range Archs {
+		if a.Name == name {
+			return a
+		}
+	}
+	return nil
+}
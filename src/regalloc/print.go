@@ -0,0 +1,60 @@
+// Copyright 2015 Meador Inge.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package regalloc
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// The dump of an allocation lists the frame of the function and the
+// registers it saves, then its blocks in the order they are laid
+// out, giving the location and live interval of each value:
+//
+//	func Fact(1) amd64 frame 6 spills 0
+//	saved rbx P!5
+//	b0:
+//		v0 = Param [0]	rbx [2,14]
+//		...
+//
+// A spilled value is in a cell of the frame, written like P!6.
+
+// Return the name of a location on a machine.
+func (loc Loc) Name(arch *Arch) string {
+	if loc.Reg >= 0 {
+		return arch.Regs[loc.Reg].Name
+	}
+	return fmt.Sprintf("P!%d", loc.Cell)
+}
+
+// Write the dump of an allocation.
+func (a *Allocation) Fprint(w io.Writer) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "func %s(%d) %s frame %d spills %d\n", a.Func.Name, a.Func.Params, a.Arch.Name, a.Frame, a.Spills)
+	for _, r := range a.Saved {
+		fmt.Fprintf(&buf, "saved %s P!%d\n", a.Arch.Regs[r].Name, a.SaveCell(r))
+	}
+	for _, b := range a.Blocks {
+		fmt.Fprintf(&buf, "%s:\n", b)
+		for _, v := range b.Values {
+			fmt.Fprintf(&buf, "\t%s", v.LongString())
+			if loc, ok := a.Locs[v]; ok {
+				iv := a.Live[v]
+				fmt.Fprintf(&buf, "\t%s [%d,%d]", loc.Name(a.Arch), iv.Start, iv.End)
+			}
+			buf.WriteByte('\n')
+		}
+		fmt.Fprintf(&buf, "\t%s\n", b.LongString())
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func (a *Allocation) String() string {
+	var buf bytes.Buffer
+	a.Fprint(&buf)
+	return buf.String()
+}
@@ -0,0 +1,309 @@
+// Copyright 2015 Meador Inge.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+// Package regalloc assigns registers to the values of functions in
+// the intermediate representation by linear scan.
+//
+// The blocks are laid out in reverse postorder and each value is
+// given a live interval, from its definition to its last use, taking
+// in the blocks it is live across.  The intervals are scanned in the
+// order they start.  A value live across a call may only be given a
+// register the call saves; other values prefer the registers a call
+// may change, which need not be saved on entry.  When no register is
+// free the value whose interval ends last is spilled to a cell of the
+// BCPL frame.
+//
+// The frame of a function holds the linkage of the call, the
+// parameters, the local cells of the function, the spill slots and
+// the cells the callee-saved registers it uses are saved in, in that
+// order.
+package regalloc
+
+import (
+	"github.com/meadori/bcpl-go/src/ir"
+	"sort"
+)
+
+// Where a value is kept: a register of the machine or a cell of the
+// frame.
+type Loc struct {
+	Reg  int // The index of the register in the machine's, or -1.
+	Cell int // The offset of the cell in the frame, or -1.
+}
+
+// The live interval of a value, between positions in the layout of
+// the function.
+type Interval struct {
+	Start, End int
+}
+
+// The allocation of a function.
+type Allocation struct {
+	Func   *ir.Func
+	Arch   *Arch
+	Blocks []*ir.Block // The blocks in the order they are laid out.
+	Locs   map[*ir.Value]Loc
+	Live   map[*ir.Value]Interval
+	Calls  []int // The positions of the calls.
+	Spills int   // The number of spill slots.
+	Saved  []int // The callee-saved registers used, saved on entry.
+	Frame  int   // The number of cells in the frame.
+}
+
+// Report whether a value needs a location.  A store has no result.
+func hasResult(v *ir.Value) bool {
+	return v.Op != ir.OpStore
+}
+
+// Lay out the blocks of a function and give each value its live
+// interval.  A block starts at an even position; each of its values
+// takes the next even position and its control transfer the one
+// after them.  The arguments of a phi are used at the end of the
+// corresponding predecessor.
+func liveness(a *Allocation) {
+	f := a.Func
+	a.Blocks = f.ReversePostorder()
+	start := make(map[*ir.Block]int)
+	end := make(map[*ir.Block]int)
+	pos := make(map[*ir.Value]int)
+	p := 0
+	for _, b := range a.Blocks {
+		start[b] = p
+		for _, v := range b.Values {
+			p += 2
+			pos[v] = p
+			if v.Op == ir.OpCall {
+				a.Calls = append(a.Calls, p)
+			}
+		}
+		p += 2
+		end[b] = p
+		p += 2
+	}
+
+	// The values live on entry to each block, found by iterating
+	// to a fixed point.
+	liveIn := make(map[*ir.Block]map[*ir.Value]bool)
+	liveOut := make(map[*ir.Block]map[*ir.Value]bool)
+	for _, b := range a.Blocks {
+		liveIn[b] = make(map[*ir.Value]bool)
+		liveOut[b] = make(map[*ir.Value]bool)
+	}
+	for changed := true; changed; {
+		changed = false
+		for i := len(a.Blocks) - 1; i >= 0; i-- {
+			b := a.Blocks[i]
+			out := liveOut[b]
+			for _, s := range b.Succs {
+				for v := range liveIn[s] {
+					if v.Block != s || v.Op != ir.OpPhi {
+						out[v] = true
+					}
+				}
+				for _, v := range s.Values {
+					if v.Op != ir.OpPhi {
+						continue
+					}
+					for j, pred := range s.Preds {
+						if pred == b {
+							out[v.Args[j]] = true
+						}
+					}
+				}
+			}
+			in := make(map[*ir.Value]bool)
+			for v := range out {
+				in[v] = true
+			}
+			if b.Control != nil {
+				in[b.Control] = true
+			}
+			for j := len(b.Values) - 1; j >= 0; j-- {
+				v := b.Values[j]
+				delete(in, v)
+				if v.Op == ir.OpPhi {
+					in[v] = true
+					continue
+				}
+				for _, arg := range v.Args {
+					in[arg] = true
+				}
+			}
+			if len(in) != len(liveIn[b]) {
+				changed = true
+			}
+			liveIn[b] = in
+		}
+	}
+
+	a.Live = make(map[*ir.Value]Interval)
+	extend := func(v *ir.Value, p int) {
+		iv, ok := a.Live[v]
+		switch {
+		case !ok:
+			iv = Interval{p, p}
+		case p < iv.Start:
+			iv.Start = p
+		case p > iv.End:
+			iv.End = p
+		}
+		a.Live[v] = iv
+	}
+	for _, b := range a.Blocks {
+		for v := range liveIn[b] {
+			if v.Block != b {
+				extend(v, start[b])
+			}
+		}
+		for v := range liveOut[b] {
+			extend(v, end[b])
+		}
+		for _, v := range b.Values {
+			if hasResult(v) {
+				extend(v, pos[v])
+			}
+			if v.Op == ir.OpPhi {
+				for j, arg := range v.Args {
+					extend(arg, end[b.Preds[j]])
+				}
+				continue
+			}
+			for _, arg := range v.Args {
+				extend(arg, pos[v])
+			}
+		}
+		if b.Control != nil {
+			extend(b.Control, end[b])
+		}
+	}
+}
+
+// Report whether an interval spans a call, so that the value must be
+// kept where the call leaves it unchanged.
+func (a *Allocation) acrossCall(iv Interval) bool {
+	i := sort.SearchInts(a.Calls, iv.Start+1)
+	return i < len(a.Calls) && a.Calls[i] < iv.End
+}
+
+// Allocate registers for the values of a function on a machine.
+func Allocate(f *ir.Func, arch *Arch) *Allocation {
+	a := &Allocation{Func: f, Arch: arch, Locs: make(map[*ir.Value]Loc)}
+	liveness(a)
+
+	var values []*ir.Value
+	for _, b := range a.Blocks {
+		for _, v := range b.Values {
+			if hasResult(v) {
+				values = append(values, v)
+			}
+		}
+	}
+	sort.SliceStable(values, func(i, j int) bool {
+		return a.Live[values[i]].Start < a.Live[values[j]].Start
+	})
+
+	free := make([]bool, len(arch.Regs))
+	for i := range free {
+		free[i] = true
+	}
+	used := make([]bool, len(arch.Regs))
+	var active []*ir.Value // Ordered by the end of their intervals.
+	spills := 0
+	spill := func(v *ir.Value) {
+		a.Locs[v] = Loc{-1, spills}
+		spills++
+	}
+	assign := func(v *ir.Value, reg int) {
+		a.Locs[v] = Loc{reg, -1}
+		free[reg], used[reg] = false, true
+		iv := a.Live[v]
+		i := sort.Search(len(active), func(i int) bool {
+			return a.Live[active[i]].End > iv.End
+		})
+		active = append(active, nil)
+		copy(active[i+1:], active[i:])
+		active[i] = v
+	}
+
+	for _, v := range values {
+		iv := a.Live[v]
+
+		// Free the registers of the intervals ended.  A value may
+		// take the register of an argument it is the last use of.
+		n := 0
+		for _, w := range active {
+			if a.Live[w].End <= iv.Start {
+				free[a.Locs[w].Reg] = true
+				continue
+			}
+			active[n] = w
+			n++
+		}
+		active = active[:n]
+
+		// A free register the value may use: one a call may change
+		// if there is one, unless the value is live across a call.
+		across := a.acrossCall(iv)
+		reg := -1
+		for i, r := range arch.Regs {
+			if !free[i] || across && !r.CalleeSaved {
+				continue
+			}
+			if reg < 0 || arch.Regs[reg].CalleeSaved && !r.CalleeSaved {
+				reg = i
+			}
+		}
+		if reg >= 0 {
+			assign(v, reg)
+			continue
+		}
+
+		// Spill the active value the value could replace whose
+		// interval ends last, or the value itself.
+		victim := -1
+		for i := len(active) - 1; i >= 0; i-- {
+			if r := a.Locs[active[i]].Reg; !across || arch.Regs[r].CalleeSaved {
+				victim = i
+				break
+			}
+		}
+		if victim < 0 || a.Live[active[victim]].End <= iv.End {
+			spill(v)
+			continue
+		}
+		w := active[victim]
+		reg = a.Locs[w].Reg
+		active = append(active[:victim], active[victim+1:]...)
+		spill(w)
+		free[reg] = true
+		assign(v, reg)
+	}
+
+	// Place the spill slots and the saved registers after the local
+	// cells in the frame.
+	base := arch.FrameHeader + f.Params + f.Locals
+	for v, loc := range a.Locs {
+		if loc.Reg < 0 {
+			a.Locs[v] = Loc{-1, base + loc.Cell}
+		}
+	}
+	a.Spills = spills
+	for i, r := range arch.Regs {
+		if used[i] && r.CalleeSaved {
+			a.Saved = append(a.Saved, i)
+		}
+	}
+	a.Frame = base + spills + len(a.Saved)
+	return a
+}
+
+// Return the frame cell a callee-saved register is saved in.
+func (a *Allocation) SaveCell(reg int) int {
+	for i, r := range a.Saved {
+		if r == reg {
+			return a.Frame - len(a.Saved) + i
+		}
+	}
+	return -1
+}
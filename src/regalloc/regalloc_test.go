@@ -0,0 +1,194 @@
+// Copyright 2015 Meador Inge.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package regalloc
+
+import (
+	"github.com/meadori/bcpl-go/src/ir"
+	"github.com/meadori/bcpl-go/src/opt"
+	"github.com/meadori/bcpl-go/src/parser"
+	"github.com/meadori/bcpl-go/src/runtime"
+	"github.com/meadori/bcpl-go/src/token"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func newTestModule(t *testing.T, src string) *ir.Module {
+	var p parser.Parser
+	p.Dialect = token.Richards
+	p.Init([]byte(src))
+	prog := p.Parse()
+	if len(p.Errors) > 0 {
+		t.Fatal(p.Errors)
+	}
+	m, err := ir.Build(prog, runtime.Target{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// A machine with few registers, so that values are spilled.
+var test_tiny = &Arch{
+	Name: "tiny",
+	Regs: []Register{
+		{"r0", false},
+		{"r1", false},
+		{"s0", true},
+	},
+	FrameHeader: 2,
+}
+
+var test_allocate_str = `let Fact(N) = N = 0 -> 1, N * Fact(N - 1)
+let Poly(A, B, C) = (A + B) * (B + C) * (C + A) + (A - B) * (B - C)
+let Calls(X, Y) = Fact(X) + Fact(Y) + X * Y
+let Id(X) = X
+`
+
+// Check that an allocation is valid: values live at the same time are
+// not in the same register, values live across a call are kept where
+// the call leaves them, the callee-saved registers used are saved and
+// the spill slots are distinct cells of the frame after the locals.
+func checkAllocation(t *testing.T, a *Allocation) {
+	f, arch := a.Func, a.Arch
+	base := arch.FrameHeader + f.Params + f.Locals
+	saved := make(map[int]bool)
+	for _, r := range a.Saved {
+		saved[r] = true
+	}
+	cells := make(map[int]*ir.Value)
+	var regs []*ir.Value
+	for v, loc := range a.Locs {
+		iv := a.Live[v]
+		if loc.Reg < 0 {
+			if loc.Cell < base || loc.Cell >= base+a.Spills {
+				t.Errorf("%s: %s spilled to P!%d outside the spill slots", f.Name, v, loc.Cell)
+			}
+			if w := cells[loc.Cell]; w != nil {
+				t.Errorf("%s: %s and %s spilled to P!%d", f.Name, v, w, loc.Cell)
+			}
+			cells[loc.Cell] = v
+			continue
+		}
+		r := arch.Regs[loc.Reg]
+		if r.CalleeSaved && !saved[loc.Reg] {
+			t.Errorf("%s: %s is not saved", f.Name, r.Name)
+		}
+		if !r.CalleeSaved && a.acrossCall(iv) {
+			t.Errorf("%s: %s is in %s across a call", f.Name, v, r.Name)
+		}
+		regs = append(regs, v)
+	}
+	for i, v := range regs {
+		for _, w := range regs[:i] {
+			if a.Locs[v].Reg != a.Locs[w].Reg {
+				continue
+			}
+			x, y := a.Live[v], a.Live[w]
+			if x.Start < y.End && y.Start < x.End {
+				t.Errorf("%s: %s %v and %s %v are both in %s", f.Name, v, x, w, y, arch.Regs[a.Locs[v].Reg].Name)
+			}
+		}
+	}
+	if a.Frame != base+a.Spills+len(a.Saved) {
+		t.Errorf("%s: frame %d, expected %d", f.Name, a.Frame, base+a.Spills+len(a.Saved))
+	}
+}
+
+func TestAllocate(t *testing.T) {
+	m := newTestModule(t, test_allocate_str)
+	for _, arch := range append(Archs, test_tiny) {
+		for _, f := range append([]*ir.Func{m.Init}, m.Funcs...) {
+			checkAllocation(t, Allocate(f, arch))
+		}
+	}
+}
+
+func TestSpill(t *testing.T) {
+	m := newTestModule(t, test_allocate_str)
+	if a := Allocate(m.Func("Poly"), AMD64); a.Spills != 0 {
+		t.Errorf("got %d spills on amd64, expected none", a.Spills)
+	}
+	a := Allocate(m.Func("Poly"), test_tiny)
+	if a.Spills == 0 {
+		t.Fatal("got no spills on tiny")
+	}
+	if base := test_tiny.FrameHeader + 3; a.Frame < base+a.Spills {
+		t.Errorf("got frame %d, expected at least %d", a.Frame, base+a.Spills)
+	}
+}
+
+func TestDump(t *testing.T) {
+	m := newTestModule(t, test_allocate_str)
+	if err := opt.Optimize(m, opt.Options{Level: opt.MaxLevel}); err != nil {
+		t.Fatal(err)
+	}
+	expected := `func Fact(1) amd64 frame 5 spills 0
+saved rbx P!4
+b0:
+	v0 = Param [0]	rbx [2,20]
+	v1 = Const [0]	rax [4,6]
+	v2 = Eq v0 v1	rax [6,8]
+	If v2 -> b1 b2
+b2:
+	v4 = Func {Fact}	rax [12,18]
+	v5 = Const [1]	rcx [14,16]
+	v6 = Sub v0 v5	rcx [16,18]
+	v7 = Call v4 v6	rax [18,20]
+	v8 = Mul v0 v7	rax [20,22]
+	Return v8
+b1:
+	v3 = Const [1]	rax [26,28]
+	Return v3
+`
+	if a := Allocate(m.Func("Fact"), AMD64); a.String() != expected {
+		t.Errorf("got\n%s\nexpected\n%s", a, expected)
+	}
+	expected = `func Id(1) tiny frame 3 spills 0
+b0:
+	v0 = Param [0]	r0 [2,4]
+	Return v0
+`
+	if a := Allocate(m.Func("Id"), test_tiny); a.String() != expected {
+		t.Errorf("got\n%s\nexpected\n%s", a, expected)
+	}
+}
+
+func TestLookupArch(t *testing.T) {
+	for _, arch := range Archs {
+		if LookupArch(arch.Name) != arch {
+			t.Errorf("%s not found", arch.Name)
+		}
+	}
+	if LookupArch("vax") != nil {
+		t.Errorf("vax found")
+	}
+}
+
+func TestAllocateTestdata(t *testing.T) {
+	files, _ := filepath.Glob("../../testdata/*.b")
+	for _, file := range files {
+		src, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		prog, err := parser.ParseProgram(src)
+		if err != nil {
+			continue
+		}
+		m, err := ir.Build(prog, runtime.Target{})
+		if err != nil {
+			t.Fatalf("%s: %v", file, err)
+		}
+		if err := opt.Optimize(m, opt.Options{Level: opt.MaxLevel}); err != nil {
+			t.Fatalf("%s: %v", file, err)
+		}
+		for _, arch := range append(Archs, test_tiny) {
+			for _, f := range append([]*ir.Func{m.Init}, m.Funcs...) {
+				checkAllocation(t, Allocate(f, arch))
+			}
+		}
+	}
+}
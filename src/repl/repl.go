@@ -0,0 +1,155 @@
+// Copyright 2015 Meador Inge.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+// Package repl implements an interactive read-eval-print loop.
+//
+// Input is read a line at a time until it forms a complete
+// declaration, definition or expression, as decided by the scanner's
+// semicolon and do insertion rules: an input is complete when its
+// brackets balance and a newline after its last token could end a
+// command.  A blank line ends an input early.  Declarations and
+// definitions are added to a persistent interpreter; the value of
+// each expression is printed.
+package repl
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/meadori/bcpl-go/src/interp"
+	"github.com/meadori/bcpl-go/src/parser"
+	"github.com/meadori/bcpl-go/src/runtime"
+	"github.com/meadori/bcpl-go/src/scanner"
+	"github.com/meadori/bcpl-go/src/token"
+	"io"
+	"strings"
+)
+
+const (
+	Prompt     = "> "   // The prompt for a new input.
+	MorePrompt = "... " // The prompt for the rest of an input.
+)
+
+type REPL struct {
+	Target  runtime.Target // The target machine, used by Init.
+	Dialect token.Dialect  // The dialect of the input.
+	in      *bufio.Reader  // The input, shared with the interpreted program.
+	out     io.Writer      // The output.
+	interp  interp.Interp  // The interpreter holding the definitions so far.
+}
+
+func (r *REPL) Init(in io.Reader, out io.Writer) {
+	r.in = bufio.NewReader(in)
+	r.out = out
+	r.interp.Target = r.Target
+	r.interp.Init(r.in, out)
+}
+
+// Report whether src, in the given dialect, is a complete input.
+func Complete(src []byte, dialect token.Dialect) bool {
+	var s scanner.Scanner
+	s.Init(src)
+	s.Dialect = dialect
+	depth, empty := 0, true
+	for {
+		canEnd := s.CanEnd()
+		tok := s.Next()
+		switch tok.Kind {
+		case token.EOF:
+			return empty || depth <= 0 && canEnd
+		case token.ILLEGAL:
+			// An unterminated string may go on in the next line;
+			// let the parser report anything else.
+			return !strings.HasPrefix(tok.Lit, "\"")
+		case token.COMMENT:
+			continue
+		case token.RBRA, token.SBRA, token.SECTBRA:
+			depth++
+		case token.RKET, token.SKET, token.SECTKET:
+			depth--
+		}
+		empty = false
+	}
+}
+
+// Report whether src starts with a declaration or definition
+// rather than an expression.
+func isDefinition(src []byte, dialect token.Dialect) bool {
+	var s scanner.Scanner
+	s.Init(src)
+	s.Mode = 0
+	s.Dialect = dialect
+	switch s.Next().Kind {
+	case token.LET, token.GLOBAL, token.MANIFEST, token.STATIC, token.SECTION, token.NEEDS:
+		return true
+	}
+	return false
+}
+
+// Evaluate a complete input.
+func (r *REPL) eval(src []byte) error {
+	var p parser.Parser
+	p.Dialect = r.Dialect
+	p.Init(src)
+	if isDefinition(src, r.Dialect) {
+		prog := p.Parse()
+		if err := p.Errors.Err(); err != nil {
+			return err
+		}
+		return r.interp.Load(prog)
+	}
+
+	e, err := p.ParseExpr()
+	if err != nil {
+		return err
+	}
+	val, err := r.interp.Eval(e)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(r.out, val)
+	return err
+}
+
+// Read and evaluate inputs until the end of the input, reporting
+// the errors in each input and carrying on.
+func (r *REPL) Run() error {
+	var input []byte
+	for {
+		prompt := Prompt
+		if input != nil {
+			prompt = MorePrompt
+		}
+		if _, err := io.WriteString(r.out, prompt); err != nil {
+			return err
+		}
+
+		line, err := r.in.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		atEOF := err == io.EOF
+		if atEOF && line != "" {
+			// A comment is only ended by a newline.
+			line += "\n"
+		}
+		blank := strings.TrimSpace(line) == ""
+		if !blank || atEOF {
+			input = append(input, line...)
+		}
+
+		if input != nil && (blank || atEOF || Complete(input, r.Dialect)) {
+			if len(bytes.TrimSpace(input)) > 0 {
+				if err := r.eval(input); err != nil {
+					fmt.Fprintln(r.out, err)
+				}
+			}
+			input = nil
+		}
+		if atEOF {
+			_, err := io.WriteString(r.out, "\n")
+			return err
+		}
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright 2015 Meador Inge.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package repl
+
+import (
+	"bytes"
+	"github.com/meadori/bcpl-go/src/token"
+	"strings"
+	"testing"
+)
+
+var test_complete = []struct {
+	src      string
+	complete bool
+}{
+	{"", true},
+	{"// just a comment\n", true},
+	{"1 + 2\n", true},
+	{"1 +\n", false},
+	{"let F(A) =\n", false},
+	{"let F(A) =\n  A + 1\n", true},
+	{"writef(\"%n\",\n", false},
+	{"global $(\n  F: 100\n", false},
+	{"global $(\n  F: 100\n$)\n", true},
+	{"writes(\"abc\n", false},
+	{"X )\n", true},
+}
+
+func TestComplete(t *testing.T) {
+	for _, test := range test_complete {
+		if complete := Complete([]byte(test.src), 0); complete != test.complete {
+			t.Errorf("Complete(%q): got %v, expected %v", test.src, complete, test.complete)
+		}
+	}
+}
+
+var test_session_in = `global $( F: 100 $)
+manifest $( N = 5 $)
+let F(A) =
+  A = 0 -> 1,
+  A * F(A - 1)
+F(N)
+let V = vec N
+V*[2] + 1
+writes("hi*n")
+Y
+
+let Y = 1 +
+
+1 / 0
+rv 100 = F
+static $( S = 7 $)
+S + 1
+`
+
+var test_session_out = `> > > ... ... > 120
+> > 1
+> hi
+0
+> 1:1: error: undeclared name Y
+> > ... 2:1: error: expected expression found ''.
+> 1:3: error: division by zero
+> -1
+> > 8
+> 
+`
+
+func TestSession(t *testing.T) {
+	var r REPL
+	var out bytes.Buffer
+	r.Init(strings.NewReader(test_session_in), &out)
+	if err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != test_session_out {
+		t.Errorf("got session:\n%s\nexpected:\n%s", out.String(), test_session_out)
+	}
+}
+
+func TestDialect(t *testing.T) {
+	var r REPL
+	var out bytes.Buffer
+	r.Dialect = token.Richards | token.Upper
+	r.Init(strings.NewReader("SECTION \"demo\"\nMANIFEST { N = 5 }\nLET V = VEC N\nV!0 + #X10 + N\n"), &out)
+	if err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "> > > > 21\n> \n"; out.String() != expected {
+		t.Errorf("got session:\n%s\nexpected:\n%s", out.String(), expected)
+	}
+}
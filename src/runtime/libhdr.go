@@ -0,0 +1,244 @@
+// Copyright 2015 Meador Inge.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package runtime
+
+import (
+	_ "embed"
+	"io"
+	"strconv"
+)
+
+// The text of the LIBHDR header declaring the global
+// numbers of the library routines.
+//
+//go:embed LIBHDR
+var Header string
+
+// The global number of start, the routine called to run a program.
+const StartGlobal = 1
+
+// The global number of stop, the routine finish calls.
+const StopGlobal = 2
+
+// A library routine and its global number.
+type Global struct {
+	Name   string
+	Number int
+	Fn     Routine
+}
+
+// The library routines, in the order declared in LIBHDR.
+var Library = []Global{
+	{"stop", 2, stop},
+	{"level", 3, level},
+	{"longjump", 4, longjump},
+	{"aptovec", 5, aptovec},
+	{"getvec", 6, getvec},
+	{"freevec", 7, freevec},
+	{"rdch", 8, rdch},
+	{"wrch", 9, wrch},
+	{"readn", 10, readn},
+	{"writes", 11, writes},
+	{"writen", 12, writen},
+	{"writef", 13, writef},
+	{"newline", 14, newline},
+	{"newpage", 15, newpage},
+	{"packstring", 16, packstring},
+	{"unpackstring", 17, unpackstring},
+}
+
+// Return argument i, or zero if it was not supplied.
+func arg(args []Word, i int) Word {
+	if i < len(args) {
+		return args[i]
+	}
+	return 0
+}
+
+func stop(rt *Runtime, args []Word) Word {
+	panic(&Exit{arg(args, 0)})
+}
+
+func level(rt *Runtime, args []Word) Word {
+	// The level of the caller, not of this routine.
+	return rt.level - 1
+}
+
+func longjump(rt *Runtime, args []Word) Word {
+	panic(&LongJump{arg(args, 0), arg(args, 1)})
+}
+
+func aptovec(rt *Runtime, args []Word) Word {
+	f, n := arg(args, 0), arg(args, 1)
+	v := rt.Store.GetVec(n)
+	if v == 0 {
+		panic(&Fault{0})
+	}
+	defer rt.Store.FreeVec(v)
+	return rt.Call(f, v, n)
+}
+
+func getvec(rt *Runtime, args []Word) Word {
+	return rt.Store.GetVec(arg(args, 0))
+}
+
+func freevec(rt *Runtime, args []Word) Word {
+	if err := rt.Store.FreeVec(arg(args, 0)); err != nil {
+		panic(err)
+	}
+	return 0
+}
+
+func rdch(rt *Runtime, args []Word) Word {
+	rt.Flush()
+	ch, err := rt.in.ReadByte()
+	if err == io.EOF {
+		return EndStreamCh
+	}
+	return Word(ch)
+}
+
+func wrch(rt *Runtime, args []Word) Word {
+	rt.out.WriteByte(byte(arg(args, 0)))
+	return 0
+}
+
+func readn(rt *Runtime, args []Word) Word {
+	ch := rdch(rt, nil)
+	for ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r' {
+		ch = rdch(rt, nil)
+	}
+	neg := false
+	if ch == '-' || ch == '+' {
+		neg = ch == '-'
+		ch = rdch(rt, nil)
+	}
+	var n Word
+	for '0' <= ch && ch <= '9' {
+		n = n*10 + ch - '0'
+		ch = rdch(rt, nil)
+	}
+	if neg {
+		n = -n
+	}
+	return rt.Target.Wrap(n)
+}
+
+func writes(rt *Runtime, args []Word) Word {
+	rt.out.WriteString(rt.String(arg(args, 0)))
+	return 0
+}
+
+func writen(rt *Runtime, args []Word) Word {
+	rt.out.WriteString(strconv.FormatInt(int64(arg(args, 0)), 10))
+	return 0
+}
+
+func newline(rt *Runtime, args []Word) Word {
+	rt.out.WriteByte('\n')
+	return 0
+}
+
+func newpage(rt *Runtime, args []Word) Word {
+	rt.out.WriteByte('\f')
+	return 0
+}
+
+// Write n in the given base.  If digits is non-zero exactly that many
+// low-order digits of n, taken as unsigned, are written.
+func writeBase(rt *Runtime, n Word, base uint, digits int) {
+	u := rt.Target.Unsigned(n)
+	str := strconv.FormatUint(u, int(base))
+	if digits > 0 {
+		for len(str) < digits {
+			str = "0" + str
+		}
+		str = str[len(str)-digits:]
+	}
+	if base == 16 {
+		for i := 0; i < len(str); i++ {
+			if 'a' <= str[i] && str[i] <= 'f' {
+				str = str[:i] + string(str[i]-'a'+'A') + str[i+1:]
+			}
+		}
+	}
+	rt.out.WriteString(str)
+}
+
+// Write n in decimal, right justified in a field of the given width.
+func writeWidth(rt *Runtime, n Word, width int) {
+	str := strconv.FormatInt(int64(n), 10)
+	for i := len(str); i < width; i++ {
+		rt.out.WriteByte(' ')
+	}
+	rt.out.WriteString(str)
+}
+
+func writef(rt *Runtime, args []Word) Word {
+	format := rt.String(arg(args, 0))
+	next := 1
+	nextArg := func() Word {
+		a := arg(args, next)
+		next++
+		return a
+	}
+
+	for i := 0; i < len(format); i++ {
+		ch := format[i]
+		if ch != '%' || i+1 == len(format) {
+			rt.out.WriteByte(ch)
+			continue
+		}
+		i++
+		switch format[i] {
+		case 'S', 's':
+			writes(rt, []Word{nextArg()})
+		case 'C', 'c':
+			wrch(rt, []Word{nextArg()})
+		case 'N', 'n':
+			writen(rt, []Word{nextArg()})
+		case 'I', 'i', 'O', 'o', 'X', 'x':
+			kind, width := format[i], 0
+			if i+1 < len(format) && '0' <= format[i+1] && format[i+1] <= '9' {
+				i++
+				width = int(format[i] - '0')
+			}
+			switch kind {
+			case 'I', 'i':
+				writeWidth(rt, nextArg(), width)
+			case 'O', 'o':
+				writeBase(rt, nextArg(), 8, width)
+			default:
+				writeBase(rt, nextArg(), 16, width)
+			}
+		default:
+			rt.out.WriteByte(format[i])
+		}
+	}
+	return 0
+}
+
+// Pack the characters v!0 to v!n, where n is v!0, into the string s
+// and return the subscript of the last word of s used.
+func packstring(rt *Runtime, args []Word) Word {
+	v, s := arg(args, 0), arg(args, 1)
+	n := rt.Store.Load(v) & rt.Target.MaxChar()
+	size := n / rt.Target.BytesPerWord()
+	rt.Store.Put(s+size, 0)
+	for i := Word(0); i <= n; i++ {
+		rt.PutByte(s, i, rt.Store.Load(v+i))
+	}
+	return size
+}
+
+// Unpack the string s into v!0 to v!n, where n is its length.
+func unpackstring(rt *Runtime, args []Word) Word {
+	s, v := arg(args, 0), arg(args, 1)
+	n := rt.GetByte(s, 0)
+	for i := Word(0); i <= n; i++ {
+		rt.Store.Put(v+i, rt.GetByte(s, i))
+	}
+	return 0
+}
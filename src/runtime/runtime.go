@@ -0,0 +1,217 @@
+// Copyright 2015 Meador Inge.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+// Package runtime implements the BCPL standard library routines
+// declared in LIBHDR against a word-addressed store.
+package runtime
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+const (
+	StoreSize   = 1 << 18 // The default number of words in the store.
+	NumGlobals  = 1000    // The default size of the global vector.
+	EndStreamCh = -1      // The value returned by rdch at end of stream.
+)
+
+// A routine callable from BCPL code.  The arguments are the actual
+// parameters of the call; missing parameters read as zero.
+type Routine func(rt *Runtime, args []Word) Word
+
+type Runtime struct {
+	Target   Target           // The target machine, used by Init.
+	Store    *Store           // The store holding globals and vectors.
+	in       *bufio.Reader    // The current input stream.
+	out      *bufio.Writer    // The current output stream.
+	routines map[Word]Routine // Routines by entry address.
+	level    Word             // The current activation level.
+}
+
+// An access to an address outside of the store or a call of
+// a word that is not the entry address of a routine.
+type Fault struct {
+	Addr Word
+}
+
+func (f *Fault) Error() string {
+	return fmt.Sprintf("fault: bad address %d", f.Addr)
+}
+
+// A call of FreeVec with a word that is not the address of a vector
+// allocated by GetVec and not yet freed.
+type FreeError struct {
+	Addr Word
+	Msg  string
+}
+
+func (e *FreeError) Error() string {
+	return fmt.Sprintf("freevec of %d: %s", e.Addr, e.Msg)
+}
+
+// The program called stop.
+type Exit struct {
+	Code Word
+}
+
+func (e *Exit) Error() string {
+	return fmt.Sprintf("stop(%d)", e.Code)
+}
+
+// A longjump to a label of the activation at a level, raised with
+// panic.  It unwinds the calls made by the activation, whose routine
+// must recover it and resume at the label.  A longjump that no
+// routine recovers is an error.
+type LongJump struct {
+	Level Word
+	Label Word
+}
+
+func (j *LongJump) Error() string {
+	return fmt.Sprintf("longjump to bad level %d", j.Level)
+}
+
+// Initialize the runtime with a fresh store and install the
+// library routines in the global vector.  The zero Target is
+// replaced by DefaultTarget, and the store is made no larger than
+// the positive addresses of the target.
+func (rt *Runtime) Init(in io.Reader, out io.Writer) {
+	if rt.Target.WordBits == 0 {
+		rt.Target = DefaultTarget
+	}
+	size := StoreSize
+	if bits := uint(rt.Target.WordBits - 1); bits < 32 && 1<<bits < size {
+		size = 1 << bits
+	}
+	rt.Store = NewStore(size, NumGlobals)
+	rt.Store.Put(0, NumGlobals)
+	rt.in = bufio.NewReader(in)
+	rt.out = bufio.NewWriter(out)
+	rt.routines = make(map[Word]Routine)
+	rt.level = 0
+	for _, g := range Library {
+		rt.SetGlobal(g.Number, rt.Define(g.Fn))
+	}
+}
+
+// Return the value of global n.
+func (rt *Runtime) Global(n int) Word {
+	return rt.Store.Load(Word(n))
+}
+
+// Set the value of global n.
+func (rt *Runtime) SetGlobal(n int, val Word) {
+	rt.Store.Put(Word(n), val)
+}
+
+// Give a routine an entry address so it can be stored in
+// a word and later called.
+func (rt *Runtime) Define(r Routine) Word {
+	entry := rt.Store.GetVec(0)
+	if entry == 0 {
+		panic(&Fault{0})
+	}
+	rt.routines[entry] = r
+	return entry
+}
+
+// Call the routine with the given entry address.
+func (rt *Runtime) Call(f Word, args ...Word) Word {
+	r, ok := rt.routines[f]
+	if !ok {
+		panic(&Fault{f})
+	}
+
+	rt.level++
+	defer func(level Word) {
+		rt.level = level
+	}(rt.level - 1)
+	return r(rt, args)
+}
+
+// Return the activation level of the routine running, which is zero
+// outside any call.
+func (rt *Runtime) Level() Word {
+	return rt.level
+}
+
+// Run a routine to completion, turning a call of stop or a fault
+// into an error.  Any buffered output is flushed.
+func (rt *Runtime) Run(f Word, args ...Word) (Word, error) {
+	return rt.Protect(func() Word {
+		return rt.Call(f, args...)
+	})
+}
+
+// Evaluate fn as Run runs a routine, for the callers of routines
+// that are not themselves routines.
+func (rt *Runtime) Protect(fn func() Word) (res Word, err error) {
+	defer func() {
+		rt.Flush()
+		if x := recover(); x != nil {
+			switch e := x.(type) {
+			case *Exit:
+				err = e
+			case *Fault:
+				err = e
+			case *FreeError:
+				err = e
+			case *LongJump:
+				err = e
+			default:
+				panic(x)
+			}
+		}
+	}()
+	return fn(), nil
+}
+
+// Flush any buffered output.
+func (rt *Runtime) Flush() {
+	rt.out.Flush()
+}
+
+// Return byte i of the string at address s.
+func (rt *Runtime) GetByte(s, i Word) Word {
+	t := rt.Target
+	w := t.Unsigned(rt.Store.Load(s + i/t.BytesPerWord()))
+	return Word(w>>t.charShift(i)) & t.MaxChar()
+}
+
+// Set byte i of the string at address s.
+func (rt *Runtime) PutByte(s, i, b Word) {
+	t := rt.Target
+	addr := s + i/t.BytesPerWord()
+	shift := t.charShift(i)
+	w := Word(t.Unsigned(rt.Store.Load(addr))) &^ (t.MaxChar() << shift)
+	rt.Store.Put(addr, t.Wrap(w|(b&t.MaxChar())<<shift))
+}
+
+// Return the Go string for the BCPL string at address s.
+func (rt *Runtime) String(s Word) string {
+	n := rt.GetByte(s, 0)
+	buf := make([]byte, n)
+	for i := range buf {
+		buf[i] = byte(rt.GetByte(s, Word(i+1)))
+	}
+	return string(buf)
+}
+
+// Allocate a BCPL string holding str and return its address.
+func (rt *Runtime) NewString(str string) Word {
+	if max := int(rt.Target.MaxChar()); len(str) > max {
+		str = str[:max]
+	}
+	s := rt.Store.GetVec(Word(len(str)) / rt.Target.BytesPerWord())
+	if s == 0 {
+		panic(&Fault{0})
+	}
+	rt.PutByte(s, 0, Word(len(str)))
+	for i := 0; i < len(str); i++ {
+		rt.PutByte(s, Word(i+1), Word(str[i]))
+	}
+	return s
+}
@@ -0,0 +1,311 @@
+// Copyright 2015 Meador Inge.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package runtime
+
+import (
+	"bytes"
+	"github.com/meadori/bcpl-go/src/parser"
+	"strings"
+	"testing"
+)
+
+// Helper test functions.
+
+func newTestRuntime(input string) (*Runtime, *bytes.Buffer) {
+	var rt Runtime
+	var out bytes.Buffer
+	rt.Init(strings.NewReader(input), &out)
+	return &rt, &out
+}
+
+func callGlobal(rt *Runtime, name string, args ...Word) Word {
+	for _, g := range Library {
+		if g.Name == name {
+			return rt.Call(rt.Global(g.Number), args...)
+		}
+	}
+	panic("no such routine: " + name)
+}
+
+func TestHeader(t *testing.T) {
+	var p parser.Parser
+	p.Init([]byte(Header))
+	m := p.Parse()
+
+	numbers := make(map[string]int)
+	for _, decl := range m.Decls {
+		for _, d := range decl.VarDecls() {
+			numbers[d.Name] = d.Constant
+		}
+	}
+
+	if numbers["start"] != StartGlobal {
+		t.Errorf("start is global %d, expected %d", numbers["start"], StartGlobal)
+	}
+	for _, g := range Library {
+		if n, ok := numbers[g.Name]; !ok || n != g.Number {
+			t.Errorf("LIBHDR declares '%s' as %d, expected %d", g.Name, n, g.Number)
+		}
+	}
+	if len(numbers) != len(Library)+1 {
+		t.Errorf("LIBHDR declares %d globals, expected %d", len(numbers), len(Library)+1)
+	}
+}
+
+var test_writef = []struct {
+	format string
+	args   []Word
+	output string
+}{
+	{"plain", nil, "plain"},
+	{"%n and %N", []Word{42, -7}, "42 and -7"},
+	{"[%c]", []Word{'x'}, "[x]"},
+	{"%o %O4", []Word{8, 8}, "10 0010"},
+	{"%x %X2", []Word{255, 0x1ab}, "FF AB"},
+	{"%I4|", []Word{12}, "  12|"},
+	{"100%%", nil, "100%"},
+}
+
+func TestWritef(t *testing.T) {
+	for _, test := range test_writef {
+		rt, out := newTestRuntime("")
+		args := append([]Word{rt.NewString(test.format)}, test.args...)
+		callGlobal(rt, "writef", args...)
+		rt.Flush()
+		if out.String() != test.output {
+			t.Errorf("writef(%q): got %q, expected %q", test.format, out.String(), test.output)
+		}
+	}
+}
+
+func TestWritefString(t *testing.T) {
+	rt, out := newTestRuntime("")
+	callGlobal(rt, "writef", rt.NewString("Hello, %s!"), rt.NewString("World"))
+	callGlobal(rt, "newline")
+	rt.Flush()
+	if out.String() != "Hello, World!\n" {
+		t.Errorf("got %q", out.String())
+	}
+}
+
+func TestReadn(t *testing.T) {
+	rt, _ := newTestRuntime("  123\n-45 x")
+	if n := callGlobal(rt, "readn"); n != 123 {
+		t.Errorf("readn: got %d, expected 123", n)
+	}
+	if n := callGlobal(rt, "readn"); n != -45 {
+		t.Errorf("readn: got %d, expected -45", n)
+	}
+	if ch := callGlobal(rt, "rdch"); ch != 'x' {
+		t.Errorf("rdch: got %d, expected 'x'", ch)
+	}
+	if ch := callGlobal(rt, "rdch"); ch != EndStreamCh {
+		t.Errorf("rdch: got %d, expected end of stream", ch)
+	}
+}
+
+func TestGetVec(t *testing.T) {
+	rt, _ := newTestRuntime("")
+	v := callGlobal(rt, "getvec", 10)
+	w := callGlobal(rt, "getvec", 10)
+	if v == 0 || w == 0 || v == w {
+		t.Fatalf("getvec: got %d and %d", v, w)
+	}
+	rt.Store.Put(v+10, 99)
+	callGlobal(rt, "freevec", v)
+	if u := callGlobal(rt, "getvec", 10); u != v {
+		t.Errorf("getvec did not reuse freed vector: got %d, expected %d", u, v)
+	} else if rt.Store.Load(u+10) != 0 {
+		t.Errorf("getvec returned a vector that was not cleared")
+	}
+	if huge := callGlobal(rt, "getvec", StoreSize); huge != 0 {
+		t.Errorf("getvec of too large a vector: got %d, expected 0", huge)
+	}
+}
+
+var test_freevec = []struct {
+	addr func(v, w Word) Word
+	msg  string
+}{
+	{func(v, w Word) Word { return v }, "already free"},
+	{func(v, w Word) Word { return w + 3 }, "not an allocated vector"},
+	{func(v, w Word) Word { return 5 }, "not an allocated vector"},
+	{func(v, w Word) Word { return StoreSize }, "not an allocated vector"},
+}
+
+func TestFreeVec(t *testing.T) {
+	for _, test := range test_freevec {
+		rt, _ := newTestRuntime("")
+		v := rt.Store.GetVec(10)
+		w := rt.Store.GetVec(10)
+		if err := rt.Store.FreeVec(v); err != nil {
+			t.Fatal(err)
+		}
+		addr := test.addr(v, w)
+		err := rt.Store.FreeVec(addr)
+		if e, ok := err.(*FreeError); !ok || e.Addr != addr || e.Msg != test.msg {
+			t.Errorf("FreeVec(%d): got %v, expected %s", addr, err, test.msg)
+		}
+
+		// The header of a vector does not decide how much is freed.
+		rt.Store.Put(w-1, 1000)
+		if err := rt.Store.FreeVec(w); err != nil {
+			t.Fatal(err)
+		}
+		if u := rt.Store.GetVec(21); u != v {
+			t.Errorf("got %d after freeing both vectors, expected %d", u, v)
+		}
+	}
+
+	rt, _ := newTestRuntime("")
+	f := rt.Define(func(rt *Runtime, args []Word) Word {
+		v := callGlobal(rt, "getvec", 4)
+		callGlobal(rt, "freevec", v)
+		return callGlobal(rt, "freevec", v)
+	})
+	if _, err := rt.Run(f); err == nil || !strings.Contains(err.Error(), "already free") {
+		t.Errorf("got %v, expected a double free", err)
+	}
+}
+
+func TestPackString(t *testing.T) {
+	rt, _ := newTestRuntime("")
+	s := rt.NewString("packed string")
+	v := rt.Store.GetVec(20)
+	callGlobal(rt, "unpackstring", s, v)
+	if n := rt.Store.Load(v); n != 13 {
+		t.Fatalf("unpackstring: got length %d, expected 13", n)
+	}
+	if ch := rt.Store.Load(v + 1); ch != 'p' {
+		t.Errorf("unpackstring: got %d, expected 'p'", ch)
+	}
+
+	d := rt.Store.GetVec(20)
+	last := callGlobal(rt, "packstring", v, d)
+	if last != 13/DefaultTarget.BytesPerWord() {
+		t.Errorf("packstring: got %d, expected %d", last, 13/DefaultTarget.BytesPerWord())
+	}
+	if str := rt.String(d); str != "packed string" {
+		t.Errorf("packstring: got %q", str)
+	}
+}
+
+var test_wrap = []struct {
+	target string
+	in     Word
+	out    Word
+}{
+	{"16", 32767, 32767},
+	{"16", 32768, -32768},
+	{"16", 65535, -1},
+	{"32", 1 << 31, -1 << 31},
+	{"36", 1<<35 + 1, -1<<35 + 1},
+	{"64", -5, -5},
+}
+
+func TestWrap(t *testing.T) {
+	for _, test := range test_wrap {
+		target, _ := LookupTarget(test.target)
+		if w := target.Wrap(test.in); w != test.out {
+			t.Errorf("%s: Wrap(%d) got %d, expected %d", test.target, test.in, w, test.out)
+		}
+	}
+}
+
+func TestTargetStrings(t *testing.T) {
+	for _, target := range Targets {
+		var rt Runtime
+		rt.Target = target
+		rt.Init(strings.NewReader(""), new(bytes.Buffer))
+		s := rt.NewString("AB")
+		if str := rt.String(s); str != "AB" {
+			t.Errorf("%s: got %q, expected \"AB\"", target.Name, str)
+		}
+		if target.BytesPerWord() < 3 {
+			continue
+		}
+		// The length and the first two characters share a word.
+		w := Word(rt.Target.Unsigned(rt.Store.Load(s)))
+		shift := Word(target.CharBits)
+		expected := 2 | Word('A')<<shift | Word('B')<<(2*shift)
+		if target.BigEndian {
+			bpw := target.BytesPerWord()
+			expected = 2<<((bpw-1)*shift) | Word('A')<<((bpw-2)*shift) | Word('B')<<((bpw-3)*shift)
+		}
+		if w != expected {
+			t.Errorf("%s: got word %#x, expected %#x", target.Name, w, expected)
+		}
+	}
+}
+
+func TestStop(t *testing.T) {
+	rt, _ := newTestRuntime("")
+	f := rt.Define(func(rt *Runtime, args []Word) Word {
+		callGlobal(rt, "stop", 3)
+		return 0
+	})
+	_, err := rt.Run(f)
+	if e, ok := err.(*Exit); !ok || e.Code != 3 {
+		t.Errorf("expected stop(3), got %v", err)
+	}
+}
+
+func TestLongjump(t *testing.T) {
+	rt, _ := newTestRuntime("")
+	var saved Word
+	var ran []string
+	inner := rt.Define(func(rt *Runtime, args []Word) Word {
+		callGlobal(rt, "longjump", saved, 7)
+		ran = append(ran, "inner")
+		return 1
+	})
+	middle := rt.Define(func(rt *Runtime, args []Word) Word {
+		rt.Call(inner)
+		ran = append(ran, "middle")
+		return 2
+	})
+	outer := rt.Define(func(rt *Runtime, args []Word) (res Word) {
+		saved = callGlobal(rt, "level")
+		defer func() {
+			j, ok := recover().(*LongJump)
+			if !ok || j.Level != rt.Level() {
+				t.Fatalf("got %v, expected a longjump to level %d", j, rt.Level())
+			}
+			res = j.Label
+		}()
+		rt.Call(middle)
+		ran = append(ran, "outer")
+		return 3
+	})
+	res, err := rt.Run(outer)
+	if err != nil || res != 7 {
+		t.Errorf("longjump: got %d, %v; expected 7", res, err)
+	}
+	if len(ran) != 0 {
+		t.Errorf("the code after the longjump ran in %v", ran)
+	}
+	if saved != 1 || rt.Level() != 0 {
+		t.Errorf("got levels %d and %d after the longjump, expected 1 and 0", saved, rt.Level())
+	}
+
+	f := rt.Define(func(rt *Runtime, args []Word) Word {
+		return callGlobal(rt, "longjump", 5, 7)
+	})
+	if _, err := rt.Run(f); err == nil || err.Error() != "longjump to bad level 5" {
+		t.Errorf("got %v, expected a bad level", err)
+	}
+}
+
+func TestAptovec(t *testing.T) {
+	rt, _ := newTestRuntime("")
+	f := rt.Define(func(rt *Runtime, args []Word) Word {
+		v, n := args[0], args[1]
+		rt.Store.Put(v+n, 5)
+		return rt.Store.Load(v+n) + n
+	})
+	if res := callGlobal(rt, "aptovec", f, 4); res != 9 {
+		t.Errorf("aptovec: got %d, expected 9", res)
+	}
+}
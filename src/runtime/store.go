@@ -0,0 +1,135 @@
+// Copyright 2015 Meador Inge.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package runtime
+
+// A BCPL machine word.
+type Word int64
+
+// A word-addressed store.  The global vector occupies the
+// bottom of the store and the rest is managed as a heap by
+// GetVec and FreeVec.  Each heap block is preceded by a
+// header word holding the number of words in the block, but
+// FreeVec takes the size from its own record of the live
+// vectors, which a program cannot overwrite.
+type Store struct {
+	mem  []Word        // The words of the store.
+	heap Word          // The first heap address.
+	free []span        // Free heap blocks, sorted by address.
+	live map[Word]Word // The sizes of the blocks of the vectors not yet freed.
+}
+
+// A contiguous run of free words, including its header.
+type span struct {
+	addr Word
+	size Word
+}
+
+// Create a new store of the given size, with the first
+// nglobals words reserved for the global vector.
+func NewStore(size, nglobals int) *Store {
+	s := new(Store)
+	s.mem = make([]Word, size)
+	s.heap = Word(nglobals)
+	s.free = []span{{s.heap, Word(size) - s.heap}}
+	s.live = make(map[Word]Word)
+	return s
+}
+
+// Return the number of words in the store.
+func (s *Store) Size() int {
+	return len(s.mem)
+}
+
+// Return the word at the given address.
+func (s *Store) Load(addr Word) Word {
+	s.check(addr)
+	return s.mem[addr]
+}
+
+// Set the word at the given address.
+func (s *Store) Put(addr, val Word) {
+	s.check(addr)
+	s.mem[addr] = val
+}
+
+func (s *Store) check(addr Word) {
+	if addr < 0 || int(addr) >= len(s.mem) {
+		panic(&Fault{addr})
+	}
+}
+
+// Allocate a vector with subscripts 0 to n and return
+// its address, or zero if there is not enough store.
+func (s *Store) GetVec(n Word) Word {
+	if n < 0 {
+		return 0
+	}
+	need := n + 2
+	for i, sp := range s.free {
+		if sp.size < need {
+			continue
+		}
+		if sp.size-need < 2 {
+			// Not worth splitting, so hand out the whole block.
+			need = sp.size
+			s.free = append(s.free[:i], s.free[i+1:]...)
+		} else {
+			s.free[i] = span{sp.addr + need, sp.size - need}
+		}
+		s.mem[sp.addr] = need
+		for a := sp.addr + 1; a < sp.addr+need; a++ {
+			s.mem[a] = 0
+		}
+		s.live[sp.addr+1] = need
+		return sp.addr + 1
+	}
+	return 0
+}
+
+// Free a vector allocated by GetVec.  Freeing zero does nothing;
+// freeing a vector twice or an address inside a vector is an error.
+func (s *Store) FreeVec(v Word) error {
+	if v == 0 {
+		return nil
+	}
+	size, ok := s.live[v]
+	if !ok {
+		if s.isFree(v) {
+			return &FreeError{v, "already free"}
+		}
+		return &FreeError{v, "not an allocated vector"}
+	}
+	delete(s.live, v)
+	blk := span{v - 1, size}
+
+	// Insert the block in address order and coalesce it with
+	// its neighbours.
+	i := 0
+	for i < len(s.free) && s.free[i].addr < blk.addr {
+		i++
+	}
+	s.free = append(s.free, span{})
+	copy(s.free[i+1:], s.free[i:])
+	s.free[i] = blk
+	if i+1 < len(s.free) && blk.addr+blk.size == s.free[i+1].addr {
+		s.free[i].size += s.free[i+1].size
+		s.free = append(s.free[:i+1], s.free[i+2:]...)
+	}
+	if i > 0 && s.free[i-1].addr+s.free[i-1].size == s.free[i].addr {
+		s.free[i-1].size += s.free[i].size
+		s.free = append(s.free[:i], s.free[i+1:]...)
+	}
+	return nil
+}
+
+// Report whether an address lies in a free heap block.
+func (s *Store) isFree(addr Word) bool {
+	for _, sp := range s.free {
+		if sp.addr <= addr && addr < sp.addr+sp.size {
+			return true
+		}
+	}
+	return false
+}
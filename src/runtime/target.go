@@ -0,0 +1,111 @@
+// Copyright 2015 Meador Inge.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package runtime
+
+import "math"
+
+// A description of the machine a program is run for.  BCPL has a
+// single data type, the word, so the target decides how arithmetic
+// wraps around, how far shifts reach and how the characters of a
+// string are packed into words.  Words are held sign extended from
+// the target's word size.
+type Target struct {
+	Name      string // The name used to select the target.
+	WordBits  int    // The number of bits in a word, at most 64.
+	CharBits  int    // The number of bits in a packed character.
+	BigEndian bool   // Whether the first character of a word is its most significant.
+}
+
+// Some targets: the default 64-bit machine, 32-bit machines like the
+// IBM 360 and 16-bit machines like the PDP-11.
+var Targets = []Target{
+	{"64", 64, 8, false},
+	{"32", 32, 8, false},
+	{"32be", 32, 8, true},
+	{"16", 16, 8, false},
+	{"16be", 16, 8, true},
+	{"36", 36, 9, true},
+}
+
+// The target used when none is given.
+var DefaultTarget = Targets[0]
+
+// Lookup the target with the given name.
+func LookupTarget(name string) (Target, bool) {
+	for _, t := range Targets {
+		if t.Name == name {
+			return t, true
+		}
+	}
+	return Target{}, false
+}
+
+// The number of characters packed into a word.
+func (t Target) BytesPerWord() Word {
+	return Word(t.WordBits / t.CharBits)
+}
+
+// The largest character code.
+func (t Target) MaxChar() Word {
+	return 1<<uint(t.CharBits) - 1
+}
+
+// Reduce a value to a word of the target, wrapping around as the
+// machine's arithmetic would.
+func (t Target) Wrap(w Word) Word {
+	shift := uint(64 - t.WordBits)
+	return w << shift >> shift
+}
+
+// Return the bits of a word taken as an unsigned number.
+func (t Target) Unsigned(w Word) uint64 {
+	shift := uint(64 - t.WordBits)
+	return uint64(w) << shift >> shift
+}
+
+// Shift a word left, or right if n is negative, filling with zeros.
+// Shifts by a whole word or more give zero.
+func (t Target) Shift(w Word, n Word) Word {
+	switch {
+	case n >= Word(t.WordBits) || n <= -Word(t.WordBits):
+		return 0
+	case n >= 0:
+		return t.Wrap(w << uint(n))
+	}
+	return t.Wrap(Word(t.Unsigned(w) >> uint(-n)))
+}
+
+// Return the floating point number held in a word, and whether the
+// target has floating point words.
+func (t Target) Float(w Word) (float64, bool) {
+	switch t.WordBits {
+	case 64:
+		return math.Float64frombits(uint64(w)), true
+	case 32:
+		return float64(math.Float32frombits(uint32(w))), true
+	}
+	return 0, false
+}
+
+// Return the word holding a floating point number, and whether the
+// target has floating point words.
+func (t Target) FromFloat(f float64) (Word, bool) {
+	switch t.WordBits {
+	case 64:
+		return Word(math.Float64bits(f)), true
+	case 32:
+		return t.Wrap(Word(math.Float32bits(float32(f)))), true
+	}
+	return 0, false
+}
+
+// Return the shift that brings character i of a word to the bottom.
+func (t Target) charShift(i Word) uint {
+	i %= t.BytesPerWord()
+	if t.BigEndian {
+		i = t.BytesPerWord() - 1 - i
+	}
+	return uint(Word(t.CharBits) * i)
+}
@@ -0,0 +1,109 @@
+// Copyright 2015 Meador Inge.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package scanner
+
+import (
+	"bytes"
+	"github.com/meadori/bcpl-go/src/token"
+	"strings"
+	"testing"
+)
+
+// Scan all of the tokens of src, failing if the scanner does not
+// reach EOF.  Every byte but the last is consumed by a token, and at
+// most one token is inserted before each of them, so a scanner that
+// makes progress returns no more than twice as many tokens as there
+// are bytes.
+func scanAll(t *testing.T, src []byte) []*token.Token {
+	var s Scanner
+	s.Init(src)
+	var toks []*token.Token
+	for i := 0; i <= 2*len(src)+2; i++ {
+		tok := s.Next()
+		toks = append(toks, tok)
+		if tok.Kind == token.EOF {
+			return toks
+		}
+	}
+	t.Fatalf("no EOF after %d tokens", len(toks))
+	return nil
+}
+
+// Report whether a token was read from the source rather than
+// inserted by the scanner.
+func inSource(src []byte, tok *token.Token) bool {
+	return bytes.HasPrefix(src[tok.Pos.Offset:], []byte(tok.Lit))
+}
+
+// Return the tokens read from the source.
+func sourceTokens(src []byte, toks []*token.Token) []*token.Token {
+	var real []*token.Token
+	for _, tok := range toks {
+		if inSource(src, tok) {
+			real = append(real, tok)
+		}
+	}
+	return real
+}
+
+func FuzzScan(f *testing.F) {
+	for _, tok := range test_single_token {
+		f.Add(tok.Lit)
+	}
+	for _, test := range test_can_end {
+		f.Add(test.src)
+	}
+	f.Add(test_fact_str)
+	f.Add(test_hello_str)
+	f.Add(test_semi_str)
+	f.Add(test_do_str)
+	f.Add(test_pos_str)
+	f.Add(test_skip_comments_str)
+
+	f.Fuzz(func(t *testing.T, str string) {
+		src := []byte(str)
+		toks := scanAll(t, src)
+
+		// The tokens read from the source appear at their offsets,
+		// in order and without overlapping.
+		offset, line, lineOffset := 0, 1, 0
+		for _, tok := range toks {
+			if tok.Pos.Offset < offset || tok.Pos.Offset > len(src) {
+				t.Fatalf("%q at offset %d, expected at least %d", tok.Lit, tok.Pos.Offset, offset)
+			}
+			line += bytes.Count(src[lineOffset:tok.Pos.Offset], []byte("\n"))
+			lineOffset = tok.Pos.Offset
+			if tok.Pos.Line != line {
+				t.Fatalf("%q on line %d, expected %d", tok.Lit, tok.Pos.Line, line)
+			}
+			if tok.Kind == token.SEMICOLON || tok.Kind == token.DO {
+				if !inSource(src, tok) {
+					continue
+				}
+			} else if !inSource(src, tok) {
+				t.Fatalf("%s at offset %d does not match the source", tok, tok.Pos.Offset)
+			}
+			offset = tok.Pos.Offset + len(tok.Lit)
+		}
+
+		// Printing the tokens separated by spaces and scanning them
+		// again gives the same tokens, apart from inserted ones.
+		var lits []string
+		real := sourceTokens(src, toks)
+		for _, tok := range real[:len(real)-1] {
+			lits = append(lits, tok.Lit)
+		}
+		printed := []byte(strings.Join(lits, " "))
+		again := sourceTokens(printed, scanAll(t, printed))
+		if len(again) != len(real) {
+			t.Fatalf("rescanning %q gave %d tokens, expected %d", printed, len(again), len(real))
+		}
+		for i, tok := range again {
+			if tok.Kind != real[i].Kind || tok.Lit != real[i].Lit {
+				t.Fatalf("rescanning %q gave %s, expected %s", printed, tok, real[i])
+			}
+		}
+	})
+}
@@ -9,7 +9,10 @@
 
 package scanner
 
-import "github.com/meadori/bcpl-go/src/token"
+import (
+	"github.com/meadori/bcpl-go/src/token"
+	"strings"
+)
 
 // Scanner states.
 const (
@@ -18,16 +21,31 @@ const (
 	maybesemi          // A semicolon might be inserted.
 )
 
+// A mode controls what the scanner returns.
+type Mode uint
+
+const (
+	ScanComments Mode = 1 << iota // Return comments as COMMENT tokens.
+)
+
 type Scanner struct {
-	src      []byte       // The source code.
-	ch       rune         // The current character.
-	chOffset int          // The current character offset.
-	offset   int          // The next character offset.
-	savedTok *token.Token // A saved token from an earlier scan.
-	state    int          // In semicolon insertion state.
+	Mode       Mode          // The scanning mode; Init sets ScanComments.
+	Dialect    token.Dialect // The dialect; Init sets the 1967 one.
+	src        []byte        // The source code.
+	ch         rune          // The current character.
+	chOffset   int           // The current character offset.
+	offset     int           // The next character offset.
+	line       int           // The current line number.
+	lineOffset int           // The offset of the start of the current line.
+	savedTok   *token.Token  // A saved token from an earlier scan.
+	state      int           // In semicolon insertion state.
 }
 
 func (s *Scanner) next() {
+	if s.ch == '\n' {
+		s.line += 1
+		s.lineOffset = s.offset
+	}
 	if s.offset < len(s.src) {
 		s.chOffset = s.offset
 		s.ch = rune(s.src[s.offset])
@@ -39,6 +57,11 @@ func (s *Scanner) next() {
 	}
 }
 
+// Return the position of the current character.
+func (s *Scanner) pos() token.Position {
+	return token.Position{s.chOffset, s.line, s.chOffset - s.lineOffset + 1}
+}
+
 func (s *Scanner) skipWhitespace() {
 	for s.ch == ' ' || s.ch == '\t' || s.ch == '\n' && s.state != maybeinsert || s.ch == '\r' {
 		s.next()
@@ -62,7 +85,8 @@ func isSemiStart(tok *token.Token) bool {
 		token.WHILE, token.GOTO, token.RESULTIS, token.CASE,
 		token.DEFAULT, token.BREAK, token.RETURN, token.FINISH,
 		token.SECTBRA, token.RBRA, token.VALOF, token.LV, token.RV,
-		token.NAME:
+		token.NAME, token.BANG, token.ENDCASE, token.LOOP, token.NEXT,
+		token.EXIT:
 		return true
 	}
 	return false
@@ -75,7 +99,8 @@ func isDoStart(tok *token.Token) bool {
 	switch tok.Kind {
 	case token.TEST, token.FOR, token.IF, token.UNLESS, token.UNTIL,
 		token.WHILE, token.GOTO, token.RESULTIS, token.CASE,
-		token.DEFAULT, token.BREAK, token.RETURN, token.FINISH:
+		token.DEFAULT, token.BREAK, token.RETURN, token.FINISH,
+		token.ENDCASE, token.LOOP, token.NEXT, token.EXIT:
 		return true
 	}
 	return false
@@ -89,7 +114,8 @@ func isCommandEnd(tok *token.Token) bool {
 	switch tok.Kind {
 	case token.BREAK, token.RETURN, token.FINISH, token.REPEAT,
 		token.SKET, token.RKET, token.SECTKET, token.NAME,
-		token.STRINGCONST, token.NUMBER, token.TRUE, token.FALSE:
+		token.STRINGCONST, token.NUMBER, token.TRUE, token.FALSE,
+		token.QUERY, token.ENDCASE, token.LOOP, token.NEXT, token.EXIT:
 		return true
 	}
 	return false
@@ -101,10 +127,13 @@ func (s *Scanner) scanComment() string {
 
 	start := s.chOffset - 2
 
-	for s.ch != '\n' {
+	for s.ch != '\n' && s.ch != -1 {
 		s.next()
 	}
 
+	if s.ch == -1 {
+		return string(s.src[start:])
+	}
 	return string(s.src[start:s.offset])
 }
 
@@ -116,18 +145,27 @@ func (s *Scanner) scanName() *token.Token {
 	// and digits starting with a capital letter. The character immediately
 	// following a name may not be a letter or a digit.
 	start := s.chOffset
-	for s.isLetter(s.ch) || s.isDigit(s.ch) {
+	for s.isLetter(s.ch) || s.isDigit(s.ch) || s.ch == '_' && s.Dialect&token.Richards != 0 {
 		s.next()
 	}
 	str := s.src[start:s.chOffset]
 
 	// (2) A sequence of two or more small letters which is not part of a NAME,
 	// SECTBRA, SECTKET or STRINGCONST is a reserved system word and may be used
-	// to represent a canonical symbol.
+	// to represent a canonical symbol.  Other dialects write reserved words
+	// in capitals or in either case.
 	kind := token.NAME
 	literal := string(str)
 	if len(str) > 1 {
-		kind = token.LookupName(literal)
+		kind = token.LookupName(literal, s.Dialect)
+	}
+
+	// Where reserved words are not written in small letters, names
+	// are not told apart by case either, and are kept in small letters
+	// as the names of the library are.  The Richards dialect tells
+	// names apart by case.
+	if kind == token.NAME && s.Dialect&(token.Upper|token.IgnoreCase) != 0 && s.Dialect&token.Richards == 0 {
+		literal = strings.ToLower(literal)
 	}
 	return token.NewToken(kind, literal)
 }
@@ -140,19 +178,58 @@ func (s *Scanner) scanNumber() *token.Token {
 	return token.NewToken(token.NUMBER, string(s.src[start:s.chOffset]))
 }
 
+func (s *Scanner) isDigitIn(ch rune, base int) bool {
+	switch base {
+	case 2:
+		return ch == '0' || ch == '1'
+	case 8:
+		return '0' <= ch && ch <= '7'
+	case 16:
+		return s.isDigit(ch) || 'a' <= ch && ch <= 'f' || 'A' <= ch && ch <= 'F'
+	}
+	return s.isDigit(ch)
+}
+
+// Scan the rest of a number of the Richards dialect written in
+// another base: #X1F, #O17 or #17, and #B101.
+func (s *Scanner) scanBasedNumber(start int) *token.Token {
+	base := 8
+	switch s.ch {
+	case 'X', 'x':
+		base = 16
+		s.next()
+	case 'O', 'o':
+		s.next()
+	case 'B', 'b':
+		base = 2
+		s.next()
+	}
+	if !s.isDigitIn(s.ch, base) {
+		return token.NewToken(token.ILLEGAL, string(s.src[start:s.chOffset]))
+	}
+	for s.isDigitIn(s.ch, base) {
+		s.next()
+	}
+	return token.NewToken(token.NUMBER, string(s.src[start:s.chOffset]))
+}
+
 func (s *Scanner) scanStringConst() *token.Token {
 	start := s.offset - 1
 	s.next()
-	for s.ch != '"' {
+	for s.ch != '"' && s.ch != -1 {
 		s.next()
 	}
+	if s.ch == -1 {
+		// An unterminated string.
+		return token.NewToken(token.ILLEGAL, string(s.src[start:s.chOffset]))
+	}
 	s.next()
 	return token.NewToken(token.STRINGCONST, string(s.src[start:s.chOffset]))
 }
 
 func (s *Scanner) scanOperator(ch rune) *token.Token {
 	kind := token.ILLEGAL
-	lit := string(ch)
+	lit := string(s.src[s.chOffset:s.offset])
 	s.next()
 
 	switch ch {
@@ -211,6 +288,7 @@ func (s *Scanner) scanOperator(ch rune) *token.Token {
 		kind = token.COMMA
 	case ':':
 		if s.ch == '=' {
+			s.next()
 			kind, lit = token.ASS, ":="
 		} else {
 			kind = token.COLON
@@ -243,12 +321,107 @@ func (s *Scanner) scanOperator(ch rune) *token.Token {
 	return token.NewToken(kind, lit)
 }
 
+// Scan an operator of the Richards dialect, returning nil if the
+// character has its 1967 meaning.
+func (s *Scanner) scanRichardsOperator(ch rune) *token.Token {
+	start := s.chOffset
+	one := func(kind token.TokenKind) *token.Token {
+		s.next()
+		return token.NewToken(kind, string(ch))
+	}
+	two := func(kind token.TokenKind) *token.Token {
+		s.next()
+		s.next()
+		return token.NewToken(kind, string(s.src[start:s.chOffset]))
+	}
+	peek := func(i int) byte {
+		if s.offset+i < len(s.src) {
+			return s.src[s.offset+i]
+		}
+		return 0
+	}
+
+	switch ch {
+	case '{':
+		return one(token.SECTBRA)
+	case '}':
+		return one(token.SECTKET)
+	case '!':
+		return one(token.BANG)
+	case '@':
+		return one(token.LV)
+	case '%':
+		return one(token.PERCENT)
+	case '?':
+		return one(token.QUERY)
+	case '.':
+		return one(token.DOT)
+	case '~':
+		if peek(0) == '=' {
+			return two(token.NE)
+		}
+		return one(token.NOT)
+	case '=':
+		if peek(0) == '>' {
+			return two(token.ARROW)
+		}
+	case '#':
+		var kind token.TokenKind
+		switch peek(0) {
+		case '+':
+			kind = token.FPLUS
+		case '-':
+			kind = token.FMINUS
+		case '*':
+			kind = token.FMUL
+		case '/':
+			kind = token.FDIV
+		case '=':
+			kind = token.FEQ
+		case '<':
+			kind = token.FLS
+			if peek(1) == '=' {
+				s.next()
+				kind = token.FLE
+			}
+		case '>':
+			kind = token.FGR
+			if peek(1) == '=' {
+				s.next()
+				kind = token.FGE
+			}
+		case '~':
+			if peek(1) != '=' {
+				return nil
+			}
+			s.next()
+			kind = token.FNE
+		default:
+			s.next()
+			return s.scanBasedNumber(start)
+		}
+		return two(kind)
+	}
+	return nil
+}
+
+// Report whether the tokens returned so far could end a command,
+// that is whether a newline here would cause a semicolon or do to
+// be inserted.
+func (s *Scanner) CanEnd() bool {
+	return s.state == maybeinsert
+}
+
 func (s *Scanner) Init(src []byte) {
 	s.src = src
 	s.ch = ' '
 	s.offset = 0
+	s.line = 1
+	s.lineOffset = 0
 	s.savedTok = nil
 	s.state = normal
+	s.Mode = ScanComments
+	s.Dialect = 0
 	s.next()
 }
 
@@ -257,9 +430,13 @@ next:
 	if s.savedTok != nil {
 		tok = s.savedTok
 		s.savedTok = nil
+		if isCommandEnd(tok) {
+			s.state = maybeinsert
+		}
 	} else {
 		s.skipWhitespace()
 
+		pos := s.pos()
 		switch ch := s.ch; {
 		case s.isLetter(ch):
 			tok = s.scanName()
@@ -271,7 +448,20 @@ next:
 			s.state = maybesemi
 			goto next
 		default:
-			tok = s.scanOperator(ch)
+			if s.Dialect&token.Richards == 0 {
+				tok = s.scanOperator(ch)
+			} else if tok = s.scanRichardsOperator(ch); tok == nil {
+				tok = s.scanOperator(ch)
+			}
+		}
+		tok.Pos = pos
+
+		// Comments take no part in semicolon and do insertion.
+		if tok.Kind == token.COMMENT {
+			if s.Mode&ScanComments == 0 {
+				goto next
+			}
+			return
 		}
 
 		switch s.state {
@@ -279,6 +469,7 @@ next:
 			if isDoStart(tok) {
 				s.savedTok = tok
 				tok = token.NewToken(token.DO, "do")
+				tok.Pos = pos
 				s.state = normal
 			} else if !isCommandEnd(tok) {
 				s.state = normal
@@ -287,8 +478,13 @@ next:
 			if isSemiStart(tok) {
 				s.savedTok = tok
 				tok = token.NewToken(token.SEMICOLON, ";")
+				tok.Pos = pos
+				s.state = normal
+			} else if isCommandEnd(tok) {
+				s.state = maybeinsert
+			} else {
+				s.state = normal
 			}
-			s.state = normal
 		case normal:
 			if isCommandEnd(tok) {
 				s.state = maybeinsert
@@ -222,6 +222,21 @@ func TestHello(t *testing.T) {
 	assertTokensEqualSource(t, test_hello_tokens, test_hello_str)
 }
 
+// A string running to the end of the source is illegal.
+var test_unterminated_str = `let A = "abc`
+
+var test_unterminated_tokens = []*token.Token{
+	token.NewToken(token.LET, "let"),
+	token.NewToken(token.NAME, "A"),
+	token.NewToken(token.EQ, "="),
+	token.NewToken(token.ILLEGAL, "\"abc"),
+	token.NewToken(token.EOF, ""),
+}
+
+func TestUnterminatedString(t *testing.T) {
+	assertTokensEqualSource(t, test_unterminated_tokens, test_unterminated_str)
+}
+
 var test_semi_str = `global $(
         COUNT: 200
         ALL: 201
@@ -296,3 +311,220 @@ var test_do_tokens = []*token.Token{
 func TestDoInsertion(t *testing.T) {
 	assertTokensEqualSource(t, test_do_tokens, test_do_str)
 }
+
+var test_pos_str = `global $(
+  COUNT: 200
+$)`
+
+var test_pos_positions = []token.Position{
+	{0, 1, 1},   // global
+	{7, 1, 8},   // $(
+	{12, 2, 3},  // COUNT
+	{17, 2, 8},  // :
+	{19, 2, 10}, // 200
+	{23, 3, 1},  // $)
+	{25, 3, 3},  // EOF
+}
+
+func TestPositions(t *testing.T) {
+	var s Scanner
+	s.Init([]byte(test_pos_str))
+	for _, epos := range test_pos_positions {
+		tok := s.Next()
+		if tok.Pos != epos {
+			t.Errorf("bad position for '%s': got %v, expected %v", tok, tok.Pos, epos)
+		}
+	}
+}
+
+var test_skip_comments_str = `COUNT: 200 // the count
+// on a line of its own
+ALL: 201`
+
+var test_skip_comments_tokens = []*token.Token{
+	token.NewToken(token.NAME, "COUNT"),
+	token.NewToken(token.COLON, ":"),
+	token.NewToken(token.NUMBER, "200"),
+	token.NewToken(token.SEMICOLON, ";"),
+	token.NewToken(token.NAME, "ALL"),
+	token.NewToken(token.COLON, ":"),
+	token.NewToken(token.NUMBER, "201"),
+	token.NewToken(token.EOF, ""),
+}
+
+func TestSkipComments(t *testing.T) {
+	var s Scanner
+	s.Init([]byte(test_skip_comments_str))
+	s.Mode = 0
+	for _, etok := range test_skip_comments_tokens {
+		tok := s.Next()
+		assertTokensEqual(t, tok, etok)
+	}
+}
+
+var test_can_end = []struct {
+	src    string
+	canEnd bool
+}{
+	{"X + 1", true},
+	{"X +", false},
+	{"F(X)", true},
+	{"F(", false},
+	{"let V = vec", false},
+	{"manifest $( N = 1 $)", true},
+	{"manifest $(\n  N = 1\n$)", true},
+	{"X\nY", true},
+	{"X // a comment\n", true},
+	{"\"abc\"", true},
+}
+
+func TestCanEnd(t *testing.T) {
+	for _, test := range test_can_end {
+		var s Scanner
+		s.Init([]byte(test.src))
+		canEnd := false
+		for {
+			canEnd = s.CanEnd()
+			if s.Next().Kind == token.EOF {
+				break
+			}
+		}
+		if canEnd != test.canEnd {
+			t.Errorf("CanEnd after %q: got %v, expected %v", test.src, canEnd, test.canEnd)
+		}
+	}
+}
+
+var test_dialects = []struct {
+	dialect token.Dialect
+	src     string
+	kinds   []token.TokenKind
+}{
+	{0, "let LET Let", []token.TokenKind{token.LET, token.NAME, token.NAME}},
+	{token.Upper, "let LET Let", []token.TokenKind{token.NAME, token.LET, token.NAME}},
+	{token.IgnoreCase, "let LET Let", []token.TokenKind{token.LET, token.LET, token.LET}},
+	{token.Upper, "VALOF RESULTIS X1 A", []token.TokenKind{token.VALOF, token.RESULTIS, token.NAME, token.NAME}},
+}
+
+func TestDialects(t *testing.T) {
+	for _, test := range test_dialects {
+		var s Scanner
+		s.Init([]byte(test.src))
+		s.Dialect = test.dialect
+		for _, kind := range test.kinds {
+			if tok := s.Next(); tok.Kind != kind {
+				t.Errorf("%q in dialect %d: got %s for '%s', expected %s", test.src, test.dialect, tok.Kind, tok, kind)
+			}
+		}
+	}
+}
+
+// Names are kept in small letters where reserved words need not be.
+var test_dialect_names = []struct {
+	dialect token.Dialect
+	src     string
+	name    string
+}{
+	{0, "WriteF", "WriteF"},
+	{token.Upper, "WRITEF", "writef"},
+	{token.IgnoreCase, "WriteF", "writef"},
+	{token.Richards | token.Upper, "WriteF", "WriteF"},
+}
+
+func TestDialectNames(t *testing.T) {
+	for _, test := range test_dialect_names {
+		var s Scanner
+		s.Init([]byte(test.src))
+		s.Dialect = test.dialect
+		if tok := s.Next(); tok.Kind != token.NAME || tok.Lit != test.name {
+			t.Errorf("%q in dialect %d: got %s '%s', expected name '%s'", test.src, test.dialect, tok.Kind, tok, test.name)
+		}
+	}
+}
+
+var test_richards_str = `SECTION "demo"
+LET f(v, n) = v!n + v%1 MOD #X1F
+AND g(x) = x #<= 1.5 -> ?, @x
+{ ~= #~= ~ => }`
+
+var test_richards_tokens = []*token.Token{
+	token.NewToken(token.SECTION, "SECTION"),
+	token.NewToken(token.STRINGCONST, "\"demo\""),
+	token.NewToken(token.LET, "LET"),
+	token.NewToken(token.NAME, "f"),
+	token.NewToken(token.RBRA, "("),
+	token.NewToken(token.NAME, "v"),
+	token.NewToken(token.COMMA, ","),
+	token.NewToken(token.NAME, "n"),
+	token.NewToken(token.RKET, ")"),
+	token.NewToken(token.EQ, "="),
+	token.NewToken(token.NAME, "v"),
+	token.NewToken(token.BANG, "!"),
+	token.NewToken(token.NAME, "n"),
+	token.NewToken(token.PLUS, "+"),
+	token.NewToken(token.NAME, "v"),
+	token.NewToken(token.PERCENT, "%"),
+	token.NewToken(token.NUMBER, "1"),
+	token.NewToken(token.REM, "MOD"),
+	token.NewToken(token.NUMBER, "#X1F"),
+	token.NewToken(token.AND, "AND"),
+	token.NewToken(token.NAME, "g"),
+	token.NewToken(token.RBRA, "("),
+	token.NewToken(token.NAME, "x"),
+	token.NewToken(token.RKET, ")"),
+	token.NewToken(token.EQ, "="),
+	token.NewToken(token.NAME, "x"),
+	token.NewToken(token.FLE, "#<="),
+	token.NewToken(token.NUMBER, "1"),
+	token.NewToken(token.DOT, "."),
+	token.NewToken(token.NUMBER, "5"),
+	token.NewToken(token.COND, "->"),
+	token.NewToken(token.QUERY, "?"),
+	token.NewToken(token.COMMA, ","),
+	token.NewToken(token.LV, "@"),
+	token.NewToken(token.NAME, "x"),
+	token.NewToken(token.SEMICOLON, ";"),
+	token.NewToken(token.SECTBRA, "{"),
+	token.NewToken(token.NE, "~="),
+	token.NewToken(token.FNE, "#~="),
+	token.NewToken(token.NOT, "~"),
+	token.NewToken(token.ARROW, "=>"),
+	token.NewToken(token.SECTKET, "}"),
+	token.NewToken(token.EOF, ""),
+}
+
+func TestRichards(t *testing.T) {
+	var s Scanner
+	s.Init([]byte(test_richards_str))
+	s.Dialect = token.Richards | token.Upper
+	for _, etok := range test_richards_tokens {
+		tok := s.Next()
+		assertTokensEqual(t, tok, etok)
+	}
+}
+
+var test_richards_words = []struct {
+	lit string
+	tok token.TokenKind
+}{
+	{"then", token.THEN},
+	{"ELSE", token.ELSE},
+	{"By", token.NAME},
+	{"endcase", token.ENDCASE},
+	{"LOOP", token.LOOP},
+	{"next", token.NEXT},
+	{"EXIT", token.EXIT},
+	{"GET", token.GET},
+	{"Exit", token.NAME},
+}
+
+func TestRichardsWords(t *testing.T) {
+	for _, test := range test_richards_words {
+		var s Scanner
+		s.Init([]byte(test.lit))
+		s.Dialect = token.Richards
+		if tok := s.Next(); tok.Kind != test.tok || tok.Lit != test.lit {
+			t.Errorf("%s: got %s %q, expected %s", test.lit, tok.Kind, tok.Lit, test.tok)
+		}
+	}
+}
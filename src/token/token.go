@@ -9,11 +9,24 @@
 
 package token
 
+import (
+	"fmt"
+	"strings"
+)
+
 type TokenKind int
 
+// A position in the source.
+type Position struct {
+	Offset int // The byte offset, starting at 0.
+	Line   int // The line number, starting at 1.
+	Column int // The column number, starting at 1 (byte count).
+}
+
 type Token struct {
 	Kind TokenKind
 	Lit  string
+	Pos  Position
 }
 
 // 2.1.1 BCPL Canonical Symbols
@@ -32,6 +45,7 @@ const (
 	STRINGCONST
 
 	// Operators
+	operator_begin
 	ASS
 	COLON
 	COMMA
@@ -59,6 +73,24 @@ const (
 	SKET
 	STAR
 
+	// Operators of the Richards dialect.
+	ARROW
+	BANG
+	DOT
+	FDIV
+	FEQ
+	FGE
+	FGR
+	FLE
+	FLS
+	FMINUS
+	FMUL
+	FNE
+	FPLUS
+	PERCENT
+	QUERY
+	operator_end
+
 	// Reserved "system" words.
 	reserved_begin
 	AND
@@ -88,6 +120,7 @@ const (
 	RESULTIS
 	RETURN
 	RV
+	STATIC
 	SWITCHON
 	TEST
 	TO
@@ -97,6 +130,22 @@ const (
 	VALOF
 	VEC
 	WHILE
+
+	// Reserved words of the Richards dialect.
+	richards_begin
+	BY
+	ELSE
+	ENDCASE
+	EVERY
+	EXIT
+	FIX
+	FLOAT
+	LOOP
+	MATCH
+	NEEDS
+	NEXT
+	SECTION
+	THEN
 	reserved_end
 )
 
@@ -138,6 +187,22 @@ var restoks = [...]string{
 	SKET:      "]",
 	STAR:      "*",
 
+	ARROW:   "=>",
+	BANG:    "!",
+	DOT:     ".",
+	FDIV:    "#/",
+	FEQ:     "#=",
+	FGE:     "#>=",
+	FGR:     "#>",
+	FLE:     "#<=",
+	FLS:     "#<",
+	FMINUS:  "#-",
+	FMUL:    "#*",
+	FNE:     "#~=",
+	FPLUS:   "#+",
+	PERCENT: "%",
+	QUERY:   "?",
+
 	AND:         "and",
 	BE:          "be",
 	BREAK:       "break",
@@ -165,6 +230,7 @@ var restoks = [...]string{
 	RESULTIS:    "resultis",
 	RETURN:      "return",
 	RV:          "rv",
+	STATIC:      "static",
 	SWITCHON:    "switchon",
 	TEST:        "test",
 	TO:          "to",
@@ -174,27 +240,142 @@ var restoks = [...]string{
 	VALOF:       "valof",
 	VEC:         "vec",
 	WHILE:       "while",
+
+	BY:      "by",
+	ELSE:    "else",
+	ENDCASE: "endcase",
+	EVERY:   "every",
+	EXIT:    "exit",
+	FIX:     "fix",
+	FLOAT:   "float",
+	LOOP:    "loop",
+	MATCH:   "match",
+	NEEDS:   "needs",
+	NEXT:    "next",
+	SECTION: "section",
+	THEN:    "then",
+}
+
+// A dialect selects the form of the language being scanned.  The
+// zero dialect is the one of the 1967 hardware conventions, in which
+// the reserved system words are written in small letters.
+type Dialect uint
+
+const (
+	Upper      Dialect = 1 << iota // Reserved words are written in capitals.
+	IgnoreCase                     // Reserved words are written in either case.
+	Richards                       // The language of Martin Richards' later compilers.
+)
+
+var dialects = map[string]Dialect{
+	"1967":     0,
+	"upper":    Upper,
+	"anycase":  IgnoreCase,
+	"richards": Richards,
+}
+
+// Parse a dialect written as a comma separated list of "1967",
+// "upper", "anycase" and "richards".
+func ParseDialect(str string) (Dialect, error) {
+	var dialect Dialect
+	for _, name := range strings.Split(str, ",") {
+		d, ok := dialects[strings.TrimSpace(name)]
+		if !ok {
+			return 0, fmt.Errorf("unknown dialect %q", name)
+		}
+		dialect |= d
+	}
+	return dialect, nil
 }
 
 // Map from reserved system words to token kind.
 var reswords map[string]TokenKind
 
+// Map from the reserved words of the Richards dialect to token kind.
+// Besides its own words the dialect spells rem and neqv as mod and
+// xor.
+var richardsWords map[string]TokenKind
+
+// Map from token kind to its spelling in the Richards dialect, where
+// that differs from the 1967 one.
+var richardsToks = map[TokenKind]string{
+	NE:   "~=",
+	NEQV: "xor",
+	NOT:  "~",
+	REM:  "mod",
+}
+
+// Map from the string representation of every token kind to the kind.
+var kinds map[string]TokenKind
+
 func init() {
 	reswords = make(map[string]TokenKind)
+	richardsWords = map[string]TokenKind{"mod": REM, "xor": NEQV}
 	for i := reserved_begin + 1; i < reserved_end; i++ {
-		reswords[restoks[i]] = i
+		if i < richards_begin {
+			reswords[restoks[i]] = i
+		}
+		if i != richards_begin {
+			richardsWords[restoks[i]] = i
+		}
+	}
+	// Where two kinds share a representation, as NOT and BANG do,
+	// the first one is kept.
+	kinds = make(map[string]TokenKind)
+	for i, str := range restoks {
+		if _, ok := kinds[str]; str != "" && !ok {
+			kinds[str] = TokenKind(i)
+		}
 	}
 }
 
 // Lookup the given string and determine if it is a name or
-// a reserved system word.
-func LookupName(str string) TokenKind {
-	if tok, is_reserved := reswords[str]; is_reserved {
+// a reserved system word in the given dialect.
+func LookupName(str string, dialect Dialect) TokenKind {
+	switch {
+	case dialect&IgnoreCase != 0:
+		str = strings.ToLower(str)
+	case dialect&Upper != 0:
+		if str != strings.ToUpper(str) {
+			return NAME
+		}
+		str = strings.ToLower(str)
+	case dialect&Richards != 0:
+		// The Richards dialect writes reserved words in capitals,
+		// or in small letters.
+		if str == strings.ToUpper(str) {
+			str = strings.ToLower(str)
+		}
+	}
+	words := reswords
+	if dialect&Richards != 0 {
+		words = richardsWords
+	}
+	if tok, is_reserved := words[str]; is_reserved {
 		return tok
 	}
 	return NAME
 }
 
+// Lookup the token kind with the given string representation,
+// returning ILLEGAL if there is none.
+func LookupKind(str string) TokenKind {
+	if kind, ok := kinds[str]; ok {
+		return kind
+	}
+	return ILLEGAL
+}
+
+// Report whether the kind is a reserved system word.
+func (kind TokenKind) IsKeyword() bool {
+	return reserved_begin < kind && kind < reserved_end && kind != richards_begin
+}
+
+// Report whether the kind is an operator or delimiter.
+func (kind TokenKind) IsOperator() bool {
+	return operator_begin < kind && kind < operator_end
+}
+
 // Create a new token.
 func NewToken(kind TokenKind, lit string) *Token {
 	t := new(Token)
@@ -203,6 +384,20 @@ func NewToken(kind TokenKind, lit string) *Token {
 	return t
 }
 
+// Report whether the position is known.
+func (pos Position) IsValid() bool {
+	return pos.Line > 0
+}
+
+// Return the string representation of the position
+// in the form "line:column".
+func (pos Position) String() string {
+	if !pos.IsValid() {
+		return "-"
+	}
+	return fmt.Sprintf("%d:%d", pos.Line, pos.Column)
+}
+
 // Return the string representation of the token.
 func (tok Token) String() string {
 	return tok.Lit
@@ -212,3 +407,18 @@ func (tok Token) String() string {
 func (kind TokenKind) String() string {
 	return restoks[kind]
 }
+
+// Return the string representation of the token kind in a dialect,
+// in which reserved words may be written in capitals.
+func (kind TokenKind) In(dialect Dialect) string {
+	str := restoks[kind]
+	if dialect&Richards != 0 {
+		if tok, ok := richardsToks[kind]; ok {
+			str = tok
+		}
+	}
+	if kind.IsKeyword() && dialect&Upper != 0 {
+		return strings.ToUpper(str)
+	}
+	return str
+}
@@ -0,0 +1,167 @@
+// Copyright 2015 Meador Inge.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package xref
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/meadori/bcpl-go/src/token"
+	"io"
+	"strings"
+	"text/tabwriter"
+)
+
+// The text of a listing has a line for each name giving its kind,
+// the routine of a local, where it is declared and where it is used,
+// then a line for each routine giving the routines it calls and is
+// called by:
+//
+//	NAME    KIND        ROUTINE  DECLARED  USES
+//	Fact    function             3:5       3:5w 3:31 4:56@ 5:22
+//	Hook    global 200           1:11      4:45
+//	N       param       Fact     3:10      3:15 3:27 3:36
+//	writen  global 12            -         5:15
+//
+//	ROUTINE  CALLS               CALLED BY
+//	Fact     Fact                Fact start
+//	start    writen Fact Colour
+//
+// A use is written where it is, followed by w if it writes the name
+// and @ if it takes its address with lv.
+
+// Return a use as it is written in the text of a listing.
+func (u Use) String() string {
+	switch u.Kind {
+	case Write:
+		return u.Pos.String() + "w"
+	case Addr:
+		return u.Pos.String() + "@"
+	}
+	return u.Pos.String()
+}
+
+// Return the kind of a symbol with its number, if it has one.
+func (sym *Symbol) kind() string {
+	switch sym.Kind {
+	case Global, Manifest:
+		return fmt.Sprintf("%s %d", sym.Kind, sym.Number)
+	}
+	return sym.Kind.String()
+}
+
+// Write the text of a listing.
+func (x *Listing) Fprint(w io.Writer) error {
+	var buf bytes.Buffer
+	tw := tabwriter.NewWriter(&buf, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tKIND\tROUTINE\tDECLARED\tUSES")
+	for _, sym := range x.Symbols {
+		var uses []string
+		for _, u := range sym.Uses {
+			uses = append(uses, u.String())
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", sym.Name, sym.kind(), sym.Routine, sym.Decl, strings.Join(uses, " "))
+	}
+	tw.Flush()
+	if len(x.Routines) > 0 {
+		buf.WriteByte('\n')
+		tw = tabwriter.NewWriter(&buf, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "ROUTINE\tCALLS\tCALLED BY")
+		for _, r := range x.Routines {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", r.Name, strings.Join(r.Calls, " "), strings.Join(r.CalledBy, " "))
+		}
+		tw.Flush()
+	}
+	var out bytes.Buffer
+	for _, line := range strings.SplitAfter(buf.String(), "\n") {
+		out.WriteString(strings.TrimRight(line, " \n"))
+		if strings.HasSuffix(line, "\n") {
+			out.WriteByte('\n')
+		}
+	}
+	_, err := w.Write(out.Bytes())
+	return err
+}
+
+func (x *Listing) String() string {
+	var buf bytes.Buffer
+	x.Fprint(&buf)
+	return buf.String()
+}
+
+// ----------------------------------------------------------------------------
+// JSON
+
+// A listing is encoded as an object with "symbols" and "routines"
+// members, with the fields of the types as members with lower-case
+// names.  Kinds are encoded as their names, and positions as objects
+// with "offset", "line" and "column" members as in package astjson.
+
+type jsonPos struct {
+	Offset int `json:"offset"`
+	Line   int `json:"line"`
+	Column int `json:"column"`
+}
+
+func encodePos(pos token.Position) *jsonPos {
+	if !pos.IsValid() {
+		return nil
+	}
+	return &jsonPos{pos.Offset, pos.Line, pos.Column}
+}
+
+type jsonUse struct {
+	Pos     *jsonPos `json:"pos"`
+	Kind    string   `json:"kind"`
+	Routine string   `json:"routine,omitempty"`
+}
+
+type jsonSymbol struct {
+	Name    string    `json:"name"`
+	Kind    string    `json:"kind"`
+	Decl    *jsonPos  `json:"decl"`
+	Routine string    `json:"routine,omitempty"`
+	Number  int       `json:"number"`
+	Uses    []jsonUse `json:"uses"`
+}
+
+type jsonRoutine struct {
+	Name     string   `json:"name"`
+	Pos      *jsonPos `json:"pos"`
+	Calls    []string `json:"calls"`
+	CalledBy []string `json:"calledBy"`
+}
+
+type jsonListing struct {
+	Symbols  []jsonSymbol  `json:"symbols"`
+	Routines []jsonRoutine `json:"routines"`
+}
+
+// Encode a listing as JSON.
+func (x *Listing) MarshalJSON() ([]byte, error) {
+	list := jsonListing{[]jsonSymbol{}, []jsonRoutine{}}
+	for _, sym := range x.Symbols {
+		uses := []jsonUse{}
+		for _, u := range sym.Uses {
+			uses = append(uses, jsonUse{encodePos(u.Pos), u.Kind.String(), u.Routine})
+		}
+		list.Symbols = append(list.Symbols, jsonSymbol{sym.Name, sym.Kind.String(), encodePos(sym.Decl), sym.Routine, sym.Number, uses})
+	}
+	for _, r := range x.Routines {
+		list.Routines = append(list.Routines, jsonRoutine{r.Name, encodePos(r.Pos),
+			append([]string{}, r.Calls...), append([]string{}, r.CalledBy...)})
+	}
+	return json.Marshal(list)
+}
+
+// Write a listing as indented JSON.
+func (x *Listing) FprintJSON(w io.Writer) error {
+	data, err := json.MarshalIndent(x, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
@@ -0,0 +1,387 @@
+// Copyright 2015 Meador Inge.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+// Package xref makes cross-reference listings of BCPL programs, like
+// those of the classic compilers: for each name, where it is declared
+// and every place it is read, written or has its address taken with
+// lv, followed by the routines each routine calls and is called by.
+// A listing is written as text or as JSON.
+package xref
+
+import (
+	"github.com/meadori/bcpl-go/src/ast"
+	"github.com/meadori/bcpl-go/src/cfg"
+	"github.com/meadori/bcpl-go/src/runtime"
+	"github.com/meadori/bcpl-go/src/token"
+	"sort"
+)
+
+// The kind of a name.
+type Kind int
+
+const (
+	Undeclared Kind = iota // A name used but not declared.
+	Global                 // A global, declared or of the library.
+	Manifest               // A manifest constant.
+	Static                 // A static cell.
+	Function               // A name given its value by a function definition.
+	Value                  // A name given its value by a simple definition.
+	Vector                 // A name given its value by a vector definition.
+	Param                  // A parameter of a function.
+	Pattern                // A name bound by a pattern of a match.
+	ForVar                 // The control variable of a for loop.
+	Label                  // A label of a command.
+)
+
+var kinds = [...]string{
+	Undeclared: "undeclared",
+	Global:     "global",
+	Manifest:   "manifest",
+	Static:     "static",
+	Function:   "function",
+	Value:      "value",
+	Vector:     "vector",
+	Param:      "param",
+	Pattern:    "pattern",
+	ForVar:     "for",
+	Label:      "label",
+}
+
+func (k Kind) String() string {
+	return kinds[k]
+}
+
+// How a name is used.
+type UseKind int
+
+const (
+	Read  UseKind = iota // The value is read, or called.
+	Write                // The value is given by a definition or an assignment.
+	Addr                 // The address is taken with lv.
+)
+
+var useKinds = [...]string{
+	Read:  "read",
+	Write: "write",
+	Addr:  "lv",
+}
+
+func (k UseKind) String() string {
+	return useKinds[k]
+}
+
+// A use of a name.
+type Use struct {
+	Pos     token.Position
+	Kind    UseKind
+	Routine string // The routine it is in, or "" at the top level.
+}
+
+// A name and its uses.  The locals of different routines, and of
+// different arms of a match, blocks or for loops, are different
+// symbols.  The labels of a routine are in scope in all of it.
+type Symbol struct {
+	Name    string
+	Kind    Kind
+	Decl    token.Position // Where it is declared, or the zero Position.
+	Routine string         // The routine of a local, or "".
+	Number  int            // The number of a global, the value of a manifest or static, or the index of a parameter.
+	Uses    []Use          // In source order.
+}
+
+// A routine and the routines it calls and is called by.  The top
+// level definitions of values that call routines are included.
+type Routine struct {
+	Name     string
+	Pos      token.Position
+	Calls    []string
+	CalledBy []string
+}
+
+// A cross-reference listing.
+type Listing struct {
+	Symbols  []*Symbol  // Sorted by name, then where declared.
+	Routines []*Routine // In the order they are defined.
+}
+
+// A scope of names.
+type scope struct {
+	outer *scope
+	names map[string]*Symbol
+}
+
+func (s *scope) lookup(name string) *Symbol {
+	for ; s != nil; s = s.outer {
+		if sym, ok := s.names[name]; ok {
+			return sym
+		}
+	}
+	return nil
+}
+
+type lister struct {
+	top     *scope
+	symbols []*Symbol
+	routine string // The routine being listed.
+}
+
+func (l *lister) declare(s *scope, name string, kind Kind, pos token.Position, n int) *Symbol {
+	sym := &Symbol{Name: name, Kind: kind, Decl: pos, Routine: l.routine, Number: n}
+	s.names[name] = sym
+	l.symbols = append(l.symbols, sym)
+	return sym
+}
+
+func (l *lister) use(sym *Symbol, pos token.Position, kind UseKind) {
+	sym.Uses = append(sym.Uses, Use{pos, kind, l.routine})
+}
+
+// Return the symbol of a name, declaring an undeclared name at the
+// top level.
+func (l *lister) lookup(s *scope, name string) *Symbol {
+	if sym := s.lookup(name); sym != nil {
+		return sym
+	}
+	routine := l.routine
+	l.routine = ""
+	defer func() {
+		l.routine = routine
+	}()
+	return l.declare(l.top, name, Undeclared, token.Position{}, 0)
+}
+
+// Make the cross-reference listing of a program.
+func New(prog *ast.Program) *Listing {
+	l := &lister{top: &scope{nil, make(map[string]*Symbol)}}
+
+	// The globals of the library are declared as they are used.
+	lib := &scope{nil, make(map[string]*Symbol)}
+	libNames := map[string]int{"start": runtime.StartGlobal}
+	for _, g := range runtime.Library {
+		libNames[g.Name] = g.Number
+	}
+	l.top.outer = lib
+
+	for _, decl := range prog.Decls {
+		for _, v := range decl.VarDecls() {
+			kind := Global
+			switch decl.(type) {
+			case *ast.ConstantDecl:
+				kind = Manifest
+			case *ast.StaticDecl:
+				kind = Static
+			}
+			l.declare(l.top, v.Name, kind, v.NamePos, v.Constant)
+		}
+	}
+	var defs []ast.Def
+	for _, def := range prog.Defs {
+		defs = append(defs, ast.Defs(def)...)
+	}
+	define := func(name string, kind Kind, pos token.Position) {
+		sym := l.top.names[name]
+		if sym == nil {
+			sym = l.declare(l.top, name, kind, pos, 0)
+		}
+		l.use(sym, pos, Write)
+	}
+	for _, d := range defs {
+		switch d := d.(type) {
+		case *ast.FuncDef:
+			define(d.Name, Function, d.NamePos)
+		case *ast.RoutineDef:
+			define(d.Name, Function, d.NamePos)
+		case *ast.SimpleDef:
+			for _, n := range d.Names.Names {
+				define(n.Val, Value, n.NamePos)
+			}
+		case *ast.VecDef:
+			define(d.Name, Vector, d.NamePos)
+		}
+	}
+	for name, n := range libNames {
+		if l.top.names[name] == nil {
+			lib.names[name] = &Symbol{Name: name, Kind: Global, Number: n}
+		}
+	}
+
+	for _, d := range defs {
+		switch d := d.(type) {
+		case *ast.FuncDef:
+			l.routine = d.Name
+			s := &scope{l.top, make(map[string]*Symbol)}
+			for i, p := range d.Params.Names {
+				l.declare(s, p.Val, Param, p.NamePos, i)
+			}
+			l.body(s, d.Body)
+			l.routine = ""
+		case *ast.RoutineDef:
+			l.routine = d.Name
+			s := &scope{l.top, make(map[string]*Symbol)}
+			for i, p := range d.Params.Names {
+				l.declare(s, p.Val, Param, p.NamePos, i)
+			}
+			l.body(s, d.Body)
+			l.routine = ""
+		case *ast.SimpleDef:
+			for _, e := range d.Exprs.Exprs {
+				l.body(l.top, e)
+			}
+		case *ast.VecDef:
+			l.body(l.top, d.Expr)
+		}
+	}
+
+	// Add the globals of the library used.
+	for _, sym := range lib.names {
+		if len(sym.Uses) > 0 {
+			l.symbols = append(l.symbols, sym)
+		}
+	}
+	for _, sym := range l.symbols {
+		sort.SliceStable(sym.Uses, func(i, j int) bool {
+			return sym.Uses[i].Pos.Offset < sym.Uses[j].Pos.Offset
+		})
+	}
+	sort.SliceStable(l.symbols, func(i, j int) bool {
+		a, b := l.symbols[i], l.symbols[j]
+		return a.Name < b.Name || a.Name == b.Name && a.Decl.Offset < b.Decl.Offset
+	})
+
+	return &Listing{l.symbols, routines(prog)}
+}
+
+// Record the uses of names in the body of a routine, or in the value
+// of a top level definition, declaring the labels it defines.
+func (l *lister) body(s *scope, e ast.Node) {
+	labels := &scope{s, make(map[string]*Symbol)}
+	ast.Inspect(e, func(n ast.Node) bool {
+		if c, ok := n.(*ast.LabelCmd); ok {
+			l.use(l.declare(labels, c.Label.Val, Label, c.Label.NamePos, 0), c.Label.NamePos, Write)
+		}
+		return true
+	})
+	l.expr(labels, e)
+}
+
+// Record the uses of names in an expression or command.  The names a
+// block defines are in scope for the rest of the block.
+func (l *lister) expr(s *scope, e ast.Node) {
+	switch e := e.(type) {
+	case *ast.Name:
+		l.use(l.lookup(s, e.Val), e.NamePos, Read)
+	case *ast.AssignCmd:
+		for _, x := range e.Lhs.Exprs {
+			if n, ok := x.(*ast.Name); ok {
+				l.use(l.lookup(s, n.Val), n.NamePos, Write)
+			} else {
+				l.expr(s, x)
+			}
+		}
+		for _, x := range e.Rhs.Exprs {
+			l.expr(s, x)
+		}
+	case *ast.UnaryExpr:
+		if n, ok := e.X.(*ast.Name); ok && e.Op == token.LV {
+			l.use(l.lookup(s, n.Val), n.NamePos, Addr)
+			return
+		}
+		l.expr(s, e.X)
+	case *ast.MatchExpr:
+		for _, arg := range e.Args.Exprs {
+			l.expr(s, arg)
+		}
+		for _, arm := range e.Arms {
+			inner := &scope{s, make(map[string]*Symbol)}
+			for _, pat := range arm.Patterns.Exprs {
+				n, ok := pat.(*ast.Name)
+				if !ok {
+					l.expr(s, pat)
+					continue
+				}
+				if sym := s.lookup(n.Val); sym != nil && sym.Kind == Manifest {
+					l.use(sym, n.NamePos, Read)
+				} else if sym := inner.names[n.Val]; sym != nil {
+					l.use(sym, n.NamePos, Write)
+				} else {
+					l.declare(inner, n.Val, Pattern, n.NamePos, 0)
+				}
+			}
+			l.expr(inner, arm.Body)
+		}
+	case *ast.BlockCmd:
+		for _, item := range e.Items {
+			let, ok := item.(*ast.LetCmd)
+			if !ok {
+				l.expr(s, item)
+				continue
+			}
+			inner := &scope{s, make(map[string]*Symbol)}
+			for _, d := range ast.Defs(let.Def) {
+				switch d := d.(type) {
+				case *ast.SimpleDef:
+					for _, x := range d.Exprs.Exprs {
+						l.expr(s, x)
+					}
+					for _, n := range d.Names.Names {
+						l.use(l.declare(inner, n.Val, Value, n.NamePos, 0), n.NamePos, Write)
+					}
+				case *ast.VecDef:
+					l.expr(s, d.Expr)
+					l.use(l.declare(inner, d.Name, Vector, d.NamePos, 0), d.NamePos, Write)
+				}
+			}
+			s = inner
+		}
+	case *ast.ForCmd:
+		l.expr(s, e.From)
+		l.expr(s, e.To)
+		if e.By != nil {
+			l.expr(s, e.By)
+		}
+		inner := &scope{s, make(map[string]*Symbol)}
+		l.use(l.declare(inner, e.Var.Val, ForVar, e.Var.NamePos, 0), e.Var.NamePos, Write)
+		l.expr(inner, e.Body)
+	case *ast.LabelCmd:
+		if e.Body != nil {
+			l.expr(s, e.Body)
+		}
+	case *ast.GotoCmd:
+		l.expr(s, e.Label)
+	default:
+		ast.Inspect(e, func(n ast.Node) bool {
+			if n == e || n == nil {
+				return true
+			}
+			l.expr(s, n)
+			return false
+		})
+	}
+}
+
+// Return the routines of a program and their calls.
+func routines(prog *ast.Program) []*Routine {
+	g := cfg.NewCallGraph(prog)
+	var list []*Routine
+	byName := make(map[string]*Routine)
+	for _, n := range g.Nodes {
+		if !n.Func && len(n.Calls) == 0 {
+			continue
+		}
+		r := &Routine{Name: n.Name, Pos: n.Pos}
+		for _, m := range n.Calls {
+			r.Calls = append(r.Calls, m.Name)
+		}
+		byName[n.Name] = r
+		list = append(list, r)
+	}
+	for _, r := range list {
+		for _, name := range r.Calls {
+			if callee := byName[name]; callee != nil {
+				callee.CalledBy = append(callee.CalledBy, r.Name)
+			}
+		}
+	}
+	return list
+}
@@ -0,0 +1,191 @@
+// Copyright 2015 Meador Inge.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package xref
+
+import (
+	"encoding/json"
+	"github.com/meadori/bcpl-go/src/ast"
+	"github.com/meadori/bcpl-go/src/parser"
+	"github.com/meadori/bcpl-go/src/token"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var test_xref_str = `global $( Hook: 200 $)
+manifest $( Red = 1 $)
+let Fact(N) = N = 0 -> 1, N * Fact(N - 1)
+let Colour(X) = match (X) : Red => 1 : Y => Hook(Y, lv Fact) .
+let start() = writen(Fact(5) + Colour(Red) + Oops)
+`
+
+func parse(t *testing.T, src string) *ast.Program {
+	var p parser.Parser
+	p.Dialect = token.Richards
+	p.Init([]byte(src))
+	prog := p.Parse()
+	if len(p.Errors) > 0 {
+		t.Fatal(p.Errors)
+	}
+	return prog
+}
+
+func TestFprint(t *testing.T) {
+	expected := `NAME    KIND        ROUTINE  DECLARED  USES
+Colour  function             4:5       4:5w 5:32
+Fact    function             3:5       3:5w 3:31 4:56@ 5:22
+Hook    global 200           1:11      4:45
+N       param       Fact     3:10      3:15 3:27 3:36
+Oops    undeclared           -         5:46
+Red     manifest 1           2:13      4:29 5:39
+X       param       Colour   4:12      4:24
+Y       pattern     Colour   4:40      4:50
+start   function             5:5       5:5w
+writen  global 12            -         5:15
+
+ROUTINE  CALLS               CALLED BY
+Fact     Fact                Fact start
+Colour   Hook                start
+start    writen Fact Colour
+`
+	if got := New(parse(t, test_xref_str)).String(); got != expected {
+		t.Errorf("got\n%s\nexpected\n%s", got, expected)
+	}
+}
+
+var test_scopes = []struct {
+	src  string
+	name string
+	kind Kind
+	uses string
+}{
+	// A parameter hides the definition of its name.
+	{"let F(X) = X\nlet X = F(1)", "X", Param, "1:12"},
+	{"let F(X) = X\nlet X = F(1)", "X", Value, "2:5w"},
+	// So does a pattern, but a manifest in a pattern is read.
+	{"manifest $( K = 1 $)\nlet F(X) = match (X, X) : K, 0 => 0 : Y, Y => Y .", "K", Manifest, "2:27"},
+	{"manifest $( K = 1 $)\nlet F(X) = match (X, X) : K, 0 => 0 : Y, Y => Y .", "Y", Pattern, "2:42w 2:47"},
+	// A name defined twice is written twice.
+	{"global $( G: 100 $)\nlet G = 1\nlet G() = lv G", "G", Global, "2:5w 3:5w 3:14@"},
+	// A vector and a static.
+	{"static $( S = 3 $)\nlet V = vec S", "S", Static, "2:13"},
+	{"static $( S = 3 $)\nlet V = vec S", "V", Vector, "2:5w"},
+	// Assignments write, lv takes the address and the rest read: of
+	// the names of a block, the variable of a for loop, a parameter and
+	// a label, which is in scope before it is defined.
+	{test_commands_str, "S", Value, "2:8w 3:22w 3:27 4:7 5:12@ 6:14"},
+	{test_commands_str, "I", ForVar, "3:8w 3:31"},
+	{test_commands_str, "N", Param, "3:17 5:4w"},
+	{test_commands_str, "Done", Label, "4:18 6:1w"},
+	// The names of a block are in scope only in the block.
+	{"let F() be $( $( let Y = 1 $); Y := 2 $)", "Y", Value, "1:22w"},
+	{"let F() be $( $( let Y = 1 $); Y := 2 $)", "Y", Undeclared, "1:32w"},
+}
+
+var test_commands_str = `let F(N) be
+$( let S = 0
+   for I = 1 to N do S := S + I
+   if S > 9 goto Done
+   N := lv S
+Done: writen(S)
+$)`
+
+func TestScopes(t *testing.T) {
+	for _, test := range test_scopes {
+		x := New(parse(t, test.src))
+		found := false
+		for _, sym := range x.Symbols {
+			if sym.Name != test.name || sym.Kind != test.kind {
+				continue
+			}
+			found = true
+			var uses []string
+			for _, u := range sym.Uses {
+				uses = append(uses, u.String())
+			}
+			if got := strings.Join(uses, " "); got != test.uses {
+				t.Errorf("%q: %s %s: got uses %q, expected %q", test.src, test.kind, test.name, got, test.uses)
+			}
+		}
+		if !found {
+			t.Errorf("%q: no %s %s in\n%s", test.src, test.kind, test.name, x)
+		}
+	}
+}
+
+func TestJSON(t *testing.T) {
+	var got struct {
+		Symbols []struct {
+			Name    string
+			Kind    string
+			Decl    *struct{ Offset, Line, Column int }
+			Routine string
+			Number  int
+			Uses    []struct {
+				Pos     struct{ Line, Column int }
+				Kind    string
+				Routine string
+			}
+		}
+		Routines []struct {
+			Name     string
+			Calls    []string
+			CalledBy []string `json:"calledBy"`
+		}
+	}
+	data, err := json.Marshal(New(parse(t, test_xref_str)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Symbols) != 10 || len(got.Routines) != 3 {
+		t.Fatalf("got %d symbols and %d routines in %s", len(got.Symbols), len(got.Routines), data)
+	}
+	fact := got.Symbols[1]
+	if fact.Name != "Fact" || fact.Kind != "function" || fact.Decl == nil || fact.Decl.Line != 3 {
+		t.Errorf("got symbol %+v", fact)
+	}
+	if u := fact.Uses[2]; u.Kind != "lv" || u.Routine != "Colour" || u.Pos.Line != 4 || u.Pos.Column != 56 {
+		t.Errorf("got use %+v", u)
+	}
+	if sym := got.Symbols[4]; sym.Name != "Oops" || sym.Decl != nil {
+		t.Errorf("got symbol %+v", sym)
+	}
+	if r := got.Routines[0]; r.Name != "Fact" || strings.Join(r.CalledBy, " ") != "Fact start" {
+		t.Errorf("got routine %+v", r)
+	}
+	if r := got.Routines[2]; r.Name != "start" || r.CalledBy == nil || len(r.CalledBy) != 0 {
+		t.Errorf("got routine %+v", r)
+	}
+}
+
+func TestTestdata(t *testing.T) {
+	files, _ := filepath.Glob("../../testdata/*.b")
+	for _, file := range files {
+		src, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		prog, err := parser.ParseProgram(src)
+		if err != nil {
+			continue
+		}
+		x := New(prog)
+		for _, sym := range x.Symbols {
+			if sym.Kind == Undeclared {
+				t.Errorf("%s: %s is undeclared", file, sym.Name)
+			}
+			if len(sym.Uses) == 0 && sym.Kind != Param && sym.Kind != Pattern && sym.Kind != Global && sym.Kind != Manifest && sym.Kind != Static {
+				t.Errorf("%s: %s %s is not used", file, sym.Kind, sym.Name)
+			}
+		}
+		if _, err := json.Marshal(x); err != nil {
+			t.Errorf("%s: %v", file, err)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+// Commands: assignments, conditionals, loops, switchon, labels and
+// valof, running a little sieve of Eratosthenes.
+manifest $( N = 30; Prime = 0; Composite = 1 $)
+static $( Found = 0 $)
+
+let Sieve(v) be
+$( for i = 2 to N do v*[i] := Prime
+   for i = 2 to N do unless v*[i] = Composite do
+   $( let j = i * i
+      Found := Found + 1
+      while j <= N do $( v*[j] := Composite; j := j + i $)
+   $)
+$)
+
+let Count(v, n) = valof
+$( let c, i = 0, 2
+   next: if i > n do resultis c
+   unless v*[i] = Composite do c := c + 1
+   i := i + 1
+   goto next
+$)
+
+let Describe(n) be
+   switchon n rem 4 into
+   $( case 0: writes("even ")
+      case 2: writes("even")
+              endline()
+              return
+      case 1:
+      default: writes("odd")
+               endline()
+   $)
+
+and endline() = newline()
+
+let start() be
+$( let v = vec N
+   let i, j = 0, 0
+   Sieve(v)
+   writes("primes: ")
+   for k = 2 to N do unless v*[k] = Composite do $( writen(k); writes(" ") $)
+   newline()
+   writef("%n primes, %n counted*n", Found, Count(v, N))
+
+   $( i := i + 1
+      if i = 3 do break
+   $) repeat
+   $( j := j + 2 $) repeatwhile j < 7
+   test i < j do writef("%n < %n*n", i, j) or writes("no*n")
+   i, j := j, i
+   writef("swapped %n %n*n", i, j)
+   until i = 0 do i := i - 1
+   Describe(1); Describe(4); Describe(6)
+   return
+$)
@@ -0,0 +1,7 @@
+// Global and manifest declarations.
+global $(
+        COUNT: 200 // a counter
+        ALL: 13
+$)
+
+manifest $( N = 20000; PI = 314 $)
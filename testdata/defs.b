@@ -0,0 +1,7 @@
+// Simple, vector and function definitions joined by and.
+let X, Y = 1, 2
+and V = vec 5
+
+// The factorial of N.
+let Fact(N) = N = 0 -> 1, N * Fact(N - 1)
+and Max(A, B) = A > B -> A, B
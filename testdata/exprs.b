@@ -0,0 +1,6 @@
+// Operator precedence and the unary operators.
+let A = 1 + 2 * 3 - 4 / 2 rem 3
+let B = -A << 2 & ! A | A eqv A neqv 0
+and V = vec 3
+let C = lv V*[2] - V
+and D = rv lv A
@@ -0,0 +1,9 @@
+// Print a table of factorials.
+manifest $( N = 6 $)
+
+let Fact(N) = N = 0 -> 1, N * Fact(N - 1)
+
+let Table(I) = I > N -> 0,
+  writef("%i2! = %n*n", I, Fact(I)) + Table(I + 1)
+
+let start() = Table(0)
@@ -0,0 +1,51 @@
+// The reserved words of Martin Richards' later compilers, written in
+// capitals as his programs write them.
+GET "libhdr"
+
+MANIFEST { Limit = 10 }
+
+// Write a word for each of the first cases, and return the number.
+LET classify(n) = VALOF
+{ SWITCHON n INTO
+  { CASE 0: RESULTIS 0
+    CASE 1: writes("one ")
+            ENDCASE
+    DEFAULT: writes("many ")
+  }
+  RESULTIS n
+}
+
+// The sign of a number: the second arm gives way to the third for a
+// negative number.
+LET sign(n) = MATCH (n)
+: 0 => 0
+: m => VALOF { IF m < 0 THEN NEXT
+               RESULTIS 1
+             }
+: ? => -1
+.
+
+// The sum of two numbers, or zero if the first is: an exit leaves
+// the every before its last arm.
+LET sum(a, b) = EVERY (a, b)
+: 0, ? => VALOF { writes("zero "); EXIT }
+: ?, ? => a + b
+.
+
+LET start() = VALOF
+{ FOR i = Limit TO 1 BY -3 DO writef("%n ", i)
+  newline()
+  FOR i = 1 TO Limit DO
+  { IF i MOD 2 = 0 THEN LOOP
+    IF i > 7 THEN BREAK
+    writef("%n ", i)
+  }
+  newline()
+  TEST classify(1) = 1 THEN writes("yes*n") ELSE writes("no*n")
+  classify(5)
+  newline()
+  writef("%n %n %n*n", sign(-4), sign(0), sign(9))
+  writef("%n*n", sum(0, 5))
+  writef("%n*n", sum(2, 5))
+  RESULTIS 0
+}
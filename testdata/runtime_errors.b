@@ -0,0 +1,5 @@
+// Errors found while running a program are reported at their
+// positions.
+let Div(A, B) = A / B // ERROR "division by zero"
+
+let start() = writen(Div(6, 3)) + writen(Div(1, 0))
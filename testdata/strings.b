@@ -0,0 +1,5 @@
+// String constants and their escapes.
+let Hello() = writes("hello,*sworld*n")
+and Tab() = writes("a*tb**c*n")
+
+let start() = Hello() + Tab() + writef("%s!*n", "done")
@@ -0,0 +1,2 @@
+// Read two numbers and print their sum.
+let start() = writen(readn() + readn()) + newline()
@@ -0,0 +1,17 @@
+// Each broken declaration or definition is reported and skipped;
+// errors are reported at the token where they are found.
+global $( FOO 42 $) // ERROR "expected '=' or ':'"
+
+let X = let Y = 1 // ERROR "expected expression found 'let'"
+
+manifest $( N = 1 $)
+42 // ERROR "expected definition found '42'"
+
+let F(A, B) = (A + B $) // ERROR "expected '\)' found '\$\)'"
+let G(A) be A + 1 := 2 // ERROR "cannot assign to expression"
+let X, Y = 1 // ERROR "assignment count mismatch"
+and Z = 2
+let Z 3 // ERROR "expected ',', '=' or '\(' found '3'"
+manifest $( Big = 99999999999999999999 $) // ERROR "number 99999999999999999999 out of range"
+let H() = 1 + 9223372036854775808 // ERROR "number 9223372036854775808 out of range"
+let OK = 1